@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/dqhieuu/novo-app/server"
+	"github.com/jackc/pgx/v4"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const adminUsage = `usage: novo-server admin <command>
+  user create -email EMAIL [-role ROLE] [-password PASSWORD] USERNAME
+  user set-role USER ROLE
+  user delete USER
+  user unlock USER
+  book delete BOOK_ID
+  images gc [-dry-run] [-ttl DURATION]
+  search reindex
+  chapters check [-dry-run]
+USER is a user name or an email. Flags come before the other arguments.`
+
+// runAdmin runs the admin commands against the configured database, without the
+// permission checks of the http handlers.
+func runAdmin(args []string, cfg *config.Config) error {
+	if len(args) < 2 {
+		return errors.New(adminUsage)
+	}
+	server.InitStorage(cfg.Images)
+
+	command, args := args[0]+" "+args[1], args[2:]
+	switch command {
+	case "user create":
+		return adminCreateUser(args)
+	case "user set-role":
+		return adminSetRole(args)
+	case "user delete":
+		return adminDeleteUser(args)
+	case "user unlock":
+		return adminUnlockUser(args)
+	case "book delete":
+		return adminDeleteBook(args)
+	case "images gc":
+		return adminImagesGC(args, cfg.Images)
+	case "search reindex":
+		return adminReindexSearch(args)
+	case "chapters check":
+		return adminCheckChapters(args, cfg.Images)
+	default:
+		return errors.New(adminUsage)
+	}
+}
+
+func parseFlags(flags *flag.FlagSet, args []string, positional int) ([]string, error) {
+	flags.SetOutput(io.Discard)
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, errors.New(err.Error() + "\n" + adminUsage)
+	}
+	if flags.NArg() != positional {
+		return nil, errors.New(adminUsage)
+	}
+	return flags.Args(), nil
+}
+
+func findUser(nameOrEmail string) (*db.User, error) {
+	queries := db.New(db.Pool())
+	user, err := queries.UserByUsernameOrEmail(context.Background(), sql.NullString{String: nameOrEmail, Valid: true})
+	if err == pgx.ErrNoRows {
+		return nil, fmt.Errorf("user %q not found", nameOrEmail)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func adminCreateUser(args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the user")
+	role := flags.String("role", server.MemberRole, "role of the user")
+	password := flags.String("password", "", "password, read from stdin when empty")
+	args, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	if *password == "" {
+		fmt.Fprint(os.Stderr, "password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return errors.New("error reading password: " + err.Error())
+		}
+		*password = strings.TrimRight(line, "\r\n")
+	}
+
+	user, userRole, err := server.CreateAccount(args[0], *password, *email, *role)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created user %d (%s) with role %s\n", user.ID, user.UserName.String, userRole.RoleName)
+	return nil
+}
+
+func adminSetRole(args []string) error {
+	args, err := parseFlags(flag.NewFlagSet("user set-role", flag.ContinueOnError), args, 2)
+	if err != nil {
+		return err
+	}
+	user, err := findUser(args[0])
+	if err != nil {
+		return err
+	}
+	oldRole, err := db.New(db.Pool()).Role(context.Background(), user.RoleID)
+	if err != nil {
+		return err
+	}
+	err = server.AssignRole(user.ID, args[1])
+	if err != nil {
+		return err
+	}
+	server.RecordAdminAudit(server.AuditRecord{
+		Action:     server.SetRoleAudit,
+		TargetType: server.UserAuditTarget,
+		TargetId:   user.ID,
+		Before:     map[string]interface{}{"role": oldRole.RoleName},
+		After:      map[string]interface{}{"role": args[1]},
+	})
+	fmt.Printf("user %d is now %s\n", user.ID, args[1])
+	return nil
+}
+
+func adminDeleteUser(args []string) error {
+	args, err := parseFlags(flag.NewFlagSet("user delete", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	user, err := findUser(args[0])
+	if err != nil {
+		return err
+	}
+	if !user.UserName.Valid {
+		return errors.New("user has no user name, finish its oauth registration first")
+	}
+	err = server.DeleteAccount(user.UserName.String)
+	if err != nil {
+		return err
+	}
+	server.RecordAdminAudit(server.AuditRecord{
+		Action:     server.DeleteUserAudit,
+		TargetType: server.UserAuditTarget,
+		TargetId:   user.ID,
+		Before: map[string]interface{}{
+			"userName": user.UserName.String,
+			"email":    user.Email,
+			"roleId":   user.RoleID,
+		},
+	})
+	fmt.Printf("deleted user %d\n", user.ID)
+	return nil
+}
+
+func adminUnlockUser(args []string) error {
+	args, err := parseFlags(flag.NewFlagSet("user unlock", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	user, err := findUser(args[0])
+	if err != nil {
+		return err
+	}
+	err = server.UnlockAccount(user.ID)
+	if err != nil {
+		return err
+	}
+	server.RecordAdminAudit(server.AuditRecord{
+		Action:     server.UnlockAccountAudit,
+		TargetType: server.UserAuditTarget,
+		TargetId:   user.ID,
+	})
+	fmt.Printf("unlocked user %d\n", user.ID)
+	return nil
+}
+
+func adminDeleteBook(args []string) error {
+	args, err := parseFlags(flag.NewFlagSet("book delete", flag.ContinueOnError), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil {
+		return errors.New("invalid book group id: " + args[0])
+	}
+
+	book, err := db.New(db.Pool()).BookGroupById(context.Background(), int32(id))
+	if err == pgx.ErrNoRows {
+		return fmt.Errorf("book group %d does not exist", id)
+	}
+	if err != nil {
+		return err
+	}
+	err = server.DeleteBookGroup(int32(id))
+	if err != nil {
+		return err
+	}
+	server.RecordAdminAudit(server.AuditRecord{
+		Action:     server.DeleteBookAudit,
+		TargetType: server.BookAuditTarget,
+		TargetId:   int32(id),
+		Before:     server.BookAuditSnapshot(book),
+	})
+	fmt.Printf("deleted book group %d\n", id)
+	return nil
+}
+
+func adminImagesGC(args []string, cfg config.Images) error {
+	flags := flag.NewFlagSet("images gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list what would be removed")
+	ttl := flags.Duration("ttl", cfg.GCTTL, "minimum age of the removed temp images")
+	_, err := parseFlags(flags, args, 0)
+	if err != nil {
+		return err
+	}
+
+	report, err := server.CleanImages(*ttl, *dryRun)
+	if err != nil {
+		return err
+	}
+	for _, image := range report.Images {
+		fmt.Printf("image %d %s\n", image.Id, image.Path)
+	}
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	} else {
+		// the collection is about no single image, it is recorded on the target 0
+		server.RecordAdminAudit(server.AuditRecord{
+			Action:     server.CleanImagesAudit,
+			TargetType: server.ImagesAuditTarget,
+			After: map[string]interface{}{
+				"ttl":      ttl.String(),
+				"attached": report.Attached,
+				"images":   len(report.Images),
+				"files":    len(report.Files),
+			},
+		})
+	}
+	fmt.Printf("%d attached images submitted, %s %d images and %d files\n",
+		report.Attached, verb, len(report.Images), len(report.Files))
+	return nil
+}
+
+func adminReindexSearch(args []string) error {
+	_, err := parseFlags(flag.NewFlagSet("search reindex", flag.ContinueOnError), args, 0)
+	if err != nil {
+		return err
+	}
+	authors, bookGroups, err := server.ReindexSearch()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("reindexed %d authors and %d book groups\n", authors, bookGroups)
+	return nil
+}
+
+// adminCheckChapters checks the hypertext chapters stored before their content was checked
+// on write.
+func adminCheckChapters(args []string, cfg config.Images) error {
+	flags := flag.NewFlagSet("chapters check", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the chapters that would change")
+	_, err := parseFlags(flags, args, 0)
+	if err != nil {
+		return err
+	}
+
+	changed, err := server.CheckExistingChapters(cfg, *dryRun)
+	for _, chapter := range changed {
+		fmt.Printf("chapter %d: %v\n", chapter.Id, chapter.Rejected)
+	}
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("%d chapters would be changed\n", len(changed))
+	} else {
+		fmt.Printf("%d chapters changed\n", len(changed))
+	}
+	return nil
+}
@@ -25,7 +25,7 @@ export default function Layout({ children }) {
   const server = WEB_CONSTANTS.SERVER;
 
   useEffect(() => {
-    const { provider, code } = router.query;
+    const { provider, code, state } = router.query;
     const isValidToken = validToken(false);
     if (!isValidToken && provider && code) {
       router.replace('/', undefined, {
@@ -33,10 +33,12 @@ export default function Layout({ children }) {
       });
       switch (provider) {
         case 'google':
+        case 'github':
+        case 'facebook':
           (async () => {
-            const { data } = await axios.get(
-              `${WEB_CONSTANTS.SERVER}/login?provider=${provider}&code=${code}`
-            );
+            const { data } = await axios.get(`${WEB_CONSTANTS.SERVER}/login`, {
+              params: { provider, code, state },
+            });
             if (data) {
               updateToken(data);
 
@@ -55,6 +57,29 @@ export default function Layout({ children }) {
           })();
           break;
       }
+    } else if (isValidToken && provider && code) {
+      // the provider sent back a login method linked from the user settings
+      router.replace('/', undefined, {
+        shallow: true,
+      });
+      (async () => {
+        try {
+          await fetchAuth({
+            url: `${server}/auth/identities`,
+            method: 'POST',
+            data: { provider, code, state },
+          });
+          toast.success('Liên kết tài khoản thành công', {
+            position: 'bottom-left',
+            autoClose: 3000,
+          });
+        } catch (e) {
+          toast.error(e.response?.data?.error ?? 'Liên kết tài khoản thất bại', {
+            position: 'bottom-left',
+            autoClose: 3000,
+          });
+        }
+      })();
     } else if (isValidToken) {
       (async () => {
         update(
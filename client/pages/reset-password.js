@@ -0,0 +1,47 @@
+import Link from 'next/link';
+import React, { useState } from 'react';
+import { useRouter } from 'next/router';
+import axios from 'axios';
+import WEB_CONSTANTS from '../utilities/constants';
+export default function ResetPassword() {
+  const router = useRouter();
+  const [password, setPassword] = useState('');
+  const [message, setMessage] = useState('');
+  const submit = (e) => {
+    e.preventDefault();
+    axios
+      .post(`${WEB_CONSTANTS.SERVER}/password-reset/confirm`, {
+        token: router.query.token,
+        password,
+      })
+      .then(() => setMessage('Đã đặt lại mật khẩu, hãy đăng nhập lại.'))
+      .catch(() =>
+        setMessage('Mật khẩu không hợp lệ hoặc liên kết đã hết hạn.')
+      );
+  };
+  return (
+    <div
+      style={{
+        display: 'flex',
+        justifyContent: 'center',
+        alignItems: 'center',
+        flexDirection: 'column',
+      }}
+    >
+      <h2>Đặt lại mật khẩu</h2>
+      <form onSubmit={submit}>
+        <input
+          type="password"
+          placeholder="Mật khẩu mới (8-50 ký tự)"
+          value={password}
+          onChange={(e) => setPassword(e.target.value)}
+        />
+        <button type="submit">Xác nhận</button>
+      </form>
+      <p>{message}</p>
+      <p>
+        Về <Link href="/">trang chủ</Link>
+      </p>
+    </div>
+  );
+}
@@ -18,6 +18,8 @@ export default function Login() {
     userNameOrEmail: '',
     password: '',
   });
+  const [twoFactor, setTwoFactor] = useState(null);
+  const [code, setCode] = useState('');
   const {
     register,
     handleSubmit,
@@ -32,22 +34,113 @@ export default function Login() {
         password: formData.password,
       },
     })
-      .then((res) => {
-        updateToken(res.data);
-        toast.success('Đăng nhập thành công', {
-          position: toast.POSITION.BOTTOM_LEFT,
-          autoClose: 3000,
-        });
-        router.push('/');
-      })
+      .then(loggedIn)
       .catch((err) => {
-        toast.error('Đăng nhập thất bại!', {
-          position: toast.POSITION.BOTTOM_LEFT,
-          autoClose: 3000,
-        });
+        if (err.response?.data?.twoFactor) {
+          setTwoFactor(err.response.data.twoFactor);
+          return;
+        }
+        if (err.response?.status === 429) {
+          toast.error(
+            'Đăng nhập sai quá nhiều lần, thử lại sau ' +
+              err.response.headers['retry-after'] +
+              ' giây',
+            {
+              position: toast.POSITION.BOTTOM_LEFT,
+              autoClose: 3000,
+            }
+          );
+          return;
+        }
+        loginFailed();
       });
   };
 
+  const loggedIn = (res) => {
+    updateToken(res.data);
+    if (res.data.recoveryCodes) {
+      window.alert(
+        'Lưu lại các mã khôi phục sau:\n' +
+          res.data.recoveryCodes.join('\n')
+      );
+    }
+    toast.success('Đăng nhập thành công', {
+      position: toast.POSITION.BOTTOM_LEFT,
+      autoClose: 3000,
+    });
+    router.push('/');
+  };
+
+  const loginFailed = () => {
+    toast.error('Đăng nhập thất bại!', {
+      position: toast.POSITION.BOTTOM_LEFT,
+      autoClose: 3000,
+    });
+  };
+
+  const submitCode = (e) => {
+    e.preventDefault();
+    axios({
+      url: `${server}/login/two-factor`,
+      method: `POST`,
+      data: {
+        challenge: twoFactor.challenge,
+        code,
+      },
+    })
+      .then(loggedIn)
+      .catch(loginFailed);
+  };
+
+  if (twoFactor) {
+    return (
+      <div
+        className="offset-md-4 col-lg-4 col-12 mt-5 p-3"
+        style={{
+          borderRadius: '0.75rem',
+          background: '#f3f3f3',
+          boxShadow: 'rgba(0, 0, 0, 0.35) 0px 5px 15px',
+        }}
+      >
+        <h3>
+          <FaArrowLeft
+            onClick={() => setTwoFactor(null)}
+          ></FaArrowLeft>
+          {' Xác thực hai bước'}
+        </h3>
+        {twoFactor.enroll && (
+          <div className="mt-3">
+            Thêm khóa sau vào ứng dụng xác thực:
+            <pre>{twoFactor.secret}</pre>
+          </div>
+        )}
+        <form onSubmit={submitCode}>
+          <div className="mb-3 mt-3">
+            <label htmlFor="code" className="form-label">
+              Mã xác thực hoặc mã khôi phục:
+            </label>
+            <input
+              type="text"
+              className="form-control"
+              id="code"
+              autoComplete="one-time-code"
+              value={code}
+              onChange={(e) => setCode(e.target.value)}
+            ></input>
+          </div>
+          <div className="d-grid">
+            <button
+              type="submit"
+              className="btn btn-secondary"
+            >
+              Xác nhận
+            </button>
+          </div>
+        </form>
+      </div>
+    );
+  }
+
   return (
     <div
       className="offset-md-4 col-lg-4 col-12 mt-5 p-3"
@@ -0,0 +1,36 @@
+import Link from 'next/link';
+import React, { useEffect, useState } from 'react';
+import { useRouter } from 'next/router';
+import axios from 'axios';
+import WEB_CONSTANTS from '../utilities/constants';
+export default function VerifyEmail() {
+  const router = useRouter();
+  const [message, setMessage] = useState('Đang xác nhận email...');
+  useEffect(() => {
+    const { token } = router.query;
+    if (!token) {
+      return;
+    }
+    axios
+      .post(`${WEB_CONSTANTS.SERVER}/verify-email`, { token })
+      .then(() => setMessage('Email của bạn đã được xác nhận!'))
+      .catch(() =>
+        setMessage('Liên kết không hợp lệ, đã hết hạn hoặc đã được dùng.')
+      );
+  }, [router.query]);
+  return (
+    <div
+      style={{
+        display: 'flex',
+        justifyContent: 'center',
+        alignItems: 'center',
+        flexDirection: 'column',
+      }}
+    >
+      <h2>{message}</h2>
+      <p>
+        Về <Link href="/">trang chủ</Link>
+      </p>
+    </div>
+  );
+}
@@ -4,6 +4,7 @@ import WEB_CONSTANTS from './constants';
 export async function refreshToken(forced = false) {
   const expire = localStorage.getItem('tokenExpire');
   const token = localStorage.getItem('token');
+  const refresh = localStorage.getItem('refreshToken');
 
   if (expire ^ token) {
     // XOR
@@ -17,12 +18,7 @@ export async function refreshToken(forced = false) {
     try {
       const res = await axios.post(
         `${server}/auth/refresh-token`,
-        null,
-        {
-          headers: {
-            Authorization: `Bearer ${token}`,
-          },
-        }
+        { refreshToken: refresh }
       );
       if (res) {
         updateToken(res.data);
@@ -46,16 +42,20 @@ function internalFetchAuth(options = {}, callback = null) {
 }
 
 export function updateToken(response) {
-  const { token, expire } = response;
+  const { token, expire, refreshToken } = response;
   if (token && expire) {
     localStorage.setItem('token', token);
     localStorage.setItem('tokenExpire', expire);
   }
+  if (refreshToken) {
+    localStorage.setItem('refreshToken', refreshToken);
+  }
 }
 
 export function deleteToken() {
   localStorage.removeItem('tokenExpire');
   localStorage.removeItem('token');
+  localStorage.removeItem('refreshToken');
 }
 
 export function validToken() {
@@ -0,0 +1,552 @@
+// Package config loads the settings of the server from an optional YAML file and from
+// environment variables, which take precedence over the file.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	LocalStorage = "local"
+	S3Storage    = "s3"
+)
+
+const (
+	FileMailer = "file"
+	SMTPMailer = "smtp"
+)
+
+const (
+	MemoryRateLimit   = "memory"
+	PostgresRateLimit = "postgres"
+)
+
+var oidcNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+// MinJwtKeyLength is the shortest JWT signing key accepted, in bytes.
+const MinJwtKeyLength = 32
+
+// Secret is a string that is never printed, logged or marshalled as is.
+type Secret string
+
+const redacted = "[redacted]"
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return strconv.Quote(s.String())
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Value returns the secret itself, for the code that actually needs it.
+func (s Secret) Value() string {
+	return string(s)
+}
+
+type Config struct {
+	Server    Server         `yaml:"server"`
+	Database  Database       `yaml:"database"`
+	Auth      Auth           `yaml:"auth"`
+	Google    Google         `yaml:"google"`
+	GitHub    GitHub         `yaml:"github"`
+	Facebook  Facebook       `yaml:"facebook"`
+	Oidc      []OidcProvider `yaml:"oidc"`
+	Images    Images         `yaml:"images"`
+	Cors      Cors           `yaml:"cors"`
+	Mail      Mail           `yaml:"mail"`
+	Login     Login          `yaml:"login"`
+	RateLimit RateLimit      `yaml:"rateLimit"`
+}
+
+type Server struct {
+	// Address the http server listens on. Default ":8080".
+	Address string `yaml:"address" env:"SERVER_ADDRESS"`
+	// TrustedProxies lists the ips or cidrs of the reverse proxies whose X-Forwarded-For
+	// and X-Real-Ip headers give the client ip. Default [], the headers are ignored.
+	TrustedProxies []string `yaml:"trustedProxies" env:"SERVER_TRUSTED_PROXIES"`
+}
+
+type Database struct {
+	// URL of the postgres database. Required.
+	URL Secret `yaml:"url" env:"POSTGRES_URL"`
+	// AutoMigrate applies the pending migrations at startup. Default false.
+	AutoMigrate bool `yaml:"autoMigrate" env:"AUTO_MIGRATE"`
+}
+
+type Auth struct {
+	// JwtKey signs the access tokens. Required, at least 32 bytes.
+	JwtKey Secret `yaml:"jwtKey" env:"JWT_KEY"`
+	// Realm of the JWT middleware. Default "my novo app".
+	Realm string `yaml:"realm" env:"JWT_REALM"`
+	// Timeout is how long an access token is valid. Default 15m.
+	Timeout time.Duration `yaml:"timeout" env:"JWT_TIMEOUT"`
+	// MaxRefresh is how long a session stays open without its refresh token being used. Default 168h.
+	MaxRefresh time.Duration `yaml:"maxRefresh" env:"JWT_MAX_REFRESH"`
+}
+
+// Google login is disabled when ClientID is empty.
+type Google struct {
+	ClientID     string `yaml:"clientId" env:"GOOGLE_CLIENT_ID"`
+	ClientSecret Secret `yaml:"clientSecret" env:"GOOGLE_CLIENT_SECRET"`
+	// RedirectURL is where Google sends users back. Default "https://novoapp.tech/?provider=google".
+	RedirectURL string `yaml:"redirectUrl" env:"GOOGLE_REDIRECT_URL"`
+}
+
+// GitHub login is disabled when ClientID is empty.
+type GitHub struct {
+	ClientID     string `yaml:"clientId" env:"GITHUB_CLIENT_ID"`
+	ClientSecret Secret `yaml:"clientSecret" env:"GITHUB_CLIENT_SECRET"`
+	// RedirectURL default "https://novoapp.tech/?provider=github".
+	RedirectURL string `yaml:"redirectUrl" env:"GITHUB_REDIRECT_URL"`
+}
+
+// Facebook login is disabled when ClientID is empty.
+type Facebook struct {
+	ClientID     string `yaml:"clientId" env:"FACEBOOK_CLIENT_ID"`
+	ClientSecret Secret `yaml:"clientSecret" env:"FACEBOOK_CLIENT_SECRET"`
+	// RedirectURL default "https://novoapp.tech/?provider=facebook".
+	RedirectURL string `yaml:"redirectUrl" env:"FACEBOOK_REDIRECT_URL"`
+}
+
+// OidcProvider is an OpenID Connect issuer whose endpoints are discovered from
+// Issuer + "/.well-known/openid-configuration". They are only read from the file.
+type OidcProvider struct {
+	// Name is the provider of the login requests, e.g. "gitlab".
+	Name         string `yaml:"name"`
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"clientId"`
+	ClientSecret Secret `yaml:"clientSecret"`
+	RedirectURL  string `yaml:"redirectUrl"`
+	// Scopes default ["openid", "email", "profile"].
+	Scopes []string `yaml:"scopes"`
+}
+
+type Images struct {
+	// MaxSize of an uploaded image and of an upload session chunk, in bytes. Default 10MiB.
+	MaxSize int64 `yaml:"maxSize" env:"IMAGE_MAX_SIZE"`
+	// RootFolder of the local storage. Default "static/images".
+	RootFolder string `yaml:"rootFolder" env:"IMAGE_ROOT_FOLDER"`
+	// Storage is "local" or "s3". Default "local".
+	Storage string `yaml:"storage" env:"IMAGE_STORAGE"`
+	// PublicURL is the base url (usually a CDN) the files are publicly reachable at.
+	// When empty, /image streams the files from the storage itself.
+	PublicURL string `yaml:"publicUrl" env:"IMAGE_PUBLIC_URL"`
+	// GCInterval is how often unused temp images are collected. Default 1h.
+	GCInterval time.Duration `yaml:"gcInterval" env:"IMAGE_GC_INTERVAL"`
+	// GCTTL is how old an unused temp image must be to be collected. Default 24h.
+	GCTTL time.Duration `yaml:"gcTtl" env:"IMAGE_GC_TTL"`
+	S3    S3            `yaml:"s3"`
+}
+
+// S3 is only used when Images.Storage is "s3".
+type S3 struct {
+	Endpoint  string `yaml:"endpoint" env:"S3_ENDPOINT"`
+	AccessKey string `yaml:"accessKey" env:"S3_ACCESS_KEY"`
+	SecretKey Secret `yaml:"secretKey" env:"S3_SECRET_KEY"`
+	Bucket    string `yaml:"bucket" env:"S3_BUCKET"`
+	Region    string `yaml:"region" env:"S3_REGION"`
+	UseSSL    bool   `yaml:"useSsl" env:"S3_USE_SSL"`
+}
+
+type Cors struct {
+	// AllowOrigins lists the allowed origins, "*" allows all of them. Default ["*"].
+	AllowOrigins []string `yaml:"allowOrigins" env:"CORS_ALLOW_ORIGINS"`
+	// AllowHeaders default ["Origin", "Content-Length", "Content-Type", "Authorization"].
+	AllowHeaders []string `yaml:"allowHeaders" env:"CORS_ALLOW_HEADERS"`
+	// AllowCredentials can't be used with the "*" origin. Default false.
+	AllowCredentials bool `yaml:"allowCredentials" env:"CORS_ALLOW_CREDENTIALS"`
+}
+
+type Mail struct {
+	// Mailer is "file" or "smtp". Default "file".
+	Mailer string `yaml:"mailer" env:"MAIL_MAILER"`
+	// From is the sender of the emails. Default "Novo <no-reply@novoapp.tech>".
+	From string `yaml:"from" env:"MAIL_FROM"`
+	// LinkURL is the client the links of the emails open. Default "https://novoapp.tech".
+	LinkURL string `yaml:"linkUrl" env:"MAIL_LINK_URL"`
+	// Folder the file mailer writes the emails to, they are only logged when empty.
+	Folder string `yaml:"folder" env:"MAIL_FOLDER"`
+	// VerificationTTL is how long an email verification link works. Default 48h.
+	VerificationTTL time.Duration `yaml:"verificationTtl" env:"MAIL_VERIFICATION_TTL"`
+	// ResetTTL is how long a password reset or two-factor enrollment link works. Default 1h.
+	ResetTTL time.Duration `yaml:"resetTtl" env:"MAIL_RESET_TTL"`
+	SMTP     SMTP          `yaml:"smtp"`
+}
+
+// SMTP is only used when Mail.Mailer is "smtp".
+type SMTP struct {
+	// Address of the server, host:port.
+	Address  string `yaml:"address" env:"SMTP_ADDRESS"`
+	Username string `yaml:"username" env:"SMTP_USERNAME"`
+	Password Secret `yaml:"password" env:"SMTP_PASSWORD"`
+}
+
+// Login throttles the password logins failing again and again, of an account or from an ip.
+type Login struct {
+	// AccountAttempts is how many failed logins of an account are let through before it is
+	// locked out. Default 5.
+	AccountAttempts int64 `yaml:"accountAttempts" env:"LOGIN_ACCOUNT_ATTEMPTS"`
+	// IPAttempts is the same for the failed logins from an ip, to any account. Default 20.
+	IPAttempts int64 `yaml:"ipAttempts" env:"LOGIN_IP_ATTEMPTS"`
+	// Lockout is the first lockout, it doubles with every failure after. Default 30s.
+	Lockout time.Duration `yaml:"lockout" env:"LOGIN_LOCKOUT"`
+	// MaxLockout caps the lockouts. Default 1h.
+	MaxLockout time.Duration `yaml:"maxLockout" env:"LOGIN_MAX_LOCKOUT"`
+	// FailureTTL is how long the failures are counted without a new one. Default 24h.
+	FailureTTL time.Duration `yaml:"failureTtl" env:"LOGIN_FAILURE_TTL"`
+}
+
+// RateLimit limits how fast a client, the user of the token or else the ip, calls the
+// write and search endpoints. Each limit is a bucket of Requests refilled over Period, 0
+// requests disable it.
+type RateLimit struct {
+	// Backend keeps the buckets in "memory", per replica, or in "postgres", shared by the
+	// replicas. Default "memory".
+	Backend string `yaml:"backend" env:"RATE_LIMIT_BACKEND"`
+	// WriteRequests limits the comments, likes, image uploads and password reset requests.
+	// Default 30 per 1m.
+	WriteRequests int64         `yaml:"writeRequests" env:"RATE_LIMIT_WRITE_REQUESTS"`
+	WritePeriod   time.Duration `yaml:"writePeriod" env:"RATE_LIMIT_WRITE_PERIOD"`
+	// SearchRequests limits the searches. Default 60 per 1m.
+	SearchRequests int64         `yaml:"searchRequests" env:"RATE_LIMIT_SEARCH_REQUESTS"`
+	SearchPeriod   time.Duration `yaml:"searchPeriod" env:"RATE_LIMIT_SEARCH_PERIOD"`
+	// ResetRequests limits the password reset mails per email, on top of the write limit
+	// per ip. Default 3 per 1h.
+	ResetRequests int64         `yaml:"resetRequests" env:"RATE_LIMIT_RESET_REQUESTS"`
+	ResetPeriod   time.Duration `yaml:"resetPeriod" env:"RATE_LIMIT_RESET_PERIOD"`
+}
+
+// Default returns the config used for everything the file and the environment leave out.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Address:        ":8080",
+			TrustedProxies: []string{},
+		},
+		Auth: Auth{
+			Realm:      "my novo app",
+			Timeout:    15 * time.Minute,
+			MaxRefresh: 24 * 7 * time.Hour,
+		},
+		Google: Google{
+			RedirectURL: "https://novoapp.tech/?provider=google",
+		},
+		GitHub: GitHub{
+			RedirectURL: "https://novoapp.tech/?provider=github",
+		},
+		Facebook: Facebook{
+			RedirectURL: "https://novoapp.tech/?provider=facebook",
+		},
+		Images: Images{
+			MaxSize:    1024 * 1024 * 10,
+			RootFolder: "static/images",
+			Storage:    LocalStorage,
+			GCInterval: time.Hour,
+			GCTTL:      24 * time.Hour,
+		},
+		Cors: Cors{
+			AllowOrigins: []string{"*"},
+			AllowHeaders: []string{"Origin", "Content-Length", "Content-Type", "Authorization"},
+		},
+		Mail: Mail{
+			Mailer:          FileMailer,
+			From:            "Novo <no-reply@novoapp.tech>",
+			LinkURL:         "https://novoapp.tech",
+			VerificationTTL: 48 * time.Hour,
+			ResetTTL:        time.Hour,
+		},
+		Login: Login{
+			AccountAttempts: 5,
+			IPAttempts:      20,
+			Lockout:         30 * time.Second,
+			MaxLockout:      time.Hour,
+			FailureTTL:      24 * time.Hour,
+		},
+		RateLimit: RateLimit{
+			Backend:        MemoryRateLimit,
+			WriteRequests:  30,
+			WritePeriod:    time.Minute,
+			SearchRequests: 60,
+			SearchPeriod:   time.Minute,
+			ResetRequests:  3,
+			ResetPeriod:    time.Hour,
+		},
+	}
+}
+
+// Load reads the config with Read and validates it.
+func Load(path string) (*Config, error) {
+	config, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Read reads the YAML file at path when it is not empty, then the environment.
+func Read(path string) (*Config, error) {
+	config := Default()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.New("error reading config file: " + err.Error())
+		}
+		err = yaml.UnmarshalStrict(data, config)
+		if err != nil {
+			return nil, errors.New("error parsing config file: " + err.Error())
+		}
+	}
+
+	err := loadEnv(reflect.ValueOf(config).Elem(), os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// loadEnv sets the fields tagged with env from the variables that are set.
+func loadEnv(value reflect.Value, lookup func(string) (string, bool)) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name, tagged := value.Type().Field(i).Tag.Lookup("env")
+		if !tagged {
+			if field.Kind() == reflect.Struct {
+				if err := loadEnv(field, lookup); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		variable, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		var err error
+		switch {
+		case field.Type() == durationType:
+			var duration time.Duration
+			duration, err = time.ParseDuration(variable)
+			field.SetInt(int64(duration))
+		case field.Kind() == reflect.String:
+			field.SetString(variable)
+		case field.Kind() == reflect.Bool:
+			var parsed bool
+			parsed, err = strconv.ParseBool(variable)
+			field.SetBool(parsed)
+		case field.Kind() == reflect.Int64:
+			var parsed int64
+			parsed, err = strconv.ParseInt(variable, 10, 64)
+			field.SetInt(parsed)
+		case field.Kind() == reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(variable, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		default:
+			err = errors.New("unsupported type")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.Address == "" {
+		invalid("server address is required")
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			invalid("invalid trusted proxy %q, must be an ip or a cidr", proxy)
+		}
+	}
+	if c.Database.URL == "" {
+		invalid("database url is required (POSTGRES_URL)")
+	}
+
+	if len(c.Auth.JwtKey) < MinJwtKeyLength {
+		invalid("jwt key must be at least %d bytes (JWT_KEY)", MinJwtKeyLength)
+	}
+	if c.Auth.Timeout <= 0 {
+		invalid("jwt timeout must be positive")
+	}
+	if c.Auth.MaxRefresh < 0 {
+		invalid("jwt max refresh can't be negative")
+	}
+
+	oauthClient := func(name, clientId string, clientSecret Secret, redirectUrl string) {
+		if clientId == "" && clientSecret == "" {
+			return
+		}
+		if clientId == "" || clientSecret == "" {
+			invalid("%s client id and secret must be set together", name)
+		}
+		if !absoluteUrl(redirectUrl) {
+			invalid("%s redirect url must be an absolute url", name)
+		}
+	}
+	oauthClient("google", c.Google.ClientID, c.Google.ClientSecret, c.Google.RedirectURL)
+	oauthClient("github", c.GitHub.ClientID, c.GitHub.ClientSecret, c.GitHub.RedirectURL)
+	oauthClient("facebook", c.Facebook.ClientID, c.Facebook.ClientSecret, c.Facebook.RedirectURL)
+	providers := map[string]bool{"google": true, "github": true, "facebook": true}
+	for _, provider := range c.Oidc {
+		if !oidcNameRegex.MatchString(provider.Name) {
+			invalid("invalid oidc provider name %q", provider.Name)
+		} else if providers[provider.Name] {
+			invalid("oidc provider %q is defined twice", provider.Name)
+		}
+		providers[provider.Name] = true
+		if !absoluteUrl(provider.Issuer) {
+			invalid("oidc provider %q issuer must be an absolute url", provider.Name)
+		}
+		if provider.ClientID == "" {
+			invalid("oidc provider %q client id is required", provider.Name)
+		}
+		oauthClient("oidc provider "+strconv.Quote(provider.Name), provider.ClientID, provider.ClientSecret, provider.RedirectURL)
+	}
+
+	if c.Images.MaxSize <= 0 {
+		invalid("image max size must be positive")
+	}
+	if c.Images.RootFolder == "" {
+		invalid("image root folder is required")
+	}
+	switch c.Images.Storage {
+	case LocalStorage:
+	case S3Storage:
+		if c.Images.S3.Endpoint == "" || c.Images.S3.Bucket == "" {
+			invalid("s3 endpoint and bucket are required with the s3 storage")
+		}
+	default:
+		invalid("unsupported image storage %q", c.Images.Storage)
+	}
+	if c.Images.PublicURL != "" && !absoluteUrl(c.Images.PublicURL) {
+		invalid("image public url must be an absolute url")
+	}
+	if c.Images.GCInterval <= 0 || c.Images.GCTTL <= 0 {
+		invalid("image gc interval and ttl must be positive")
+	}
+
+	if len(c.Cors.AllowOrigins) == 0 {
+		invalid("at least one cors origin is required")
+	}
+	if c.Cors.AllowCredentials && c.Cors.AllowAllOrigins() {
+		invalid("cors credentials can't be allowed for every origin")
+	}
+
+	switch c.Mail.Mailer {
+	case FileMailer:
+	case SMTPMailer:
+		if _, _, err := net.SplitHostPort(c.Mail.SMTP.Address); err != nil {
+			invalid("smtp address must be host:port with the smtp mailer")
+		}
+	default:
+		invalid("unsupported mailer %q", c.Mail.Mailer)
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		invalid("invalid mail sender %q", c.Mail.From)
+	}
+	if !absoluteUrl(c.Mail.LinkURL) {
+		invalid("mail link url must be an absolute url")
+	}
+	if c.Mail.VerificationTTL <= 0 || c.Mail.ResetTTL <= 0 {
+		invalid("mail verification and reset ttl must be positive")
+	}
+
+	if c.Login.AccountAttempts <= 0 || c.Login.IPAttempts <= 0 {
+		invalid("login account and ip attempts must be positive")
+	}
+	if c.Login.Lockout <= 0 || c.Login.MaxLockout < c.Login.Lockout {
+		invalid("login lockout must be positive and at most the max lockout")
+	}
+	if c.Login.FailureTTL <= 0 {
+		invalid("login failure ttl must be positive")
+	}
+
+	switch c.RateLimit.Backend {
+	case MemoryRateLimit, PostgresRateLimit:
+	default:
+		invalid("unsupported rate limit backend %q", c.RateLimit.Backend)
+	}
+	rateLimit := func(name string, requests int64, period time.Duration) {
+		if requests < 0 {
+			invalid("%s rate limit requests can't be negative", name)
+		}
+		if requests > 0 && period <= 0 {
+			invalid("%s rate limit period must be positive", name)
+		}
+	}
+	rateLimit("write", c.RateLimit.WriteRequests, c.RateLimit.WritePeriod)
+	rateLimit("search", c.RateLimit.SearchRequests, c.RateLimit.SearchPeriod)
+	rateLimit("reset", c.RateLimit.ResetRequests, c.RateLimit.ResetPeriod)
+
+	if len(problems) > 0 {
+		return errors.New("invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func (c Cors) AllowAllOrigins() bool {
+	for _, origin := range c.AllowOrigins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func absoluteUrl(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && parsed.Scheme != "" && parsed.Host != ""
+}
+
+// String renders the config as YAML, with the secrets redacted, so it can be logged.
+func (c *Config) String() string {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return "error rendering config: " + err.Error()
+	}
+	return string(data)
+}
@@ -35,6 +35,34 @@ func (q *Queries) BookAuthorById(ctx context.Context, id int32) (BookAuthorByIdR
 	return i, err
 }
 
+const bookAuthorIdByName = `-- name: BookAuthorIdByName :one
+SELECT id
+FROM book_authors
+WHERE name = $1
+ORDER BY id
+FETCH FIRST ROW ONLY
+`
+
+func (q *Queries) BookAuthorIdByName(ctx context.Context, name string) (int32, error) {
+	row := q.db.QueryRow(ctx, bookAuthorIdByName, name)
+	var id int32
+	err := row.Scan(&id)
+	return id, err
+}
+
+const bookAuthorOwner = `-- name: BookAuthorOwner :one
+SELECT owner_id
+FROM book_authors
+WHERE id = $1
+`
+
+func (q *Queries) BookAuthorOwner(ctx context.Context, id int32) (sql.NullInt32, error) {
+	row := q.db.QueryRow(ctx, bookAuthorOwner, id)
+	var owner_id sql.NullInt32
+	err := row.Scan(&owner_id)
+	return owner_id, err
+}
+
 const bookAuthors = `-- name: BookAuthors :many
 SELECT id, name, aliases, description, avatar_image_id
 FROM book_authors
@@ -156,9 +184,9 @@ func (q *Queries) GetBookGroupAuthors(ctx context.Context, id int32) ([]GetBookG
 }
 
 const insertBookAuthor = `-- name: InsertBookAuthor :one
-INSERT INTO book_authors(name, aliases, description, avatar_image_id)
-VALUES ($1, $2, $3, $4)
-RETURNING id, name, aliases, description, avatar_image_id, book_author_tsv
+INSERT INTO book_authors(name, aliases, description, avatar_image_id, owner_id)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, name, aliases, description, avatar_image_id, book_author_tsv, owner_id
 `
 
 type InsertBookAuthorParams struct {
@@ -166,6 +194,7 @@ type InsertBookAuthorParams struct {
 	Aliases       sql.NullString `json:"aliases"`
 	Description   sql.NullString `json:"description"`
 	AvatarImageID sql.NullInt32  `json:"avatarImageID"`
+	OwnerID       sql.NullInt32  `json:"ownerID"`
 }
 
 func (q *Queries) InsertBookAuthor(ctx context.Context, arg InsertBookAuthorParams) (BookAuthor, error) {
@@ -174,6 +203,7 @@ func (q *Queries) InsertBookAuthor(ctx context.Context, arg InsertBookAuthorPara
 		arg.Aliases,
 		arg.Description,
 		arg.AvatarImageID,
+		arg.OwnerID,
 	)
 	var i BookAuthor
 	err := row.Scan(
@@ -183,10 +213,24 @@ func (q *Queries) InsertBookAuthor(ctx context.Context, arg InsertBookAuthorPara
 		&i.Description,
 		&i.AvatarImageID,
 		&i.BookAuthorTsv,
+		&i.OwnerID,
 	)
 	return i, err
 }
 
+const reindexBookAuthors = `-- name: ReindexBookAuthors :execrows
+UPDATE book_authors
+SET name = name
+`
+
+func (q *Queries) ReindexBookAuthors(ctx context.Context) (int64, error) {
+	result, err := q.db.Exec(ctx, reindexBookAuthors)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const searchAuthors = `-- name: SearchAuthors :many
 SELECT book_authors.name, book_authors.id, book_authors.aliases, i.path
 FROM book_authors
@@ -126,9 +126,10 @@ SELECT book_chapters.chapter_number,
 FROM book_chapters
          JOIN book_groups bg on book_chapters.book_group_id = bg.id
          JOIN users u on book_chapters.owner_id = u.id
-         JOIN book_chapter_views bcv on book_chapters.id = bcv.book_chapter_id
+         LEFT JOIN book_chapter_views bcv on book_chapters.id = bcv.book_chapter_id
 WHERE bg.id = $1
 GROUP BY book_chapters.id, u.id
+ORDER BY book_chapters.chapter_number
 `
 
 type GetBookGroupChaptersRow struct {
@@ -169,6 +170,38 @@ func (q *Queries) GetBookGroupChapters(ctx context.Context, id int32) ([]GetBook
 	return items, nil
 }
 
+const hypertextChapters = `-- name: HypertextChapters :many
+SELECT id, text_content
+FROM book_chapters
+WHERE type = 'hypertext'
+ORDER BY id
+`
+
+type HypertextChaptersRow struct {
+	ID          int32          `json:"id"`
+	TextContent sql.NullString `json:"textContent"`
+}
+
+func (q *Queries) HypertextChapters(ctx context.Context) ([]HypertextChaptersRow, error) {
+	rows, err := q.db.Query(ctx, hypertextChapters)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []HypertextChaptersRow
+	for rows.Next() {
+		var i HypertextChaptersRow
+		if err := rows.Scan(&i.ID, &i.TextContent); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const insertBookChapter = `-- name: InsertBookChapter :one
 INSERT INTO book_chapters(chapter_number, name, text_content, type, book_group_id, owner_id)
 VALUES ($1, $2, $3, $4, $5, $6)
@@ -231,3 +264,19 @@ func (q *Queries) UpdateBookChapter(ctx context.Context, arg UpdateBookChapterPa
 	)
 	return err
 }
+
+const updateBookChapterTextContent = `-- name: UpdateBookChapterTextContent :exec
+UPDATE book_chapters
+SET text_content=$2
+WHERE id = $1
+`
+
+type UpdateBookChapterTextContentParams struct {
+	ID          int32          `json:"id"`
+	TextContent sql.NullString `json:"textContent"`
+}
+
+func (q *Queries) UpdateBookChapterTextContent(ctx context.Context, arg UpdateBookChapterTextContentParams) error {
+	_, err := q.db.Exec(ctx, updateBookChapterTextContent, arg.ID, arg.TextContent)
+	return err
+}
@@ -640,6 +640,19 @@ func (q *Queries) RandomBookGroups(ctx context.Context, limit int32) ([]RandomBo
 	return items, nil
 }
 
+const reindexBookGroups = `-- name: ReindexBookGroups :execrows
+UPDATE book_groups
+SET title = title
+`
+
+func (q *Queries) ReindexBookGroups(ctx context.Context) (int64, error) {
+	result, err := q.db.Exec(ctx, reindexBookGroups)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const searchResult = `-- name: SearchResult :many
 SELECT bg.id id,
        (array_agg(i.path))[1] AS image,
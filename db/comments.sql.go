@@ -257,6 +257,26 @@ func (q *Queries) GetBookGroupComments(ctx context.Context, arg GetBookGroupComm
 	return items, nil
 }
 
+const getComment = `-- name: GetComment :one
+SELECT id, content, user_id, book_group_id, book_chapter_id, posted_time
+FROM book_comments
+WHERE id = $1
+`
+
+func (q *Queries) GetComment(ctx context.Context, id int32) (BookComment, error) {
+	row := q.db.QueryRow(ctx, getComment, id)
+	var i BookComment
+	err := row.Scan(
+		&i.ID,
+		&i.Content,
+		&i.UserID,
+		&i.BookGroupID,
+		&i.BookChapterID,
+		&i.PostedTime,
+	)
+	return i, err
+}
+
 const getCommentChapterInfo = `-- name: GetCommentChapterInfo :one
 SELECT book_chapters.id, book_chapters.chapter_number
 FROM book_chapters
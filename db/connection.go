@@ -3,7 +3,10 @@ package db
 import (
 	"context"
 	"fmt"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/static"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"log"
 	"os"
 )
 
@@ -31,31 +34,65 @@ func validateVersion(ctx context.Context) {
 	}
 
 	if dbVersion != CodeVersion {
-		panic(fmt.Sprintf("Incorrect database version (Current: %d != Supported: %d)", dbVersion, CodeVersion))
+		panic(fmt.Sprintf("Incorrect database version (Current: %d != Supported: %d), run `novo-server migrate up`", dbVersion, CodeVersion))
 	}
 }
 
+// Init connects with the POSTGRES_URL of the environment, for the tests that don't load
+// the whole config.
 func Init() {
 	if pool != nil {
 		return
 	}
 
-	ctx := context.Background()
 	// Verifies if env to db location exists
 	pgUrl, ok := os.LookupEnv("POSTGRES_URL")
 	if !ok {
 		panic(`Environmental variable "POSTGRES_URL" is not set. This program will now exit.`)
 	}
+	Connect(config.Database{URL: config.Secret(pgUrl)})
+}
+
+// Connect opens the pool, applies the pending migrations when AutoMigrate is set, and
+// makes sure the database has the version the code expects.
+func Connect(cfg config.Database) {
+	if pool != nil {
+		return
+	}
 
+	ctx := context.Background()
+	Open(cfg)
+	if cfg.AutoMigrate {
+		migrator, err := NewMigrator(pool, static.Migrations)
+		if err != nil {
+			panic(err)
+		}
+		applied, err := migrator.Up(ctx, 0)
+		if err != nil {
+			panic(err)
+		}
+		for _, migration := range applied {
+			log.Printf("applied migration %d_%s\n", migration.Version, migration.Name)
+		}
+	}
+	// Checks current migrated version
+	validateVersion(ctx)
+}
+
+// Open only opens the pool, for the migrate command that works on outdated databases.
+func Open(cfg config.Database) {
+	if pool != nil {
+		return
+	}
+
+	ctx := context.Background()
 	// Creates a connection pool, supporting concurrency
-	dbPool, err := pgxpool.Connect(ctx, pgUrl)
+	dbPool, err := pgxpool.Connect(ctx, cfg.URL.Value())
 	if err != nil {
 		panic(err)
 	}
 	// Assigns the database pool to package's var
 	pool = dbPool
-	// Checks current migrated version
-	validateVersion(ctx)
 }
 
 func Pool() *pgxpool.Pool {
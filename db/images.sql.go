@@ -6,6 +6,7 @@ package db
 import (
 	"context"
 	"database/sql"
+	"time"
 )
 
 const checkImageExistById = `-- name: CheckImageExistById :one
@@ -92,6 +93,46 @@ func (q *Queries) DeleteTempImage(ctx context.Context, imageID int32) error {
 	return err
 }
 
+const expiredTempImages = `-- name: ExpiredTempImages :many
+SELECT i.id, i.path, t.date_created
+FROM temp_images t
+         JOIN images i ON i.id = t.image_id
+WHERE t.date_created < $1
+  AND NOT exists(select 1 from book_chapter_images where image_id = t.image_id)
+  AND NOT exists(select 1 from book_group_arts where image_id = t.image_id)
+  AND NOT exists(select 1 from book_groups where primary_cover_art_id = t.image_id)
+  AND NOT exists(select 1 from users where avatar_image_id = t.image_id)
+  AND NOT exists(select 1 from genres where image_id = t.image_id)
+  AND NOT exists(select 1 from book_authors where avatar_image_id = t.image_id)
+ORDER BY t.date_created
+`
+
+type ExpiredTempImagesRow struct {
+	ID          int32     `json:"id"`
+	Path        string    `json:"path"`
+	DateCreated time.Time `json:"dateCreated"`
+}
+
+func (q *Queries) ExpiredTempImages(ctx context.Context, dateCreated time.Time) ([]ExpiredTempImagesRow, error) {
+	rows, err := q.db.Query(ctx, expiredTempImages, dateCreated)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ExpiredTempImagesRow
+	for rows.Next() {
+		var i ExpiredTempImagesRow
+		if err := rows.Scan(&i.ID, &i.Path, &i.DateCreated); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getImageBasedOnHash = `-- name: GetImageBasedOnHash :one
 SELECT id, md5, sha1, path, name, description
 FROM images
@@ -165,3 +206,38 @@ func (q *Queries) InsertImage(ctx context.Context, arg InsertImageParams) (int32
 	err := row.Scan(&id)
 	return id, err
 }
+
+const submitAttachedTempImages = `-- name: SubmitAttachedTempImages :execrows
+DELETE
+FROM temp_images t
+WHERE exists(select 1 from book_chapter_images where image_id = t.image_id)
+   OR exists(select 1 from book_group_arts where image_id = t.image_id)
+   OR exists(select 1 from book_groups where primary_cover_art_id = t.image_id)
+   OR exists(select 1 from users where avatar_image_id = t.image_id)
+   OR exists(select 1 from genres where image_id = t.image_id)
+   OR exists(select 1 from book_authors where avatar_image_id = t.image_id)
+`
+
+func (q *Queries) SubmitAttachedTempImages(ctx context.Context) (int64, error) {
+	result, err := q.db.Exec(ctx, submitAttachedTempImages)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const submitTempImagesByPath = `-- name: SubmitTempImagesByPath :execrows
+DELETE
+FROM temp_images t
+    USING images i
+WHERE i.id = t.image_id
+  AND i.path = ANY ($1::text[])
+`
+
+func (q *Queries) SubmitTempImagesByPath(ctx context.Context, paths []string) (int64, error) {
+	result, err := q.db.Exec(ctx, submitTempImagesByPath, paths)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
@@ -0,0 +1,272 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// migrationLockId keeps two servers from migrating the database at the same time.
+const migrationLockId = 6_402_231_877
+
+var migrationFileRegex = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+var ErrDirtyDatabase = errors.New("dirty database, fix it and use migrate force")
+
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrator applies the migrations to the database, keeping the version in the
+// schema_migrations table the same way golang-migrate does, so both can be used.
+type Migrator struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+// LoadMigrations reads the migrations of the folder "migrations" of fsys, sorted by version.
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	files, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, errors.New("error reading migrations: " + err.Error())
+	}
+
+	byVersion := make(map[uint64]*Migration)
+	for _, file := range files {
+		match := migrationFileRegex.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("invalid migration version: %s", file.Name())
+		}
+		content, err := fs.ReadFile(fsys, path.Join("migrations", file.Name()))
+		if err != nil {
+			return nil, errors.New("error reading migration: " + err.Error())
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migrations %d have different names", version)
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("migration %d has no up file", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func NewMigrator(pool *pgxpool.Pool, fsys fs.FS) (*Migrator, error) {
+	migrations, err := LoadMigrations(fsys)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool: pool, migrations: migrations}, nil
+}
+
+func (m *Migrator) Migrations() []Migration {
+	return m.migrations
+}
+
+// LatestVersion is the version the database has after every migration is applied.
+func (m *Migrator) LatestVersion() uint64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+// withLock runs fn on a single connection holding the migration lock.
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := m.pool.Acquire(ctx)
+	if err != nil {
+		return errors.New("error acquiring connection: " + err.Error())
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "SELECT pg_advisory_lock($1)", int64(migrationLockId))
+	if err != nil {
+		return errors.New("error locking migrations: " + err.Error())
+	}
+	defer func() {
+		_, _ = conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", int64(migrationLockId))
+	}()
+
+	_, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version bigint  NOT NULL,
+    dirty   boolean NOT NULL,
+    PRIMARY KEY (version)
+)`)
+	if err != nil {
+		return errors.New("error creating schema_migrations: " + err.Error())
+	}
+	return fn(conn)
+}
+
+type querier interface {
+	QueryRow(context.Context, string, ...interface{}) pgx.Row
+}
+
+func readVersion(ctx context.Context, q querier) (uint64, bool, error) {
+	var version int64
+	var dirty bool
+	err := q.QueryRow(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
+	if err == pgx.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.New("error reading database version: " + err.Error())
+	}
+	return uint64(version), dirty, nil
+}
+
+func writeVersion(ctx context.Context, tx pgx.Tx, version uint64, dirty bool) error {
+	_, err := tx.Exec(ctx, "TRUNCATE schema_migrations")
+	if err == nil && version > 0 {
+		_, err = tx.Exec(ctx, "INSERT INTO schema_migrations (version, dirty) VALUES ($1, $2)", int64(version), dirty)
+	}
+	if err != nil {
+		return errors.New("error writing database version: " + err.Error())
+	}
+	return nil
+}
+
+// Version returns the current version of the database, 0 when nothing is applied.
+func (m *Migrator) Version(ctx context.Context) (version uint64, dirty bool, err error) {
+	err = m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		version, dirty, err = readVersion(ctx, conn)
+		return err
+	})
+	return version, dirty, err
+}
+
+// run applies a migration script and the new version in one transaction, so a failing
+// migration leaves the database as it was.
+func (m *Migrator) run(ctx context.Context, conn *pgxpool.Conn, script string, version uint64) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return errors.New("error starting transaction: " + err.Error())
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	if script != "" {
+		_, err = tx.Exec(ctx, script)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeVersion(ctx, tx, version, false)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Up applies up to steps pending migrations, every one of them when steps is 0.
+func (m *Migrator) Up(ctx context.Context, steps int) ([]Migration, error) {
+	var applied []Migration
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		version, dirty, err := readVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return ErrDirtyDatabase
+		}
+		for _, migration := range m.migrations {
+			if migration.Version <= version {
+				continue
+			}
+			if steps > 0 && len(applied) == steps {
+				break
+			}
+			err = m.run(ctx, conn, migration.Up, migration.Version)
+			if err != nil {
+				return fmt.Errorf("error applying migration %d_%s: %s", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the last steps applied migrations.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		version, dirty, err := readVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return ErrDirtyDatabase
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if migration.Version > version {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("migration %d_%s can't be reverted", migration.Version, migration.Name)
+			}
+			var previous uint64
+			if i > 0 {
+				previous = m.migrations[i-1].Version
+			}
+			err = m.run(ctx, conn, migration.Down, previous)
+			if err != nil {
+				return fmt.Errorf("error reverting migration %d_%s: %s", migration.Version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Force sets the version without running anything and clears the dirty flag, once a
+// failed migration has been fixed by hand.
+func (m *Migrator) Force(ctx context.Context, version uint64) error {
+	known := version == 0
+	for _, migration := range m.migrations {
+		known = known || migration.Version == version
+	}
+	if !known {
+		return fmt.Errorf("unknown migration version %d", version)
+	}
+	return m.withLock(ctx, func(conn *pgxpool.Conn) error {
+		return m.run(ctx, conn, "", version)
+	})
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"github.com/dqhieuu/novo-app/static"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(static.Migrations)
+	assert.Nil(t, err)
+	if assert.NotEmpty(t, migrations) {
+		assert.Equal(t, uint64(CodeVersion), migrations[len(migrations)-1].Version)
+	}
+	for i, migration := range migrations {
+		assert.Equal(t, uint64(i+1), migration.Version)
+		assert.NotEmpty(t, migration.Down, "%d_%s has no down migration", migration.Version, migration.Name)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := LoadMigrations(fstest.MapFS{
+		"migrations/10_second.up.sql":  {Data: []byte("up 10")},
+		"migrations/2_first.up.sql":    {Data: []byte("up 2")},
+		"migrations/2_first.down.sql":  {Data: []byte("down 2")},
+		"migrations/README.md":         {Data: []byte("not a migration")},
+		"migrations/10_second.down.sh": {Data: []byte("not a migration")},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []Migration{
+		{Version: 2, Name: "first", Up: "up 2", Down: "down 2"},
+		{Version: 10, Name: "second", Up: "up 10"},
+	}, migrations)
+
+	_, err = LoadMigrations(fstest.MapFS{
+		"migrations/1_first.down.sql": {Data: []byte("down 1")},
+	})
+	assert.EqualError(t, err, "migration 1 has no up file")
+
+	_, err = LoadMigrations(fstest.MapFS{
+		"migrations/1_first.up.sql": {Data: []byte("up 1")},
+		"migrations/1_other.up.sql": {Data: []byte("up 1")},
+	})
+	assert.NotNil(t, err)
+}
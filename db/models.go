@@ -5,8 +5,22 @@ package db
 import (
 	"database/sql"
 	"time"
+
+	"github.com/jackc/pgtype"
 )
 
+type AuditEvent struct {
+	ID          int64         `json:"id"`
+	ActorID     sql.NullInt32 `json:"actorID"`
+	Action      string        `json:"action"`
+	TargetType  string        `json:"targetType"`
+	TargetID    int32         `json:"targetID"`
+	Before      pgtype.JSONB  `json:"before"`
+	After       pgtype.JSONB  `json:"after"`
+	Ip          string        `json:"ip"`
+	DateCreated time.Time     `json:"dateCreated"`
+}
+
 type BookAuthor struct {
 	ID            int32          `json:"id"`
 	Name          string         `json:"name"`
@@ -14,6 +28,7 @@ type BookAuthor struct {
 	Description   sql.NullString `json:"description"`
 	AvatarImageID sql.NullInt32  `json:"avatarImageID"`
 	BookAuthorTsv sql.NullString `json:"bookAuthorTsv"`
+	OwnerID       sql.NullInt32  `json:"ownerID"`
 }
 
 type BookChapter struct {
@@ -85,6 +100,16 @@ type BookGroupLike struct {
 	BookGroupID int32 `json:"bookGroupID"`
 }
 
+type EmailToken struct {
+	TokenHash   string       `json:"tokenHash"`
+	UserID      int32        `json:"userID"`
+	Purpose     string       `json:"purpose"`
+	Email       string       `json:"email"`
+	DateCreated time.Time    `json:"dateCreated"`
+	DateExpires time.Time    `json:"dateExpires"`
+	DateUsed    sql.NullTime `json:"dateUsed"`
+}
+
 type Genre struct {
 	ID          int32          `json:"id"`
 	Name        string         `json:"name"`
@@ -101,10 +126,56 @@ type Image struct {
 	Description sql.NullString `json:"description"`
 }
 
+type LoginAttempt struct {
+	ID          int64         `json:"id"`
+	UserID      sql.NullInt32 `json:"userID"`
+	Identifier  string        `json:"identifier"`
+	Ip          string        `json:"ip"`
+	Outcome     string        `json:"outcome"`
+	DateCreated time.Time     `json:"dateCreated"`
+}
+
+type LoginChallenge struct {
+	TokenHash   string    `json:"tokenHash"`
+	UserID      int32     `json:"userID"`
+	DateExpires time.Time `json:"dateExpires"`
+	Attempts    int32     `json:"attempts"`
+}
+
+type LoginThrottle struct {
+	Key             string       `json:"key"`
+	Failures        int32        `json:"failures"`
+	DateLastFailure time.Time    `json:"dateLastFailure"`
+	LockedUntil     sql.NullTime `json:"lockedUntil"`
+}
+
+type OauthState struct {
+	State       string        `json:"state"`
+	Provider    string        `json:"provider"`
+	Nonce       string        `json:"nonce"`
+	Verifier    string        `json:"verifier"`
+	DateCreated time.Time     `json:"dateCreated"`
+	UserID      sql.NullInt32 `json:"userID"`
+}
+
+type RateLimitBucket struct {
+	Key         string    `json:"key"`
+	Tokens      float64   `json:"tokens"`
+	DateUpdated time.Time `json:"dateUpdated"`
+}
+
+type RefreshToken struct {
+	TokenHash   string       `json:"tokenHash"`
+	SessionID   string       `json:"sessionID"`
+	DateCreated time.Time    `json:"dateCreated"`
+	DateUsed    sql.NullTime `json:"dateUsed"`
+}
+
 type Role struct {
-	ID          int32          `json:"id"`
-	Name        string         `json:"name"`
-	Description sql.NullString `json:"description"`
+	ID               int32          `json:"id"`
+	Name             string         `json:"name"`
+	Description      sql.NullString `json:"description"`
+	RequireTwoFactor bool           `json:"requireTwoFactor"`
 }
 
 type RolePermission struct {
@@ -113,19 +184,62 @@ type RolePermission struct {
 	RoleID int32  `json:"roleID"`
 }
 
+type Session struct {
+	ID          string       `json:"id"`
+	UserID      int32        `json:"userID"`
+	DateCreated time.Time    `json:"dateCreated"`
+	DateExpires time.Time    `json:"dateExpires"`
+	DateRevoked sql.NullTime `json:"dateRevoked"`
+}
+
 type TempImage struct {
 	ImageID     int32     `json:"imageID"`
 	DateCreated time.Time `json:"dateCreated"`
 }
 
+type TotpRecoveryCode struct {
+	UserID   int32        `json:"userID"`
+	CodeHash string       `json:"codeHash"`
+	DateUsed sql.NullTime `json:"dateUsed"`
+}
+
+type UploadSession struct {
+	ID          string    `json:"id"`
+	UserID      int32     `json:"userID"`
+	Category    string    `json:"category"`
+	Size        int64     `json:"size"`
+	Received    int64     `json:"received"`
+	Sha1        string    `json:"sha1"`
+	DateCreated time.Time `json:"dateCreated"`
+	DateUpdated time.Time `json:"dateUpdated"`
+}
+
 type User struct {
-	ID            int32          `json:"id"`
-	DateCreated   time.Time      `json:"dateCreated"`
-	UserName      sql.NullString `json:"userName"`
-	Password      sql.NullString `json:"password"`
-	Email         string         `json:"email"`
-	Summary       sql.NullString `json:"summary"`
-	AvatarImageID sql.NullInt32  `json:"avatarImageID"`
-	RoleID        int32          `json:"roleID"`
-	FavoriteList  sql.NullString `json:"favoriteList"`
+	ID                int32          `json:"id"`
+	DateCreated       time.Time      `json:"dateCreated"`
+	UserName          sql.NullString `json:"userName"`
+	Password          sql.NullString `json:"password"`
+	Email             string         `json:"email"`
+	Summary           sql.NullString `json:"summary"`
+	AvatarImageID     sql.NullInt32  `json:"avatarImageID"`
+	RoleID            int32          `json:"roleID"`
+	FavoriteList      sql.NullString `json:"favoriteList"`
+	PermissionVersion int32          `json:"permissionVersion"`
+	EmailVerified     bool           `json:"emailVerified"`
+}
+
+type UserIdentity struct {
+	Provider    string         `json:"provider"`
+	Subject     string         `json:"subject"`
+	UserID      int32          `json:"userID"`
+	Email       sql.NullString `json:"email"`
+	DateCreated time.Time      `json:"dateCreated"`
+}
+
+type UserTotp struct {
+	UserID      int32        `json:"userID"`
+	Secret      string       `json:"secret"`
+	DateCreated time.Time    `json:"dateCreated"`
+	DateEnabled sql.NullTime `json:"dateEnabled"`
+	LastStep    int64        `json:"lastStep"`
 }
@@ -31,6 +31,17 @@ func (q *Queries) CheckPermissionOnUserId(ctx context.Context, arg CheckPermissi
 	return exists, err
 }
 
+const deleteRolePermissions = `-- name: DeleteRolePermissions :exec
+DELETE
+FROM role_permissions
+WHERE role_id = $1
+`
+
+func (q *Queries) DeleteRolePermissions(ctx context.Context, roleID int32) error {
+	_, err := q.db.Exec(ctx, deleteRolePermissions, roleID)
+	return err
+}
+
 const getUserPermission = `-- name: GetUserPermission :many
 SELECT rp.module, rp.action, rp.role_id FROM users JOIN role_permissions rp on users.role_id = rp.role_id WHERE users.id = $1
 `
@@ -54,3 +65,74 @@ func (q *Queries) GetUserPermission(ctx context.Context, id int32) ([]RolePermis
 	}
 	return items, nil
 }
+
+const grantPermission = `-- name: GrantPermission :exec
+INSERT INTO role_permissions (module, action, role_id)
+VALUES ($1, $2, $3)
+ON CONFLICT DO NOTHING
+`
+
+type GrantPermissionParams struct {
+	Module string `json:"module"`
+	Action string `json:"action"`
+	RoleID int32  `json:"roleID"`
+}
+
+func (q *Queries) GrantPermission(ctx context.Context, arg GrantPermissionParams) error {
+	_, err := q.db.Exec(ctx, grantPermission, arg.Module, arg.Action, arg.RoleID)
+	return err
+}
+
+const revokePermission = `-- name: RevokePermission :execrows
+DELETE
+FROM role_permissions
+WHERE module = $1
+  AND action = $2
+  AND role_id = $3
+`
+
+type RevokePermissionParams struct {
+	Module string `json:"module"`
+	Action string `json:"action"`
+	RoleID int32  `json:"roleID"`
+}
+
+func (q *Queries) RevokePermission(ctx context.Context, arg RevokePermissionParams) (int64, error) {
+	result, err := q.db.Exec(ctx, revokePermission, arg.Module, arg.Action, arg.RoleID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const rolePermissionsByName = `-- name: RolePermissionsByName :many
+SELECT rp.module, rp.action
+FROM role_permissions rp
+         JOIN roles r ON r.id = rp.role_id
+WHERE r.name = $1
+`
+
+type RolePermissionsByNameRow struct {
+	Module string `json:"module"`
+	Action string `json:"action"`
+}
+
+func (q *Queries) RolePermissionsByName(ctx context.Context, name string) ([]RolePermissionsByNameRow, error) {
+	rows, err := q.db.Query(ctx, rolePermissionsByName, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []RolePermissionsByNameRow
+	for rows.Next() {
+		var i RolePermissionsByNameRow
+		if err := rows.Scan(&i.Module, &i.Action); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
@@ -144,7 +144,8 @@ const completeOauthAccount = `-- name: CompleteOauthAccount :exec
 UPDATE users
 SET user_name       = $2,
     avatar_image_id = $3,
-    role_id         = $4
+    role_id         = $4,
+    permission_version = permission_version + 1
 WHERE id = $1
 `
 
@@ -184,7 +185,8 @@ SELECT users.id,
        r.name as role,
        users.summary,
        i.path as avatarPath,
-       i.id   as avatarId
+       i.id   as avatarId,
+       users.email_verified
 FROM users
          JOIN roles r on users.role_id = r.id
          LEFT JOIN images i on users.avatar_image_id = i.id
@@ -192,14 +194,15 @@ WHERE users.id = $1
 `
 
 type GetUserInfoRow struct {
-	ID         int32          `json:"id"`
-	UserName   sql.NullString `json:"userName"`
-	Email      string         `json:"email"`
-	Password   sql.NullString `json:"password"`
-	Role       string         `json:"role"`
-	Summary    sql.NullString `json:"summary"`
-	Avatarpath sql.NullString `json:"avatarpath"`
-	Avatarid   sql.NullInt32  `json:"avatarid"`
+	ID            int32          `json:"id"`
+	UserName      sql.NullString `json:"userName"`
+	Email         string         `json:"email"`
+	Password      sql.NullString `json:"password"`
+	Role          string         `json:"role"`
+	Summary       sql.NullString `json:"summary"`
+	Avatarpath    sql.NullString `json:"avatarpath"`
+	Avatarid      sql.NullInt32  `json:"avatarid"`
+	EmailVerified bool           `json:"emailVerified"`
 }
 
 func (q *Queries) GetUserInfo(ctx context.Context, id int32) (GetUserInfoRow, error) {
@@ -214,21 +217,23 @@ func (q *Queries) GetUserInfo(ctx context.Context, id int32) (GetUserInfoRow, er
 		&i.Summary,
 		&i.Avatarpath,
 		&i.Avatarid,
+		&i.EmailVerified,
 	)
 	return i, err
 }
 
 const insertUser = `-- name: InsertUser :one
-INSERT INTO users(user_name, password, email, role_id)
-VALUES ($1, $2, $3, (SELECT id FROM roles WHERE name = $4))
-RETURNING id, date_created, user_name, password, email, summary, avatar_image_id, role_id, favorite_list
+INSERT INTO users(user_name, password, email, email_verified, role_id)
+VALUES ($1, $2, $3, $4, (SELECT id FROM roles WHERE name = $5))
+RETURNING id, date_created, user_name, password, email, summary, avatar_image_id, role_id, favorite_list, permission_version, email_verified
 `
 
 type InsertUserParams struct {
-	UserName sql.NullString `json:"userName"`
-	Password sql.NullString `json:"password"`
-	Email    string         `json:"email"`
-	RoleName string         `json:"roleName"`
+	UserName      sql.NullString `json:"userName"`
+	Password      sql.NullString `json:"password"`
+	Email         string         `json:"email"`
+	EmailVerified bool           `json:"emailVerified"`
+	RoleName      string         `json:"roleName"`
 }
 
 func (q *Queries) InsertUser(ctx context.Context, arg InsertUserParams) (User, error) {
@@ -236,6 +241,7 @@ func (q *Queries) InsertUser(ctx context.Context, arg InsertUserParams) (User, e
 		arg.UserName,
 		arg.Password,
 		arg.Email,
+		arg.EmailVerified,
 		arg.RoleName,
 	)
 	var i User
@@ -249,6 +255,8 @@ func (q *Queries) InsertUser(ctx context.Context, arg InsertUserParams) (User, e
 		&i.AvatarImageID,
 		&i.RoleID,
 		&i.FavoriteList,
+		&i.PermissionVersion,
+		&i.EmailVerified,
 	)
 	return i, err
 }
@@ -308,7 +316,8 @@ Update users
 SET email           = $2,
     user_name       = $3,
     summary         = $4,
-    avatar_image_id = $5
+    avatar_image_id = $5,
+    email_verified  = email_verified AND email = $2
 WHERE id = $1
 `
 
@@ -332,7 +341,7 @@ func (q *Queries) UpdateUserInfo(ctx context.Context, arg UpdateUserInfoParams)
 }
 
 const userByEmail = `-- name: UserByEmail :one
-SELECT id, date_created, user_name, password, email, summary, avatar_image_id, role_id, favorite_list
+SELECT id, date_created, user_name, password, email, summary, avatar_image_id, role_id, favorite_list, permission_version, email_verified
 FROM users
 WHERE email = $1
     FETCH FIRST ROWS ONLY
@@ -351,12 +360,39 @@ func (q *Queries) UserByEmail(ctx context.Context, email string) (User, error) {
 		&i.AvatarImageID,
 		&i.RoleID,
 		&i.FavoriteList,
+		&i.PermissionVersion,
+		&i.EmailVerified,
+	)
+	return i, err
+}
+
+const userById = `-- name: UserById :one
+SELECT id, date_created, user_name, password, email, summary, avatar_image_id, role_id, favorite_list, permission_version, email_verified
+FROM users
+WHERE id = $1
+`
+
+func (q *Queries) UserById(ctx context.Context, id int32) (User, error) {
+	row := q.db.QueryRow(ctx, userById, id)
+	var i User
+	err := row.Scan(
+		&i.ID,
+		&i.DateCreated,
+		&i.UserName,
+		&i.Password,
+		&i.Email,
+		&i.Summary,
+		&i.AvatarImageID,
+		&i.RoleID,
+		&i.FavoriteList,
+		&i.PermissionVersion,
+		&i.EmailVerified,
 	)
 	return i, err
 }
 
 const userByUsernameOrEmail = `-- name: UserByUsernameOrEmail :one
-SELECT id, date_created, user_name, password, email, summary, avatar_image_id, role_id, favorite_list
+SELECT id, date_created, user_name, password, email, summary, avatar_image_id, role_id, favorite_list, permission_version, email_verified
 FROM users
 WHERE user_name = $1
    OR email = $1
@@ -376,6 +412,68 @@ func (q *Queries) UserByUsernameOrEmail(ctx context.Context, userName sql.NullSt
 		&i.AvatarImageID,
 		&i.RoleID,
 		&i.FavoriteList,
+		&i.PermissionVersion,
+		&i.EmailVerified,
 	)
 	return i, err
 }
+
+const userPermissionVersion = `-- name: UserPermissionVersion :one
+SELECT permission_version
+FROM users
+WHERE id = $1
+`
+
+func (q *Queries) UserPermissionVersion(ctx context.Context, id int32) (int32, error) {
+	row := q.db.QueryRow(ctx, userPermissionVersion, id)
+	var permission_version int32
+	err := row.Scan(&permission_version)
+	return permission_version, err
+}
+
+const userPasswordForUpdate = `-- name: UserPasswordForUpdate :one
+SELECT password
+FROM users
+WHERE id = $1
+    FOR UPDATE
+`
+
+func (q *Queries) UserPasswordForUpdate(ctx context.Context, id int32) (sql.NullString, error) {
+	row := q.db.QueryRow(ctx, userPasswordForUpdate, id)
+	var password sql.NullString
+	err := row.Scan(&password)
+	return password, err
+}
+
+const userEmailVerified = `-- name: UserEmailVerified :one
+SELECT email_verified
+FROM users
+WHERE id = $1
+`
+
+func (q *Queries) UserEmailVerified(ctx context.Context, id int32) (bool, error) {
+	row := q.db.QueryRow(ctx, userEmailVerified, id)
+	var email_verified bool
+	err := row.Scan(&email_verified)
+	return email_verified, err
+}
+
+const verifyUserEmail = `-- name: VerifyUserEmail :execrows
+UPDATE users
+SET email_verified = true
+WHERE id = $1
+  AND email = $2
+`
+
+type VerifyUserEmailParams struct {
+	ID    int32  `json:"id"`
+	Email string `json:"email"`
+}
+
+func (q *Queries) VerifyUserEmail(ctx context.Context, arg VerifyUserEmailParams) (int64, error) {
+	result, err := q.db.Exec(ctx, verifyUserEmail, arg.ID, arg.Email)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
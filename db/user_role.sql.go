@@ -8,6 +8,30 @@ import (
 	"database/sql"
 )
 
+const bumpRolePermissionVersion = `-- name: BumpRolePermissionVersion :exec
+UPDATE users
+SET permission_version = permission_version + 1
+WHERE role_id = $1
+`
+
+func (q *Queries) BumpRolePermissionVersion(ctx context.Context, roleID int32) error {
+	_, err := q.db.Exec(ctx, bumpRolePermissionVersion, roleID)
+	return err
+}
+
+const countUsersWithRole = `-- name: CountUsersWithRole :one
+SELECT count(*)
+FROM users
+WHERE role_id = $1
+`
+
+func (q *Queries) CountUsersWithRole(ctx context.Context, roleID int32) (int64, error) {
+	row := q.db.QueryRow(ctx, countUsersWithRole, roleID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 const deleteRole = `-- name: DeleteRole :exec
 DELETE
 FROM roles
@@ -19,6 +43,20 @@ func (q *Queries) DeleteRole(ctx context.Context, name string) error {
 	return err
 }
 
+const deleteRoleById = `-- name: DeleteRoleById :execrows
+DELETE
+FROM roles
+WHERE id = $1
+`
+
+func (q *Queries) DeleteRoleById(ctx context.Context, id int32) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteRoleById, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const getRoleId = `-- name: GetRoleId :one
 SELECT id FROM roles WHERE name = $1
 `
@@ -33,7 +71,7 @@ func (q *Queries) GetRoleId(ctx context.Context, name string) (int32, error) {
 const insertNewRole = `-- name: InsertNewRole :one
 INSERT INTO roles (name, description)
 VALUES ($1, $2)
-RETURNING id, name, description
+RETURNING id, name, description, require_two_factor
 `
 
 type InsertNewRoleParams struct {
@@ -44,33 +82,107 @@ type InsertNewRoleParams struct {
 func (q *Queries) InsertNewRole(ctx context.Context, arg InsertNewRoleParams) (Role, error) {
 	row := q.db.QueryRow(ctx, insertNewRole, arg.Name, arg.Description)
 	var i Role
-	err := row.Scan(&i.ID, &i.Name, &i.Description)
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Description,
+		&i.RequireTwoFactor,
+	)
 	return i, err
 }
 
+const listRoles = `-- name: ListRoles :many
+SELECT r.id,
+       r.name,
+       r.description,
+       r.require_two_factor,
+       array_remove(array_agg(rp.module || '.' || rp.action ORDER BY rp.module, rp.action), null)::text[] permissions,
+       (SELECT count(*) FROM users u WHERE u.role_id = r.id)                                             user_count
+FROM roles r
+         LEFT JOIN role_permissions rp ON r.id = rp.role_id
+GROUP BY r.id
+ORDER BY r.id
+`
+
+type ListRolesRow struct {
+	ID               int32          `json:"id"`
+	Name             string         `json:"name"`
+	Description      sql.NullString `json:"description"`
+	RequireTwoFactor bool           `json:"requireTwoFactor"`
+	Permissions      []string       `json:"permissions"`
+	UserCount        int64          `json:"userCount"`
+}
+
+func (q *Queries) ListRoles(ctx context.Context) ([]ListRolesRow, error) {
+	rows, err := q.db.Query(ctx, listRoles)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListRolesRow
+	for rows.Next() {
+		var i ListRolesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.Description,
+			&i.RequireTwoFactor,
+			&i.Permissions,
+			&i.UserCount,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const role = `-- name: Role :one
 SELECT r.name                             role_name,
-       array_remove(array_agg(module || '.' || action), null)::text[] role_permissions
+       array_remove(array_agg(module || '.' || action), null)::text[] role_permissions,
+       r.require_two_factor
 FROM roles r
          LEFT JOIN role_permissions rp ON r.id = rp.role_id
 WHERE r.id = $1
-GROUP BY r.name
+GROUP BY r.name, r.require_two_factor
 `
 
 type RoleRow struct {
-	RoleName        string   `json:"roleName"`
-	RolePermissions []string `json:"rolePermissions"`
+	RoleName         string   `json:"roleName"`
+	RolePermissions  []string `json:"rolePermissions"`
+	RequireTwoFactor bool     `json:"requireTwoFactor"`
 }
 
 func (q *Queries) Role(ctx context.Context, id int32) (RoleRow, error) {
 	row := q.db.QueryRow(ctx, role, id)
 	var i RoleRow
-	err := row.Scan(&i.RoleName, &i.RolePermissions)
+	err := row.Scan(&i.RoleName, &i.RolePermissions, &i.RequireTwoFactor)
+	return i, err
+}
+
+const roleById = `-- name: RoleById :one
+SELECT id, name, description, require_two_factor
+FROM roles
+WHERE id = $1
+`
+
+func (q *Queries) RoleById(ctx context.Context, id int32) (Role, error) {
+	row := q.db.QueryRow(ctx, roleById, id)
+	var i Role
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Description,
+		&i.RequireTwoFactor,
+	)
 	return i, err
 }
 
 const setRole = `-- name: SetRole :exec
-UPDATE users SET role_id = $2 where id = $1
+UPDATE users SET role_id = $2, permission_version = permission_version + 1 where id = $1
 `
 
 type SetRoleParams struct {
@@ -82,3 +194,62 @@ func (q *Queries) SetRole(ctx context.Context, arg SetRoleParams) error {
 	_, err := q.db.Exec(ctx, setRole, arg.ID, arg.RoleID)
 	return err
 }
+
+const setRoleRequireTwoFactor = `-- name: SetRoleRequireTwoFactor :execrows
+UPDATE roles
+SET require_two_factor = $2
+WHERE id = $1
+`
+
+type SetRoleRequireTwoFactorParams struct {
+	ID               int32 `json:"id"`
+	RequireTwoFactor bool  `json:"requireTwoFactor"`
+}
+
+func (q *Queries) SetRoleRequireTwoFactor(ctx context.Context, arg SetRoleRequireTwoFactorParams) (int64, error) {
+	result, err := q.db.Exec(ctx, setRoleRequireTwoFactor, arg.ID, arg.RequireTwoFactor)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const updateRole = `-- name: UpdateRole :one
+UPDATE roles
+SET name        = $2,
+    description = $3
+WHERE id = $1
+RETURNING id, name, description, require_two_factor
+`
+
+type UpdateRoleParams struct {
+	ID          int32          `json:"id"`
+	Name        string         `json:"name"`
+	Description sql.NullString `json:"description"`
+}
+
+func (q *Queries) UpdateRole(ctx context.Context, arg UpdateRoleParams) (Role, error) {
+	row := q.db.QueryRow(ctx, updateRole, arg.ID, arg.Name, arg.Description)
+	var i Role
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.Description,
+		&i.RequireTwoFactor,
+	)
+	return i, err
+}
+
+const userRoleName = `-- name: UserRoleName :one
+SELECT r.name
+FROM users u
+         JOIN roles r ON r.id = u.role_id
+WHERE u.id = $1
+`
+
+func (q *Queries) UserRoleName(ctx context.Context, id int32) (string, error) {
+	row := q.db.QueryRow(ctx, userRoleName, id)
+	var name string
+	err := row.Scan(&name)
+	return name, err
+}
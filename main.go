@@ -1,14 +1,70 @@
 package main
 
 import (
+	"fmt"
+	"github.com/dqhieuu/novo-app/config"
 	"github.com/dqhieuu/novo-app/db"
 	"github.com/dqhieuu/novo-app/server"
+	"log"
+	"os"
 )
 
+const usage = `usage: novo-server [command]
+  (none)    run the server
+  migrate   apply or revert the schema migrations
+  admin     manage users, books, images and the search index`
+
 func main() {
-	db.Init()
+	// CONFIG_FILE optionally points to a YAML config, see config.example.yaml
+	cfg, err := config.Read(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	command := ""
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+	case "":
+	case "migrate":
+		// migrate only needs the database, and must work while its version is wrong
+		if cfg.Database.URL == "" {
+			log.Fatalln("database url is required (POSTGRES_URL)")
+		}
+		db.Open(cfg.Database)
+		err = runMigrate(os.Args[2:])
+		db.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	case "admin":
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	if command == "admin" {
+		db.Connect(cfg.Database)
+		err = runAdmin(os.Args[2:], cfg)
+		db.Close()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	log.Printf("config:\n%s", cfg)
+	db.Connect(cfg.Database)
 	defer db.Pool().Close()
 	//server.TryOutsideTest()
 
-	server.Run()
+	server.Run(cfg)
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/dqhieuu/novo-app/static"
+	"strconv"
+)
+
+const migrateUsage = "usage: novo-server migrate up [N] | down [N] | status | force VERSION"
+
+// runMigrate applies the migrations embedded in the binary.
+// up applies N (default all) pending migrations, down reverts N (default 1) applied ones.
+func runMigrate(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+	ctx := context.Background()
+	migrator, err := db.NewMigrator(db.Pool(), static.Migrations)
+	if err != nil {
+		return err
+	}
+
+	steps := func(defaultSteps int) (int, error) {
+		if len(args) < 2 {
+			return defaultSteps, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return 0, errors.New("invalid number of migrations: " + args[1])
+		}
+		return n, nil
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := steps(0)
+		if err != nil {
+			return err
+		}
+		applied, err := migrator.Up(ctx, n)
+		for _, migration := range applied {
+			fmt.Printf("applied %d_%s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("no pending migration")
+		}
+		return err
+	case "down":
+		n, err := steps(1)
+		if err != nil {
+			return err
+		}
+		reverted, err := migrator.Down(ctx, n)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %d_%s\n", migration.Version, migration.Name)
+		}
+		return err
+	case "status":
+		version, dirty, err := migrator.Version(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrator.Migrations() {
+			state := "pending"
+			if migration.Version <= version {
+				state = "applied"
+			}
+			fmt.Printf("%-8s %d_%s\n", state, migration.Version, migration.Name)
+		}
+		fmt.Printf("database version %d (code expects %d)", version, db.CodeVersion)
+		if dirty {
+			fmt.Print(", dirty")
+		}
+		fmt.Println()
+		return nil
+	case "force":
+		if len(args) < 2 {
+			return errors.New(migrateUsage)
+		}
+		version, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return errors.New("invalid version: " + args[1])
+		}
+		return migrator.Force(ctx, version)
+	default:
+		return errors.New(migrateUsage)
+	}
+}
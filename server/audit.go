@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgtype"
+	"log"
+	"net/http"
+	"time"
+)
+
+// The privileged actions are kept in audit_events: who did what to which resource, from
+// which ip, with the resource before and after. The handlers record them once the action
+// succeeded; failing to record is logged, the action is not undone. The admin command
+// records its actions without an actor, from the cli ip.
+
+const (
+	DeleteBookAudit       = "book.delete"
+	EditCommentAudit      = "comment.edit"
+	DeleteCommentAudit    = "comment.delete"
+	SetRoleAudit          = "user.set_role"
+	DeleteUserAudit       = "user.delete"
+	UnlockAccountAudit    = "user.unlock"
+	CreateRoleAudit       = "role.create"
+	UpdateRoleAudit       = "role.update"
+	DeleteRoleAudit       = "role.delete"
+	SetTwoFactorAudit     = "role.set_two_factor"
+	GrantPermissionAudit  = "role.grant_permission"
+	RevokePermissionAudit = "role.revoke_permission"
+	CleanImagesAudit      = "images.gc"
+)
+
+const (
+	BookAuditTarget    = "book"
+	CommentAuditTarget = "comment"
+	ImagesAuditTarget  = "images"
+	RoleAuditTarget    = "role"
+	UserAuditTarget    = "user"
+)
+
+const cliAuditIp = "cli"
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 200
+)
+
+// AuditRecord is an action to record, Before and After are marshalled to json, nil when
+// the resource didn't exist or doesn't anymore.
+type AuditRecord struct {
+	Action     string
+	TargetType string
+	TargetId   int32
+	Before     interface{}
+	After      interface{}
+}
+
+type AuditEvent struct {
+	Id          int64           `json:"id"`
+	ActorId     *int32          `json:"actorId"`
+	ActorName   *string         `json:"actorName"`
+	Action      string          `json:"action"`
+	TargetType  string          `json:"targetType"`
+	TargetId    int32           `json:"targetId"`
+	Before      json.RawMessage `json:"before"`
+	After       json.RawMessage `json:"after"`
+	Ip          string          `json:"ip"`
+	DateCreated int64           `json:"dateCreated"`
+}
+
+// AuditFilter keeps the events matching every field set, zero fields match all.
+type AuditFilter struct {
+	ActorId    int32
+	Action     string
+	TargetType string
+	TargetId   int32
+	From       time.Time
+	To         time.Time
+}
+
+func auditSnapshot(value interface{}) (pgtype.JSONB, error) {
+	if value == nil {
+		return pgtype.JSONB{Status: pgtype.Null}, nil
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return pgtype.JSONB{}, err
+	}
+	return pgtype.JSONB{Bytes: bytes, Status: pgtype.Present}, nil
+}
+
+// auditActor is the user doing the request, from RequirePermission or else the token.
+func auditActor(c *gin.Context) sql.NullInt32 {
+	if user := CurrentUser(c); user != nil {
+		return sql.NullInt32{Int32: user.Id, Valid: true}
+	}
+	if userId, ok := jwt.ExtractClaims(c)[UserIdClaimKey].(float64); ok {
+		return sql.NullInt32{Int32: int32(userId), Valid: true}
+	}
+	return sql.NullInt32{}
+}
+
+// actingOnOthers tells if the user of the request doesn't own the resource, e.g. a moderator
+// editing the comment of another user.
+func actingOnOthers(c *gin.Context, ownerId int32) bool {
+	actor := auditActor(c)
+	return !actor.Valid || actor.Int32 != ownerId
+}
+
+func insertAuditEvent(ctx context.Context, queries *db.Queries, actor sql.NullInt32, ip string, record AuditRecord) error {
+	before, err := auditSnapshot(record.Before)
+	if err != nil {
+		return errors.New("error marshalling audit snapshot: " + err.Error())
+	}
+	after, err := auditSnapshot(record.After)
+	if err != nil {
+		return errors.New("error marshalling audit snapshot: " + err.Error())
+	}
+	err = queries.InsertAuditEvent(ctx, db.InsertAuditEventParams{
+		ActorID:    actor,
+		Action:     record.Action,
+		TargetType: record.TargetType,
+		TargetID:   record.TargetId,
+		Before:     before,
+		After:      after,
+		Ip:         ip,
+	})
+	if err != nil {
+		return errors.New("error recording audit event: " + err.Error())
+	}
+	return nil
+}
+
+// RecordAudit records the action done by the user of the request.
+func RecordAudit(c *gin.Context, record AuditRecord) {
+	err := insertAuditEvent(context.Background(), db.New(db.Pool()), auditActor(c), c.ClientIP(), record)
+	if err != nil {
+		log.Printf("%s\n", err)
+	}
+}
+
+// RecordAdminAudit records the action done by the admin command.
+func RecordAdminAudit(record AuditRecord) {
+	err := insertAuditEvent(context.Background(), db.New(db.Pool()), sql.NullInt32{}, cliAuditIp, record)
+	if err != nil {
+		log.Printf("%s\n", err)
+	}
+}
+
+func BookAuditSnapshot(book db.BookGroupByIdRow) gin.H {
+	return gin.H{
+		"title":       book.Title,
+		"aliases":     book.Aliases.String,
+		"description": book.Description.String,
+		"ownerId":     book.OwnerID,
+	}
+}
+
+func commentAuditSnapshot(comment db.BookComment) gin.H {
+	snapshot := gin.H{
+		"content":     comment.Content,
+		"userId":      comment.UserID,
+		"bookGroupId": comment.BookGroupID,
+	}
+	if comment.BookChapterID.Valid {
+		snapshot["bookChapterId"] = comment.BookChapterID.Int32
+	}
+	return snapshot
+}
+
+func roleAuditSnapshot(role db.Role) gin.H {
+	return gin.H{
+		"name":             role.Name,
+		"description":      role.Description.String,
+		"requireTwoFactor": role.RequireTwoFactor,
+	}
+}
+
+func permissionAuditSnapshot(module, action string) gin.H {
+	return gin.H{
+		"module": module,
+		"action": action,
+	}
+}
+
+// auditOffset is the number of events before the page, in int64 as the pages go up to
+// math.MaxInt32.
+func auditOffset(page, limit int32) int64 {
+	return (int64(page) - 1) * int64(limit)
+}
+
+func auditFilterParams(filter AuditFilter) db.CountAuditEventsParams {
+	return db.CountAuditEventsParams{
+		ActorID:    filter.ActorId,
+		Action:     filter.Action,
+		TargetType: filter.TargetType,
+		TargetID:   filter.TargetId,
+		DateFrom:   sql.NullTime{Time: filter.From, Valid: !filter.From.IsZero()},
+		DateTo:     sql.NullTime{Time: filter.To, Valid: !filter.To.IsZero()},
+	}
+}
+
+// AuditEvents lists a page of the events matching filter, the latest first, and how many
+// match in all.
+func AuditEvents(filter AuditFilter, page, limit int32) ([]AuditEvent, int64, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	params := auditFilterParams(filter)
+	total, err := queries.CountAuditEvents(ctx, params)
+	if err != nil {
+		return nil, 0, errors.New("error counting audit events: " + err.Error())
+	}
+	rows, err := queries.AuditEvents(ctx, db.AuditEventsParams{
+		ActorID:    params.ActorID,
+		Action:     params.Action,
+		TargetType: params.TargetType,
+		TargetID:   params.TargetID,
+		DateFrom:   params.DateFrom,
+		DateTo:     params.DateTo,
+		OffsetRows: auditOffset(page, limit),
+		LimitRows:  limit,
+	})
+	if err != nil {
+		return nil, 0, errors.New("error getting audit events: " + err.Error())
+	}
+	events := make([]AuditEvent, 0, len(rows))
+	for _, row := range rows {
+		event := AuditEvent{
+			Id:          row.ID,
+			Action:      row.Action,
+			TargetType:  row.TargetType,
+			TargetId:    row.TargetID,
+			Ip:          row.Ip,
+			DateCreated: row.DateCreated.UnixMicro(),
+		}
+		if row.ActorID.Valid {
+			actorId := row.ActorID.Int32
+			event.ActorId = &actorId
+		}
+		if row.ActorName.Valid {
+			actorName := row.ActorName.String
+			event.ActorName = &actorName
+		}
+		if row.Before.Status == pgtype.Present {
+			event.Before = row.Before.Bytes
+		}
+		if row.After.Status == pgtype.Present {
+			event.After = row.After.Bytes
+		}
+		events = append(events, event)
+	}
+	return events, total, nil
+}
+
+func auditIntQuery(c *gin.Context, name string, value *int32) error {
+	if query := c.Query(name); query != "" {
+		_, err := fmt.Sscan(query, value)
+		if err != nil || *value < 1 {
+			return errors.New("invalid " + name)
+		}
+	}
+	return nil
+}
+
+func auditTimeQuery(c *gin.Context, name string, value *time.Time) error {
+	if query := c.Query(name); query != "" {
+		parsed, err := time.Parse(time.RFC3339, query)
+		if err != nil {
+			return errors.New("invalid " + name + ", expected an RFC 3339 date")
+		}
+		*value = parsed
+	}
+	return nil
+}
+
+// parseAuditQuery reads the filter and the page of the audit log from the query string.
+func parseAuditQuery(c *gin.Context) (AuditFilter, int32, int32, error) {
+	filter := AuditFilter{
+		Action:     c.Query("action"),
+		TargetType: c.Query("targetType"),
+	}
+	page, limit := int32(1), int32(defaultAuditLimit)
+	for _, param := range []struct {
+		name  string
+		value *int32
+	}{
+		{"actorId", &filter.ActorId},
+		{"targetId", &filter.TargetId},
+		{"page", &page},
+		{"limit", &limit},
+	} {
+		if err := auditIntQuery(c, param.name, param.value); err != nil {
+			return filter, 0, 0, err
+		}
+	}
+	if limit > maxAuditLimit {
+		return filter, 0, 0, fmt.Errorf("limit must be at most %d", maxAuditLimit)
+	}
+	if err := auditTimeQuery(c, "from", &filter.From); err != nil {
+		return filter, 0, 0, err
+	}
+	if err := auditTimeQuery(c, "to", &filter.To); err != nil {
+		return filter, 0, 0, err
+	}
+	return filter, page, limit, nil
+}
+
+func AuditHandler(c *gin.Context) {
+	filter, page, limit, err := parseAuditQuery(c)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	events, total, err := AuditEvents(filter, page, limit)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusInternalServerError)
+		return
+	}
+
+	var latestPage interface{}
+	if total > 0 {
+		latestPage = (total-1)/int64(limit) + 1
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"events":     events,
+		"latestPage": latestPage,
+	})
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func auditTestContext(query string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/auth/admin/audit?"+query, nil)
+	return c
+}
+
+func TestAuditQueryParams(t *testing.T) {
+	filter, page, limit, err := parseAuditQuery(auditTestContext(""))
+	assert.Nil(t, err)
+	assert.Equal(t, AuditFilter{}, filter)
+	assert.Equal(t, int32(1), page)
+	assert.Equal(t, int32(defaultAuditLimit), limit)
+
+	filter, page, limit, err = parseAuditQuery(auditTestContext(
+		"actorId=3&action=book.delete&targetType=book&targetId=7&from=2021-01-02T03:04:05Z&page=2&limit=10"))
+	assert.Nil(t, err)
+	assert.Equal(t, AuditFilter{
+		ActorId:    3,
+		Action:     DeleteBookAudit,
+		TargetType: BookAuditTarget,
+		TargetId:   7,
+		From:       time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC),
+	}, filter)
+	assert.Equal(t, int32(2), page)
+	assert.Equal(t, int32(10), limit)
+
+	for _, query := range []string{"actorId=x", "targetId=-1", "page=0", "limit=1000", "from=yesterday", "to=2021-01-02"} {
+		_, _, _, err = parseAuditQuery(auditTestContext(query))
+		assert.NotNil(t, err, query)
+	}
+
+	_, page, limit, err = parseAuditQuery(auditTestContext("page=2147483647&limit=200"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(math.MaxInt32-1)*200, auditOffset(page, limit))
+}
+
+func TestActingOnOthers(t *testing.T) {
+	c := auditTestContext("")
+	assert.True(t, actingOnOthers(c, 1))
+	c.Set(currentUserKey, &AuthorizedUser{Id: 1})
+	assert.False(t, actingOnOthers(c, 1))
+	assert.True(t, actingOnOthers(c, 2))
+}
+
+func TestAuditLog(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	actorName := "testauditactor"
+	actor, _, err := CreateAccount(actorName, "secretpw", "auditactor@atest.com", MemberRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = DeleteAccount(actorName)
+	}()
+
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+	start := time.Now().Add(-time.Second)
+	records := []AuditRecord{
+		{Action: EditCommentAudit, TargetType: CommentAuditTarget, TargetId: actor.ID,
+			Before: gin.H{"content": "old content"}, After: gin.H{"content": "new content"}},
+		{Action: DeleteCommentAudit, TargetType: CommentAuditTarget, TargetId: actor.ID,
+			Before: gin.H{"content": "new content"}},
+	}
+	for _, record := range records {
+		err = insertAuditEvent(ctx, queries, sql.NullInt32{Int32: actor.ID, Valid: true}, "192.0.2.31", record)
+		assert.Nil(t, err)
+	}
+
+	filter := AuditFilter{TargetType: CommentAuditTarget, TargetId: actor.ID, From: start}
+	events, total, err := AuditEvents(filter, 1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), total)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, DeleteCommentAudit, events[0].Action)
+		assert.Nil(t, events[0].After)
+		assert.Equal(t, actorName, *events[1].ActorName)
+		assert.Equal(t, "192.0.2.31", events[1].Ip)
+		var before map[string]string
+		assert.Nil(t, json.Unmarshal(events[1].Before, &before))
+		assert.Equal(t, "old content", before["content"])
+	}
+
+	filter.Action = EditCommentAudit
+	events, total, err = AuditEvents(filter, 1, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), total)
+	assert.Len(t, events, 1)
+
+	// the second page is past the events
+	events, _, err = AuditEvents(filter, 2, 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 0)
+	events, _, err = AuditEvents(filter, math.MaxInt32, maxAuditLimit)
+	assert.Nil(t, err)
+	assert.Len(t, events, 0)
+
+	// the events outlive their actor
+	assert.Nil(t, DeleteAccount(actorName))
+	events, _, err = AuditEvents(filter, 1, 10)
+	assert.Nil(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Nil(t, events[0].ActorId)
+	}
+}
@@ -1,10 +1,14 @@
 package server
 
 import (
+	"context"
 	"errors"
 	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
 	"github.com/gin-gonic/gin"
 	"log"
+	"net/http"
 	"time"
 )
 
@@ -12,6 +16,10 @@ type UserClaims struct {
 	UserId          int32
 	RoleName        string
 	RolePermissions []string
+	// PermissionVersion is the version of the role of the user when the token was issued,
+	// the role claims are ignored once it changed.
+	PermissionVersion int32
+	SessionId         string
 }
 
 type PasswordLogin struct {
@@ -22,19 +30,65 @@ type PasswordLogin struct {
 type OauthLogin struct {
 	Provider string `form:"provider" json:"provider" binding:"required"`
 	Code     string `form:"code" json:"code" binding:"required"`
+	State    string `form:"state" json:"state" binding:"required"`
 }
 
 const UserIdClaimKey = "uid"
 const RoleNameClaimKey = "rol"
 const RolePermsClaimKey = "rolp"
+const PermVersionClaimKey = "pv"
+
+func sessionClaims(user *db.User, role *db.RoleRow, sessionId string) UserClaims {
+	return UserClaims{
+		UserId:            user.ID,
+		RoleName:          role.RoleName,
+		RolePermissions:   role.RolePermissions,
+		PermissionVersion: user.PermissionVersion,
+		SessionId:         sessionId,
+	}
+}
+
+// login opens a session for the user and returns the claims of its token. The refresh
+// token of the session is left on the context for the login response. The failed logins of
+// the account are forgotten.
+func login(c *gin.Context, user *db.User, role *db.RoleRow, lifetime time.Duration) (UserClaims, error) {
+	err := forgetLoginFailures(context.Background(), db.New(db.Pool()), user.ID)
+	if err != nil {
+		return UserClaims{}, err
+	}
+	sessionId, err := CreateSession(user.ID, lifetime)
+	if err != nil {
+		return UserClaims{}, err
+	}
+	refreshToken, err := IssueRefreshToken(context.Background(), db.New(db.Pool()), sessionId)
+	if err != nil {
+		return UserClaims{}, err
+	}
+	c.Set(refreshTokenKey, refreshToken)
+	return sessionClaims(user, role, sessionId), nil
+}
+
+// loginWithSecondFactor logs the user in, unless a second factor is needed: the login
+// challenge is then left on the context for the unauthorized response.
+func loginWithSecondFactor(c *gin.Context, user *db.User, role *db.RoleRow, lifetime time.Duration) (UserClaims, error) {
+	challenge, err := StartLoginChallenge(user, role)
+	if err != nil {
+		return UserClaims{}, err
+	}
+	if challenge != nil {
+		c.Set(loginChallengeKey, challenge)
+		return UserClaims{}, ErrSecondFactorRequired
+	}
+	return login(c, user, role, lifetime)
+}
 
 // AuthMiddleware is a jwt auth(enticator/orizator)
-func AuthMiddleware() *jwt.GinJWTMiddleware {
+func AuthMiddleware(cfg config.Auth) *jwt.GinJWTMiddleware {
+	lifetime := SessionLifetime(cfg)
 	authMiddleware, err := jwt.New(&jwt.GinJWTMiddleware{
-		Realm:       "my novo app",
-		Key:         []byte("U3M9B6BdNrWOxnar6P0HSqskxjec7DkG"),
-		Timeout:     24 * 7 * time.Hour,
-		MaxRefresh:  24 * 7 * time.Hour,
+		Realm:       cfg.Realm,
+		Key:         []byte(cfg.JwtKey.Value()),
+		Timeout:     cfg.Timeout,
 		IdentityKey: UserIdClaimKey,
 
 		// For the login function
@@ -42,12 +96,15 @@ func AuthMiddleware() *jwt.GinJWTMiddleware {
 			// Try if it has password login fields
 			var loginInfo PasswordLogin
 			if err := c.ShouldBind(&loginInfo); err == nil {
-				user, role, err := UserByLoginInfo(loginInfo)
+				user, role, until, err := ThrottledPasswordLogin(loginInfo, c.ClientIP())
+				if err == ErrLoginLocked {
+					c.Set(retryAfterKey, until)
+				}
 				if err != nil {
 					return nil, err
 				}
 
-				return UserClaims{UserId: user.ID, RoleName: role.RoleName, RolePermissions: role.RolePermissions}, nil
+				return loginWithSecondFactor(c, user, role, lifetime)
 			}
 
 			// Try if it has oauth login fields
@@ -58,7 +115,7 @@ func AuthMiddleware() *jwt.GinJWTMiddleware {
 					return nil, err
 				}
 
-				return UserClaims{UserId: user.ID, RoleName: role.RoleName, RolePermissions: role.RolePermissions}, nil
+				return loginWithSecondFactor(c, user, role, lifetime)
 			}
 
 			return nil, errors.New("login credentials invalid")
@@ -67,14 +124,37 @@ func AuthMiddleware() *jwt.GinJWTMiddleware {
 		PayloadFunc: func(data interface{}) jwt.MapClaims {
 			if v, ok := data.(UserClaims); ok {
 				return jwt.MapClaims{
-					UserIdClaimKey:    v.UserId,
-					RoleNameClaimKey:  v.RoleName,
-					RolePermsClaimKey: v.RolePermissions,
+					UserIdClaimKey:      v.UserId,
+					RoleNameClaimKey:    v.RoleName,
+					RolePermsClaimKey:   v.RolePermissions,
+					PermVersionClaimKey: v.PermissionVersion,
+					SessionIdClaimKey:   v.SessionId,
 				}
 			}
 			return jwt.MapClaims{}
 		},
 
+		// The login challenge of a user needing a second factor is added to the error, and
+		// the lockouts are answered with a 429
+		Unauthorized: func(c *gin.Context, code int, message string) {
+			if until, ok := c.Get(retryAfterKey); ok {
+				code = http.StatusTooManyRequests
+				c.Header("Retry-After", retryAfter(until.(time.Time)))
+			}
+			response := gin.H{
+				"code":    code,
+				"message": message,
+			}
+			if challenge, ok := c.Get(loginChallengeKey); ok {
+				response["twoFactor"] = challenge
+			}
+			c.JSON(code, response)
+		},
+
+		LoginResponse: func(c *gin.Context, code int, token string, expire time.Time) {
+			tokenResponse(c, token, expire, c.GetString(refreshTokenKey), lifetime)
+		},
+
 		SendCookie:   true,
 		SecureCookie: false, //non HTTPS dev environments
 		//CookieHTTPOnly: true,  // JS can't modify. Helps mitigate cookie hijacking
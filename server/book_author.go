@@ -5,7 +5,6 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/dqhieuu/novo-app/db"
 	"github.com/gin-gonic/gin"
 	"net/http"
@@ -92,7 +91,7 @@ func UpdateBookAuthor(id int32, name, description string, imageID int32, alias i
 	return nil
 }
 
-func CreateBookAuthor(name, description string, imageID int32, alias interface{}) (*db.BookAuthor, error) {
+func CreateBookAuthor(name, description string, imageID int32, alias interface{}, ownerId int32) (*db.BookAuthor, error) {
 
 	ctx := context.Background()
 	queries := db.New(db.Pool())
@@ -113,6 +112,10 @@ func CreateBookAuthor(name, description string, imageID int32, alias interface{}
 		Name:          name,
 		Description:   descriptionSql,
 		AvatarImageID: imageIdSql,
+		OwnerID: sql.NullInt32{
+			Int32: ownerId,
+			Valid: ownerId > 0,
+		},
 	}
 
 	if alias != nil {
@@ -163,23 +166,6 @@ func CreateAuthorHandler(c *gin.Context) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: AuthorModule,
-		Action: PostAction,
-		ID:     userId,
-	})
-	if err != nil {
-		ReportError(c, err, "error", 500)
-		return
-	}
-	if !check {
-		ReportError(c, errors.New("permission denied"), "error", 403)
-		return
-	}
-
 	var a CreateAuthor
 	if err := c.ShouldBindJSON(&a); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -257,7 +243,7 @@ func CreateAuthorHandler(c *gin.Context) {
 		return
 	}
 
-	_, err = CreateBookAuthor(a.Name, a.Description, a.AvatarId, a.Alias)
+	_, err = CreateBookAuthor(a.Name, a.Description, a.AvatarId, a.Alias, CurrentUser(c).Id)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"error": err.Error(),
@@ -280,193 +266,121 @@ func UpdateAuthorHandler(c *gin.Context) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-	permAllow := false
-
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: AuthorModule,
-		Action: ModifyAction,
-		ID:     userId,
-	})
+	var authorId int32
+	_, err := fmt.Sscan(c.Param("authorId"), &authorId)
 	if err != nil {
-		ReportError(c, err, "error", 500)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if !check {
-		check, err = queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-			Module: AuthorModule,
-			Action: ModifySelfAction,
-			ID:     userId,
+	oldAuthor, err := BookAuthorById(authorId)
+	if oldAuthor == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Author not exist",
 		})
-		if err != nil {
-			ReportError(c, err, "error", 500)
-			return
-		}
-		if check {
-			permAllow = true
-		}
-	} else {
-		permAllow = true
-	}
-	if permAllow {
-		var authorId int32
-		_, err = fmt.Sscan(c.Param("authorId"), &authorId)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		oldAuthor, err := BookAuthorById(authorId)
-		if oldAuthor == nil {
-			c.JSON(http.StatusNotFound, gin.H{
-				"error": "Author not exist",
-			})
-			return
-		}
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		var a UpdateAuthor
-		if err := c.ShouldBindJSON(&a); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var a UpdateAuthor
+	if err := c.ShouldBindJSON(&a); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if len(a.Name) > 30 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "name must be less than or equal to 30 characters",
+		})
+		return
+	}
+
+	if a.Alias != nil {
+		_, ok := a.Alias.(string)
+		if !ok {
+			ReportError(c, errors.New("invalid aliases"), "error", http.StatusBadRequest)
 			return
 		}
-
-		if len(a.Name) > 30 {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": "name must be less than or equal to 30 characters",
-			})
+		if HasControlCharacters(a.Alias.(string)) {
+			ReportError(c, errors.New("invalid aliases"), "error", http.StatusBadRequest)
 			return
 		}
-
-		if a.Alias != nil {
-			_, ok := a.Alias.(string)
-			if !ok {
-				ReportError(c, errors.New("invalid aliases"), "error", http.StatusBadRequest)
-				return
-			}
-			if HasControlCharacters(a.Alias.(string)) {
-				ReportError(c, errors.New("invalid aliases"), "error", http.StatusBadRequest)
-				return
-			}
-			if CheckEmptyString(a.Alias.(string)) {
-				a.Alias = nil
-			}
+		if CheckEmptyString(a.Alias.(string)) {
+			a.Alias = nil
 		}
+	}
 
-		if len(a.Description) > 1000 {
-			a.Description = a.Description[0:1000]
-			//c.JSON(http.StatusBadRequest, gin.H{
-			//	"error": "description must be less than or equal to 100 characters",
-			//})
-			//return
-		}
+	if len(a.Description) > 1000 {
+		a.Description = a.Description[0:1000]
+		//c.JSON(http.StatusBadRequest, gin.H{
+		//	"error": "description must be less than or equal to 100 characters",
+		//})
+		//return
+	}
 
-		exist, err := queries.CheckAuthorExistByName(ctx, a.Name)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		if exist == true {
-			c.JSON(http.StatusConflict, gin.H{"error": "name was exist"})
-			return
-		}
+	exist, err := queries.CheckAuthorExistByName(ctx, a.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if exist == true {
+		c.JSON(http.StatusConflict, gin.H{"error": "name was exist"})
+		return
+	}
 
-		if len(a.Name) == 0 {
-			a.Name = oldAuthor.Name
-		}
-		if len(a.Description) == 0 {
-			a.Description = oldAuthor.Description.String
-		}
-		if a.AvatarId == 0 {
-			a.AvatarId = oldAuthor.AvatarImageID.Int32
-		}
-		if a.Alias == nil {
-			a.Alias = oldAuthor.Aliases
-		}
-		err = UpdateBookAuthor(authorId, a.Name, a.Description, a.AvatarId, a.Alias)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Update Author successfully",
+	if len(a.Name) == 0 {
+		a.Name = oldAuthor.Name
+	}
+	if len(a.Description) == 0 {
+		a.Description = oldAuthor.Description.String
+	}
+	if a.AvatarId == 0 {
+		a.AvatarId = oldAuthor.AvatarImageID.Int32
+	}
+	if a.Alias == nil {
+		a.Alias = oldAuthor.Aliases
+	}
+	err = UpdateBookAuthor(authorId, a.Name, a.Description, a.AvatarId, a.Alias)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
 		})
-	} else {
-		ReportError(c, errors.New("permission denied"), "error", 403)
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Update Author successfully",
+	})
 }
 
 func DeleteAuthorHandler(c *gin.Context) {
-	ctx := context.Background()
-	queries := db.New(db.Pool())
-
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-	permAllow := false
-
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: AuthorModule,
-		Action: DeleteAction,
-		ID:     userId,
-	})
+	var authorId int32
+	_, err := fmt.Sscan(c.Param("authorId"), &authorId)
 	if err != nil {
-		ReportError(c, err, "error", 500)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if !check {
-		check, err = queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-			Module: AuthorModule,
-			Action: DeleteSelfAction,
-			ID:     userId,
+	oldAuthor, err := BookAuthorById(authorId)
+	if oldAuthor == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Author not exist",
 		})
-		if err != nil {
-			ReportError(c, err, "error", 500)
-			return
-		}
-		if check {
-			permAllow = true
-		}
-	} else {
-		permAllow = true
+		return
 	}
-
-	if permAllow {
-		var authorId int32
-		_, err = fmt.Sscan(c.Param("authorId"), &authorId)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		oldAuthor, err := BookAuthorById(authorId)
-		if oldAuthor == nil {
-			c.JSON(http.StatusNotFound, gin.H{
-				"error": "Author not exist",
-			})
-			return
-		}
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-		err = DeleteBookAuthor(authorId)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
-			return
-		}
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Delete Author successfully",
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	err = DeleteBookAuthor(authorId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
 		})
-	} else {
-		ReportError(c, errors.New("permission denied"), "error", 403)
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Delete Author successfully",
+	})
 }
 
 func SearchAuthorHandler(c *gin.Context) {
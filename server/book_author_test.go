@@ -43,7 +43,7 @@ func TestCreateBookAuthor(t *testing.T) {
 	name := "nameTest"
 	description := "descTest"
 	imageID := sql.NullInt32{}.Int32
-	bookAuthorTest, err := CreateBookAuthor(name, description, imageID)
+	bookAuthorTest, err := CreateBookAuthor(name, description, imageID, nil, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -102,7 +102,7 @@ func TestUpdateBookAuthor(t *testing.T) {
 	name := "nameTest"
 	description := "descTest"
 	avatarImageID := int32(0)
-	err := UpdateBookAuthor(id, name, description, avatarImageID)
+	err := UpdateBookAuthor(id, name, description, avatarImageID, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -5,7 +5,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/config"
 	"github.com/dqhieuu/novo-app/db"
 	"github.com/gin-gonic/gin"
 	"net/http"
@@ -45,6 +45,8 @@ type UpdateChapterParams struct {
 	Name          interface{}  `json:"name"`
 	TextContent   string  `json:"textContent"`
 	Images        []int32 `json:"images"`
+	// ImageKeys are the images embedded in TextContent, kept from the image gc
+	ImageKeys     []string `json:"-"`
 }
 
 func checkChapterName(name string) bool {
@@ -95,7 +97,6 @@ func BookChaptersByBookGroupId(bookGroupID, page int32) ([]*db.BookChapter, erro
 func UpdateBookChapter(chapter UpdateChapterParams) error {
 
 	ctx := context.Background()
-	queries := db.New(db.Pool())
 
 	nameSql := sql.NullString{}
 
@@ -118,44 +119,56 @@ func UpdateBookChapter(chapter UpdateChapterParams) error {
 		return errors.New(stringErr)
 	}
 
-	err = queries.UpdateBookChapter(ctx, db.UpdateBookChapterParams{
-		ID:            chapter.Id,
-		ChapterNumber: chapter.ChapterNumber,
-		Name:          nameSql,
-		TextContent:   textContextSql,
-	})
-	if err != nil {
-		stringErr := fmt.Sprintf("Update book chapter  failed: %s", err)
-		return errors.New(stringErr)
-	}
-
-	if chapter.Images != nil {
-		err = queries.DeleteImageOfBookChapter(ctx, chapter.Id)
+	err = RunInTx(ctx, func(queries *db.Queries) error {
+		err := queries.UpdateBookChapter(ctx, db.UpdateBookChapterParams{
+			ID:            chapter.Id,
+			ChapterNumber: chapter.ChapterNumber,
+			Name:          nameSql,
+			TextContent:   textContextSql,
+		})
 		if err != nil {
-			stringErr := fmt.Sprintf("Update book chapter  failed: %s", err)
-			return errors.New(stringErr)
-		}
-		for i := 0; i < len(chapter.Images); i++ {
-			err = queries.InsertBookChapterImage(ctx, db.InsertBookChapterImageParams{
-				BookChapterID: chapter.Id,
-				ImageID:       chapter.Images[i],
-				Rank:          int32(i + 1),
-			})
+			return err
+		}
+
+		if chapter.Images != nil {
+			err = queries.DeleteImageOfBookChapter(ctx, chapter.Id)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < len(chapter.Images); i++ {
+				err = queries.InsertBookChapterImage(ctx, db.InsertBookChapterImageParams{
+					BookChapterID: chapter.Id,
+					ImageID:       chapter.Images[i],
+					Rank:          int32(i + 1),
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(chapter.ImageKeys) > 0 {
+			_, err = queries.SubmitTempImagesByPath(ctx, chapter.ImageKeys)
 			if err != nil {
-				stringErr := fmt.Sprintf("Update book chapter  failed: %s", err)
-				return errors.New(stringErr)
+				return err
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		stringErr := fmt.Sprintf("Update book chapter  failed: %s", err)
+		return errors.New(stringErr)
 	}
 
 	return nil
 }
 
+// CreateBookChapter inserts the chapter, and keeps the images embedded in its text, imageKeys,
+// from the image gc.
 func CreateBookChapter(chapterNumber float64, description, textContext, chapterType string,
-	bookGroupID, ownerID int32) (*db.BookChapter, error) {
+	bookGroupID, ownerID int32, imageKeys []string) (*db.BookChapter, error) {
 
 	ctx := context.Background()
-	queries := db.New(db.Pool())
 
 	descriptionSql := sql.NullString{}
 	if description == "" {
@@ -172,13 +185,24 @@ func CreateBookChapter(chapterNumber float64, description, textContext, chapterT
 		return nil, errors.New(stringErr)
 	}
 
-	bookChapter, err := queries.InsertBookChapter(ctx, db.InsertBookChapterParams{
-		ChapterNumber: chapterNumber,
-		Name:          descriptionSql,
-		TextContent:   textContextSql,
-		Type:          chapterType,
-		BookGroupID:   bookGroupID,
-		OwnerID:       ownerID,
+	var bookChapter db.BookChapter
+	err = RunInTx(ctx, func(queries *db.Queries) error {
+		var err error
+		bookChapter, err = queries.InsertBookChapter(ctx, db.InsertBookChapterParams{
+			ChapterNumber: chapterNumber,
+			Name:          descriptionSql,
+			TextContent:   textContextSql,
+			Type:          chapterType,
+			BookGroupID:   bookGroupID,
+			OwnerID:       ownerID,
+		})
+		if err != nil {
+			return err
+		}
+		if len(imageKeys) > 0 {
+			_, err = queries.SubmitTempImagesByPath(ctx, imageKeys)
+		}
+		return err
 	})
 	if err != nil {
 		stringErr := fmt.Sprintf("Create book chapter  failed: %s", err)
@@ -198,100 +222,78 @@ func DeleteBookChapterByBookGroupId(bookGroupId int32) error {
 	return nil
 }
 
-func CreateHypertextChapterHandler(c *gin.Context) {
-	ctx := context.Background()
-	queries := db.New(db.Pool())
+func CreateHypertextChapterHandler(cfg config.Images) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId := CurrentUser(c).Id
 
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: BookChapterModule,
-		Action: PostAction,
-		ID:     userId,
-	})
-	if err != nil {
-		ReportError(c, err, "error", 500)
-		return
-	}
-	if !check {
-		ReportError(c, errors.New("permission denied"), "error", 403)
-		return
-	}
+		var newHypertextChapter HypertextChapter
+		if err := c.ShouldBindJSON(&newHypertextChapter); err != nil {
+			ReportError(c, err, "error parsing json", http.StatusBadRequest)
+			return
+		}
 
-	var newHypertextChapter HypertextChapter
-	if err := c.ShouldBindJSON(&newHypertextChapter); err != nil {
-		ReportError(c, err, "error parsing json", http.StatusBadRequest)
-		return
-	}
+		if newHypertextChapter.ChapterNumber == nil {
+			ReportError(c, errors.New("missing chapter number"), "error", http.StatusBadRequest)
+			return
+		}
 
-	if newHypertextChapter.ChapterNumber == nil {
-		ReportError(c, errors.New("missing chapter number"), "error", http.StatusBadRequest)
-		return
-	}
+		//check chapter name
+		var chapterName string
+		if newHypertextChapter.Name != nil {
+			_, ok := newHypertextChapter.Name.(string)
+			if !ok {
+				ReportError(c, errors.New("invalid chapter name"), "error", http.StatusBadRequest)
+				return
+			}
+			chapterName = newHypertextChapter.Name.(string)
+			chapterName = strings.TrimSpace(chapterName)
+			if !checkChapterName(chapterName) {
+				ReportError(c, errors.New("invalid chapter name"), "error", http.StatusBadRequest)
+				return
+			}
+			if CheckEmptyString(chapterName) {
+				chapterName = ""
+			}
+		}
 
-	//check chapter name
-	var chapterName string
-	if newHypertextChapter.Name != nil {
-		_, ok := newHypertextChapter.Name.(string)
-		if !ok {
-			ReportError(c, errors.New("invalid chapter name"), "error", http.StatusBadRequest)
+		//check content
+		if HasControlCharacters(newHypertextChapter.TextContent) || CheckEmptyString(newHypertextChapter.TextContent) {
+			ReportError(c, errors.New("invalid content"), "error", http.StatusBadRequest)
 			return
 		}
-		chapterName = newHypertextChapter.Name.(string)
-		chapterName = strings.TrimSpace(chapterName)
-		if !checkChapterName(chapterName) {
-			ReportError(c, errors.New("invalid chapter name"), "error", http.StatusBadRequest)
+		textContent, rejected, imageKeys := CheckChapterContent(newHypertextChapter.TextContent, publicImageUrl(cfg))
+		if len(rejected) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":    "invalid content",
+				"rejected": rejected,
+			})
 			return
 		}
-		if CheckEmptyString(chapterName) {
-			chapterName = ""
-		}
-	}
 
-	//check content
-	if HasControlCharacters(newHypertextChapter.TextContent) || CheckEmptyString(newHypertextChapter.TextContent) {
-		ReportError(c, errors.New("invalid content"), "error", http.StatusBadRequest)
-		return
-	}
+		newChapter, err := CreateBookChapter(
+			newHypertextChapter.ChapterNumber.(float64),
+			chapterName,
+			textContent,
+			"hypertext",
+			newHypertextChapter.BookGroupId,
+			userId,
+			imageKeys)
 
-	newChapter, err := CreateBookChapter(
-		newHypertextChapter.ChapterNumber.(float64),
-		chapterName,
-		newHypertextChapter.TextContent,
-		"hypertext",
-		newHypertextChapter.BookGroupId,
-		userId)
-
-	if err != nil {
-		ReportError(c, err, "error creating new hypertext chapter", 500)
-		return
+		if err != nil {
+			ReportError(c, err, "error creating new hypertext chapter", 500)
+			return
+		}
+		c.JSON(200, gin.H{
+			"id": newChapter.ID,
+		})
 	}
-	c.JSON(200, gin.H{
-		"id": newChapter.ID,
-	})
 }
 
 func CreateImagesChapterHandler(c *gin.Context) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: BookChapterModule,
-		Action: PostAction,
-		ID:     userId,
-	})
-	if err != nil {
-		ReportError(c, err, "error", 500)
-		return
-	}
-	if !check {
-		ReportError(c, errors.New("permission denied"), "error", 403)
-		return
-	}
+	userId := CurrentUser(c).Id
 
 	var newImageChapter ImageChapter
 	if err := c.ShouldBindJSON(&newImageChapter); err != nil {
@@ -323,11 +325,23 @@ func CreateImagesChapterHandler(c *gin.Context) {
 		}
 	}
 
-	newChapter, err := CreateBookChapter(
+	//keep the images that exist
+	var images []int32
+	for _, imageId := range newImageChapter.Images {
+		check, err := queries.CheckImageExistById(ctx, imageId)
+		if err != nil {
+			ReportError(c, err, "internal error", 500)
+			return
+		}
+		if check {
+			images = append(images, imageId)
+		}
+	}
+
+	newChapter, err := CreateImagesChapter(
 		newImageChapter.ChapterNumber.(float64),
 		chapterName,
-		"",
-		"images",
+		images,
 		newImageChapter.BookGroupId,
 		userId)
 
@@ -336,26 +350,6 @@ func CreateImagesChapterHandler(c *gin.Context) {
 		return
 	}
 
-	//adding images
-	for index, imageId := range newImageChapter.Images {
-		check, err := queries.CheckImageExistById(ctx, imageId)
-		if err != nil {
-			ReportError(c, err, "internal error", 500)
-			return
-		}
-		if check {
-			err = queries.InsertBookChapterImage(ctx, db.InsertBookChapterImageParams{
-				BookChapterID: newChapter.ID,
-				ImageID:       imageId,
-				Rank:          int32(index + 1),
-			})
-			if err != nil {
-				ReportError(c, err, "error adding image chapter", 500)
-				return
-			}
-		}
-	}
-
 	c.JSON(200, gin.H{
 		"id": newChapter.ID,
 	})
@@ -411,152 +405,130 @@ func DeleteBookChapterHandler(c *gin.Context) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-	permAllow := false
-
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: BookChapterModule,
-		Action: DeleteAction,
-		ID:     userId,
-	})
+	var chapterId int32
+	_, err := fmt.Sscan(c.Param("chapterId"), &chapterId)
 	if err != nil {
-		ReportError(c, err, "error", 500)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if !check {
-		check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-			Module: BookChapterModule,
-			Action: DeleteSelfAction,
-			ID:     userId,
+	oldChapter, err := BookChapterById(chapterId)
+	if oldChapter == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Chapter not exist",
 		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err = queries.DeleteBookChapterById(ctx, chapterId)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Delete Chapter successfully",
+	})
+}
+
+func UpdateHypertextChapter(cfg config.Images) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var newChapter UpdateChapterParams
+		_, err := fmt.Sscan(c.Param("chapterId"), &newChapter.Id)
 		if err != nil {
-			ReportError(c, err, "error", 500)
+			c.JSON(http.StatusBadRequest, gin.H{"error chapterId": err.Error()})
 			return
 		}
-		if check {
-			permAllow = true
-		}
-	} else {
-		permAllow = true
-	}
-	if permAllow {
-		var chapterId int32
-		_, err = fmt.Sscan(c.Param("chapterId"), &chapterId)
+		oldChapter, err := BookChapterById(newChapter.Id)
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		oldChapter, err := BookChapterById(chapterId)
 		if oldChapter == nil {
 			c.JSON(http.StatusNotFound, gin.H{
 				"error": "Chapter not exist",
 			})
 			return
 		}
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-			return
-		}
-
-		err = queries.DeleteBookChapterById(ctx, chapterId)
-		if err != nil {
+		if oldChapter.Type != "hypertext" {
 			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
+				"error": "Type of chapter is not hypertext",
 			})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Delete Chapter successfully",
-		})
-	} else {
-		ReportError(c, errors.New("permission denied"), "error", 403)
-		return
-	}
-}
 
-func UpdateHypertextChapter(c *gin.Context) {
-	var newChapter UpdateChapterParams
-	_, err := fmt.Sscan(c.Param("chapterId"), &newChapter.Id)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error chapterId": err.Error()})
-		return
-	}
-	oldChapter, err := BookChapterById(newChapter.Id)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-	if oldChapter == nil {
-		c.JSON(http.StatusNotFound, gin.H{
-			"error": "Chapter not exist",
-		})
-		return
-	}
-	if oldChapter.Type != "hypertext" {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "Type of chapter is not hypertext",
-		})
-		return
-	}
-
-	if err = c.ShouldBindJSON(&newChapter); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error json": err.Error()})
-		return
-	}
-	if newChapter.ChapterNumber < 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error json": "chapter number cannot be less than 0"})
-		return
-	}
-	if newChapter.ChapterNumber == 0 {
-		newChapter.ChapterNumber = oldChapter.ChapterNumber
-	}
-	if newChapter.Name != nil {
-		_, ok := newChapter.Name.(string)
-		if !ok {
-			ReportError(c, errors.New("chapter name is not a string"), "error", 400)
+		if err = c.ShouldBindJSON(&newChapter); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error json": err.Error()})
 			return
 		}
-		if newChapter.Name.(string) == "" {
-			newChapter.Name = nil
+		if newChapter.ChapterNumber < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error json": "chapter number cannot be less than 0"})
+			return
 		}
-		if len(newChapter.Name.(string)) > 200 {
-			newChapter.Name = newChapter.Name.(string)[0:200]
+		if newChapter.ChapterNumber == 0 {
+			newChapter.ChapterNumber = oldChapter.ChapterNumber
+		}
+		if newChapter.Name != nil {
+			_, ok := newChapter.Name.(string)
+			if !ok {
+				ReportError(c, errors.New("chapter name is not a string"), "error", 400)
+				return
+			}
+			if newChapter.Name.(string) == "" {
+				newChapter.Name = nil
+			}
+			if len(newChapter.Name.(string)) > 200 {
+				newChapter.Name = newChapter.Name.(string)[0:200]
+			}
+		} else {
+			newChapter.Name = oldChapter.Name
 		}
-	} else {
-		newChapter.Name = oldChapter.Name
-	}
-
-	if newChapter.TextContent == "" {
-		newChapter.TextContent = oldChapter.TextContent.String
-	}
-	newChapter.Images = nil
 
-	//err = ValidTitle(&newChapter.Name)
-	//if err != nil {
-	//	c.JSON(http.StatusBadRequest, gin.H{
-	//		"error": err.Error(),
-	//	})
-	//	return
-	//}
-	//err = ValidDescription(&newChapter.TextContent)
-	//if err != nil {
-	//	c.JSON(http.StatusBadRequest, gin.H{
-	//		"error": err.Error(),
-	//	})
-	//	return
-	//}
-	err = UpdateBookChapter(newChapter)
+		if newChapter.TextContent == "" {
+			newChapter.TextContent = oldChapter.TextContent.String
+		} else {
+			var rejected []string
+			newChapter.TextContent, rejected, newChapter.ImageKeys = CheckChapterContent(newChapter.TextContent, publicImageUrl(cfg))
+			if len(rejected) > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":    "invalid content",
+					"rejected": rejected,
+				})
+				return
+			}
+		}
+		newChapter.Images = nil
+
+		//err = ValidTitle(&newChapter.Name)
+		//if err != nil {
+		//	c.JSON(http.StatusBadRequest, gin.H{
+		//		"error": err.Error(),
+		//	})
+		//	return
+		//}
+		//err = ValidDescription(&newChapter.TextContent)
+		//if err != nil {
+		//	c.JSON(http.StatusBadRequest, gin.H{
+		//		"error": err.Error(),
+		//	})
+		//	return
+		//}
+		err = UpdateBookChapter(newChapter)
 
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": err.Error(),
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Update chapter successfully",
 		})
-		return
 	}
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Update chapter successfully",
-	})
 }
 
 func UpdateImagesChapterHandler(c *gin.Context) {
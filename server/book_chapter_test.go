@@ -51,7 +51,7 @@ func TestBookChapterById(t *testing.T) {
 //
 //	assert.Equal(t, bookChapter2.ChapterNumber, chapterNumber)
 //	assert.Equal(t, bookChapter2.Name.String, description)
-//	assert.Equal(t, bookChapter2.TextContext.String, textContext)
+//	assert.Equal(t, bookChapter2.TextContent.String, textContext)
 //	assert.Equal(t, bookChapter2.Type, chapterType)
 //	assert.Equal(t, bookChapter2.BookGroupID, bookGroupID)
 //	assert.Equal(t, bookChapter2.OwnerID, ownerID)
@@ -70,7 +70,7 @@ func TestCreateBookChapter(t *testing.T) {
 	bookGroupID := bookGroups[r.Intn(len(bookGroups))].ID
 	ownerID := users[r.Intn(len(users))].ID
 	bookChapter1, err := CreateBookChapter(chapterNumber, description,
-		textContext, chapterType, bookGroupID, ownerID)
+		textContext, chapterType, bookGroupID, ownerID, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -81,7 +81,7 @@ func TestCreateBookChapter(t *testing.T) {
 
 	assert.Equal(t, bookChapter2.ChapterNumber, chapterNumber)
 	assert.Equal(t, bookChapter2.Name.String, description)
-	assert.Equal(t, bookChapter2.TextContext.String, textContext)
+	assert.Equal(t, bookChapter2.TextContent.String, textContext)
 	assert.Equal(t, bookChapter2.Type, chapterType)
 	assert.Equal(t, bookChapter2.BookGroupID, bookGroupID)
 	assert.Equal(t, bookChapter2.OwnerID, ownerID)
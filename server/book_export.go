@@ -0,0 +1,436 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EpubExportFormat = "epub"
+	CbzExportFormat  = "cbz"
+)
+
+type ExportChapter struct {
+	Number      float64
+	Name        string
+	Type        string
+	TextContent string
+	// Images are the storage keys of the pages of an images chapter
+	Images []string
+}
+
+type ExportBook struct {
+	Id          int32
+	Title       string
+	Description string
+	Authors     []string
+	Genres      []string
+	// Cover is the storage key of the primary cover art
+	Cover    string
+	Chapters []ExportChapter
+}
+
+func xmlEscape(text string) string {
+	var builder strings.Builder
+	_ = xml.EscapeText(&builder, []byte(text))
+	return builder.String()
+}
+
+func chapterTitle(chapter ExportChapter) string {
+	title := "Chapter " + strconv.FormatFloat(chapter.Number, 'f', -1, 64)
+	if chapter.Name != "" {
+		title += ": " + chapter.Name
+	}
+	return title
+}
+
+func copyStorageFile(ctx context.Context, storage Storage, key string, w io.Writer) error {
+	file, err := storage.Open(ctx, key)
+	if err != nil {
+		return errors.New("error opening " + key + ": " + err.Error())
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// LoadExportBook gathers what goes into an export of the book group.
+func LoadExportBook(bookGroupId int32) (*ExportBook, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	bookGroup, err := queries.BookGroupById(ctx, bookGroupId)
+	if err != nil {
+		return nil, errors.New("error getting book group: " + err.Error())
+	}
+	book := ExportBook{Id: bookGroup.ID, Title: bookGroup.Title, Description: bookGroup.Description.String}
+
+	authors, err := queries.GetBookGroupAuthors(ctx, bookGroupId)
+	if err != nil {
+		return nil, errors.New("error getting authors: " + err.Error())
+	}
+	for _, author := range authors {
+		book.Authors = append(book.Authors, author.Name)
+	}
+
+	genres, err := queries.GetBookGroupGenres(ctx, bookGroupId)
+	if err != nil {
+		return nil, errors.New("error getting book group genres: " + err.Error())
+	}
+	for _, genre := range genres {
+		book.Genres = append(book.Genres, genre.Name)
+	}
+
+	if bookGroup.PrimaryCoverArtID.Valid {
+		cover, err := queries.GetImageBasedOnId(ctx, bookGroup.PrimaryCoverArtID.Int32)
+		if err != nil {
+			return nil, errors.New("error getting primary art: " + err.Error())
+		}
+		book.Cover = cover.Path
+	}
+
+	chapters, err := queries.GetBookGroupChapters(ctx, bookGroupId)
+	if err != nil {
+		return nil, errors.New("error getting book group chapters: " + err.Error())
+	}
+	for _, chapter := range chapters {
+		bookChapter, err := queries.BookChapterById(ctx, chapter.Chapterid)
+		if err != nil {
+			return nil, errors.New("error getting chapter: " + err.Error())
+		}
+		exportChapter := ExportChapter{
+			Number:      chapter.ChapterNumber,
+			Name:        chapter.Name.String,
+			Type:        bookChapter.Type,
+			TextContent: bookChapter.TextContent.String,
+		}
+		if bookChapter.Type == "images" {
+			images, err := queries.ImagesByBookChapter(ctx, chapter.Chapterid)
+			if err != nil {
+				return nil, errors.New("error getting chapter images: " + err.Error())
+			}
+			for _, image := range images {
+				exportChapter.Images = append(exportChapter.Images, image.Path)
+			}
+		}
+		book.Chapters = append(book.Chapters, exportChapter)
+	}
+
+	return &book, nil
+}
+
+// WriteCbz writes the images chapters of the book as a comic book archive, one folder
+// per chapter. Hypertext chapters have no place in a cbz and are left out.
+func WriteCbz(w io.Writer, book *ExportBook, storage Storage) error {
+	ctx := context.Background()
+	archive := zip.NewWriter(w)
+
+	comicInfo := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<ComicInfo>
+  <Title>%s</Title>
+  <Summary>%s</Summary>
+  <Writer>%s</Writer>
+  <Genre>%s</Genre>
+</ComicInfo>
+`, xmlEscape(book.Title), xmlEscape(book.Description),
+		xmlEscape(strings.Join(book.Authors, ", ")), xmlEscape(strings.Join(book.Genres, ", ")))
+	file, err := archive.Create("ComicInfo.xml")
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(file, comicInfo); err != nil {
+		return err
+	}
+
+	if book.Cover != "" {
+		file, err = archive.Create("0000 cover" + path.Ext(book.Cover))
+		if err != nil {
+			return err
+		}
+		if err = copyStorageFile(ctx, storage, book.Cover, file); err != nil {
+			return err
+		}
+	}
+
+	for chapterIndex, chapter := range book.Chapters {
+		if chapter.Type != "images" {
+			continue
+		}
+		folder := fmt.Sprintf("%04d %s", chapterIndex+1, strings.ReplaceAll(chapterTitle(chapter), "/", "-"))
+		for pageIndex, image := range chapter.Images {
+			file, err = archive.Create(fmt.Sprintf("%s/%04d%s", folder, pageIndex+1, path.Ext(image)))
+			if err != nil {
+				return err
+			}
+			if err = copyStorageFile(ctx, storage, image, file); err != nil {
+				return err
+			}
+		}
+	}
+
+	return archive.Close()
+}
+
+type epubWriter struct {
+	ctx      context.Context
+	archive  *zip.Writer
+	storage  Storage
+	manifest []string
+	// images maps the storage keys already in the epub to their file name
+	images map[string]string
+}
+
+func (e *epubWriter) addFile(name, mediaType, properties, content string) error {
+	file, err := e.archive.Create("OEBPS/" + name)
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(file, content); err != nil {
+		return err
+	}
+	e.addManifest(name, mediaType, properties)
+	return nil
+}
+
+func (e *epubWriter) addManifest(name, mediaType, properties string) {
+	item := fmt.Sprintf(`<item id="item%d" href="%s" media-type="%s"`, len(e.manifest), xmlEscape(name), mediaType)
+	if properties != "" {
+		item += fmt.Sprintf(` properties="%s"`, properties)
+	}
+	e.manifest = append(e.manifest, item+"/>")
+}
+
+// addImage copies an image from the storage once, returning its file name in the epub.
+func (e *epubWriter) addImage(key, properties string) (string, error) {
+	if name, ok := e.images[key]; ok {
+		return name, nil
+	}
+	mediaType := imageTypeByExtension(key)
+	if mediaType == "" {
+		return "", errors.New("unsupported image " + key)
+	}
+	name := fmt.Sprintf("images/%d%s", len(e.images)+1, imageExtension(mediaType))
+	file, err := e.archive.Create("OEBPS/" + name)
+	if err != nil {
+		return "", err
+	}
+	if err = copyStorageFile(e.ctx, e.storage, key, file); err != nil {
+		return "", err
+	}
+	e.addManifest(name, mediaType, properties)
+	e.images[key] = name
+	return name, nil
+}
+
+func epubPage(title, body string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title></head>
+<body>
+%s
+</body>
+</html>
+`, xmlEscape(title), body)
+}
+
+// WriteEpub writes the book as an EPUB 3. Images chapters become one page of images, the
+// images hypertext chapters link to are embedded.
+func WriteEpub(w io.Writer, book *ExportBook, storage Storage) error {
+	archive := zip.NewWriter(w)
+	e := epubWriter{ctx: context.Background(), archive: archive, storage: storage, images: map[string]string{}}
+
+	// the mimetype comes first and uncompressed so readers can sniff it
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(file, "application/epub+zip"); err != nil {
+		return err
+	}
+	file, err = archive.Create("META-INF/container.xml")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(file, `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`)
+	if err != nil {
+		return err
+	}
+
+	var spine, navigation []string
+	if book.Cover != "" {
+		cover, err := e.addImage(book.Cover, "cover-image")
+		if err != nil {
+			return err
+		}
+		err = e.addFile("cover.xhtml", "application/xhtml+xml", "",
+			epubPage(book.Title, fmt.Sprintf(`<img src="%s" alt="%s"/>`, xmlEscape(cover), xmlEscape(book.Title))))
+		if err != nil {
+			return err
+		}
+		spine = append(spine, fmt.Sprintf(`<itemref idref="item%d"/>`, len(e.manifest)-1))
+	}
+
+	for index, chapter := range book.Chapters {
+		var body strings.Builder
+		title := chapterTitle(chapter)
+		body.WriteString("<h1>" + xmlEscape(title) + "</h1>\n")
+
+		if chapter.Type == "images" {
+			for _, image := range chapter.Images {
+				name, err := e.addImage(image, "")
+				if err != nil {
+					return err
+				}
+				body.WriteString(fmt.Sprintf(`<div><img src="../%s" alt=""/></div>`+"\n", xmlEscape(name)))
+			}
+		} else {
+			// the sanitizer also turns the html into something an xml parser accepts
+			var imageErr error
+			sanitizer := HtmlSanitizer{ImageSrc: func(src string) (string, bool) {
+				if !strings.HasPrefix(src, "/image/") {
+					return "", false
+				}
+				name, err := e.addImage(strings.TrimPrefix(src, "/image/"), "")
+				if err != nil {
+					imageErr = err
+					return "", false
+				}
+				return "../" + name, true
+			}}
+			content, err := sanitizer.Sanitize(chapter.TextContent)
+			if err != nil {
+				return err
+			}
+			if imageErr != nil {
+				return imageErr
+			}
+			body.WriteString(content)
+		}
+
+		name := fmt.Sprintf("text/chapter%d.xhtml", index+1)
+		err = e.addFile(name, "application/xhtml+xml", "", epubPage(title, body.String()))
+		if err != nil {
+			return err
+		}
+		spine = append(spine, fmt.Sprintf(`<itemref idref="item%d"/>`, len(e.manifest)-1))
+		navigation = append(navigation, fmt.Sprintf(`<li><a href="%s">%s</a></li>`, xmlEscape(name), xmlEscape(title)))
+	}
+
+	err = e.addFile("nav.xhtml", "application/xhtml+xml", "nav", epubPage(book.Title, fmt.Sprintf(
+		"<nav epub:type=\"toc\" id=\"toc\">\n<ol>\n%s\n</ol>\n</nav>", strings.Join(navigation, "\n"))))
+	if err != nil {
+		return err
+	}
+
+	var metadata []string
+	metadata = append(metadata,
+		fmt.Sprintf(`<dc:identifier id="book-id">urn:novo:book:%d</dc:identifier>`, book.Id),
+		fmt.Sprintf(`<dc:title>%s</dc:title>`, xmlEscape(book.Title)),
+		`<dc:language>und</dc:language>`,
+		fmt.Sprintf(`<meta property="dcterms:modified">%s</meta>`, time.Now().UTC().Format("2006-01-02T15:04:05Z")))
+	if book.Description != "" {
+		metadata = append(metadata, fmt.Sprintf(`<dc:description>%s</dc:description>`, xmlEscape(book.Description)))
+	}
+	for _, author := range book.Authors {
+		metadata = append(metadata, fmt.Sprintf(`<dc:creator>%s</dc:creator>`, xmlEscape(author)))
+	}
+	for _, genre := range book.Genres {
+		metadata = append(metadata, fmt.Sprintf(`<dc:subject>%s</dc:subject>`, xmlEscape(genre)))
+	}
+	if book.Cover != "" {
+		// for EPUB 2 readers
+		metadata = append(metadata, `<meta name="cover" content="item0"/>`)
+	}
+
+	file, err = archive.Create("OEBPS/content.opf")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    %s
+  </metadata>
+  <manifest>
+    %s
+  </manifest>
+  <spine>
+    %s
+  </spine>
+</package>
+`, strings.Join(metadata, "\n    "), strings.Join(e.manifest, "\n    "), strings.Join(spine, "\n    "))
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+func ExportBookGroupHandler(c *gin.Context) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	bookGroupId64, err := strconv.ParseInt(c.Param("bookGroupId"), 10, 32)
+	if err != nil {
+		ReportError(c, err, "error parsing book group id", http.StatusBadRequest)
+		return
+	}
+	bookGroupId := int32(bookGroupId64)
+
+	format := c.DefaultQuery("format", EpubExportFormat)
+	var contentType string
+	var write func(io.Writer, *ExportBook, Storage) error
+	switch format {
+	case EpubExportFormat:
+		contentType, write = "application/epub+zip", WriteEpub
+	case CbzExportFormat:
+		contentType, write = "application/vnd.comicbook+zip", WriteCbz
+	default:
+		ReportError(c, errors.New("unsupported export format"), "error", http.StatusBadRequest)
+		return
+	}
+
+	check, err := queries.CheckBookGroupById(ctx, bookGroupId)
+	if err != nil {
+		ReportError(c, err, "error getting book group", 500)
+		return
+	}
+	if !check {
+		ReportError(c, errors.New("book group does not exist"), "error", http.StatusNotFound)
+		return
+	}
+
+	book, err := LoadExportBook(bookGroupId)
+	if err != nil {
+		ReportError(c, err, "error loading book group", 500)
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="book-%d.%s"`, bookGroupId, format))
+	c.Status(http.StatusOK)
+	// the archive is streamed, once it started an error can only cut it short
+	err = write(c.Writer, book, ImageStorage())
+	if err != nil {
+		log.Printf("error exporting book group %d: %s\n", bookGroupId, err)
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func testExportBook() *ExportBook {
+	return &ExportBook{
+		Id:          1,
+		Title:       "Export & Test",
+		Description: "A book",
+		Authors:     []string{"First Author"},
+		Genres:      []string{"Drama"},
+		Cover:       "test/variant.png",
+		Chapters: []ExportChapter{
+			{Number: 1, Name: "Start", Type: "hypertext",
+				TextContent: `<p>Hello<br>world</p><img src="/image/test/variant.png"><script>x()</script>`},
+			{Number: 2, Type: "images", Images: []string{"test/variant.png", "test/variant.png"}},
+		},
+	}
+}
+
+func TestWriteEpub(t *testing.T) {
+	defer setupVariantStorages(t)()
+
+	var buffer bytes.Buffer
+	err := WriteEpub(&buffer, testExportBook(), ImageStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "mimetype", archive.File[0].Name)
+	assert.Equal(t, zip.Store, archive.File[0].Method)
+
+	// the export can be imported back
+	var saved []string
+	book, err := ParseEpub(archive, func(file *zip.File) (int32, string, error) {
+		saved = append(saved, file.Name)
+		return int32(len(saved)), "chapter-image/" + file.Name, nil
+	}, config.Default().Images.MaxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Export & Test", book.Title)
+	assert.Equal(t, "A book", book.Description)
+	assert.Equal(t, []string{"First Author"}, book.Authors)
+	assert.Equal(t, "OEBPS/images/1.png", book.Cover.Name)
+	// cover page and the two chapters
+	assert.Len(t, book.Chapters, 3)
+	assert.Equal(t, "Chapter 1: Start", book.Chapters[1].Name)
+	assert.Contains(t, book.Chapters[1].TextContent, "<p>Hello<br/>world</p>")
+	assert.NotContains(t, book.Chapters[1].TextContent, "script")
+	// the same image is only stored once
+	assert.Equal(t, []string{"OEBPS/images/1.png"}, saved)
+}
+
+func TestWriteCbz(t *testing.T) {
+	defer setupVariantStorages(t)()
+
+	var buffer bytes.Buffer
+	err := WriteCbz(&buffer, testExportBook(), ImageStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, page := range archivePages(archive) {
+		names = append(names, page.Name)
+	}
+	assert.Equal(t, []string{"0000 cover.png", "0002 Chapter 2/0001.png", "0002 Chapter 2/0002.png"}, names)
+	assert.Equal(t, "ComicInfo.xml", archive.File[0].Name)
+
+	book := testExportBook()
+	book.Cover = "test/missing.png"
+	assert.NotNil(t, WriteCbz(&bytes.Buffer{}, book, ImageStorage()))
+}
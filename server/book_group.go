@@ -5,7 +5,6 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/dqhieuu/novo-app/db"
 	"github.com/gin-gonic/gin"
 	"net/http"
@@ -67,7 +66,6 @@ func BookGroupsByTitle(title string, page int32) ([]*db.BookGroupsByTitleRow, er
 
 func UpdateBookGroup(id int32, input *InputBookGroup) error {
 	ctx := context.Background()
-	queries := db.New(db.Pool())
 	updateBookGroup := db.UpdateBookGroupParams{
 		ID:    id,
 		Title: input.Title,
@@ -92,62 +90,71 @@ func UpdateBookGroup(id int32, input *InputBookGroup) error {
 			Valid:  true,
 		}
 	}
-	err := queries.UpdateBookGroup(ctx, updateBookGroup)
-	if err != nil {
-		stringErr := fmt.Sprintf("Update book group failed: %s", err)
-		return errors.New(stringErr)
-	}
 
-	if input.GenreIds != nil {
-		err = DeleteGenresByBookGroup(id)
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		err := queries.UpdateBookGroup(ctx, updateBookGroup)
 		if err != nil {
-			stringErr := fmt.Sprintf("Update book group failed: %s", err)
-			return errors.New(stringErr)
+			return err
 		}
-		for i := 0; i < len(input.GenreIds); i++ {
-			_, err = CreateBookGroupGenre(id, input.GenreIds[i])
+
+		if input.GenreIds != nil {
+			err = queries.DelBookGroupGenresByBookGroup(ctx, id)
 			if err != nil {
-				stringErr := fmt.Sprintf("Update book group failed: %s", err)
-				return errors.New(stringErr)
+				return err
+			}
+			for i := 0; i < len(input.GenreIds); i++ {
+				_, err = queries.InsertBookGroupGenre(ctx, db.InsertBookGroupGenreParams{
+					BookGroupID: id,
+					GenreID:     input.GenreIds[i],
+				})
+				if err != nil {
+					return err
+				}
 			}
 		}
-	}
 
-	if input.AuthorIds != nil {
-		err = DeleteAuthorsByBookGroup(id)
-		if err != nil {
-			stringErr := fmt.Sprintf("Update book group failed: %s", err)
-			return errors.New(stringErr)
-		}
-		for i := 0; i < len(input.AuthorIds); i++ {
-			_, err = CreateBookGroupAuthor(id, input.AuthorIds[i])
+		if input.AuthorIds != nil {
+			err = queries.DelBookGroupAuthorsByBookGroup(ctx, id)
 			if err != nil {
-				stringErr := fmt.Sprintf("Update book group failed: %s", err)
-				return errors.New(stringErr)
+				return err
+			}
+			for i := 0; i < len(input.AuthorIds); i++ {
+				_, err = queries.InsertBookGroupAuthor(ctx, db.InsertBookGroupAuthorParams{
+					BookGroupID:  id,
+					BookAuthorID: input.AuthorIds[i],
+				})
+				if err != nil {
+					return err
+				}
 			}
 		}
-	}
 
-	if input.CoverArtIds != nil {
-		err = DeleteCoverOfBookGroup(id)
-		if err != nil {
-			stringErr := fmt.Sprintf("Update book group failed: %s", err)
-			return errors.New(stringErr)
-		}
-		for i := 0; i < len(input.CoverArtIds); i++ {
-			_, err = CreateBookGroupArt(id, input.CoverArtIds[i])
+		if input.CoverArtIds != nil {
+			err = queries.DeleteCoverOfBookGroup(ctx, id)
 			if err != nil {
-				stringErr := fmt.Sprintf("Update book group failed: %s", err)
-				return errors.New(stringErr)
+				return err
+			}
+			for i := 0; i < len(input.CoverArtIds); i++ {
+				_, err = queries.InsertBookGroupArt(ctx, db.InsertBookGroupArtParams{
+					BookGroupID: id,
+					ImageID:     input.CoverArtIds[i],
+				})
+				if err != nil {
+					return err
+				}
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		stringErr := fmt.Sprintf("Update book group failed: %s", err)
+		return errors.New(stringErr)
 	}
 	return nil
 }
 
 func CreateBookGroup(input *InputBookGroup) (*db.InsertBookGroupRow, error) {
 	ctx := context.Background()
-	queries := db.New(db.Pool())
 	newBookGroup := db.InsertBookGroupParams{
 		Title: input.Title,
 		Description: sql.NullString{
@@ -167,30 +174,48 @@ func CreateBookGroup(input *InputBookGroup) (*db.InsertBookGroupRow, error) {
 		}
 	}
 
-	bookGroup, err := queries.InsertBookGroup(ctx, newBookGroup)
-	if err != nil {
-		stringErr := fmt.Sprintf("Create book group failed: %s", err)
-		return nil, errors.New(stringErr)
-	}
-	for i := 0; i < len(input.GenreIds); i++ {
-		_, err = CreateBookGroupGenre(bookGroup.ID, input.GenreIds[i])
+	var bookGroup db.InsertBookGroupRow
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		var err error
+		bookGroup, err = queries.InsertBookGroup(ctx, newBookGroup)
 		if err != nil {
-			return nil, err
+			return err
 		}
-	}
 
-	for i := 0; i < len(input.AuthorIds); i++ {
-		_, err = CreateBookGroupAuthor(bookGroup.ID, input.AuthorIds[i])
-		if err != nil {
-			return nil, err
+		for i := 0; i < len(input.GenreIds); i++ {
+			_, err = queries.InsertBookGroupGenre(ctx, db.InsertBookGroupGenreParams{
+				BookGroupID: bookGroup.ID,
+				GenreID:     input.GenreIds[i],
+			})
+			if err != nil {
+				return err
+			}
 		}
-	}
 
-	for i := 0; i < len(input.CoverArtIds); i++ {
-		_, err = CreateBookGroupArt(bookGroup.ID, input.CoverArtIds[i])
-		if err != nil {
-			return nil, err
+		for i := 0; i < len(input.AuthorIds); i++ {
+			_, err = queries.InsertBookGroupAuthor(ctx, db.InsertBookGroupAuthorParams{
+				BookGroupID:  bookGroup.ID,
+				BookAuthorID: input.AuthorIds[i],
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for i := 0; i < len(input.CoverArtIds); i++ {
+			_, err = queries.InsertBookGroupArt(ctx, db.InsertBookGroupArtParams{
+				BookGroupID: bookGroup.ID,
+				ImageID:     input.CoverArtIds[i],
+			})
+			if err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		stringErr := fmt.Sprintf("Create book group failed: %s", err)
+		return nil, errors.New(stringErr)
 	}
 
 	return &bookGroup, nil
@@ -433,29 +458,8 @@ type InputBookGroup struct {
 }
 
 func CreateBookGroupHandler(c *gin.Context) {
-	ctx := context.Background()
-	queries := db.New(db.Pool())
-
-	claims := jwt.ExtractClaims(c)
 	var bookGroup InputBookGroup
-	userId := int32(claims[UserIdClaimKey].(float64))
-
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: BookGroupModule,
-		Action: PostAction,
-		ID:     userId,
-	})
-
-	if err != nil {
-		ReportError(c, err, "error", 500)
-		return
-	}
-	if !check {
-		ReportError(c, errors.New("permission denied"), "error", 403)
-		return
-	}
-
-	bookGroup.OwnerId = userId
+	bookGroup.OwnerId = CurrentUser(c).Id
 
 	if err := c.ShouldBindJSON(&bookGroup); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -625,6 +629,29 @@ func ValidPrimaryCoverArtId(PrimaryCoverArtId *int32, coverArtIds *[]int32) {
 	}
 }
 
+// ReindexSearch recomputes the full text search vectors of the authors and book groups,
+// which the triggers only update when a row changes.
+func ReindexSearch() (int64, int64, error) {
+	ctx := context.Background()
+	var authors, bookGroups int64
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		var err error
+		authors, err = queries.ReindexBookAuthors(ctx)
+		if err != nil {
+			return errors.New("error reindexing book authors: " + err.Error())
+		}
+		bookGroups, err = queries.ReindexBookGroups(ctx)
+		if err != nil {
+			return errors.New("error reindexing book groups: " + err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return authors, bookGroups, nil
+}
+
 func GetSearchSuggestionHandler(c *gin.Context) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
@@ -910,70 +937,46 @@ func DeleteBookGroupHandler(c *gin.Context) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	permAccept := false
-
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: BookGroupModule,
-		Action: DeleteAction,
-		ID:     userId,
-	})
+	bookGroupIdString := c.Param("bookGroupId")
+	bookGroupId64, err := strconv.ParseInt(bookGroupIdString, 10, 32)
 	if err != nil {
-		ReportError(c, err, "error", 500)
+		ReportError(c, err, "error parsing book group id", http.StatusBadRequest)
 		return
 	}
-	if !check {
-		check, err = queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-			Module: BookGroupModule,
-			Action: DeleteSelfAction,
-			ID:     userId,
-		})
-		if err != nil {
-			ReportError(c, err, "error", 500)
-			return
-		}
-		if check {
-			permAccept = true
-		}
-	} else {
-		permAccept = true
-	}
 
-	if permAccept {
-		bookGroupIdString := c.Param("bookGroupId")
-		bookGroupId64, err := strconv.ParseInt(bookGroupIdString, 10, 32)
-		if err != nil {
-			ReportError(c, err, "error parsing book group id", http.StatusBadRequest)
-			return
-		}
+	bookId := int32(bookGroupId64)
 
-		bookId := int32(bookGroupId64)
+	check, err := queries.CheckBookGroupById(ctx, bookId)
+	if err != nil {
+		ReportError(c, err, "error getting book group", 500)
+		return
+	}
 
-		check, err := queries.CheckBookGroupById(ctx, bookId)
+	if !check {
+		ReportError(c, errors.New("book group does not exist"), "error", http.StatusBadRequest)
+		return
+	} else {
+		book, err := queries.BookGroupById(ctx, bookId)
 		if err != nil {
 			ReportError(c, err, "error getting book group", 500)
 			return
 		}
-
-		if !check {
-			ReportError(c, errors.New("book group does not exist"), "error", http.StatusBadRequest)
+		err = queries.DeleteBookGroup(ctx, bookId)
+		if err != nil {
+			ReportError(c, err, "error deleting book group", 500)
 			return
-		} else {
-			err := queries.DeleteBookGroup(ctx, bookId)
-			if err != nil {
-				ReportError(c, err, "error deleting book group", 500)
-				return
-			}
 		}
-
-		c.JSON(200, gin.H{
-			"message": "delete successful",
+		RecordAudit(c, AuditRecord{
+			Action:     DeleteBookAudit,
+			TargetType: BookAuditTarget,
+			TargetId:   bookId,
+			Before:     BookAuditSnapshot(book),
 		})
-	} else {
-		ReportError(c, errors.New("permission denied"), "error", 403)
-		return
 	}
+
+	c.JSON(200, gin.H{
+		"message": "delete successful",
+	})
 }
 
 func UpdateBookGroupHandler(c *gin.Context) {
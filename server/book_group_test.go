@@ -264,7 +264,7 @@ func TestBookGroupsByTitle(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	var tmp2 []*db.BookGroup
+	var tmp2 []*db.InsertBookGroupRow
 	for i := 0; i < len(bookGroups) && len(tmp2) <= limitBookGroup; i++ {
 		if strings.Contains(bookGroups[i].Title, subTitle) == true {
 			tmp2 = append(tmp2, bookGroups[i])
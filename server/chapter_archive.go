@@ -0,0 +1,325 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ChapterArchive is the upload session category of CBZ/ZIP files imported with /auth/chapter/archive.
+const ChapterArchive = "chapter-archive"
+const MaxArchiveSize = MaxUploadSessionSize
+const MaxArchivePages = 1000
+
+var archivePageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+type ArchivePageError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// memoryFile lets an archive page go through SaveImageFromStream like an uploaded file.
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+// naturalLess compares file names the way people number pages: "2.jpg" comes before "10.jpg".
+func naturalLess(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		aDigits, bDigits := leadingDigits(a), leadingDigits(b)
+		if aDigits != "" && bDigits != "" {
+			aNumber, bNumber := strings.TrimLeft(aDigits, "0"), strings.TrimLeft(bDigits, "0")
+			if len(aNumber) != len(bNumber) {
+				return len(aNumber) < len(bNumber)
+			}
+			if aNumber != bNumber {
+				return aNumber < bNumber
+			}
+			a, b = a[len(aDigits):], b[len(bDigits):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	end := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r)
+	})
+	if end < 0 {
+		return s
+	}
+	return s[:end]
+}
+
+// archivePages lists the image files of an archive in page order. Folders, metadata
+// (ComicInfo.xml...) and the files macOS adds to zips are left out.
+func archivePages(archive *zip.Reader) []*zip.File {
+	var pages []*zip.File
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() || strings.HasPrefix(file.Name, "__MACOSX/") {
+			continue
+		}
+		if strings.HasPrefix(path.Base(file.Name), ".") {
+			continue
+		}
+		if !archivePageExtensions[strings.ToLower(path.Ext(file.Name))] {
+			continue
+		}
+		pages = append(pages, file)
+	}
+	sort.SliceStable(pages, func(i, j int) bool {
+		return naturalLess(pages[i].Name, pages[j].Name)
+	})
+	return pages
+}
+
+// readArchivePage reads a page in memory, refusing pages bigger than maxSize.
+func readArchivePage(file *zip.File, maxSize int64) (*memoryFile, error) {
+	if file.UncompressedSize64 > uint64(maxSize) {
+		return nil, errors.New("file too large")
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return nil, errors.New("error opening page: " + err.Error())
+	}
+	defer reader.Close()
+
+	// the header can lie about the size, don't trust it with the memory
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, errors.New("error reading page: " + err.Error())
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errors.New("file too large")
+	}
+	return &memoryFile{bytes.NewReader(data)}, nil
+}
+
+// SaveArchivePages saves every page of the archive as a chapter image. The pages that
+// could not be saved are reported and left out of the returned ids.
+func SaveArchivePages(archive *zip.Reader, maxSize int64) ([]int32, []ArchivePageError) {
+	var imageIds []int32
+	pageErrors := make([]ArchivePageError, 0)
+	for _, page := range archivePages(archive) {
+		pageFile, err := readArchivePage(page, maxSize)
+		if err == nil {
+			var imageId int32
+			imageId, _, err = SaveImageFromStream(pageFile, ChapterImage, uuid.NewString(), "")
+			if err == nil {
+				imageIds = append(imageIds, imageId)
+				continue
+			}
+		}
+		pageErrors = append(pageErrors, ArchivePageError{File: page.Name, Error: err.Error()})
+	}
+	return imageIds, pageErrors
+}
+
+// CreateImagesChapter creates the chapter and its pages in one transaction, so a failure
+// doesn't leave a chapter with missing pages behind.
+func CreateImagesChapter(chapterNumber float64, name string, images []int32, bookGroupId, ownerId int32) (*db.BookChapter, error) {
+	ctx := context.Background()
+	var bookChapter db.BookChapter
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		var err error
+		nameSql := sql.NullString{String: name, Valid: name != ""}
+		bookChapter, err = queries.InsertBookChapter(ctx, db.InsertBookChapterParams{
+			ChapterNumber: chapterNumber,
+			Name:          nameSql,
+			TextContent:   sql.NullString{String: "", Valid: true},
+			Type:          "images",
+			BookGroupID:   bookGroupId,
+			OwnerID:       ownerId,
+		})
+		if err != nil {
+			return errors.New("error creating book chapter: " + err.Error())
+		}
+
+		for index, imageId := range images {
+			err = queries.InsertBookChapterImage(ctx, db.InsertBookChapterImageParams{
+				BookChapterID: bookChapter.ID,
+				ImageID:       imageId,
+				Rank:          int32(index + 1),
+			})
+			if err != nil {
+				return errors.New("error adding image chapter: " + err.Error())
+			}
+			err = queries.DeleteTempImage(ctx, imageId)
+			if err != nil {
+				return errors.New("error deleting temp image: " + err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &bookChapter, nil
+}
+
+// openUploadedArchive returns the archive sent in the "file" field, or the one staged by
+// the completed upload session of the "uploadSession" field for archives too big for a request.
+func openUploadedArchive(c *gin.Context, queries *db.Queries, userId int32, category string) (*zip.Reader, func(), int, error) {
+	if sessionId := c.PostForm("uploadSession"); sessionId != "" {
+		if _, err := uuid.Parse(sessionId); err != nil {
+			return nil, nil, http.StatusBadRequest, errors.New("invalid upload session id")
+		}
+		session, err := queries.GetUploadSession(context.Background(), db.GetUploadSessionParams{
+			ID:     sessionId,
+			UserID: userId,
+		})
+		if err == pgx.ErrNoRows {
+			return nil, nil, http.StatusNotFound, errors.New("upload session not found")
+		}
+		if err != nil {
+			return nil, nil, http.StatusInternalServerError, err
+		}
+		if session.Category != category || session.Received != session.Size {
+			return nil, nil, http.StatusConflict, errors.New("upload session is not a complete " + category)
+		}
+
+		file, err := os.Open(uploadSessionPath(session.ID))
+		if err != nil {
+			return nil, nil, http.StatusInternalServerError, err
+		}
+		closeArchive := func() {
+			_ = file.Close()
+			err := removeUploadSession(context.Background(), queries, session.ID)
+			if err != nil {
+				log.Printf("error removing upload session %s: %s\n", session.ID, err)
+			}
+		}
+		err = verifyUploadChecksum(file, session.Sha1)
+		if err != nil {
+			closeArchive()
+			return nil, nil, http.StatusUnprocessableEntity, err
+		}
+		archive, err := zip.NewReader(file, session.Size)
+		if err != nil {
+			closeArchive()
+			return nil, nil, http.StatusUnsupportedMediaType, errors.New("invalid archive: " + err.Error())
+		}
+		return archive, closeArchive, 0, nil
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, errors.New("error getting file stream")
+	}
+	if fileHeader.Size > MaxArchiveSize {
+		return nil, nil, http.StatusRequestEntityTooLarge, errors.New("file too large")
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	archive, err := zip.NewReader(file, fileHeader.Size)
+	if err != nil {
+		_ = file.Close()
+		return nil, nil, http.StatusUnsupportedMediaType, errors.New("invalid archive: " + err.Error())
+	}
+	return archive, func() { _ = file.Close() }, 0, nil
+}
+
+func CreateArchiveChapterHandler(cfg config.Images) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		queries := db.New(db.Pool())
+
+		userId := CurrentUser(c).Id
+
+		bookGroupId64, err := strconv.ParseInt(c.PostForm("bookGroupId"), 10, 32)
+		if err != nil {
+			ReportError(c, errors.New("invalid book group id"), "error", http.StatusBadRequest)
+			return
+		}
+		bookGroupId := int32(bookGroupId64)
+		check, err := queries.CheckBookGroupById(ctx, bookGroupId)
+		if err != nil {
+			ReportError(c, err, "error getting book group", 500)
+			return
+		}
+		if !check {
+			ReportError(c, errors.New("book group does not exist"), "error", http.StatusBadRequest)
+			return
+		}
+
+		chapterNumber, err := strconv.ParseFloat(c.PostForm("chapterNumber"), 64)
+		if err != nil {
+			ReportError(c, errors.New("missing chapter number"), "error", http.StatusBadRequest)
+			return
+		}
+
+		chapterName := strings.TrimSpace(c.PostForm("name"))
+		if !checkChapterName(chapterName) {
+			ReportError(c, errors.New("invalid chapter name"), "error", http.StatusBadRequest)
+			return
+		}
+
+		archive, closeArchive, code, err := openUploadedArchive(c, queries, userId, ChapterArchive)
+		if err != nil {
+			ReportError(c, err, "error opening archive", code)
+			return
+		}
+		defer closeArchive()
+
+		if len(archivePages(archive)) > MaxArchivePages {
+			ReportError(c, errors.New("too many pages"), "error", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		images, pageErrors := SaveArchivePages(archive, cfg.MaxSize)
+		if len(images) == 0 {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":  "no page could be imported",
+				"errors": pageErrors,
+			})
+			return
+		}
+
+		newChapter, err := CreateImagesChapter(chapterNumber, chapterName, images, bookGroupId, userId)
+		if err != nil {
+			ReportError(c, err, "error creating new images chapter", 500)
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"id":     newChapter.ID,
+			"pages":  len(images),
+			"errors": pageErrors,
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+)
+
+func createTestArchive(t *testing.T, files map[string][]byte) *zip.Reader {
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for name, content := range files {
+		file, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = file.Write(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestNaturalLess(t *testing.T) {
+	assert.True(t, naturalLess("2.jpg", "10.jpg"))
+	assert.False(t, naturalLess("10.jpg", "2.jpg"))
+	assert.True(t, naturalLess("page-002.png", "Page-10.png"))
+	assert.True(t, naturalLess("ch1/10.jpg", "ch2/1.jpg"))
+	assert.True(t, naturalLess("a.jpg", "b.jpg"))
+	assert.True(t, naturalLess("1.jpg", "1a.jpg"))
+	assert.False(t, naturalLess("1.jpg", "1.jpg"))
+}
+
+func TestArchivePages(t *testing.T) {
+	archive := createTestArchive(t, map[string][]byte{
+		"10.jpg":             []byte("10"),
+		"2.jpg":              []byte("2"),
+		"1.PNG":              []byte("1"),
+		"ComicInfo.xml":      []byte("<ComicInfo/>"),
+		"__MACOSX/._1.png":   []byte("resource fork"),
+		"extra/.DS_Store":    []byte("finder"),
+		"extra/11.webp":      []byte("11"),
+		"extra/not-an-image": []byte("text"),
+	})
+
+	var names []string
+	for _, page := range archivePages(archive) {
+		names = append(names, page.Name)
+	}
+	assert.Equal(t, []string{"1.PNG", "2.jpg", "10.jpg", "extra/11.webp"}, names)
+
+	page, err := readArchivePage(archivePages(archive)[2], 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(page)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("10"), data)
+}
+
+func TestReadArchivePageTooLarge(t *testing.T) {
+	archive := createTestArchive(t, map[string][]byte{
+		"1.jpg": make([]byte, 1025),
+	})
+	_, err := readArchivePage(archive.File[0], 1024)
+	assert.NotNil(t, err)
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/dqhieuu/novo-app/db"
 	"github.com/gin-gonic/gin"
 	"net/http"
@@ -108,27 +107,12 @@ func CreateCommentHandler(c *gin.Context) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: CommentModule,
-		Action: PostAction,
-		ID:     userId,
-	})
-	if err != nil {
-		ReportError(c, err, "error", 500)
-		return
-	}
-	if !check {
-		ReportError(c, errors.New("permission denied"), "error", 403)
-		return
-	}
+	userId := CurrentUser(c).Id
 
 	var postComment PostComment
 	reg := regexp.MustCompile(`(\r\n|\n){3,}`)
 
-	err = c.ShouldBindJSON(&postComment)
+	err := c.ShouldBindJSON(&postComment)
 	if err != nil {
 		ReportError(c, err, "error parsing json", http.StatusBadRequest)
 		return
@@ -404,152 +388,115 @@ func EditCommentHandler(c *gin.Context) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-	permAllow := false
+	commentIdString := c.Param("commentId")
+	commentId64, err := strconv.ParseInt(commentIdString, 10, 32)
+	if err != nil {
+		ReportError(c, err, "error parsing comment id", 500)
+		return
+	}
 
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: CommentModule,
-		Action: ModifyAction,
-		ID:     userId,
-	})
+	check, err := queries.CheckIfCommentExist(ctx, int32(commentId64))
 	if err != nil {
-		ReportError(c, err, "error", 500)
+		ReportError(c, err, "internal error", 500)
 		return
 	}
 	if !check {
-		check, err = queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-			Module: CommentModule,
-			Action: ModifySelfAction,
-			ID:     userId,
-		})
-		if err != nil {
-			ReportError(c, err, "error", 500)
-			return
-		}
-		if check {
-			permAllow = true
-		}
-	} else {
-		permAllow = true
+		ReportError(c, errors.New("comment does not exist"), "error", http.StatusBadRequest)
+		return
 	}
 
-	if permAllow {
-		commentIdString := c.Param("commentId")
-		commentId64, err := strconv.ParseInt(commentIdString, 10, 32)
-		if err != nil {
-			ReportError(c, err, "error parsing comment id", 500)
-			return
-		}
-
-		check, err = queries.CheckIfCommentExist(ctx, int32(commentId64))
-		if err != nil {
-			ReportError(c, err, "internal error", 500)
-			return
-		}
-		if !check {
-			ReportError(c, errors.New("comment does not exist"), "error", http.StatusBadRequest)
-			return
-		}
+	var content PostComment
+	err = c.ShouldBindJSON(&content)
+	if err != nil {
+		ReportError(c, err, "error parsing json", http.StatusBadRequest)
+		return
+	}
 
-		var content PostComment
-		err = c.ShouldBindJSON(&content)
-		if err != nil {
-			ReportError(c, err, "error parsing json", http.StatusBadRequest)
-			return
-		}
+	reg := regexp.MustCompile(`(\r\n|\n){3,}`)
+	content.Comment = reg.ReplaceAllString(content.Comment, "\n\n")
+	if len(content.Comment) < 10 || len(content.Comment) > 500 || HasControlCharacters(content.Comment) || CheckEmptyString(content.Comment) {
+		ReportError(c, errors.New("invalid comment"), "error", http.StatusBadRequest)
+		return
+	}
 
-		reg := regexp.MustCompile(`(\r\n|\n){3,}`)
-		content.Comment = reg.ReplaceAllString(content.Comment, "\n\n")
-		if len(content.Comment) < 10 || len(content.Comment) > 500 || HasControlCharacters(content.Comment) || CheckEmptyString(content.Comment) {
-			ReportError(c, errors.New("invalid comment"), "error", http.StatusBadRequest)
-			return
-		}
+	oldComment, err := queries.GetComment(ctx, int32(commentId64))
+	if err != nil {
+		ReportError(c, err, "internal error", 500)
+		return
+	}
 
-		err = queries.UpdateComment(ctx, db.UpdateCommentParams{
-			ID:      int32(commentId64),
-			Content: content.Comment,
-		})
+	err = queries.UpdateComment(ctx, db.UpdateCommentParams{
+		ID:      int32(commentId64),
+		Content: content.Comment,
+	})
 
-		if err != nil {
-			ReportError(c, err, "error updating comment", 500)
-			return
-		}
+	if err != nil {
+		ReportError(c, err, "error updating comment", 500)
+		return
+	}
 
-		c.JSON(200, gin.H{
-			"message": "success",
+	if actingOnOthers(c, oldComment.UserID) {
+		newComment := oldComment
+		newComment.Content = content.Comment
+		RecordAudit(c, AuditRecord{
+			Action:     EditCommentAudit,
+			TargetType: CommentAuditTarget,
+			TargetId:   oldComment.ID,
+			Before:     commentAuditSnapshot(oldComment),
+			After:      commentAuditSnapshot(newComment),
 		})
-	} else {
-		ReportError(c, errors.New("permission denied"), "error", 403)
-		return
 	}
+
+	c.JSON(200, gin.H{
+		"message": "success",
+	})
 }
 
 func DeleteCommentHandler(c *gin.Context) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-	permAllow := false
+	commentIdString := c.Param("commentId")
+	commentId64, err := strconv.ParseInt(commentIdString, 10, 32)
+	if err != nil {
+		ReportError(c, err, "error parsing comment id", 500)
+		return
+	}
 
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: CommentModule,
-		Action: ModifyAction,
-		ID:     userId,
-	})
+	check, err := queries.CheckIfCommentExist(ctx, int32(commentId64))
 	if err != nil {
-		ReportError(c, err, "error", 500)
+		ReportError(c, err, "internal error", 500)
 		return
 	}
 	if !check {
-		check, err = queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-			Module: CommentModule,
-			Action: ModifySelfAction,
-			ID:     userId,
-		})
-		if err != nil {
-			ReportError(c, err, "error", 500)
-			return
-		}
-		if check {
-			permAllow = true
-		}
-	} else {
-		permAllow = true
+		ReportError(c, errors.New("comment does not exist"), "error", http.StatusBadRequest)
+		return
 	}
 
-	if permAllow {
-		commentIdString := c.Param("commentId")
-		commentId64, err := strconv.ParseInt(commentIdString, 10, 32)
-		if err != nil {
-			ReportError(c, err, "error parsing comment id", 500)
-			return
-		}
-
-		check, err = queries.CheckIfCommentExist(ctx, int32(commentId64))
-		if err != nil {
-			ReportError(c, err, "internal error", 500)
-			return
-		}
-		if !check {
-			ReportError(c, errors.New("comment does not exist"), "error", http.StatusBadRequest)
-			return
-		}
+	comment, err := queries.GetComment(ctx, int32(commentId64))
+	if err != nil {
+		ReportError(c, err, "internal error", 500)
+		return
+	}
 
-		err = queries.DeleteComment(ctx, int32(commentId64))
-		if err != nil {
-			ReportError(c, err, "error deleting comment", 500)
-			return
-		}
+	err = queries.DeleteComment(ctx, int32(commentId64))
+	if err != nil {
+		ReportError(c, err, "error deleting comment", 500)
+		return
+	}
 
-		c.JSON(200, gin.H{
-			"message": "success",
+	if actingOnOthers(c, comment.UserID) {
+		RecordAudit(c, AuditRecord{
+			Action:     DeleteCommentAudit,
+			TargetType: CommentAuditTarget,
+			TargetId:   comment.ID,
+			Before:     commentAuditSnapshot(comment),
 		})
-	} else {
-		ReportError(c, errors.New("permission denied"), "error", 403)
-		return
 	}
+
+	c.JSON(200, gin.H{
+		"message": "success",
+	})
 }
 
 func GetLatestCommentsHandler(c *gin.Context) {
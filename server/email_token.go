@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The email verification and password reset links carry a random token. Tokens are kept
+// signed with the server key, bound to a purpose and to the email they were sent to, and
+// work once before they expire.
+
+const (
+	VerifyEmailPurpose   = "verify_email"
+	ResetPasswordPurpose = "reset_password"
+)
+
+var (
+	ErrInvalidEmailToken    = errors.New("the link is invalid, expired or already used")
+	ErrEmailAlreadyVerified = errors.New("the email is already verified")
+)
+
+type EmailTokenInput struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type PasswordResetInput struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+// issueEmailToken returns a new token of the user for purpose, valid for ttl.
+func issueEmailToken(ctx context.Context, queries *db.Queries, userId int32, purpose, email string, ttl time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", errors.New("error generating email token: " + err.Error())
+	}
+	err = queries.InsertEmailToken(ctx, db.InsertEmailTokenParams{
+		TokenHash:   signToken(token, purpose),
+		UserID:      userId,
+		Purpose:     purpose,
+		Email:       email,
+		DateExpires: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", errors.New("error storing email token: " + err.Error())
+	}
+	return token, nil
+}
+
+// useEmailToken spends the token, it returns the user and the email it was sent to.
+func useEmailToken(ctx context.Context, queries *db.Queries, token, purpose string) (db.UseEmailTokenRow, error) {
+	row, err := queries.UseEmailToken(ctx, db.UseEmailTokenParams{
+		TokenHash: signToken(token, purpose),
+		Purpose:   purpose,
+	})
+	if err == pgx.ErrNoRows {
+		return row, ErrInvalidEmailToken
+	}
+	return row, err
+}
+
+// emailLink is the page of the client at path, with the token.
+func emailLink(path, token string) string {
+	return strings.TrimSuffix(mailConfig.LinkURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// SendVerificationEmail mails a link verifying the current email of the user.
+func SendVerificationEmail(userId int32) error {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	user, err := queries.UserById(ctx, userId)
+	if err != nil {
+		return errors.New("error getting user: " + err.Error())
+	}
+	if user.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+	token, err := issueEmailToken(ctx, queries, user.ID, VerifyEmailPurpose, user.Email, mailConfig.VerificationTTL)
+	if err != nil {
+		return err
+	}
+	return MailSender().Send(ctx, Email{
+		To:      user.Email,
+		Subject: "Xác nhận email của bạn",
+		Body: "Mở liên kết sau để xác nhận email của tài khoản Novo:\n\n" +
+			emailLink("/verify-email", token) + "\n\n" +
+			"Liên kết hết hạn sau " + mailConfig.VerificationTTL.String() + ".\n",
+	})
+}
+
+// VerifyEmail marks the email the token was sent to as verified, if it is still the
+// email of the user.
+func VerifyEmail(token string) error {
+	ctx := context.Background()
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		sent, err := useEmailToken(ctx, queries, token, VerifyEmailPurpose)
+		if err != nil {
+			return err
+		}
+		verified, err := queries.VerifyUserEmail(ctx, db.VerifyUserEmailParams{
+			ID:    sent.UserID,
+			Email: sent.Email,
+		})
+		if err != nil {
+			return err
+		}
+		if verified == 0 {
+			return ErrInvalidEmailToken
+		}
+		return nil
+	})
+	if err == ErrInvalidEmailToken {
+		return err
+	}
+	if err != nil {
+		return errors.New("error verifying email: " + err.Error())
+	}
+	return nil
+}
+
+// RequestPasswordReset mails a password reset link to the account with the email. Unknown
+// emails are ignored, so that the answer doesn't tell which accounts exist.
+func RequestPasswordReset(email string) error {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	user, err := queries.UserByEmail(ctx, strings.TrimSpace(email))
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return errors.New("error getting user: " + err.Error())
+	}
+	token, err := issueEmailToken(ctx, queries, user.ID, ResetPasswordPurpose, user.Email, mailConfig.ResetTTL)
+	if err != nil {
+		return err
+	}
+	return MailSender().Send(ctx, Email{
+		To:      user.Email,
+		Subject: "Đặt lại mật khẩu",
+		Body: "Mở liên kết sau để đặt lại mật khẩu của tài khoản Novo:\n\n" +
+			emailLink("/reset-password", token) + "\n\n" +
+			"Liên kết hết hạn sau " + mailConfig.ResetTTL.String() + ". " +
+			"Bỏ qua email này nếu bạn không yêu cầu đặt lại mật khẩu.\n",
+	})
+}
+
+// ResetPassword sets the password of the user the token was sent to, while it is still their
+// email. Opening the link proves the email too, and every session of the user ends.
+func ResetPassword(token, password string) error {
+	if !ValidPassword(password) {
+		return ErrInvalidPassword
+	}
+	hashedPassword, err := GeneratePasswordHash(password)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var userId int32
+	err = RunInTx(ctx, func(queries *db.Queries) error {
+		sent, err := useEmailToken(ctx, queries, token, ResetPasswordPurpose)
+		if err != nil {
+			return err
+		}
+		userId = sent.UserID
+		// the links mailed to a former email of the user don't work anymore
+		verified, err := queries.VerifyUserEmail(ctx, db.VerifyUserEmailParams{
+			ID:    sent.UserID,
+			Email: sent.Email,
+		})
+		if err != nil {
+			return err
+		}
+		if verified == 0 {
+			return ErrInvalidEmailToken
+		}
+		err = queries.UpdatePassword(ctx, db.UpdatePasswordParams{
+			ID: sent.UserID,
+			Password: sql.NullString{
+				String: hex.EncodeToString(hashedPassword),
+				Valid:  true,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		return queries.DeleteUserEmailTokens(ctx, db.DeleteUserEmailTokensParams{
+			UserID:  sent.UserID,
+			Purpose: ResetPasswordPurpose,
+		})
+	})
+	if err == ErrInvalidEmailToken {
+		return err
+	}
+	if err != nil {
+		return errors.New("error resetting password: " + err.Error())
+	}
+	_, err = RevokeUserSessions(userId)
+	return err
+}
+
+func emailTokenErrorCode(err error) int {
+	switch err {
+	case ErrInvalidEmailToken, ErrEmailAlreadyVerified, ErrInvalidPassword:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func VerifyEmailHandler(c *gin.Context) {
+	var input EmailTokenInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	err = VerifyEmail(input.Token)
+	if err != nil {
+		ReportError(c, err, "error", emailTokenErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "email verified",
+	})
+}
+
+func ResendVerificationHandler(c *gin.Context) {
+	err := SendVerificationEmail(currentUserId(c))
+	if err != nil {
+		ReportError(c, err, "error", emailTokenErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "verification email sent",
+	})
+}
+
+// RequestPasswordResetHandler limits the requests per email, and mails the link after
+// answering, so that the answer neither tells nor takes longer for the existing accounts.
+func RequestPasswordResetHandler(limit RateLimit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input PasswordResetRequest
+		err := c.ShouldBindJSON(&input)
+		if err != nil {
+			ReportError(c, err, "error", http.StatusBadRequest)
+			return
+		}
+		if !takeRate(c, limit, "email:"+strings.ToLower(strings.TrimSpace(input.Email))) {
+			return
+		}
+		go func() {
+			err := RequestPasswordReset(input.Email)
+			if err != nil {
+				log.Printf("error requesting password reset: %s\n", err)
+			}
+		}()
+		c.JSON(http.StatusOK, gin.H{
+			"message": "if an account uses this email, a reset link was sent to it",
+		})
+	}
+}
+
+func ResetPasswordHandler(c *gin.Context) {
+	var input PasswordResetInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	err = ResetPassword(input.Token, input.Password)
+	if err != nil {
+		ReportError(c, err, "error", emailTokenErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "password reset",
+	})
+}
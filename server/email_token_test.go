@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// capturingMailer keeps the emails instead of sending them.
+type capturingMailer struct {
+	emails []Email
+}
+
+func (m *capturingMailer) Send(_ context.Context, email Email) error {
+	m.emails = append(m.emails, email)
+	return nil
+}
+
+var emailLinkRegex = regexp.MustCompile(`https?://\S+`)
+
+// lastEmailToken is the token of the link of the last email.
+func lastEmailToken(t *testing.T, m *capturingMailer) string {
+	if len(m.emails) == 0 {
+		t.Fatal("no email sent")
+	}
+	link, err := url.Parse(emailLinkRegex.FindString(m.emails[len(m.emails)-1].Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return link.Query().Get("token")
+}
+
+func TestEmailTokens(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	mails := &capturingMailer{}
+	oldMailer := mailer
+	SetMailer(mails)
+	defer SetMailer(oldMailer)
+
+	username, email := "testemailuser", "emailtoken@atest.com"
+	user, _, err := RegisterAccount(username, "secretpw", email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = DeleteAccount(username)
+	}()
+	assert.False(t, user.EmailVerified)
+
+	assert.Nil(t, SendVerificationEmail(user.ID))
+	assert.Equal(t, email, mails.emails[0].To)
+	token := lastEmailToken(t, mails)
+	// a token only works for its purpose, and once
+	assert.Equal(t, ErrInvalidEmailToken, ResetPassword(token, "newsecretpw"))
+	assert.Nil(t, VerifyEmail(token))
+	assert.Equal(t, ErrInvalidEmailToken, VerifyEmail(token))
+	verified, _ := db.New(db.Pool()).UserEmailVerified(context.Background(), user.ID)
+	assert.True(t, verified)
+	assert.Equal(t, ErrEmailAlreadyVerified, SendVerificationEmail(user.ID))
+
+	// unknown emails get the same answer and no email
+	sent := len(mails.emails)
+	assert.Nil(t, RequestPasswordReset("nobody@atest.com"))
+	assert.Equal(t, sent, len(mails.emails))
+
+	sessionId, err := CreateSession(user.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, RequestPasswordReset(email))
+	token = lastEmailToken(t, mails)
+	assert.Equal(t, ErrInvalidPassword, ResetPassword(token, "short"))
+	assert.Nil(t, ResetPassword(token, "newsecretpw"))
+	assert.Equal(t, ErrInvalidEmailToken, ResetPassword(token, "othersecretpw"))
+	_, _, err = UserByLoginInfo(PasswordLogin{UsernameOrEmail: username, Password: "newsecretpw"})
+	assert.Nil(t, err)
+	active, _ := sessionActive(sessionId, user.ID)
+	assert.False(t, active)
+
+	// the expired tokens are refused
+	expired, err := issueEmailToken(context.Background(), db.New(db.Pool()), user.ID, ResetPasswordPurpose, email, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrInvalidEmailToken, ResetPassword(expired, "othersecretpw"))
+
+	// the links mailed to a former email are refused
+	assert.Nil(t, RequestPasswordReset(email))
+	token = lastEmailToken(t, mails)
+	err = db.New(db.Pool()).UpdateUserInfo(context.Background(), db.UpdateUserInfoParams{
+		ID:       user.ID,
+		Email:    "newemailtoken@atest.com",
+		UserName: sql.NullString{String: username, Valid: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrInvalidEmailToken, ResetPassword(token, "othersecretpw"))
+	_, _, err = UserByLoginInfo(PasswordLogin{UsernameOrEmail: username, Password: "newsecretpw"})
+	assert.Nil(t, err)
+}
+
+func TestResetRequestLimit(t *testing.T) {
+	db.Init()
+	defer db.Close()
+	oldLimiter := rateLimiter
+	SetRateLimiter(NewMemoryRateLimiter())
+	defer SetRateLimiter(oldLimiter)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/password-reset", RequestPasswordResetHandler(RateLimit{Name: "reset", Requests: 1, Period: time.Hour}))
+	post := func(email string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/password-reset", strings.NewReader(`{"email": "`+email+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("nobody@atest.com"))
+	// the emails are limited whatever their case and spaces
+	assert.Equal(t, http.StatusTooManyRequests, post(" Nobody@atest.com"))
+	assert.Equal(t, http.StatusOK, post("somebody@atest.com"))
+}
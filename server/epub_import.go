@@ -0,0 +1,521 @@
+package server
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"errors"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// BookEpub is the upload session category of EPUB files imported with /auth/chapter/epub.
+const BookEpub = "book-epub"
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubItem struct {
+	Id         string `xml:"id,attr"`
+	Href       string `xml:"href,attr"`
+	MediaType  string `xml:"media-type,attr"`
+	Properties string `xml:"properties,attr"`
+}
+
+type epubPackage struct {
+	Metadata struct {
+		Titles       []string `xml:"title"`
+		Creators     []string `xml:"creator"`
+		Descriptions []string `xml:"description"`
+		Metas        []struct {
+			Name    string `xml:"name,attr"`
+			Content string `xml:"content,attr"`
+		} `xml:"meta"`
+	} `xml:"metadata"`
+	Manifest []epubItem `xml:"manifest>item"`
+	Spine    []struct {
+		IdRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+type EpubChapter struct {
+	File        string
+	Name        string
+	TextContent string
+}
+
+type EpubBook struct {
+	Title       string
+	Description string
+	Authors     []string
+	Cover       *zip.File
+	Chapters    []EpubChapter
+	// Images are the ids of the images embedded in the chapters
+	Images []int32
+	// Errors are reported back to the uploader, per file of the epub
+	Errors []ArchivePageError
+}
+
+// epubImageSaver stores an image of the epub, returning its id and storage key.
+type epubImageSaver func(file *zip.File) (int32, string, error)
+
+// newEpubImageSaver saves the images as chapter images, up to maxSize.
+func newEpubImageSaver(maxSize int64) epubImageSaver {
+	return func(file *zip.File) (int32, string, error) {
+		image, err := readArchivePage(file, maxSize)
+		if err != nil {
+			return -1, "", err
+		}
+		return SaveImageFromStream(image, ChapterImage, uuid.NewString(), "")
+	}
+}
+
+// epubPath resolves a link found in the base file to the name of the file in the archive.
+func epubPath(base, href string) (string, bool) {
+	link, err := url.Parse(href)
+	if err != nil || link.Scheme != "" || link.Host != "" || link.Path == "" {
+		return "", false
+	}
+	if strings.HasPrefix(link.Path, "/") {
+		return strings.TrimPrefix(path.Clean(link.Path), "/"), true
+	}
+	return path.Join(path.Dir(base), link.Path), true
+}
+
+func readEpubXml(files map[string]*zip.File, name string, v interface{}, maxSize int64) error {
+	file, ok := files[name]
+	if !ok {
+		return errors.New("missing " + name)
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return errors.New("error opening " + name + ": " + err.Error())
+	}
+	defer reader.Close()
+	err = xml.NewDecoder(io.LimitReader(reader, maxSize)).Decode(v)
+	if err != nil {
+		return errors.New("error parsing " + name + ": " + err.Error())
+	}
+	return nil
+}
+
+func findHtmlElement(node *html.Node, tags ...atom.Atom) *html.Node {
+	if node.Type == html.ElementNode {
+		for _, tag := range tags {
+			if node.DataAtom == tag {
+				return node
+			}
+		}
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if found := findHtmlElement(child, tags...); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// replaceSvgImages turns the <svg><image xlink:href=""/></svg> wrappers epubs use for
+// full page images into plain <img>, as the sanitizer drops svg.
+func replaceSvgImages(node *html.Node) {
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type != html.ElementNode || child.DataAtom != atom.Svg {
+			replaceSvgImages(child)
+			child = next
+			continue
+		}
+		if image := findHtmlElement(child, atom.Image); image != nil {
+			for _, attribute := range image.Attr {
+				if attribute.Key == "href" {
+					node.InsertBefore(&html.Node{
+						Type:     html.ElementNode,
+						Data:     "img",
+						DataAtom: atom.Img,
+						Attr:     []html.Attribute{{Key: "src", Val: attribute.Val}},
+					}, child)
+					node.RemoveChild(child)
+					break
+				}
+			}
+		}
+		child = next
+	}
+}
+
+// truncateName cuts a chapter name to the allowed length without splitting a character.
+func truncateName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	for len(name) > limitNameCharacter {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return strings.TrimSpace(name)
+}
+
+// parseEpubChapter returns nil for blank pages.
+func parseEpubChapter(file *zip.File, bookTitle string, sanitizer *HtmlSanitizer, maxSize int64) (*EpubChapter, error) {
+	reader, err := file.Open()
+	if err != nil {
+		return nil, errors.New("error opening chapter: " + err.Error())
+	}
+	defer reader.Close()
+	document, err := html.Parse(io.LimitReader(reader, maxSize))
+	if err != nil {
+		return nil, errors.New("error parsing chapter: " + err.Error())
+	}
+
+	body := findHtmlElement(document, atom.Body)
+	if body == nil {
+		return nil, errors.New("missing body")
+	}
+	replaceSvgImages(body)
+	// skip the blank pages, a page with only an image is kept
+	if htmlText(body) == "" && findHtmlElement(body, atom.Img) == nil {
+		return nil, nil
+	}
+
+	chapter := EpubChapter{File: file.Name}
+	if heading := findHtmlElement(body, atom.H1, atom.H2, atom.H3); heading != nil {
+		chapter.Name = htmlText(heading)
+	}
+	if title := findHtmlElement(document, atom.Title); chapter.Name == "" && title != nil {
+		// a lot of epubs repeat the book title in every chapter
+		if text := htmlText(title); text != bookTitle {
+			chapter.Name = text
+		}
+	}
+	chapter.Name = truncateName(chapter.Name)
+	if !checkChapterName(chapter.Name) {
+		chapter.Name = ""
+	}
+
+	var children []*html.Node
+	for child := body.FirstChild; child != nil; child = child.NextSibling {
+		children = append(children, child)
+	}
+	chapter.TextContent = sanitizer.SanitizeNodes(children)
+	return &chapter, nil
+}
+
+// ParseEpub reads the metadata and the chapters of the epub, in spine order. The embedded
+// images are stored with saveImage and the chapters link to their /image path. The files
+// bigger than maxSize are refused.
+func ParseEpub(archive *zip.Reader, saveImage epubImageSaver, maxSize int64) (*EpubBook, error) {
+	files := map[string]*zip.File{}
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+
+	var container epubContainer
+	err := readEpubXml(files, "META-INF/container.xml", &container, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, errors.New("missing package document")
+	}
+	packagePath := container.Rootfiles[0].FullPath
+	var epub epubPackage
+	err = readEpubXml(files, packagePath, &epub, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	book := EpubBook{Errors: make([]ArchivePageError, 0)}
+	for _, title := range epub.Metadata.Titles {
+		if book.Title = strings.TrimSpace(title); book.Title != "" {
+			break
+		}
+	}
+	for _, description := range epub.Metadata.Descriptions {
+		// descriptions are often escaped html
+		nodes, err := html.ParseFragment(strings.NewReader(description), &html.Node{
+			Type: html.ElementNode, Data: "body", DataAtom: atom.Body,
+		})
+		if err != nil {
+			continue
+		}
+		var texts []string
+		for _, node := range nodes {
+			texts = append(texts, htmlText(node))
+		}
+		if book.Description = strings.TrimSpace(strings.Join(texts, " ")); book.Description != "" {
+			break
+		}
+	}
+	for _, creator := range epub.Metadata.Creators {
+		creator = strings.Join(strings.Fields(creator), " ")
+		if creator != "" && !containsString(book.Authors, creator) {
+			book.Authors = append(book.Authors, creator)
+		}
+	}
+
+	manifest := map[string]epubItem{}
+	coverId := ""
+	for _, item := range epub.Manifest {
+		manifest[item.Id] = item
+		if containsString(strings.Fields(item.Properties), "cover-image") {
+			coverId = item.Id
+		}
+	}
+	for _, meta := range epub.Metadata.Metas {
+		if coverId == "" && meta.Name == "cover" {
+			coverId = meta.Content
+		}
+	}
+	if cover, ok := manifest[coverId]; ok {
+		if coverPath, ok := epubPath(packagePath, cover.Href); ok {
+			book.Cover = files[coverPath]
+		}
+	}
+
+	savedImages := map[string]string{}
+	for _, itemRef := range epub.Spine {
+		item, ok := manifest[itemRef.IdRef]
+		if !ok || (item.MediaType != "application/xhtml+xml" && item.MediaType != "text/html") {
+			continue
+		}
+		chapterPath, ok := epubPath(packagePath, item.Href)
+		file, found := files[chapterPath]
+		if !ok || !found {
+			book.Errors = append(book.Errors, ArchivePageError{File: item.Href, Error: "missing chapter file"})
+			continue
+		}
+
+		sanitizer := HtmlSanitizer{ImageSrc: func(src string) (string, bool) {
+			imagePath, ok := epubPath(chapterPath, src)
+			if !ok {
+				return "", false
+			}
+			if saved, ok := savedImages[imagePath]; ok {
+				return saved, true
+			}
+			imageFile, ok := files[imagePath]
+			if !ok {
+				return "", false
+			}
+			imageId, key, err := saveImage(imageFile)
+			if err != nil {
+				book.Errors = append(book.Errors, ArchivePageError{File: imagePath, Error: err.Error()})
+				return "", false
+			}
+			book.Images = append(book.Images, imageId)
+			savedImages[imagePath] = "/image/" + key
+			return savedImages[imagePath], true
+		}}
+
+		chapter, err := parseEpubChapter(file, book.Title, &sanitizer, maxSize)
+		if err != nil {
+			book.Errors = append(book.Errors, ArchivePageError{File: chapterPath, Error: err.Error()})
+			continue
+		}
+		if len(sanitizer.Rejected) > 0 {
+			book.Errors = append(book.Errors, ArchivePageError{
+				File:  chapterPath,
+				Error: "removed " + strings.Join(sanitizer.Rejected, ", "),
+			})
+		}
+		if chapter == nil {
+			continue
+		}
+		book.Chapters = append(book.Chapters, *chapter)
+	}
+
+	return &book, nil
+}
+
+// ImportEpub creates the chapters of the epub, numbered from firstChapter, in one transaction.
+// When bookGroupId is 0 the book group is created from the epub metadata first.
+func ImportEpub(book *EpubBook, bookGroupId int32, firstChapter float64, coverArtId int32, ownerId int32) (int32, []int32, error) {
+	ctx := context.Background()
+	var chapterIds []int32
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		var err error
+		if bookGroupId == 0 {
+			title, description := book.Title, book.Description
+			_ = ValidTitle(&title)
+			_ = ValidDescription(&description)
+			if title == "" {
+				return errors.New("missing book title")
+			}
+			bookGroup, err := queries.InsertBookGroup(ctx, db.InsertBookGroupParams{
+				Title:             title,
+				Description:       sql.NullString{String: description, Valid: description != ""},
+				OwnerID:           ownerId,
+				PrimaryCoverArtID: sql.NullInt32{Int32: coverArtId, Valid: coverArtId > 0},
+			})
+			if err != nil {
+				return errors.New("error creating book group: " + err.Error())
+			}
+			bookGroupId = bookGroup.ID
+
+			if coverArtId > 0 {
+				_, err = queries.InsertBookGroupArt(ctx, db.InsertBookGroupArtParams{
+					BookGroupID: bookGroupId,
+					ImageID:     coverArtId,
+				})
+				if err != nil {
+					return errors.New("error adding cover art: " + err.Error())
+				}
+				err = queries.DeleteTempImage(ctx, coverArtId)
+				if err != nil {
+					return errors.New("error deleting temp image: " + err.Error())
+				}
+			}
+
+			for _, authorName := range book.Authors {
+				authorId, err := queries.BookAuthorIdByName(ctx, authorName)
+				if err == pgx.ErrNoRows {
+					var author db.BookAuthor
+					author, err = queries.InsertBookAuthor(ctx, db.InsertBookAuthorParams{
+						Name:    authorName,
+						OwnerID: sql.NullInt32{Int32: ownerId, Valid: true},
+					})
+					authorId = author.ID
+				}
+				if err != nil {
+					return errors.New("error getting author: " + err.Error())
+				}
+				_, err = queries.InsertBookGroupAuthor(ctx, db.InsertBookGroupAuthorParams{
+					BookGroupID:  bookGroupId,
+					BookAuthorID: authorId,
+				})
+				if err != nil {
+					return errors.New("error adding author: " + err.Error())
+				}
+			}
+		}
+
+		chapterIds = make([]int32, 0, len(book.Chapters))
+		for index, chapter := range book.Chapters {
+			bookChapter, err := queries.InsertBookChapter(ctx, db.InsertBookChapterParams{
+				ChapterNumber: firstChapter + float64(index),
+				Name:          sql.NullString{String: chapter.Name, Valid: chapter.Name != ""},
+				TextContent:   sql.NullString{String: chapter.TextContent, Valid: true},
+				Type:          "hypertext",
+				BookGroupID:   bookGroupId,
+				OwnerID:       ownerId,
+			})
+			if err != nil {
+				return errors.New("error creating book chapter: " + err.Error())
+			}
+			chapterIds = append(chapterIds, bookChapter.ID)
+		}
+
+		// the chapters only link to their images in text_content, keep them from being collected
+		for _, imageId := range book.Images {
+			err = queries.DeleteTempImage(ctx, imageId)
+			if err != nil {
+				return errors.New("error deleting temp image: " + err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return bookGroupId, chapterIds, nil
+}
+
+func CreateEpubChaptersHandler(cfg config.Images) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		queries := db.New(db.Pool())
+
+		user := CurrentUser(c)
+
+		// without a book group, one is created from the epub metadata
+		var bookGroupId int32
+		if bookGroupIdString := c.PostForm("bookGroupId"); bookGroupIdString != "" {
+			bookGroupId64, err := strconv.ParseInt(bookGroupIdString, 10, 32)
+			if err != nil {
+				ReportError(c, errors.New("invalid book group id"), "error", http.StatusBadRequest)
+				return
+			}
+			bookGroupId = int32(bookGroupId64)
+			check, err := queries.CheckBookGroupById(ctx, bookGroupId)
+			if err != nil {
+				ReportError(c, err, "error getting book group", 500)
+				return
+			}
+			if !check {
+				ReportError(c, errors.New("book group does not exist"), "error", http.StatusBadRequest)
+				return
+			}
+		} else if !user.Can(BookGroupModule, PostAction) {
+			ReportError(c, ErrPermissionDenied, "error", 403)
+			return
+		}
+
+		var err error
+		firstChapter := 1.0
+		if firstChapterString := c.PostForm("firstChapter"); firstChapterString != "" {
+			firstChapter, err = strconv.ParseFloat(firstChapterString, 64)
+			if err != nil {
+				ReportError(c, errors.New("invalid first chapter number"), "error", http.StatusBadRequest)
+				return
+			}
+		}
+
+		archive, closeArchive, code, err := openUploadedArchive(c, queries, user.Id, BookEpub)
+		if err != nil {
+			ReportError(c, err, "error opening epub", code)
+			return
+		}
+		defer closeArchive()
+
+		book, err := ParseEpub(archive, newEpubImageSaver(cfg.MaxSize), cfg.MaxSize)
+		if err != nil {
+			ReportError(c, err, "error reading epub", http.StatusUnprocessableEntity)
+			return
+		}
+		if len(book.Chapters) == 0 {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":  "no chapter could be imported",
+				"errors": book.Errors,
+			})
+			return
+		}
+
+		var coverArtId int32
+		if bookGroupId == 0 && book.Cover != nil {
+			cover, err := readArchivePage(book.Cover, cfg.MaxSize)
+			if err == nil {
+				coverArtId, _, err = SaveImageFromStream(cover, CoverArt, uuid.NewString(), "")
+			}
+			if err != nil {
+				book.Errors = append(book.Errors, ArchivePageError{File: book.Cover.Name, Error: err.Error()})
+				coverArtId = 0
+			}
+		}
+
+		bookGroupId, chapterIds, err := ImportEpub(book, bookGroupId, firstChapter, coverArtId, user.Id)
+		if err != nil {
+			ReportError(c, err, "error importing epub", 500)
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"bookGroupId": bookGroupId,
+			"chapters":    chapterIds,
+			"errors":      book.Errors,
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"archive/zip"
+	"errors"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const testEpubPackage = `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>Test Book</dc:title>
+    <dc:creator>First Author</dc:creator>
+    <dc:creator> Second  Author </dc:creator>
+    <dc:description>&lt;p&gt;A &lt;b&gt;short&lt;/b&gt; description&lt;/p&gt;</dc:description>
+  </metadata>
+  <manifest>
+    <item id="cover" href="images/cover.jpg" media-type="image/jpeg" properties="cover-image"/>
+    <item id="c1" href="text/chapter%201.xhtml" media-type="application/xhtml+xml"/>
+    <item id="c2" href="text/chapter2.xhtml" media-type="application/xhtml+xml"/>
+    <item id="blank" href="text/blank.xhtml" media-type="application/xhtml+xml"/>
+    <item id="missing" href="text/missing.xhtml" media-type="application/xhtml+xml"/>
+  </manifest>
+  <spine>
+    <itemref idref="c2"/>
+    <itemref idref="blank"/>
+    <itemref idref="c1"/>
+    <itemref idref="missing"/>
+  </spine>
+</package>`
+
+func TestParseEpub(t *testing.T) {
+	archive := createTestArchive(t, map[string][]byte{
+		"META-INF/container.xml": []byte(`<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles><rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/></rootfiles>
+</container>`),
+		"OEBPS/content.opf":         []byte(testEpubPackage),
+		"OEBPS/images/cover.jpg":    []byte("cover"),
+		"OEBPS/images/page.png":     []byte("page"),
+		"OEBPS/text/blank.xhtml":    []byte(`<html><head><title>Test Book</title></head><body><p> </p></body></html>`),
+		"OEBPS/text/chapter2.xhtml": []byte(`<html><head><title>Test Book</title></head><body><p>Second</p></body></html>`),
+		"OEBPS/text/chapter 1.xhtml": []byte(`<html><head><title>Test Book</title><style>p{}</style></head>
+<body><h1>Chapter One</h1><p onclick="x()">First</p><img src="../images/page.png"/><img src="../images/missing.png"/>
+<svg xmlns:xlink="http://www.w3.org/1999/xlink"><image xlink:href="../images/page.png"/></svg></body></html>`),
+	})
+
+	var saved []string
+	book, err := ParseEpub(archive, func(file *zip.File) (int32, string, error) {
+		saved = append(saved, file.Name)
+		if file.Name != "OEBPS/images/page.png" {
+			return -1, "", errors.New("unexpected image")
+		}
+		return 7, "chapter-image/page.png", nil
+	}, config.Default().Images.MaxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "Test Book", book.Title)
+	assert.Equal(t, "A short description", book.Description)
+	assert.Equal(t, []string{"First Author", "Second Author"}, book.Authors)
+	assert.Equal(t, "OEBPS/images/cover.jpg", book.Cover.Name)
+
+	assert.Len(t, book.Chapters, 2)
+	assert.Equal(t, "", book.Chapters[0].Name)
+	assert.Equal(t, "<p>Second</p>", book.Chapters[0].TextContent)
+	assert.Equal(t, "Chapter One", book.Chapters[1].Name)
+	assert.Contains(t, book.Chapters[1].TextContent, `<p>First</p><img src="/image/chapter-image/page.png"/>`)
+	assert.NotContains(t, book.Chapters[1].TextContent, "missing.png")
+	assert.NotContains(t, book.Chapters[1].TextContent, "svg")
+
+	// the page is embedded twice but only stored once
+	assert.Equal(t, []string{"OEBPS/images/page.png"}, saved)
+	assert.Equal(t, []int32{7}, book.Images)
+
+	var errorFiles []string
+	for _, fileError := range book.Errors {
+		errorFiles = append(errorFiles, fileError.File)
+	}
+	assert.Contains(t, errorFiles, "text/missing.xhtml")
+	assert.Contains(t, errorFiles, "OEBPS/text/chapter 1.xhtml")
+}
+
+func TestEpubPath(t *testing.T) {
+	resolved, ok := epubPath("OEBPS/text/a.xhtml", "../images/a%20b.png#x")
+	assert.True(t, ok)
+	assert.Equal(t, "OEBPS/images/a b.png", resolved)
+
+	_, ok = epubPath("OEBPS/text/a.xhtml", "https://example.com/a.png")
+	assert.False(t, ok)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+type CleanedImage struct {
+	Id   int32  `json:"id"`
+	Path string `json:"path"`
+}
+
+type ImageCleanReport struct {
+	DryRun bool `json:"dryRun"`
+	// Attached is the number of temp images that turned out to be in use and were submitted
+	Attached int64          `json:"attached"`
+	Images   []CleanedImage `json:"images"`
+	// Files are the storage and cache keys that were (or would be) removed
+	Files []string `json:"files"`
+}
+
+// imageFileKeys lists every file an image may have left behind: the original, the thumbnails
+// pre-rendered by older versions and the variants rendered by /image, in every output format.
+func imageFileKeys(key string) []string {
+	keys := []string{key}
+	extensions := map[string]bool{}
+	for _, outType := range ThumbnailFormats {
+		extensions[imageExtension(outType)] = true
+	}
+	for _, width := range append([]int{0}, ThumbnailWidths...) {
+		for extension := range extensions {
+			keys = append(keys, fmt.Sprintf("%s.%d%s", key, width, extension))
+		}
+	}
+	return keys
+}
+
+// removeImageFiles deletes the files of an image from the image storage and the thumbnail cache,
+// returning the keys that existed.
+func removeImageFiles(ctx context.Context, key string, dryRun bool) ([]string, error) {
+	var removed []string
+	for _, storage := range []Storage{ImageStorage(), ThumbnailCache()} {
+		for _, fileKey := range imageFileKeys(key) {
+			exists, err := storage.Exists(ctx, fileKey)
+			if err != nil {
+				return removed, err
+			}
+			if !exists {
+				continue
+			}
+			if !dryRun {
+				err = storage.Delete(ctx, fileKey)
+				if err != nil {
+					return removed, err
+				}
+			}
+			removed = append(removed, fileKey)
+		}
+	}
+	return removed, nil
+}
+
+// CleanImages removes the images that stayed in temp_images for longer than ttl without being
+// attached to anything, along with their files. A dry run only reports what would be removed.
+func CleanImages(ttl time.Duration, dryRun bool) (*ImageCleanReport, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+	report := ImageCleanReport{DryRun: dryRun, Images: []CleanedImage{}, Files: []string{}}
+
+	if !dryRun {
+		attached, err := queries.SubmitAttachedTempImages(ctx)
+		if err != nil {
+			return nil, errors.New("error submitting attached temp images: " + err.Error())
+		}
+		report.Attached = attached
+	}
+
+	expiredImages, err := queries.ExpiredTempImages(ctx, time.Now().Add(-ttl))
+	if err != nil {
+		return nil, errors.New("error getting expired temp images: " + err.Error())
+	}
+
+	for _, expiredImage := range expiredImages {
+		if !dryRun {
+			err = queries.DeleteTempImage(ctx, expiredImage.ID)
+			if err != nil {
+				return &report, errors.New("error deleting temp image: " + err.Error())
+			}
+			err = queries.DeleteImage(ctx, expiredImage.ID)
+			if err != nil {
+				return &report, errors.New("error deleting image: " + err.Error())
+			}
+		}
+		report.Images = append(report.Images, CleanedImage{Id: expiredImage.ID, Path: expiredImage.Path})
+
+		if !validStorageKey(expiredImage.Path) {
+			continue
+		}
+		files, err := removeImageFiles(ctx, expiredImage.Path, dryRun)
+		report.Files = append(report.Files, files...)
+		if err != nil {
+			// the row is already gone, keep going with the other images
+			log.Printf("error removing files of image %s: %s\n", expiredImage.Path, err)
+		}
+	}
+
+	return &report, nil
+}
+
+// StartImageCollector periodically cleans the orphaned temp images and abandoned uploads in the background.
+func StartImageCollector(cfg config.Images) {
+	go func() {
+		ticker := time.NewTicker(cfg.GCInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report, err := CleanImages(cfg.GCTTL, false)
+			if err != nil {
+				log.Printf("error cleaning temp images: %s\n", err)
+			}
+			if report != nil && (len(report.Images) > 0 || report.Attached > 0) {
+				log.Printf("image gc: submitted %d attached images, removed %d images and %d files\n",
+					report.Attached, len(report.Images), len(report.Files))
+			}
+
+			sessions, err := CleanUploadSessions(UploadSessionTTL)
+			if err != nil {
+				log.Printf("error cleaning upload sessions: %s\n", err)
+			}
+			if sessions > 0 {
+				log.Printf("image gc: removed %d abandoned upload sessions\n", sessions)
+			}
+		}
+	}()
+}
+
+// ImageGCReportHandler shows what the image collector would remove right now, without removing it.
+func ImageGCReportHandler(cfg config.Images) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var err error
+		ttl := cfg.GCTTL
+		if ttlQuery := c.Query("ttl"); ttlQuery != "" {
+			ttl, err = time.ParseDuration(ttlQuery)
+			if err != nil || ttl < 0 {
+				ReportError(c, errors.New("invalid ttl"), "error", http.StatusBadRequest)
+				return
+			}
+		}
+
+		report, err := CleanImages(ttl, true)
+		if err != nil {
+			ReportError(c, err, "error cleaning temp images", http.StatusInternalServerError)
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
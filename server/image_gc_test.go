@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRemoveImageFiles(t *testing.T) {
+	defer setupVariantStorages(t)()
+	ctx := context.Background()
+
+	variant, _ := ParseImageVariant("test/variant.png", "128", "webp")
+	file, _, err := OpenImageVariant(variant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, file.Close())
+
+	// thumbnail pre-rendered by older versions next to the original
+	legacy := []byte("legacy thumbnail")
+	err = ImageStorage().Save(ctx, "test/variant.png.64.png", bytes.NewReader(legacy), int64(len(legacy)), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := removeImageFiles(ctx, "test/variant.png", true)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"test/variant.png", "test/variant.png.64.png", "test/variant.png.128.webp"}, removed)
+	exists, _ := ImageStorage().Exists(ctx, "test/variant.png")
+	assert.True(t, exists, "A dry run should not remove anything")
+
+	removed, err = removeImageFiles(ctx, "test/variant.png", false)
+	assert.Nil(t, err)
+	assert.Len(t, removed, 3)
+	exists, _ = ImageStorage().Exists(ctx, "test/variant.png")
+	assert.False(t, exists)
+	exists, _ = ThumbnailCache().Exists(ctx, variant.CacheKey())
+	assert.False(t, exists)
+}
+
+func TestCleanImagesKeepsEmbeddedImages(t *testing.T) {
+	db.Init()
+	defer db.Close()
+	createData()
+	defer removeData()
+	defer setupVariantStorages(t)()
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	orphan := []byte("orphan image")
+	err := ImageStorage().Save(ctx, "test/orphan.png", bytes.NewReader(orphan), int64(len(orphan)), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageIds := map[string]int32{}
+	for _, key := range []string{"test/variant.png", "test/orphan.png"} {
+		imageIds[key], err = queries.InsertImage(ctx, db.InsertImageParams{
+			Md5:  key,
+			Sha1: key,
+			Path: key,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, imageId := range imageIds {
+			_ = queries.DeleteTempImage(ctx, imageId)
+			_ = queries.DeleteImage(ctx, imageId)
+		}
+	}()
+
+	content, rejected, imageKeys := CheckChapterContent("![page](/image/test/variant.png?w=256)\n", "")
+	assert.Empty(t, rejected)
+	chapter, err := CreateBookChapter(1, "", content, "hypertext", bookGroups[0].ID, users[0].ID, imageKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = queries.DeleteBookChapterById(ctx, chapter.ID)
+	}()
+
+	// past the ttl, only the image no chapter embeds is collected
+	_, err = CleanImages(-time.Minute, false)
+	assert.Nil(t, err)
+	exists, err := queries.CheckImageExistById(ctx, imageIds["test/variant.png"])
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	exists, _ = ImageStorage().Exists(ctx, "test/variant.png")
+	assert.True(t, exists)
+	exists, _ = queries.CheckImageExistById(ctx, imageIds["test/orphan.png"])
+	assert.False(t, exists)
+	exists, _ = ImageStorage().Exists(ctx, "test/orphan.png")
+	assert.False(t, exists)
+}
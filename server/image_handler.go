@@ -1,11 +1,16 @@
 package server
 
 import (
-	"errors"
+	"context"
+	"github.com/dqhieuu/novo-app/config"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"io"
 	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
 )
 
 const (
@@ -16,75 +21,125 @@ const (
 	CoverArt = "cover-art"
 )
 
-func UploadImageHandler(c *gin.Context) {
-	imageCategory := c.Param("imageType")
-	switch imageCategory {
-	case ChapterImage, UserAvatar, AuthorAvatar, GenreImage, CoverArt:
-	default:
-		c.JSON(406, gin.H{
-			"error": "invalid image category",
-		})
-		return
+func UploadImageHandler(cfg config.Images) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		imageCategory := c.Param("imageType")
+		if !validImageCategory(imageCategory) {
+			c.JSON(406, gin.H{
+				"error": "invalid image category",
+			})
+			return
+		}
+		file, err := c.FormFile("file")
+		if err != nil {
+			log.Printf("error getting request body: %s\n", err)
+			c.JSON(400, gin.H{
+				"error": "error getting file stream",
+			})
+			return
+		}
+		if checkFileSize(file.Size, cfg.MaxSize) {
+			c.JSON(413, gin.H{
+				"error": "file too large",
+			})
+			return
+		}
+		filestream, err := file.Open()
+		if err != nil {
+			log.Printf("error getting file stream: %s\n", err)
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		saveImageName := uuid.NewString()
+		saveImageId, savePath, err := SaveImageFromStream(filestream, imageCategory, saveImageName, "")
+		switch err {
+		case ErrUnsupportedMediaType:
+			c.JSON(415, gin.H{
+				"error": err.Error(),
+			})
+		case nil:
+			c.JSON(200, gin.H{
+				"id": saveImageId,
+				"path": savePath,
+			})
+		default:
+			c.JSON(500, gin.H{
+				"error": err.Error(),
+			})
+		}
 	}
-	file, err := c.FormFile("file")
-	if err != nil {
-		log.Printf("error getting request body: %s\n", err)
-		c.JSON(400, gin.H{
-			"error": "error getting file stream",
-		})
-		return
-	}
-	if checkFileSize(file.Size) {
-		c.JSON(413, gin.H{
-			"error": "file too large",
-		})
-		return
-	}
-	filestream, err := file.Open()
-	if err != nil {
-		log.Printf("error getting file stream: %s\n", err)
-		c.JSON(500, gin.H{
-			"error": err.Error(),
-		})
-		return
-	}
-	saveImageName := uuid.NewString()
-	saveImageId, savePath, err := SaveImageFromStream(filestream, imageCategory, saveImageName, "")
-	switch err {
-	case errors.New("unsupported media type"):
-		c.JSON(415, gin.H{
-			"error": err.Error(),
-		})
-	case nil:
-		c.JSON(200, gin.H{
-			"id": saveImageId,
-			"path": savePath,
-		})
-	default:
-		c.JSON(500, gin.H{
-			"error": err.Error(),
-		})
-	}
-	_, err = filestream.Seek(0, io.SeekStart)
-	if err != nil {
-		log.Printf("error resetting file pointer: %s\n", err)
-		return
-	}
-	outType := "image/jpeg"
-	_, err = GenerateThumbnail(savePath, 512, &outType)
-	if err != nil {
-		log.Printf("error generating 512 width thumbnail")
-	}
-	_, err = GenerateThumbnail(savePath, 256, &outType)
-	if err != nil {
-		log.Printf("error generating 256 width thumbnail")
-	}
-	_, err = GenerateThumbnail(savePath, 128, &outType)
-	if err != nil {
-		log.Printf("error generating 128 width thumbnail")
-	}
-	_, err = GenerateThumbnail(savePath, 64, &outType)
-	if err != nil {
-		log.Printf("error generating 64 width thumbnail")
+}
+
+// ImageCacheControl is safe because image keys are never reused for another content.
+const ImageCacheControl = "public, max-age=31536000, immutable"
+
+func GetImageHandler(cfg config.Images) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("path"), "/")
+		if !validStorageKey(key) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": ErrImageNotFound.Error(),
+			})
+			return
+		}
+
+		variant, err := ParseImageVariant(key, c.Query("w"), c.Query("fmt"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		variant.NegotiateFormat(c.GetHeader("Accept"))
+		c.Header("Vary", "Accept")
+
+		if publicUrl := publicImageUrl(cfg); variant.IsOriginal() && publicUrl != "" {
+			c.Redirect(http.StatusFound, publicUrl+"/"+key)
+			return
+		}
+
+		var file io.ReadCloser
+		var contentType string
+		if variant.IsOriginal() {
+			file, err = ImageStorage().Open(context.Background(), key)
+			contentType = mime.TypeByExtension(filepath.Ext(key))
+		} else {
+			file, contentType, err = OpenImageVariant(variant)
+		}
+		if err == ErrImageNotFound {
+			c.Header("Cache-Control", "no-cache")
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+		if err != nil {
+			c.Header("Cache-Control", "no-cache")
+			ReportError(c, err, "error opening image", 500)
+			return
+		}
+		defer func() {
+			err := file.Close()
+			if err != nil {
+				log.Printf("error closing image: %s\n", err)
+			}
+		}()
+
+		// the image exists, the client may still have it
+		etag := variant.ETag()
+		c.Header("Cache-Control", ImageCacheControl)
+		c.Header("ETag", etag)
+		if etagMatches(c.GetHeader("If-None-Match"), etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		c.DataFromReader(200, -1, contentType, file, nil)
 	}
-}
\ No newline at end of file
+}
@@ -23,12 +23,14 @@ import (
 	"path/filepath"
 	//"encoding/json"
 	//"github.com/dqhieuu/novo-app/db"
+	"github.com/chai2010/webp"
 	"github.com/disintegration/imaging"
 	"github.com/google/uuid"
 )
 
-const MaxSize = 1024 * 1024 * 10
-const RootFolder = "static/images"
+const WebpQuality = 80
+
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
 
 type Image struct {
 	Path string `json:"path"`
@@ -70,20 +72,37 @@ func checkFileDir(path string, rootFolder string) (string, string, error) {
 	return rootDir + "/" + rootFolder + "/" + path, rootDir + "/" + rootFolder + "/" + dir, nil
 }
 
-func newFileName(fileType string) string {
-	var ext string
+func imageExtension(fileType string) string {
 	switch fileType {
 	case "image/jpeg":
-		ext = ".jpg"
+		return ".jpg"
 	case "image/png":
-		ext = ".png"
+		return ".png"
 	case "image/gif":
-		ext = ".gif"
+		return ".gif"
+	case "image/webp":
+		return ".webp"
 	}
-	return uuid.NewString() + ext
+	return ""
+}
+
+func newFileName(fileType string) string {
+	return uuid.NewString() + imageExtension(fileType)
 }
 
-func getImageType(fileStream multipart.File) (string, error) {
+func streamSize(fileStream io.Seeker) (int64, error) {
+	size, err := fileStream.Seek(0, io.SeekEnd)
+	if err != nil {
+		return -1, err
+	}
+	_, err = fileStream.Seek(0, io.SeekStart)
+	if err != nil {
+		return -1, err
+	}
+	return size, nil
+}
+
+func getImageType(fileStream io.ReadSeeker) (string, error) {
 	buffer := make([]byte, 512)
 	if _, err := fileStream.Read(buffer); err != nil {
 		return "", err
@@ -98,7 +117,7 @@ func getImageType(fileStream multipart.File) (string, error) {
 
 func detectImageType(imgType string) bool {
 	switch imgType {
-	case "image/jpeg", "image/png", "image/gif":
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
 		return true
 	}
 	return false
@@ -137,6 +156,21 @@ func GetImageResolution(filestream multipart.File) (int, int, error) {
 }
 
 func ResizeImage(fileStream multipart.File, params ResizeImageParams) error {
+	out, err := os.Create(params.OutDst)
+	if err != nil {
+		return err
+	}
+
+	err = resizeImage(out, fileStream, params)
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// resizeImage writes the resized fileStream to out, then rewinds fileStream
+func resizeImage(out io.Writer, fileStream io.ReadSeeker, params ResizeImageParams) error {
 	var srcImg image.Image
 	var err error
 	switch params.InType {
@@ -146,6 +180,10 @@ func ResizeImage(fileStream multipart.File, params ResizeImageParams) error {
 		srcImg, err = png.Decode(fileStream)
 	case "image/gif":
 		srcImg, err = gif.Decode(fileStream)
+	case "image/webp":
+		srcImg, err = webp.Decode(fileStream)
+	default:
+		err = ErrUnsupportedMediaType
 	}
 
 	if err != nil {
@@ -154,11 +192,6 @@ func ResizeImage(fileStream multipart.File, params ResizeImageParams) error {
 
 	dstImg := imaging.Resize(srcImg, params.Width, params.Height, imaging.MitchellNetravali)
 
-	out, err := os.Create(params.OutDst)
-	if err != nil {
-		return err
-	}
-
 	switch params.OutType {
 	case "image/jpeg":
 		err = jpeg.Encode(out, dstImg, nil)
@@ -166,14 +199,12 @@ func ResizeImage(fileStream multipart.File, params ResizeImageParams) error {
 		err = png.Encode(out, dstImg)
 	case "image/gif":
 		err = gif.Encode(out, dstImg, nil)
+	case "image/webp":
+		err = webp.Encode(out, dstImg, &webp.Options{Quality: WebpQuality})
 	default:
 		err = jpeg.Encode(out, dstImg, nil)
 	}
 
-	if err != nil {
-		return err
-	}
-	err = out.Close()
 	if err != nil {
 		return err
 	}
@@ -184,8 +215,8 @@ func ResizeImage(fileStream multipart.File, params ResizeImageParams) error {
 	return nil
 }
 
-func checkFileSize(size int64) bool {
-	if size > MaxSize {
+func checkFileSize(size, maxSize int64) bool {
+	if size > maxSize {
 		return true
 	}
 	return false
@@ -193,64 +224,81 @@ func checkFileSize(size int64) bool {
 
 func GenerateThumbnail(path string, size int, filetype *string) (string, error) {
 	//log.Println(*filetype)
-	fullPath, dirPath, err := checkFileDir(path, RootFolder)
+	ctx := context.Background()
+	storage := ImageStorage()
+
+	source, err := storage.Open(ctx, path)
 	if err != nil {
-		return "", errors.New("error checking directory: " + err.Error())
+		return "", errors.New("error opening file: " + err.Error())
 	}
-	filestream, err := os.Open(fullPath)
+	sourceData, err := ioutil.ReadAll(source)
+	_ = source.Close()
 	if err != nil {
-		return "", errors.New("error opening file: " + err.Error())
+		return "", errors.New("error reading file: " + err.Error())
+	}
+
+	thumbnail, outType, err := renderThumbnail(sourceData, size, filetype)
+	if err != nil {
+		return "", err
+	}
+
+	thumbFileName := fmt.Sprintf("%s.%d%s", filepath.Base(path), size, imageExtension(outType))
+	thumbPath := filepath.Dir(path) + "/" + thumbFileName
+
+	err = storage.Save(ctx, thumbPath, thumbnail, int64(thumbnail.Len()), outType)
+	if err != nil {
+		return "", errors.New("error saving thumbnail: " + err.Error())
 	}
 
+	return thumbPath, nil
+}
+
+// renderThumbnail resizes sourceData down to size pixels wide (never up) and encodes it
+// as filetype, or as the source type when filetype is nil. A size of 0 keeps the width.
+func renderThumbnail(sourceData []byte, size int, filetype *string) (*bytes.Buffer, string, error) {
+	filestream := bytes.NewReader(sourceData)
+
 	srcType, err := getImageType(filestream)
 	if err != nil {
-		return "", errors.New("error getting source file type: " + err.Error())
+		return nil, "", errors.New("error getting source file type: " + err.Error())
 	}
 
 	resolution, _, err := image.DecodeConfig(filestream)
 	if err != nil {
-		return "", errors.New("error getting resolution: " + err.Error())
+		return nil, "", errors.New("error getting resolution: " + err.Error())
 	}
 	_, err = filestream.Seek(0, io.SeekStart)
 	if err != nil {
-		return "", errors.New("error resetting file pointer: " + err.Error())
+		return nil, "", errors.New("error resetting file pointer: " + err.Error())
 	}
 
-	width := minInt(size, resolution.Width)
+	width := resolution.Width
+	if size > 0 {
+		width = minInt(size, resolution.Width)
+	}
 	outType := ""
 	if filetype == nil {
 		outType = srcType
 	} else {
 		outType = *filetype
 	}
-
-	extension := ""
-	switch outType {
-	case "image/jpeg":
-		extension = ".jpg"
-	case "image/png":
-		extension = ".png"
-	case "image/gif":
-		extension = ".gif"
-	default:
-		extension = ".jpg"
+	if imageExtension(outType) == "" {
+		outType = "image/jpeg"
 	}
-	thumbFileName := fmt.Sprintf("%s.%d%s", filepath.Base(path), size, extension)
-	outDst := fmt.Sprintf("%s/%s", dirPath, thumbFileName)
 
-	err = ResizeImage(filestream, ResizeImageParams{
+	var thumbnail bytes.Buffer
+	err = resizeImage(&thumbnail, filestream, ResizeImageParams{
 		InType:  srcType,
 		OutType: outType,
-		OutDst:  outDst,
 		Width:   width,
 		Height:  0,
 	})
 
 	if err != nil {
-		return "", errors.New("error resizing image: " + err.Error())
+		return nil, "", errors.New("error resizing image: " + err.Error())
 	}
 
-	return filepath.Dir(path) + "/" + thumbFileName, nil
+	return &thumbnail, outType, nil
 }
 
 func SubmitImages(submitImages []int32) error {
@@ -267,31 +315,10 @@ func SubmitImages(submitImages []int32) error {
 	return nil
 }
 
-func CleanImages() error {
-	ctx := context.Background()
-	queries := db.New(db.Pool())
-	deletedRows, err := queries.ClearTempImages(ctx)
-	if err != nil {
-		return errors.New("error clearing temp images: " + err.Error())
-	}
-	for _, row := range deletedRows {
-		err = queries.DeleteImage(ctx, row)
-		if err != nil {
-			return errors.New("error deleting image: " + err.Error())
-		}
-	}
-	return nil
-}
-
 func SaveImageFromStream(filestream multipart.File, location string, fileNameNoExt string, description string) (int32, string, error) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	_, dirPath, err := checkFileDir(location+"/"+fileNameNoExt, RootFolder)
-	if err != nil {
-		return -1, "", errors.New("error getting actual file path: " + err.Error())
-	}
-
 	fileType, err := getImageType(filestream)
 	if err != nil {
 		return -1, "", errors.New("error getting image type: " + err.Error())
@@ -299,7 +326,7 @@ func SaveImageFromStream(filestream multipart.File, location string, fileNameNoE
 
 	ok := detectImageType(fileType)
 	if !ok {
-		return -1, "", errors.New("unsupported media type")
+		return -1, "", ErrUnsupportedMediaType
 	}
 
 	md5Hash, sha1Hash, err := generateHashes(filestream)
@@ -329,30 +356,17 @@ func SaveImageFromStream(filestream multipart.File, location string, fileNameNoE
 		}
 		return peekRow.ID, peekRow.Path, nil
 	} else {
-		//saving file to the server
-		extension := ""
-		switch fileType {
-		case "image/jpeg":
-			extension = ".jpg"
-		case "image/png":
-			extension = ".png"
-		case "image/gif":
-			extension = ".gif"
-		}
+		//saving file to the storage
+		extension := imageExtension(fileType)
 		dst := location + "/" + fileNameNoExt + extension
 
-		//err = c.SaveUploadedFile(file, dst)
-		saveFileStream, err := os.Create(dirPath + "/" + fileNameNoExt + extension)
+		size, err := streamSize(filestream)
 		if err != nil {
-			return -1, "", errors.New("error creating new file: " + err.Error())
+			return -1, "", errors.New("error getting file size: " + err.Error())
 		}
-		_, err = io.Copy(saveFileStream, filestream)
+		err = ImageStorage().Save(ctx, dst, filestream, size, fileType)
 		if err != nil {
-			return -1, "", errors.New("error copying file: " + err.Error())
-		}
-		err = saveFileStream.Close()
-		if err != nil {
-			return -1, "", errors.New("error closing save file stream: " + err.Error())
+			return -1, "", errors.New("error saving file: " + err.Error())
 		}
 
 		//inserting image to the database
@@ -381,11 +395,6 @@ func SaveImageFromUrl(fileUrl string, location string, fileNameNoExt string, des
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	_, dirPath, err := checkFileDir(location+"/"+fileNameNoExt, RootFolder)
-	if err != nil {
-		return -1, errors.New("error getting actual file path: " + err.Error())
-	}
-
 	response, err := http.Get(fileUrl)
 	if err != nil {
 		return -1, errors.New("error getting http response: " + err.Error())
@@ -417,31 +426,10 @@ func SaveImageFromUrl(fileUrl string, location string, fileNameNoExt string, des
 		return peekRow.ID, nil
 	} else {
 		imageType := http.DetectContentType(bodyData)
-		extension := ""
-		switch imageType {
-		case "image/jpeg":
-			extension = ".jpg"
-		case "image/png":
-			extension = ".png"
-		case "image/gif":
-			extension = ".gif"
-		}
+		extension := imageExtension(imageType)
 		dst := location + "/" + fileNameNoExt + extension
-		response.Body = ioutil.NopCloser(bytes.NewBuffer(bodyData))
-
-		saveFile, err := os.Create(dirPath + "/" + fileNameNoExt + extension)
-		if err != nil {
-			return -1, errors.New("error creating new file: " + err.Error())
-		}
-
-		defer func(saveFile *os.File) {
-			err := saveFile.Close()
-			if err != nil {
-				log.Printf("Error closing new file: %s\n", err)
-			}
-		}(saveFile)
 
-		_, err = io.Copy(saveFile, response.Body)
+		err = ImageStorage().Save(ctx, dst, bytes.NewReader(bodyData), int64(len(bodyData)), imageType)
 		if err != nil {
 			return -1, errors.New("error saving file: " + err.Error())
 		}
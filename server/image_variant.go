@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CacheFolder keeps the resized variants rendered by /image, whatever the image storage is.
+const CacheFolder = "static/cache"
+
+// ThumbnailWidths are the only widths /image?w= accepts, so variants can't be used
+// to fill the disk with arbitrary sizes.
+var ThumbnailWidths = []int{64, 128, 256, 512, 1024}
+
+var ThumbnailFormats = map[string]string{
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+var ErrInvalidVariant = errors.New("invalid image width or format")
+
+var thumbnailCache Storage
+
+// variantLock is held while a variant is rendered, refs counts the requests holding or
+// waiting for it so that it is only forgotten when none does.
+type variantLock struct {
+	sync.Mutex
+	refs int
+}
+
+var variantLocks = struct {
+	sync.Mutex
+	locks map[string]*variantLock
+}{locks: map[string]*variantLock{}}
+
+type ImageVariant struct {
+	Key     string
+	Width   int
+	OutType string
+}
+
+func ThumbnailCache() Storage {
+	if thumbnailCache == nil {
+		thumbnailCache = NewLocalStorage(CacheFolder)
+	}
+	return thumbnailCache
+}
+
+func SetThumbnailCache(storage Storage) {
+	thumbnailCache = storage
+}
+
+// ParseImageVariant validates the w and fmt query parameters of /image.
+// An empty width keeps the original width, an empty format keeps the original type.
+func ParseImageVariant(key, width, format string) (*ImageVariant, error) {
+	variant := ImageVariant{Key: key}
+
+	if width != "" {
+		parsedWidth, err := strconv.Atoi(width)
+		if err != nil {
+			return nil, ErrInvalidVariant
+		}
+		allowed := false
+		for _, thumbnailWidth := range ThumbnailWidths {
+			if parsedWidth == thumbnailWidth {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, ErrInvalidVariant
+		}
+		variant.Width = parsedWidth
+	}
+
+	if format != "" {
+		outType, ok := ThumbnailFormats[strings.ToLower(format)]
+		if !ok {
+			return nil, ErrInvalidVariant
+		}
+		variant.OutType = outType
+	}
+
+	return &variant, nil
+}
+
+// NegotiateFormat renders the resized jpeg and png images as WebP for clients that accept
+// it, unless a format was asked for explicitly. The originals are served as stored, from the
+// public url when there is one, and gifs are left alone to keep animations.
+func (v *ImageVariant) NegotiateFormat(accept string) {
+	if v.Width == 0 || v.OutType != "" || !acceptsMediaType(accept, "image/webp") {
+		return
+	}
+	switch imageTypeByExtension(v.Key) {
+	case "image/jpeg", "image/png":
+		v.OutType = "image/webp"
+	}
+}
+
+// acceptsMediaType tells if the Accept header names mediaType with a q-value above 0,
+// wildcards don't count since they don't tell the client can decode it.
+func acceptsMediaType(accept, mediaType string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), mediaType) {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			name, value, ok := cutParam(param)
+			if ok && name == "q" {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return false
+				}
+				quality = parsed
+			}
+		}
+		return quality > 0
+	}
+	return false
+}
+
+func cutParam(param string) (string, string, bool) {
+	i := strings.Index(param, "=")
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.ToLower(strings.TrimSpace(param[:i])), strings.TrimSpace(param[i+1:]), true
+}
+
+// IsOriginal is true when no resizing or conversion was asked for.
+func (v *ImageVariant) IsOriginal() bool {
+	return v.Width == 0 && v.OutType == ""
+}
+
+// CacheKey follows the old thumbnail naming: "<key>.<width><ext>".
+func (v *ImageVariant) CacheKey() string {
+	outType := v.OutType
+	if outType == "" {
+		outType = imageTypeByExtension(v.Key)
+	}
+	return fmt.Sprintf("%s.%d%s", v.Key, v.Width, imageExtension(outType))
+}
+
+// ETag only depends on the request, image keys are never overwritten.
+func (v *ImageVariant) ETag() string {
+	hash := md5.Sum([]byte(fmt.Sprintf("%s|%d|%s", v.Key, v.Width, v.OutType)))
+	return `"` + hex.EncodeToString(hash[:]) + `"`
+}
+
+// etagMatches tells if the If-None-Match header lists etag, weakly compared as GET allows.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func imageTypeByExtension(key string) string {
+	lowerKey := strings.ToLower(key)
+	for _, outType := range ThumbnailFormats {
+		if strings.HasSuffix(lowerKey, imageExtension(outType)) {
+			return outType
+		}
+	}
+	return ""
+}
+
+// lockVariant waits for the other requests rendering the variant, the global lock is
+// released before waiting so that the other variants aren't held up.
+func lockVariant(cacheKey string) *variantLock {
+	variantLocks.Lock()
+	lock, ok := variantLocks.locks[cacheKey]
+	if !ok {
+		lock = &variantLock{}
+		variantLocks.locks[cacheKey] = lock
+	}
+	lock.refs++
+	variantLocks.Unlock()
+
+	lock.Lock()
+	return lock
+}
+
+func unlockVariant(cacheKey string, lock *variantLock) {
+	lock.Unlock()
+
+	variantLocks.Lock()
+	defer variantLocks.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(variantLocks.locks, cacheKey)
+	}
+}
+
+// OpenImageVariant returns the cached variant, rendering it from the original on first request.
+func OpenImageVariant(variant *ImageVariant) (io.ReadCloser, string, error) {
+	ctx := context.Background()
+	cache := ThumbnailCache()
+	cacheKey := variant.CacheKey()
+
+	lock := lockVariant(cacheKey)
+	defer unlockVariant(cacheKey, lock)
+
+	cached, err := cache.Open(ctx, cacheKey)
+	if err == nil {
+		outType := variant.OutType
+		if outType == "" {
+			outType = imageTypeByExtension(cacheKey)
+		}
+		return cached, outType, nil
+	}
+	if err != ErrImageNotFound {
+		return nil, "", err
+	}
+
+	source, err := ImageStorage().Open(ctx, variant.Key)
+	if err != nil {
+		return nil, "", err
+	}
+	sourceData, err := ioutil.ReadAll(source)
+	_ = source.Close()
+	if err != nil {
+		return nil, "", errors.New("error reading file: " + err.Error())
+	}
+
+	var outType *string
+	if variant.OutType != "" {
+		outType = &variant.OutType
+	}
+	thumbnail, renderedType, err := renderThumbnail(sourceData, variant.Width, outType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = cache.Save(ctx, cacheKey, bytes.NewReader(thumbnail.Bytes()), int64(thumbnail.Len()), renderedType)
+	if err != nil {
+		return nil, "", errors.New("error caching thumbnail: " + err.Error())
+	}
+
+	return ioutil.NopCloser(thumbnail), renderedType, nil
+}
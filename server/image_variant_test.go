@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func setupVariantStorages(t *testing.T) func() {
+	oldStorage, oldCache := imageStorage, thumbnailCache
+	SetImageStorage(NewLocalStorage(t.TempDir()))
+	SetThumbnailCache(NewLocalStorage(t.TempDir()))
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	img.Set(10, 10, color.White)
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		t.Fatalf("Error encoding test image: %s\n", err)
+	}
+	err := ImageStorage().Save(context.Background(), "test/variant.png", &buffer, int64(buffer.Len()), "image/png")
+	if err != nil {
+		t.Fatalf("Error saving test image: %s\n", err)
+	}
+
+	return func() {
+		SetImageStorage(oldStorage)
+		SetThumbnailCache(oldCache)
+	}
+}
+
+func TestParseImageVariant(t *testing.T) {
+	variant, err := ParseImageVariant("test/a.png", "", "")
+	assert.Nil(t, err)
+	assert.True(t, variant.IsOriginal())
+
+	variant, err = ParseImageVariant("test/a.png", "256", "jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, 256, variant.Width)
+	assert.Equal(t, "image/jpeg", variant.OutType)
+	assert.Equal(t, "test/a.png.256.jpg", variant.CacheKey())
+
+	_, err = ParseImageVariant("test/a.png", "300", "")
+	assert.Equal(t, ErrInvalidVariant, err)
+
+	_, err = ParseImageVariant("test/a.png", "abc", "")
+	assert.Equal(t, ErrInvalidVariant, err)
+
+	_, err = ParseImageVariant("test/a.png", "", "bmp")
+	assert.Equal(t, ErrInvalidVariant, err)
+
+	variant, err = ParseImageVariant("test/a.png", "", "webp")
+	assert.Nil(t, err)
+	assert.Equal(t, "test/a.png.0.webp", variant.CacheKey())
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	accept := "image/avif,image/webp,image/apng,image/*,*/*;q=0.8"
+
+	variant, _ := ParseImageVariant("test/a.jpg", "256", "")
+	variant.NegotiateFormat(accept)
+	assert.Equal(t, "image/webp", variant.OutType)
+
+	// the originals are served as stored
+	variant, _ = ParseImageVariant("test/a.jpg", "", "")
+	variant.NegotiateFormat(accept)
+	assert.True(t, variant.IsOriginal())
+
+	variant, _ = ParseImageVariant("test/a.png", "256", "")
+	variant.NegotiateFormat("image/png,image/*")
+	assert.Equal(t, "", variant.OutType)
+
+	variant, _ = ParseImageVariant("test/a.png", "256", "")
+	variant.NegotiateFormat("image/webp;q=0, image/*")
+	assert.Equal(t, "", variant.OutType)
+
+	variant, _ = ParseImageVariant("test/a.png", "256", "")
+	variant.NegotiateFormat("image/png, image/webp; q=0.5")
+	assert.Equal(t, "image/webp", variant.OutType)
+
+	variant, _ = ParseImageVariant("test/a.gif", "256", "")
+	variant.NegotiateFormat(accept)
+	assert.Equal(t, "", variant.OutType)
+
+	variant, _ = ParseImageVariant("test/a.png", "", "png")
+	variant.NegotiateFormat(accept)
+	assert.Equal(t, "image/png", variant.OutType)
+}
+
+func TestOpenWebpVariant(t *testing.T) {
+	defer setupVariantStorages(t)()
+
+	variant, _ := ParseImageVariant("test/variant.png", "256", "webp")
+	file, contentType, err := OpenImageVariant(variant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "image/webp", contentType)
+
+	data, err := ioutil.ReadAll(file)
+	assert.Nil(t, file.Close())
+	assert.Nil(t, err)
+	assert.Equal(t, "image/webp", http.DetectContentType(data))
+
+	// a webp upload can be resized back to the other formats
+	webpVariant := &ImageVariant{Key: "test/variant.webp", Width: 128, OutType: "image/jpeg"}
+	err = ImageStorage().Save(context.Background(), webpVariant.Key, bytes.NewReader(data), int64(len(data)), contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, contentType, err = OpenImageVariant(webpVariant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, file.Close())
+	assert.Equal(t, "image/jpeg", contentType)
+	assert.True(t, detectImageType("image/webp"))
+}
+
+func TestOpenImageVariant(t *testing.T) {
+	defer setupVariantStorages(t)()
+
+	variant, err := ParseImageVariant("test/variant.png", "128", "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, contentType, err := OpenImageVariant(variant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, file.Close())
+	assert.Equal(t, "image/jpeg", contentType)
+
+	cached, err := ThumbnailCache().Open(context.Background(), variant.CacheKey())
+	if err != nil {
+		t.Fatalf("Variant was not cached: %s\n", err)
+	}
+	config, format, err := image.DecodeConfig(cached)
+	assert.Nil(t, cached.Close())
+	assert.Nil(t, err)
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, 128, config.Width)
+	assert.Equal(t, 64, config.Height)
+
+	missing, _ := ParseImageVariant("test/missing.png", "128", "")
+	_, _, err = OpenImageVariant(missing)
+	assert.Equal(t, ErrImageNotFound, err)
+}
+
+func TestConcurrentImageVariant(t *testing.T) {
+	defer setupVariantStorages(t)()
+
+	variant, err := ParseImageVariant("test/variant.png", "64", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rendering, overlaps int32
+	done := make(chan error)
+	for i := 0; i < 8; i++ {
+		go func() {
+			lock := lockVariant(variant.CacheKey())
+			if atomic.AddInt32(&rendering, 1) > 1 {
+				atomic.AddInt32(&overlaps, 1)
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&rendering, -1)
+			unlockVariant(variant.CacheKey(), lock)
+
+			file, _, err := OpenImageVariant(variant)
+			if err == nil {
+				err = file.Close()
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("concurrent variant requests deadlocked")
+		}
+	}
+	assert.Equal(t, int32(0), overlaps)
+
+	variantLocks.Lock()
+	assert.Len(t, variantLocks.locks, 0)
+	variantLocks.Unlock()
+}
+
+func TestEtagMatches(t *testing.T) {
+	assert.True(t, etagMatches(`"a"`, `"a"`))
+	assert.True(t, etagMatches(`"b", W/"a"`, `"a"`))
+	assert.True(t, etagMatches(`*`, `"a"`))
+	assert.False(t, etagMatches(``, `"a"`))
+	assert.False(t, etagMatches(`"ab"`, `"a"`))
+}
+
+func TestGetImageHandler(t *testing.T) {
+	defer setupVariantStorages(t)()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/image/*path", GetImageHandler(config.Default().Images))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/image/test/variant.png?w=64", nil))
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "image/png", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, ImageCacheControl, recorder.Header().Get("Cache-Control"))
+	etag := recorder.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	request := httptest.NewRequest(http.MethodGet, "/image/test/variant.png?w=64", nil)
+	request.Header.Set("If-None-Match", etag)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusNotModified, recorder.Code)
+
+	// a prefix of the etag isn't a match
+	request = httptest.NewRequest(http.MethodGet, "/image/test/variant.png?w=64", nil)
+	request.Header.Set("If-None-Match", `"x`+etag[1:]+`, `+etag[:len(etag)-1]+`x"`)
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, 200, recorder.Code)
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/image/test/variant.png?w=65", nil))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+
+	request = httptest.NewRequest(http.MethodGet, "/image/test/variant.png?w=128", nil)
+	request.Header.Set("Accept", "image/webp,*/*")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, 200, recorder.Code)
+	assert.Equal(t, "image/webp", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "Accept", recorder.Header().Get("Vary"))
+
+	// the originals stay on the public url whatever the client accepts
+	publicRouter := gin.New()
+	publicRouter.GET("/image/*path", GetImageHandler(config.Images{PublicURL: "https://cdn.example.com/"}))
+	request = httptest.NewRequest(http.MethodGet, "/image/test/variant.png", nil)
+	request.Header.Set("Accept", "image/webp,*/*")
+	recorder = httptest.NewRecorder()
+	publicRouter.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusFound, recorder.Code)
+	assert.Equal(t, "https://cdn.example.com/test/variant.png", recorder.Header().Get("Location"))
+
+	// a missing image is not found, even for a client sending its etag
+	missing, _ := ParseImageVariant("test/missing.png", "64", "")
+	request = httptest.NewRequest(http.MethodGet, "/image/test/missing.png?w=64", nil)
+	request.Header.Set("If-None-Match", missing.ETag())
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("ETag"))
+}
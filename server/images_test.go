@@ -135,7 +135,11 @@ func TestCleanImages(t *testing.T) {
 		t.Fatalf("Error inserting test image row: %s\n", err)
 	}
 
-	err = CleanImages()
+	report, err := CleanImages(0, true)
+	assert.Nil(t, err)
+	assert.True(t, report.DryRun)
+
+	_, err = CleanImages(0, false)
 	assert.Nil(t, err)
 }
 
@@ -14,7 +14,7 @@ var roleNames = []string{"member", "moderator", "admin"}
 var users []*db.User
 var genres []*db.Genre
 var bookAuthors []*db.BookAuthor
-var bookGroups []*db.BookGroup
+var bookGroups []*db.InsertBookGroupRow
 var bookGroupGenres []*db.BookGroupGenre
 var bookGroupAuthors []*db.BookGroupAuthor
 var bookChapters []*db.BookChapter
@@ -83,7 +83,7 @@ func deleteUsers() {
 }
 
 func createBookGroups() {
-	bookGroups = []*db.BookGroup{}
+	bookGroups = []*db.InsertBookGroupRow{}
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 	var description sql.NullString
@@ -123,7 +123,7 @@ func deleteBookGroups() {
 			fmt.Println(err)
 		}
 	}
-	bookGroups = []*db.BookGroup{}
+	bookGroups = []*db.InsertBookGroupRow{}
 	//fmt.Println("Delete data in book groups table done")
 }
 
@@ -155,7 +155,7 @@ func createBookChapters() {
 		bookChapter, err := queries.InsertBookChapter(ctx, db.InsertBookChapterParams{
 			ChapterNumber: chapterNumber,
 			Name:          descriptionSql,
-			TextContext:   textContextSql,
+			TextContent:   textContextSql,
 			Type:          chapterType,
 			BookGroupID:   bookGroupID,
 			OwnerID:       ownerID,
@@ -3,7 +3,6 @@ package server
 import (
 	"context"
 	"errors"
-	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/dqhieuu/novo-app/db"
 	"github.com/gin-gonic/gin"
 	"net/http"
@@ -71,22 +70,7 @@ func LikeOperationHandler(c *gin.Context) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	extract := jwt.ExtractClaims(c)
-	userId := int32(extract[UserIdClaimKey].(float64))
-
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: LikeModule,
-		Action: PostAction,
-		ID:     userId,
-	})
-	if err != nil {
-		ReportError(c, err, "error", 500)
-		return
-	}
-	if !check {
-		ReportError(c, errors.New("permission denied"), "error", 403)
-		return
-	}
+	userId := CurrentUser(c).Id
 
 	bookGroupIdString := c.Param("bookGroupId")
 	operation := c.Param("operation")
@@ -107,9 +91,6 @@ func LikeOperationHandler(c *gin.Context) {
 		ReportError(c, errors.New("book group does not exist"), "error", http.StatusBadRequest)
 		return
 	} else {
-		extract := jwt.ExtractClaims(c)
-		userId := int32(extract[UserIdClaimKey].(float64))
-
 		switch operation {
 		case Like:
 			alreadyLike, err := queries.CheckAlreadyLike(ctx, db.CheckAlreadyLikeParams{
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The failed password logins are counted per account and per ip in the database, so that
+// every replica sees them. Past the free attempts, each failure locks the account or the ip
+// out for twice as long as the previous one, and every attempt is kept in login_attempts.
+// Unknown accounts are counted by the name or email tried, so that the answers don't tell
+// which accounts exist.
+
+var ErrLoginLocked = errors.New("too many failed logins, try again later")
+
+const (
+	LoginSucceeded          = "success"
+	LoginFailed             = "invalid_credentials"
+	LoginSecondFactorFailed = "invalid_second_factor"
+	LoginLocked             = "locked"
+)
+
+// retryAfterKey is where the authenticator leaves the end of a lockout.
+const retryAfterKey = "retryAfter"
+
+// loginConfig is how the failed logins are throttled, InitLoginThrottle sets it.
+var loginConfig = config.Default().Login
+
+func InitLoginThrottle(cfg config.Login) {
+	loginConfig = cfg
+}
+
+type LoginLockout struct {
+	Key             string `json:"key"`
+	Failures        int32  `json:"failures"`
+	DateLastFailure int64  `json:"dateLastFailure"`
+	LockedUntil     int64  `json:"lockedUntil"`
+}
+
+type LoginAttempt struct {
+	Identifier  string `json:"identifier"`
+	Ip          string `json:"ip"`
+	Outcome     string `json:"outcome"`
+	DateCreated int64  `json:"dateCreated"`
+}
+
+// loginThrottle is a counter of failed logins, with the failures it lets through.
+type loginThrottle struct {
+	key          string
+	freeAttempts int64
+}
+
+func accountThrottleKey(userId int32) string {
+	return fmt.Sprintf("user:%d", userId)
+}
+
+func loginThrottles(account, ip string) []loginThrottle {
+	return []loginThrottle{
+		{key: account, freeAttempts: loginConfig.AccountAttempts},
+		{key: "ip:" + ip, freeAttempts: loginConfig.IPAttempts},
+	}
+}
+
+// lockoutDuration is how long the failures lock out: nothing within the free attempts,
+// then the first lockout doubled for each failure after, up to the max lockout.
+func lockoutDuration(cfg config.Login, failures, freeAttempts int64) time.Duration {
+	if failures <= freeAttempts {
+		return 0
+	}
+	lockout := cfg.Lockout
+	for i := freeAttempts + 1; i < failures && lockout < cfg.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > cfg.MaxLockout {
+		return cfg.MaxLockout
+	}
+	return lockout
+}
+
+// retryAfter is the Retry-After header of a lockout ending at until, in whole seconds.
+func retryAfter(until time.Time) string {
+	return strconv.Itoa(int(math.Ceil(time.Until(until).Seconds())))
+}
+
+// lockThrottles locks the rows of the throttles until the end of the transaction, and
+// returns the end of their longest lockout, zero when none is locked out.
+func lockThrottles(ctx context.Context, queries *db.Queries, throttles []loginThrottle) (time.Time, error) {
+	var until time.Time
+	for _, throttle := range throttles {
+		row, err := queries.LockLoginThrottle(ctx, throttle.key)
+		if err != nil {
+			return time.Time{}, errors.New("error locking login throttle: " + err.Error())
+		}
+		if row.LockedUntil.Valid && row.LockedUntil.Time.After(until) {
+			until = row.LockedUntil.Time
+		}
+	}
+	if until.Before(time.Now()) {
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// recordLoginFailure counts a failure on each throttle and locks out those past their
+// free attempts.
+func recordLoginFailure(ctx context.Context, queries *db.Queries, throttles []loginThrottle) error {
+	now := time.Now()
+	err := queries.DeleteStaleLoginThrottles(ctx, now.Add(-loginConfig.FailureTTL))
+	if err != nil {
+		return errors.New("error deleting stale login throttles: " + err.Error())
+	}
+	for _, throttle := range throttles {
+		failures, err := queries.RecordLoginFailure(ctx, db.RecordLoginFailureParams{
+			Key:          throttle.key,
+			ForgetBefore: now.Add(-loginConfig.FailureTTL),
+		})
+		if err != nil {
+			return errors.New("error recording login failure: " + err.Error())
+		}
+		lockout := lockoutDuration(loginConfig, int64(failures), throttle.freeAttempts)
+		if lockout == 0 {
+			continue
+		}
+		err = queries.SetLoginLock(ctx, db.SetLoginLockParams{
+			Key:         throttle.key,
+			LockedUntil: sql.NullTime{Time: now.Add(lockout), Valid: true},
+		})
+		if err != nil {
+			return errors.New("error locking login: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// loginAttempt is who tries to log in, for login_attempts.
+type loginAttempt struct {
+	userId     sql.NullInt32
+	identifier string
+	ip         string
+}
+
+func recordLoginAttempt(ctx context.Context, queries *db.Queries, attempt loginAttempt, outcome string) {
+	err := queries.InsertLoginAttempt(ctx, db.InsertLoginAttemptParams{
+		UserID:     attempt.userId,
+		Identifier: attempt.identifier,
+		Ip:         attempt.ip,
+		Outcome:    outcome,
+	})
+	if err != nil {
+		log.Printf("error recording login attempt: %s\n", err)
+	}
+}
+
+// throttleLogin runs login unless a throttle is locked out, it then returns ErrLoginLocked
+// and the end of the lockout. login runs in the transaction holding the rows of the
+// throttles, so that the concurrent attempts wait for this one to be counted. The errors
+// for which failed is true are counted as failures with the outcome failure, the others
+// roll back the transaction and are returned as they are.
+func throttleLogin(attempt loginAttempt, throttles []loginThrottle, login func(queries *db.Queries) error, failed func(error) bool, failure string) (time.Time, error) {
+	ctx := context.Background()
+	var until time.Time
+	var loginErr error
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		var err error
+		until, err = lockThrottles(ctx, queries, throttles)
+		if err != nil {
+			return err
+		}
+		if !until.IsZero() {
+			recordLoginAttempt(ctx, queries, attempt, LoginLocked)
+			return nil
+		}
+
+		loginErr = login(queries)
+		if loginErr == nil {
+			recordLoginAttempt(ctx, queries, attempt, LoginSucceeded)
+			return nil
+		}
+		if !failed(loginErr) {
+			return loginErr
+		}
+		recordLoginAttempt(ctx, queries, attempt, failure)
+		return recordLoginFailure(ctx, queries, throttles)
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !until.IsZero() {
+		return until, ErrLoginLocked
+	}
+	return time.Time{}, loginErr
+}
+
+// forgetLoginFailures resets the count of the account once the user logged in.
+func forgetLoginFailures(ctx context.Context, queries *db.Queries, userId int32) error {
+	_, err := queries.DeleteLoginThrottle(ctx, accountThrottleKey(userId))
+	if err != nil {
+		return errors.New("error resetting login throttle: " + err.Error())
+	}
+	return nil
+}
+
+// invalidCredentials tells if the password login failed on the credentials, rather than
+// on the database.
+func invalidCredentials(err error) bool {
+	return err == ErrUserNotFound || err == ErrPasswordlessUser || err == ErrIncorrectPassword
+}
+
+// ThrottledPasswordLogin checks the password login from ip unless the account or the ip is
+// locked out, it then returns ErrLoginLocked and the end of the lockout. The count of the
+// account is only reset by the login, the second factor can still fail.
+func ThrottledPasswordLogin(loginInfo PasswordLogin, ip string) (*db.User, *db.RoleRow, time.Time, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	attempt := loginAttempt{identifier: loginInfo.UsernameOrEmail, ip: ip}
+	account := "login:" + strings.ToLower(loginInfo.UsernameOrEmail)
+	user, err := queries.UserByUsernameOrEmail(ctx, sql.NullString{String: loginInfo.UsernameOrEmail, Valid: true})
+	if err == nil {
+		attempt.userId = sql.NullInt32{Int32: user.ID, Valid: true}
+		account = accountThrottleKey(user.ID)
+	} else if err != pgx.ErrNoRows {
+		return nil, nil, time.Time{}, errors.New("error getting user: " + err.Error())
+	}
+
+	var loggedIn *db.User
+	var role *db.RoleRow
+	until, err := throttleLogin(attempt, loginThrottles(account, ip), func(queries *db.Queries) error {
+		var err error
+		loggedIn, role, err = userByLoginInfo(ctx, queries, loginInfo)
+		return err
+	}, invalidCredentials, LoginFailed)
+	if err != nil {
+		return nil, nil, until, err
+	}
+	return loggedIn, role, time.Time{}, nil
+}
+
+// UnlockAccount ends the lockout of the user and forgets their failed logins.
+func UnlockAccount(userId int32) error {
+	return forgetLoginFailures(context.Background(), db.New(db.Pool()), userId)
+}
+
+// LoginLockouts lists the accounts and ips locked out now.
+func LoginLockouts() ([]LoginLockout, error) {
+	rows, err := db.New(db.Pool()).LockedLoginThrottles(context.Background())
+	if err != nil {
+		return nil, errors.New("error getting login lockouts: " + err.Error())
+	}
+	lockouts := make([]LoginLockout, 0, len(rows))
+	for _, row := range rows {
+		lockouts = append(lockouts, LoginLockout{
+			Key:             row.Key,
+			Failures:        row.Failures,
+			DateLastFailure: row.DateLastFailure.UnixMicro(),
+			LockedUntil:     row.LockedUntil.Time.UnixMicro(),
+		})
+	}
+	return lockouts, nil
+}
+
+// UserLoginAttempts lists the last login attempts of the user, the latest first.
+func UserLoginAttempts(userId int32, limit int32) ([]LoginAttempt, error) {
+	rows, err := db.New(db.Pool()).UserLoginAttempts(context.Background(), db.UserLoginAttemptsParams{
+		UserID: sql.NullInt32{Int32: userId, Valid: true},
+		Limit:  limit,
+	})
+	if err != nil {
+		return nil, errors.New("error getting login attempts: " + err.Error())
+	}
+	attempts := make([]LoginAttempt, 0, len(rows))
+	for _, row := range rows {
+		attempts = append(attempts, LoginAttempt{
+			Identifier:  row.Identifier,
+			Ip:          row.Ip,
+			Outcome:     row.Outcome,
+			DateCreated: row.DateCreated.UnixMicro(),
+		})
+	}
+	return attempts, nil
+}
+
+func userIdParam(c *gin.Context) (int32, bool) {
+	var userId int32
+	_, err := fmt.Sscan(c.Param("userId"), &userId)
+	if err != nil {
+		ReportError(c, errors.New("invalid user id"), "error", http.StatusBadRequest)
+		return 0, false
+	}
+	return userId, true
+}
+
+func LoginLockoutsHandler(c *gin.Context) {
+	lockouts, err := LoginLockouts()
+	if err != nil {
+		ReportError(c, err, "error", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"lockouts": lockouts,
+	})
+}
+
+func UnlockAccountHandler(c *gin.Context) {
+	userId, ok := userIdParam(c)
+	if !ok {
+		return
+	}
+	err := UnlockAccount(userId)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusInternalServerError)
+		return
+	}
+	RecordAudit(c, AuditRecord{
+		Action:     UnlockAccountAudit,
+		TargetType: UserAuditTarget,
+		TargetId:   userId,
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "account unlocked",
+	})
+}
+
+func UserLoginAttemptsHandler(c *gin.Context) {
+	userId, ok := userIdParam(c)
+	if !ok {
+		return
+	}
+	limit := int32(50)
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 32)
+		if err != nil || parsed <= 0 || parsed > 500 {
+			ReportError(c, errors.New("invalid limit"), "error", http.StatusBadRequest)
+			return
+		}
+		limit = int32(parsed)
+	}
+	attempts, err := UserLoginAttempts(userId, limit)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"attempts": attempts,
+	})
+}
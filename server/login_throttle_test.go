@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	cfg := config.Login{Lockout: 30 * time.Second, MaxLockout: 5 * time.Minute}
+	expected := map[int64]time.Duration{
+		1:  0,
+		5:  0,
+		6:  30 * time.Second,
+		7:  time.Minute,
+		9:  4 * time.Minute,
+		10: 5 * time.Minute,
+		60: 5 * time.Minute,
+	}
+	for failures, lockout := range expected {
+		assert.Equal(t, lockout, lockoutDuration(cfg, failures, 5), failures)
+	}
+}
+
+func TestLockoutRetryAfter(t *testing.T) {
+	assert.Equal(t, "30", retryAfter(time.Now().Add(29500*time.Millisecond)))
+}
+
+func TestInvalidCredentials(t *testing.T) {
+	for _, err := range []error{ErrUserNotFound, ErrPasswordlessUser, ErrIncorrectPassword} {
+		assert.True(t, invalidCredentials(err), err.Error())
+	}
+	// the database failing doesn't lock the accounts out
+	assert.False(t, invalidCredentials(errors.New("error getting user: conn closed")))
+}
+
+func TestLoginLockout(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	oldConfig := loginConfig
+	loginConfig = config.Login{AccountAttempts: 2, IPAttempts: 100, Lockout: time.Minute, MaxLockout: time.Hour, FailureTTL: time.Hour}
+	defer func() {
+		loginConfig = oldConfig
+	}()
+
+	username, password := "testthrottleuser", "secretpw"
+	user, _, err := CreateAccount(username, password, "throttle@atest.com", MemberRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := "192.0.2.23"
+	defer func() {
+		_ = DeleteAccount(username)
+		_ = UnlockAccount(user.ID)
+		_, _ = db.New(db.Pool()).DeleteLoginThrottle(context.Background(), "ip:"+ip)
+	}()
+
+	wrong := PasswordLogin{UsernameOrEmail: username, Password: "wrongpw"}
+	right := PasswordLogin{UsernameOrEmail: username, Password: password}
+	for i := 0; i < 2; i++ {
+		_, _, _, err = ThrottledPasswordLogin(wrong, ip)
+		assert.NotNil(t, err)
+		assert.NotEqual(t, ErrLoginLocked, err)
+	}
+	// the right password doesn't reset the count of the account, the login does
+	_, _, _, err = ThrottledPasswordLogin(right, ip)
+	assert.Nil(t, err)
+	assert.Nil(t, forgetLoginFailures(context.Background(), db.New(db.Pool()), user.ID))
+	for i := 0; i < 3; i++ {
+		_, _, _, err = ThrottledPasswordLogin(wrong, ip)
+		assert.NotEqual(t, ErrLoginLocked, err)
+	}
+
+	// the right password is refused during the lockout, from any ip
+	_, _, until, err := ThrottledPasswordLogin(right, "192.0.2.24")
+	assert.Equal(t, ErrLoginLocked, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), until, 5*time.Second)
+
+	lockouts, err := LoginLockouts()
+	assert.Nil(t, err)
+	assert.Contains(t, lockoutKeys(lockouts), accountThrottleKey(user.ID))
+
+	assert.Nil(t, UnlockAccount(user.ID))
+	_, _, _, err = ThrottledPasswordLogin(right, ip)
+	assert.Nil(t, err)
+
+	attempts, err := UserLoginAttempts(user.ID, 3)
+	assert.Nil(t, err)
+	if assert.Len(t, attempts, 3) {
+		assert.Equal(t, LoginSucceeded, attempts[0].Outcome)
+		assert.Equal(t, LoginLocked, attempts[1].Outcome)
+		assert.Equal(t, LoginFailed, attempts[2].Outcome)
+		assert.Equal(t, ip, attempts[2].Ip)
+	}
+}
+
+func lockoutKeys(lockouts []LoginLockout) []string {
+	keys := make([]string, 0, len(lockouts))
+	for _, lockout := range lockouts {
+		keys = append(keys, lockout.Key)
+	}
+	return keys
+}
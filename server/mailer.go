@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dqhieuu/novo-app/config"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Email is a plain text email to a single recipient.
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the emails of the accounts, the verification and password reset links.
+type Mailer interface {
+	Send(ctx context.Context, email Email) error
+}
+
+const (
+	FileMailerType = config.FileMailer
+	SMTPMailerType = config.SMTPMailer
+)
+
+var ErrInvalidRecipient = errors.New("invalid email recipient")
+
+var mailer Mailer
+
+// mailConfig is what the emails are made with: the sender, the client the links open and
+// how long they work.
+var mailConfig = config.Default().Mail
+
+// InitMail sets up the mailer.
+func InitMail(cfg *config.Config) {
+	mailConfig = cfg.Mail
+	if mailer != nil {
+		return
+	}
+
+	switch cfg.Mail.Mailer {
+	case FileMailerType:
+		mailer = NewFileMailer(cfg.Mail.Folder, cfg.Mail.From)
+	case SMTPMailerType:
+		mailer = NewSMTPMailer(cfg.Mail.SMTP.Address, cfg.Mail.SMTP.Username, cfg.Mail.SMTP.Password.Value(), cfg.Mail.From)
+	default:
+		log.Fatalf("unsupported mailer: %s\n", cfg.Mail.Mailer)
+	}
+}
+
+// MailSender returns the configured mailer, falling back to logging the emails when
+// InitMail has not been called (e.g. in tests).
+func MailSender() Mailer {
+	if mailer == nil {
+		mailer = NewFileMailer("", mailConfig.From)
+	}
+	return mailer
+}
+
+func SetMailer(m Mailer) {
+	mailer = m
+}
+
+// formatEmail renders the email as a message of RFC 5322. The recipient must be a single
+// address, so that it can't add headers.
+func formatEmail(from string, email Email, date time.Time) ([]byte, error) {
+	to, err := mail.ParseAddress(email.To)
+	if err != nil || strings.ContainsAny(email.To, "\r\n") {
+		return nil, ErrInvalidRecipient
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", to.String())
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(email.Body, "\n", "\r\n"))
+	return message.Bytes(), nil
+}
+
+// FileMailer writes the emails to a folder, or to the log when the folder is empty, so the
+// links can be opened without a mail server.
+type FileMailer struct {
+	Folder string
+	From   string
+}
+
+func NewFileMailer(folder, from string) *FileMailer {
+	return &FileMailer{Folder: folder, From: from}
+}
+
+func (m *FileMailer) Send(_ context.Context, email Email) error {
+	message, err := formatEmail(m.From, email, time.Now())
+	if err != nil {
+		return err
+	}
+	if m.Folder == "" {
+		log.Printf("email to %s:\n%s\n", email.To, message)
+		return nil
+	}
+
+	err = os.MkdirAll(m.Folder, 0755)
+	if err != nil {
+		return errors.New("error creating mail folder: " + err.Error())
+	}
+	suffix, err := randomToken()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), suffix[:8])
+	err = ioutil.WriteFile(filepath.Join(m.Folder, name), message, 0644)
+	if err != nil {
+		return errors.New("error writing email: " + err.Error())
+	}
+	return nil
+}
+
+// SMTPMailer sends the emails through an SMTP server, with STARTTLS when it offers it.
+type SMTPMailer struct {
+	Address string
+	From    string
+	auth    smtp.Auth
+}
+
+func NewSMTPMailer(address, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{Address: address, From: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(address)
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(_ context.Context, email Email) error {
+	message, err := formatEmail(m.From, email, time.Now())
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return errors.New("invalid email sender: " + err.Error())
+	}
+	to, _ := mail.ParseAddress(email.To)
+
+	err = smtp.SendMail(m.Address, m.auth, from.Address, []string{to.Address}, message)
+	if err != nil {
+		return errors.New("error sending email: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatEmail(t *testing.T) {
+	date := time.Date(2021, 11, 20, 10, 0, 0, 0, time.UTC)
+	message, err := formatEmail("Novo <no-reply@novoapp.tech>", Email{
+		To:      "reader@atest.com",
+		Subject: "Đặt lại mật khẩu",
+		Body:    "line 1\nline 2",
+	}, date)
+	assert.Nil(t, err)
+	text := string(message)
+	assert.True(t, strings.HasPrefix(text, "From: Novo <no-reply@novoapp.tech>\r\nTo: <reader@atest.com>\r\n"))
+	assert.Contains(t, text, "Subject: =?utf-8?q?")
+	assert.Contains(t, text, "Date: Sat, 20 Nov 2021 10:00:00 +0000\r\n")
+	assert.True(t, strings.HasSuffix(text, "\r\n\r\nline 1\r\nline 2"))
+
+	for _, to := range []string{"not an email", "reader@atest.com\r\nBcc: everyone@atest.com", "a@atest.com, b@atest.com"} {
+		_, err = formatEmail("no-reply@novoapp.tech", Email{To: to, Subject: "hi"}, date)
+		assert.Equal(t, ErrInvalidRecipient, err, to)
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	folder := t.TempDir()
+	err := NewFileMailer(folder, "no-reply@novoapp.tech").Send(context.Background(), Email{
+		To:      "reader@atest.com",
+		Subject: "hello",
+		Body:    "the link",
+	})
+	assert.Nil(t, err)
+
+	files, _ := filepath.Glob(filepath.Join(folder, "*.eml"))
+	assert.Len(t, files, 1)
+	message, _ := ioutil.ReadFile(files[0])
+	assert.Contains(t, string(message), "To: <reader@atest.com>")
+	assert.Contains(t, string(message), "the link")
+}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Hypertext chapters are stored as the Markdown the editor writes, and the reader renders it
+// without raw html. The text is kept as it is; what is checked are the targets of the images
+// and links, found the way CommonMark does: inline ("![alt](target)", "[text](target)"),
+// autolinks ("<https://...>") and reference definitions ("[id]: target"). Code spans and
+// fenced code blocks are skipped, they are rendered as text.
+
+type markdownTarget struct {
+	image       bool
+	destination string
+	// start and end are the offsets of the destination in the content
+	start, end int
+}
+
+type markdownOpener struct {
+	position int
+	image    bool
+}
+
+var (
+	markdownFence      = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})")
+	markdownDefinition = regexp.MustCompile(`^ {0,3}\[((?:[^\]\\]|\\.)+)\]:[ \t]*(<[^>\n]*>|\S+)`)
+	markdownAutolink   = regexp.MustCompile(`^<([a-zA-Z][a-zA-Z0-9+.\-]{1,31}:[^\s<>]*)>`)
+)
+
+// maskMarkdownCode blanks the fenced code blocks, keeping the offsets of the rest.
+func maskMarkdownCode(content string) string {
+	masked := []byte(content)
+	fence := ""
+	offset := 0
+	for _, line := range strings.SplitAfter(content, "\n") {
+		match := markdownFence.FindStringSubmatch(line)
+		inFence := fence != ""
+		switch {
+		case !inFence && match != nil:
+			fence = match[1]
+			inFence = true
+		case inFence && match != nil && match[1][0] == fence[0] && len(match[1]) >= len(fence) &&
+			strings.TrimSpace(line[len(match[0]):]) == "":
+			fence = ""
+		}
+		if inFence {
+			blank(masked, offset, offset+len(line))
+		}
+		offset += len(line)
+	}
+	return string(masked)
+}
+
+func blank(text []byte, start, end int) {
+	for i := start; i < end; i++ {
+		if text[i] != '\n' {
+			text[i] = ' '
+		}
+	}
+}
+
+// normalizeMarkdownLabel matches the labels of references case and whitespace insensitively.
+func normalizeMarkdownLabel(label string) string {
+	return strings.ToLower(strings.Join(strings.Fields(label), " "))
+}
+
+// markdownDestination returns the end of the inline link destination starting at start, and
+// the offsets of the destination itself, without its angle brackets.
+func markdownDestination(text string, start int) (int, int, bool) {
+	i := start
+	for i < len(text) && (text[i] == ' ' || text[i] == '\t' || text[i] == '\n') {
+		i++
+	}
+	if i < len(text) && text[i] == '<' {
+		end := strings.IndexAny(text[i+1:], ">\n")
+		if end < 0 || text[i+1+end] != '>' {
+			return 0, 0, false
+		}
+		return i + 1, i + 1 + end, true
+	}
+	begin, depth := i, 0
+	for ; i < len(text); i++ {
+		char := text[i]
+		if char <= ' ' {
+			break
+		}
+		if char == '\\' && i+1 < len(text) {
+			i++
+			continue
+		}
+		if char == '(' {
+			depth++
+		}
+		if char == ')' {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+	}
+	return begin, i, true
+}
+
+// markdownTargets lists the images and links of the Markdown with their destinations.
+func markdownTargets(content string) []markdownTarget {
+	text := maskMarkdownCode(content)
+
+	// the reference definitions, masked so their labels aren't taken for links
+	definitions := map[string]markdownTarget{}
+	masked := []byte(text)
+	offset := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if match := markdownDefinition.FindStringSubmatchIndex(line); match != nil {
+			start, end := match[4], match[5]
+			if line[start] == '<' {
+				start, end = start+1, end-1
+			}
+			label := normalizeMarkdownLabel(line[match[2]:match[3]])
+			if _, ok := definitions[label]; !ok {
+				definitions[label] = markdownTarget{
+					destination: line[start:end],
+					start:       offset + start,
+					end:         offset + end,
+				}
+			}
+			blank(masked, offset, offset+len(line))
+		}
+		offset += len(line)
+	}
+	text = string(masked)
+
+	var targets []markdownTarget
+	reference := func(label string, image bool) {
+		if definition, ok := definitions[normalizeMarkdownLabel(label)]; ok {
+			definition.image = image
+			targets = append(targets, definition)
+		}
+	}
+	var openers []markdownOpener
+	for i := 0; i < len(text); {
+		switch {
+		case text[i] == '\\':
+			i += 2
+		case text[i] == '`':
+			run := i
+			for run < len(text) && text[run] == '`' {
+				run++
+			}
+			ticks := text[i:run]
+			closing := strings.Index(text[run:], ticks)
+			for closing >= 0 && run+closing+len(ticks) < len(text) && text[run+closing+len(ticks)] == '`' {
+				next := strings.Index(text[run+closing+len(ticks)+1:], ticks)
+				if next < 0 {
+					closing = -1
+					break
+				}
+				closing += len(ticks) + 1 + next
+			}
+			if closing < 0 {
+				i = run
+			} else {
+				i = run + closing + len(ticks)
+			}
+		case text[i] == '<':
+			if match := markdownAutolink.FindStringSubmatchIndex(text[i:]); match != nil {
+				targets = append(targets, markdownTarget{
+					destination: text[i+match[2] : i+match[3]],
+					start:       i + match[2],
+					end:         i + match[3],
+				})
+				i += match[1]
+			} else {
+				i++
+			}
+		case text[i] == '!' && i+1 < len(text) && text[i+1] == '[':
+			openers = append(openers, markdownOpener{position: i + 2, image: true})
+			i += 2
+		case text[i] == '[':
+			openers = append(openers, markdownOpener{position: i + 1})
+			i++
+		case text[i] == ']' && len(openers) > 0:
+			opener := openers[len(openers)-1]
+			openers = openers[:len(openers)-1]
+			label := text[opener.position:i]
+			i++
+			switch {
+			case i < len(text) && text[i] == '(':
+				start, end, ok := markdownDestination(text, i+1)
+				if !ok {
+					continue
+				}
+				targets = append(targets, markdownTarget{
+					image:       opener.image,
+					destination: text[start:end],
+					start:       start,
+					end:         end,
+				})
+				i = end
+			case i < len(text) && text[i] == '[':
+				closing := strings.IndexByte(text[i+1:], ']')
+				if closing < 0 {
+					continue
+				}
+				if closing > 0 {
+					label = text[i+1 : i+1+closing]
+				}
+				reference(label, opener.image)
+				i += closing + 2
+			default:
+				reference(label, opener.image)
+			}
+		default:
+			i++
+		}
+	}
+	return targets
+}
+
+// CheckChapterContent checks the Markdown of a hypertext chapter before it is stored: images
+// must be served by /image, and links go to http, https or mailto urls. It returns the
+// content with the image paths cleaned, the rejected targets so the uploader can be told,
+// and the storage keys of the images, which the chapter keeps from the image gc.
+// The images at publicUrl are taken for their /image path.
+func CheckChapterContent(content, publicUrl string) (string, []string, []string) {
+	return checkChapterContent(content, publicUrl, false)
+}
+
+// checkChapterContent is CheckChapterContent, dropRejected empties the rejected targets too,
+// for the chapters already stored.
+func checkChapterContent(content, publicUrl string, dropRejected bool) (string, []string, []string) {
+	rejected := make([]string, 0)
+	imageKeys := make([]string, 0)
+	reject := func(format, destination string) {
+		message := fmt.Sprintf(format, destination)
+		for _, existing := range rejected {
+			if existing == message {
+				return
+			}
+		}
+		rejected = append(rejected, message)
+	}
+
+	// the destinations to clean, by offset since a definition can be used by several images
+	cleanedSrc := map[int]markdownTarget{}
+	drop := func(target markdownTarget) {
+		if dropRejected {
+			target.destination = ""
+			cleanedSrc[target.start] = target
+		}
+	}
+	for _, target := range markdownTargets(content) {
+		if !target.image {
+			if !allowedLink(target.destination) {
+				reject("link to %q", target.destination)
+				drop(target)
+			}
+			continue
+		}
+		src, key, ok := chapterImageSrc(target.destination, publicUrl)
+		if !ok {
+			reject("image %q", target.destination)
+			drop(target)
+			continue
+		}
+		if !containsString(imageKeys, key) {
+			imageKeys = append(imageKeys, key)
+		}
+		if src != target.destination {
+			target.destination = src
+			cleanedSrc[target.start] = target
+		}
+	}
+
+	targets := make([]markdownTarget, 0, len(cleanedSrc))
+	for _, target := range cleanedSrc {
+		targets = append(targets, target)
+	}
+	// from the end, so that the offsets before stay right
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].start > targets[j].start
+	})
+	cleaned := content
+	for _, target := range targets {
+		cleaned = cleaned[:target.start] + target.destination + cleaned[target.end:]
+	}
+	return cleaned, rejected, imageKeys
+}
+
+type CheckedChapter struct {
+	Id       int32    `json:"id"`
+	Rejected []string `json:"rejected"`
+}
+
+// CheckExistingChapters checks the hypertext chapters stored before their content was
+// checked on write: the image paths are cleaned, the rejected targets emptied, and the
+// embedded images kept from the image gc. It returns the chapters that changed, a dry run
+// doesn't update them.
+func CheckExistingChapters(cfg config.Images, dryRun bool) ([]CheckedChapter, error) {
+	ctx := context.Background()
+	chapters, err := db.New(db.Pool()).HypertextChapters(ctx)
+	if err != nil {
+		return nil, errors.New("error getting hypertext chapters: " + err.Error())
+	}
+
+	changed := make([]CheckedChapter, 0)
+	for _, chapter := range chapters {
+		cleaned, rejected, imageKeys := checkChapterContent(chapter.TextContent.String, publicImageUrl(cfg), true)
+		if cleaned != chapter.TextContent.String {
+			changed = append(changed, CheckedChapter{Id: chapter.ID, Rejected: rejected})
+		}
+		if dryRun {
+			continue
+		}
+		err = RunInTx(ctx, func(queries *db.Queries) error {
+			if cleaned != chapter.TextContent.String {
+				err := queries.UpdateBookChapterTextContent(ctx, db.UpdateBookChapterTextContentParams{
+					ID:          chapter.ID,
+					TextContent: sql.NullString{String: cleaned, Valid: true},
+				})
+				if err != nil {
+					return err
+				}
+			}
+			if len(imageKeys) == 0 {
+				return nil
+			}
+			_, err := queries.SubmitTempImagesByPath(ctx, imageKeys)
+			return err
+		})
+		if err != nil {
+			return changed, fmt.Errorf("error updating chapter %d: %s", chapter.ID, err)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCheckChapterContent(t *testing.T) {
+	// the Markdown is stored as it was written
+	content := "> a quote, \"quoted\" & it's fine\n\n" +
+		"Some `a<b` code, then **bold** and <https://example.com/x>.\n\n" +
+		"![cover](/image/a.png?w=256&x=1) and [a link](https://example.com \"title\")\n\n" +
+		"```\n![not an image](https://evil.com/a.png)\n```\n"
+	cleaned, rejected, imageKeys := CheckChapterContent(content, "")
+	assert.Empty(t, rejected)
+	assert.Equal(t, []string{"a.png"}, imageKeys)
+	assert.Equal(t, "> a quote, \"quoted\" & it's fine\n\n"+
+		"Some `a<b` code, then **bold** and <https://example.com/x>.\n\n"+
+		"![cover](/image/a.png?w=256) and [a link](https://example.com \"title\")\n\n"+
+		"```\n![not an image](https://evil.com/a.png)\n```\n", cleaned)
+
+	// cleaning again doesn't change anything
+	again, _, _ := CheckChapterContent(cleaned, "")
+	assert.Equal(t, cleaned, again)
+}
+
+func TestCheckChapterContentRejected(t *testing.T) {
+	_, rejected, _ := CheckChapterContent("![x](https://evil.com/a.png) [y](javascript:alert(1)) "+
+		"<javascript:alert(2)> [![ok](/image/a.png)](data:text/html,x)", "")
+	assert.Equal(t, []string{
+		`image "https://evil.com/a.png"`,
+		`link to "javascript:alert(1)"`,
+		`link to "javascript:alert(2)"`,
+		`link to "data:text/html,x"`,
+	}, rejected)
+
+	// the references are followed to their definition
+	_, rejected, _ = CheckChapterContent("![x][evil] and ![Local]\n\n[evil]: <https://evil.com/b.png>\n[local]: /image/b.png\n", "")
+	assert.Equal(t, []string{`image "https://evil.com/b.png"`}, rejected)
+
+	// a link to a definition is only checked as a link
+	_, rejected, _ = CheckChapterContent("[x][site]\n\n[site]: https://example.com\n", "")
+	assert.Empty(t, rejected)
+}
+
+func TestCheckChapterContentDropRejected(t *testing.T) {
+	content := "![x](https://evil.com/a.png) [y](javascript:alert(1)) <javascript:alert(2)> " +
+		"![ok](/image/a.png?w=256&x=1)\n\n[evil]: https://evil.com/b.png\n"
+	cleaned, rejected, imageKeys := checkChapterContent(content, "", true)
+	assert.Len(t, rejected, 3)
+	assert.Equal(t, []string{"a.png"}, imageKeys)
+	assert.Equal(t, "![x]() [y]() <> ![ok](/image/a.png?w=256)\n\n[evil]: https://evil.com/b.png\n", cleaned)
+
+	// the emptied targets stay as they are
+	again, _, _ := checkChapterContent(cleaned, "", true)
+	assert.Equal(t, cleaned, again)
+}
+
+func TestCheckExistingChapters(t *testing.T) {
+	db.Init()
+	defer db.Close()
+	createData()
+	defer removeData()
+
+	content := "[y](javascript:alert(1)) ![ok](/image/a.png?x=1)\n"
+	chapter, err := CreateBookChapter(1, "", content, "hypertext", bookGroups[0].ID, users[0].ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = db.New(db.Pool()).DeleteBookChapterById(context.Background(), chapter.ID)
+	}()
+	cfg := config.Default().Images
+
+	changed, err := CheckExistingChapters(cfg, true)
+	assert.Nil(t, err)
+	assert.Contains(t, changed, CheckedChapter{Id: chapter.ID, Rejected: []string{`link to "javascript:alert(1)"`}})
+	stored, _ := BookChapterById(chapter.ID)
+	assert.Equal(t, content, stored.TextContent.String, "A dry run should not update the chapters")
+
+	_, err = CheckExistingChapters(cfg, false)
+	assert.Nil(t, err)
+	stored, _ = BookChapterById(chapter.ID)
+	assert.Equal(t, "[y]() ![ok](/image/a.png)\n", stored.TextContent.String)
+
+	changed, err = CheckExistingChapters(cfg, true)
+	assert.Nil(t, err)
+	for _, checked := range changed {
+		assert.NotEqual(t, chapter.ID, checked.Id)
+	}
+}
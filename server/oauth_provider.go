@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dqhieuu/novo-app/config"
+	"golang.org/x/oauth2"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// OauthIdentity is the account of a user at a provider.
+type OauthIdentity struct {
+	// Subject identifies the account at the provider, it never changes.
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// OauthProvider is a service users log in with. The login gets through the browser of the
+// user with AuthCodeURL, then the code the provider sends back is traded with Identity.
+type OauthProvider interface {
+	AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error)
+	Identity(ctx context.Context, code, nonce, verifier string) (*OauthIdentity, error)
+}
+
+var ErrUnknownProvider = errors.New("unsupported provider")
+
+// oauthProviders are the enabled providers by name.
+var oauthProviders = make(map[string]OauthProvider)
+
+const (
+	GoogleProvider   = "google"
+	GitHubProvider   = "github"
+	FacebookProvider = "facebook"
+)
+
+var (
+	githubEndpoint = oauth2.Endpoint{
+		AuthURL:  "https://github.com/login/oauth/authorize",
+		TokenURL: "https://github.com/login/oauth/access_token",
+	}
+	githubApiURL     = "https://api.github.com"
+	facebookEndpoint = oauth2.Endpoint{
+		AuthURL:  "https://www.facebook.com/v12.0/dialog/oauth",
+		TokenURL: "https://graph.facebook.com/v12.0/oauth/access_token",
+	}
+	facebookGraphURL = "https://graph.facebook.com/v12.0"
+)
+
+const googleIssuer = "https://accounts.google.com"
+
+// InitOauth enables the providers with a client id.
+func InitOauth(cfg *config.Config) {
+	if cfg.Google.ClientID != "" {
+		oauthProviders[GoogleProvider] = NewOidcProvider(cfg.Google.ClientID, cfg.Google.ClientSecret.Value(),
+			cfg.Google.RedirectURL, googleIssuer, nil)
+	}
+	if cfg.GitHub.ClientID != "" {
+		oauthProviders[GitHubProvider] = NewGitHubProvider(cfg.GitHub.ClientID, cfg.GitHub.ClientSecret.Value(),
+			cfg.GitHub.RedirectURL, githubEndpoint, githubApiURL)
+	}
+	if cfg.Facebook.ClientID != "" {
+		oauthProviders[FacebookProvider] = NewFacebookProvider(cfg.Facebook.ClientID, cfg.Facebook.ClientSecret.Value(),
+			cfg.Facebook.RedirectURL, facebookEndpoint, facebookGraphURL)
+	}
+	for _, provider := range cfg.Oidc {
+		oauthProviders[provider.Name] = NewOidcProvider(provider.ClientID, provider.ClientSecret.Value(),
+			provider.RedirectURL, provider.Issuer, provider.Scopes)
+	}
+}
+
+// pkceChallenge is the S256 code challenge of the verifier.
+func pkceChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func pkceAuthParams(verifier string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+}
+
+// getJSON reads the JSON answer of url into value.
+func getJSON(client *http.Client, url string, value interface{}) error {
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s answered %d: %s", url, response.StatusCode, body)
+	}
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+// oauth2Provider logs in with plain OAuth 2, the identity is read from an api of the provider.
+type oauth2Provider struct {
+	config   *oauth2.Config
+	identity func(client *http.Client) (*OauthIdentity, error)
+}
+
+func (p *oauth2Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	return p.config.AuthCodeURL(state, pkceAuthParams(verifier)...), nil
+}
+
+func (p *oauth2Provider) Identity(ctx context.Context, code, nonce, verifier string) (*OauthIdentity, error) {
+	token, err := p.config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		return nil, errors.New("error exchanging oauth code: " + err.Error())
+	}
+	identity, err := p.identity(p.config.Client(ctx, token))
+	if err != nil {
+		return nil, errors.New("error getting oauth identity: " + err.Error())
+	}
+	return identity, nil
+}
+
+func NewGitHubProvider(clientId, clientSecret, redirectUrl string, endpoint oauth2.Endpoint, apiUrl string) OauthProvider {
+	return &oauth2Provider{
+		config: &oauth2.Config{
+			ClientID:     clientId,
+			ClientSecret: clientSecret,
+			Endpoint:     endpoint,
+			RedirectURL:  redirectUrl,
+			Scopes:       []string{"read:user", "user:email"},
+		},
+		identity: func(client *http.Client) (*OauthIdentity, error) {
+			var user struct {
+				Id int64 `json:"id"`
+			}
+			err := getJSON(client, apiUrl+"/user", &user)
+			if err != nil {
+				return nil, err
+			}
+			// the public email of the profile may be unverified, the primary one of the list isn't
+			var emails []struct {
+				Email    string `json:"email"`
+				Primary  bool   `json:"primary"`
+				Verified bool   `json:"verified"`
+			}
+			err = getJSON(client, apiUrl+"/user/emails", &emails)
+			if err != nil {
+				return nil, err
+			}
+			identity := &OauthIdentity{Subject: strconv.FormatInt(user.Id, 10)}
+			for _, email := range emails {
+				if email.Primary {
+					identity.Email, identity.EmailVerified = email.Email, email.Verified
+				}
+			}
+			return identity, nil
+		},
+	}
+}
+
+func NewFacebookProvider(clientId, clientSecret, redirectUrl string, endpoint oauth2.Endpoint, graphUrl string) OauthProvider {
+	return &oauth2Provider{
+		config: &oauth2.Config{
+			ClientID:     clientId,
+			ClientSecret: clientSecret,
+			Endpoint:     endpoint,
+			RedirectURL:  redirectUrl,
+			Scopes:       []string{"email"},
+		},
+		identity: func(client *http.Client) (*OauthIdentity, error) {
+			var user struct {
+				Id    string `json:"id"`
+				Email string `json:"email"`
+			}
+			err := getJSON(client, graphUrl+"/me?fields=id,email", &user)
+			if err != nil {
+				return nil, err
+			}
+			// facebook only gives the confirmed emails
+			return &OauthIdentity{Subject: user.Id, Email: user.Email, EmailVerified: user.Email != ""}, nil
+		},
+	}
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	gojwt "github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcKeysRefresh is the shortest time between two reads of the keys of an issuer, an
+// unknown key id is only looked up again after it.
+const oidcKeysRefresh = time.Minute
+
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// oidcProvider logs in with an OpenID Connect issuer, the identity is the id token. The
+// endpoints are discovered on first use, so an issuer down at startup only fails its logins.
+type oidcProvider struct {
+	issuer string
+	config oauth2.Config
+
+	mutex      sync.Mutex
+	discovery  *oidcDiscovery
+	keys       map[string]interface{}
+	keysLoaded time.Time
+}
+
+func NewOidcProvider(clientId, clientSecret, redirectUrl, issuer string, scopes []string) OauthProvider {
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+	return &oidcProvider{
+		issuer: strings.TrimSuffix(issuer, "/"),
+		config: oauth2.Config{
+			ClientID:     clientId,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectUrl,
+			Scopes:       scopes,
+		},
+	}
+}
+
+// discover returns the oauth config of the issuer, with its endpoints.
+func (p *oidcProvider) discover(ctx context.Context) (*oauth2.Config, *oidcDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.discovery == nil {
+		var discovery oidcDiscovery
+		err := getJSON(oauth2.NewClient(ctx, nil), p.issuer+"/.well-known/openid-configuration", &discovery)
+		if err != nil {
+			return nil, nil, errors.New("error discovering oidc issuer: " + err.Error())
+		}
+		if strings.TrimSuffix(discovery.Issuer, "/") != p.issuer {
+			return nil, nil, fmt.Errorf("oidc issuer %s announces itself as %s", p.issuer, discovery.Issuer)
+		}
+		if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksURI == "" {
+			return nil, nil, fmt.Errorf("oidc issuer %s lacks an endpoint", p.issuer)
+		}
+		p.discovery = &discovery
+		p.config.Endpoint = oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		}
+	}
+	config := p.config
+	return &config, p.discovery, nil
+}
+
+func (p *oidcProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	config, _, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	options := append(pkceAuthParams(verifier), oauth2.SetAuthURLParam("nonce", nonce))
+	return config.AuthCodeURL(state, options...), nil
+}
+
+func (p *oidcProvider) Identity(ctx context.Context, code, nonce, verifier string) (*OauthIdentity, error) {
+	config, discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", verifier))
+	if err != nil {
+		return nil, errors.New("error exchanging oauth code: " + err.Error())
+	}
+	idToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("oidc issuer gave no id token")
+	}
+	claims, err := p.verify(ctx, discovery, idToken, nonce)
+	if err != nil {
+		return nil, errors.New("invalid id token: " + err.Error())
+	}
+
+	identity := &OauthIdentity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	if identity.Subject == "" {
+		return nil, errors.New("invalid id token: no subject")
+	}
+	return identity, nil
+}
+
+// verify checks the signature of the id token with the keys of the issuer, then that it
+// was issued by it for this client and this login.
+func (p *oidcProvider) verify(ctx context.Context, discovery *oidcDiscovery, idToken, nonce string) (gojwt.MapClaims, error) {
+	claims := gojwt.MapClaims{}
+	parser := gojwt.Parser{ValidMethods: oidcSigningMethods}
+	_, err := parser.ParseWithClaims(idToken, claims, func(token *gojwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, discovery.JwksURI, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !claims.VerifyIssuer(discovery.Issuer, true) {
+		return nil, errors.New("wrong issuer")
+	}
+	if !claims.VerifyAudience(p.config.ClientID, true) {
+		return nil, errors.New("wrong audience")
+	}
+	if !claims.VerifyExpiresAt(gojwt.TimeFunc().Unix(), true) {
+		return nil, errors.New("expired")
+	}
+	if claimedNonce, _ := claims["nonce"].(string); claimedNonce != nonce {
+		return nil, errors.New("wrong nonce")
+	}
+	return claims, nil
+}
+
+// key returns the public key kid of the issuer. Without kid, the issuer must have only one key.
+func (p *oidcProvider) key(ctx context.Context, jwksUri, kid string) (interface{}, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key, ok := p.keys[kid]
+	if !ok && time.Since(p.keysLoaded) >= oidcKeysRefresh {
+		var jwks struct {
+			Keys []jsonWebKey `json:"keys"`
+		}
+		err := getJSON(oauth2.NewClient(ctx, nil), jwksUri, &jwks)
+		if err != nil {
+			return nil, errors.New("error getting oidc keys: " + err.Error())
+		}
+		p.keys = make(map[string]interface{})
+		for _, jwk := range jwks.Keys {
+			if parsed, err := jwk.publicKey(); err == nil {
+				p.keys[jwk.Kid] = parsed
+			}
+		}
+		p.keysLoaded = time.Now()
+		key, ok = p.keys[kid]
+	}
+	if !ok && kid == "" && len(p.keys) == 1 {
+		for _, key = range p.keys {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return key, nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := func(value string) (*big.Int, error) {
+		bytes, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(bytes), nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/dqhieuu/novo-app/db"
+	gojwt "github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	mockClientId     = "novo"
+	mockClientSecret = "novo-secret"
+	mockRedirectURL  = "https://novoapp.tech/?provider=mock"
+)
+
+type mockAuthorization struct {
+	challenge string
+	nonce     string
+}
+
+// mockOidcServer is an OpenID Connect issuer for the tests. The users it logs in are
+// the claims in user, the id tokens can be tampered with through tamper.
+type mockOidcServer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	user   gojwt.MapClaims
+	tamper func(claims gojwt.MapClaims, token *gojwt.Token)
+
+	mutex sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+func newMockOidcServer(t *testing.T) *mockOidcServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := &mockOidcServer{
+		key:   key,
+		user:  gojwt.MapClaims{"sub": "mock-1", "email": "oidc@atest.com", "email_verified": true},
+		codes: make(map[string]mockAuthorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                mock.URL,
+			AuthorizationEndpoint: mock.URL + "/authorize",
+			TokenEndpoint:         mock.URL + "/token",
+			JwksURI:               mock.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		encode := func(value *big.Int) string {
+			return base64.RawURLEncoding.EncodeToString(value.Bytes())
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {{
+			Kty: "RSA",
+			Kid: "mock-key",
+			N:   encode(key.N),
+			E:   encode(big.NewInt(int64(key.E))),
+		}}})
+	})
+	// the user is logged in at once, and sent back with the code
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("client_id") != mockClientId || query.Get("code_challenge_method") != "S256" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		code, _ := randomToken()
+		mock.mutex.Lock()
+		mock.codes[code] = mockAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+		mock.mutex.Unlock()
+		redirect, _ := url.Parse(query.Get("redirect_uri"))
+		values := redirect.Query()
+		values.Set("code", code)
+		values.Set("state", query.Get("state"))
+		redirect.RawQuery = values.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientId, clientSecret, _ := r.BasicAuth()
+		if clientId == "" {
+			clientId, clientSecret = r.FormValue("client_id"), r.FormValue("client_secret")
+		}
+		mock.mutex.Lock()
+		authorization, ok := mock.codes[r.FormValue("code")]
+		delete(mock.codes, r.FormValue("code"))
+		mock.mutex.Unlock()
+		if !ok || clientId != mockClientId || clientSecret != mockClientSecret ||
+			pkceChallenge(r.FormValue("code_verifier")) != authorization.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+
+		claims := gojwt.MapClaims{
+			"iss":   mock.URL,
+			"aud":   mockClientId,
+			"exp":   time.Now().Add(time.Minute).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": authorization.nonce,
+		}
+		for name, value := range mock.user {
+			claims[name] = value
+		}
+		token := gojwt.NewWithClaims(gojwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "mock-key"
+		signingKey := mock.key
+		if mock.tamper != nil {
+			mock.tamper(claims, token)
+			if other, ok := token.Header["signingKey"].(*rsa.PrivateKey); ok {
+				delete(token.Header, "signingKey")
+				signingKey = other
+			}
+		}
+		idToken, err := token.SignedString(signingKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "mock-access-token",
+			"token_type":   "Bearer",
+			"id_token":     idToken,
+		})
+	})
+	mock.Server = httptest.NewServer(mux)
+	t.Cleanup(mock.Close)
+	return mock
+}
+
+// authorize follows the login at the provider like a browser, and returns the code and
+// the state the provider sends back to the redirect url.
+func authorize(t *testing.T, authUrl string) (string, string) {
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := client.Get(authUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("authorize answered %d", response.StatusCode)
+	}
+	location, err := url.Parse(response.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Host != "novoapp.tech" || location.Query().Get("provider") != "mock" {
+		t.Fatalf("redirected to %s", location)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestOidcProvider(t *testing.T) {
+	mock := newMockOidcServer(t)
+	ctx := context.Background()
+	provider := NewOidcProvider(mockClientId, mockClientSecret, mockRedirectURL, mock.URL, nil)
+
+	login := func(nonce, verifier string) (*OauthIdentity, error) {
+		authUrl, err := provider.AuthCodeURL(ctx, "state", "nonce", "verifier")
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, _ := url.Parse(authUrl)
+		assert.Equal(t, "openid email profile", parsed.Query().Get("scope"))
+		assert.Equal(t, pkceChallenge("verifier"), parsed.Query().Get("code_challenge"))
+
+		code, state := authorize(t, authUrl)
+		assert.Equal(t, "state", state)
+		return provider.Identity(ctx, code, nonce, verifier)
+	}
+
+	identity, err := login("nonce", "verifier")
+	assert.Nil(t, err)
+	assert.Equal(t, &OauthIdentity{Subject: "mock-1", Email: "oidc@atest.com", EmailVerified: true}, identity)
+
+	_, err = login("nonce", "other verifier")
+	assert.NotNil(t, err, "the PKCE verifier must match the challenge")
+	_, err = login("other nonce", "verifier")
+	assert.NotNil(t, err, "the nonce must be the one of the login")
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tampered := []struct {
+		name   string
+		tamper func(claims gojwt.MapClaims, token *gojwt.Token)
+	}{
+		{"signed by another key", func(claims gojwt.MapClaims, token *gojwt.Token) {
+			token.Header["signingKey"] = otherKey
+		}},
+		{"unknown key id", func(claims gojwt.MapClaims, token *gojwt.Token) {
+			token.Header["kid"] = "other-key"
+		}},
+		{"another audience", func(claims gojwt.MapClaims, token *gojwt.Token) {
+			claims["aud"] = "other-client"
+		}},
+		{"another issuer", func(claims gojwt.MapClaims, token *gojwt.Token) {
+			claims["iss"] = "https://issuer.atest.com"
+		}},
+		{"expired", func(claims gojwt.MapClaims, token *gojwt.Token) {
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+		}},
+		{"no expiration", func(claims gojwt.MapClaims, token *gojwt.Token) {
+			delete(claims, "exp")
+		}},
+		{"no subject", func(claims gojwt.MapClaims, token *gojwt.Token) {
+			delete(claims, "sub")
+		}},
+	}
+	for _, test := range tampered {
+		t.Run(test.name, func(t *testing.T) {
+			mock.tamper = test.tamper
+			defer func() {
+				mock.tamper = nil
+			}()
+			_, err := login("nonce", "verifier")
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestOidcProviderDiscovery(t *testing.T) {
+	mock := newMockOidcServer(t)
+	ctx := context.Background()
+
+	// the issuer must be the one the discovery document names
+	provider := NewOidcProvider(mockClientId, mockClientSecret, mockRedirectURL, mock.URL+"/other", nil)
+	_, err := provider.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	assert.NotNil(t, err)
+
+	provider = NewOidcProvider(mockClientId, mockClientSecret, mockRedirectURL, mock.URL+"/", []string{"openid"})
+	authUrl, err := provider.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(authUrl, mock.URL+"/authorize?"))
+}
+
+func TestGitHubProvider(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "code" || r.FormValue("code_verifier") != "verifier" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error": "bad_verification_code"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token": "github-token", "token_type": "bearer"}`))
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer github-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{"id": 4242, "email": "public@atest.com"}`))
+	})
+	mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"email": "public@atest.com", "primary": false, "verified": false},
+			{"email": "github@atest.com", "primary": true, "verified": true}]`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	provider := NewGitHubProvider("client", "secret", "https://novoapp.tech/?provider=github", oauth2.Endpoint{
+		AuthURL:  server.URL + "/login/oauth/authorize",
+		TokenURL: server.URL + "/login/oauth/access_token",
+	}, server.URL)
+	authUrl, err := provider.AuthCodeURL(context.Background(), "state", "", "verifier")
+	assert.Nil(t, err)
+	assert.Contains(t, authUrl, "code_challenge="+pkceChallenge("verifier"))
+
+	identity, err := provider.Identity(context.Background(), "code", "", "verifier")
+	assert.Nil(t, err)
+	assert.Equal(t, &OauthIdentity{Subject: "4242", Email: "github@atest.com", EmailVerified: true}, identity)
+	_, err = provider.Identity(context.Background(), "code", "", "other verifier")
+	assert.NotNil(t, err)
+}
+
+func TestOauthLogin(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	mock := newMockOidcServer(t)
+	oauthProviders["mock"] = NewOidcProvider(mockClientId, mockClientSecret, mockRedirectURL, mock.URL, nil)
+	defer delete(oauthProviders, "mock")
+
+	login := func() (string, string, *db.User, error) {
+		authUrl, err := StartOauthLogin("mock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, state := authorize(t, authUrl)
+		user, _, err := UserByOauthToken(OauthLogin{Provider: "mock", Code: code, State: state})
+		return code, state, user, err
+	}
+
+	mock.user = gojwt.MapClaims{"sub": "mock-login", "email": "oidclogin@atest.com", "email_verified": false}
+	_, _, _, err := login()
+	assert.Equal(t, ErrOauthEmailUnverified, err)
+
+	mock.user["email_verified"] = true
+	code, state, user, err := login()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_, _ = db.Pool().Exec(context.Background(), "DELETE FROM users WHERE id = $1", user.ID)
+	}()
+	assert.Equal(t, "oidclogin@atest.com", user.Email)
+
+	// the identity is found by its subject from now on, whatever its email
+	mock.user["email"] = "changed@atest.com"
+	_, _, again, err := login()
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, again.ID)
+
+	_, _, err = UserByOauthToken(OauthLogin{Provider: "mock", Code: code, State: state})
+	assert.Equal(t, ErrInvalidOauthState, err)
+	_, err = StartOauthLogin("unknown")
+	assert.Equal(t, ErrUnknownProvider, err)
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"errors"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrResourceNotFound = errors.New("resource not found")
+	ErrEmailUnverified  = errors.New("verify your email to post")
+)
+
+// currentUserKey is where RequirePermission puts the user on the gin context.
+const currentUserKey = "currentUser"
+
+// selfActions are the actions a user can also get on only the resources they own.
+var selfActions = map[string]string{
+	ModifyAction: ModifySelfAction,
+	DeleteAction: DeleteSelfAction,
+}
+
+// AuthorizedUser is the user a request was let through for.
+type AuthorizedUser struct {
+	Id          int32
+	Role        string
+	Permissions map[string]bool
+	// Owner is true when the user was only allowed because they own the resource.
+	Owner bool
+}
+
+// Can tells if the role of the user can do action on module.
+func (u *AuthorizedUser) Can(module, action string) bool {
+	return u.Permissions[module+"."+action]
+}
+
+// CurrentUser returns the user resolved by RequirePermission, nil on routes without it.
+func CurrentUser(c *gin.Context) *AuthorizedUser {
+	user, ok := c.Get(currentUserKey)
+	if !ok {
+		return nil
+	}
+	return user.(*AuthorizedUser)
+}
+
+// userRoleName and userPermissionVersion read the user from the database, tests replace them.
+var userRoleName = func(userId int32) (string, error) {
+	return db.New(db.Pool()).UserRoleName(context.Background(), userId)
+}
+
+var userPermissionVersion = func(userId int32) (int32, error) {
+	return db.New(db.Pool()).UserPermissionVersion(context.Background(), userId)
+}
+
+var userEmailVerified = func(userId int32) (bool, error) {
+	return db.New(db.Pool()).UserEmailVerified(context.Background(), userId)
+}
+
+type cachedVersion struct {
+	version int32
+	loaded  time.Time
+}
+
+// versionCache keeps the permission version of the users, so checking that the role claims
+// of a token are current doesn't need the database on every request.
+type versionCache struct {
+	mutex      sync.RWMutex
+	users      map[int32]cachedVersion
+	generation uint64
+}
+
+func (c *versionCache) get(userId int32) (int32, error) {
+	c.mutex.RLock()
+	cached, ok := c.users[userId]
+	generation := c.generation
+	c.mutex.RUnlock()
+	if ok && time.Since(cached.loaded) < permissionCacheTTL {
+		return cached.version, nil
+	}
+
+	version, err := userPermissionVersion(userId)
+	if err != nil {
+		return 0, err
+	}
+	c.mutex.Lock()
+	if c.generation == generation {
+		c.users[userId] = cachedVersion{version: version, loaded: time.Now()}
+	}
+	c.mutex.Unlock()
+	return version, nil
+}
+
+func (c *versionCache) forget(userId int32) {
+	c.mutex.Lock()
+	delete(c.users, userId)
+	c.generation++
+	c.mutex.Unlock()
+}
+
+func (c *versionCache) invalidate() {
+	c.mutex.Lock()
+	c.users = make(map[int32]cachedVersion)
+	c.generation++
+	c.mutex.Unlock()
+}
+
+var permissionVersions = &versionCache{users: make(map[int32]cachedVersion)}
+
+// claimedRole returns the role and the permissions signed in the token, false when the
+// token doesn't have them or was issued before the role of the user last changed.
+func claimedRole(claims jwt.MapClaims, userId int32) (string, map[string]bool, bool, error) {
+	version, ok := claims[PermVersionClaimKey].(float64)
+	if !ok {
+		return "", nil, false, nil
+	}
+	current, err := permissionVersions.get(userId)
+	if err != nil {
+		return "", nil, false, err
+	}
+	role, ok := claims[RoleNameClaimKey].(string)
+	claimedPermissions, permsOk := claims[RolePermsClaimKey].([]interface{})
+	if int32(version) != current || !ok || !permsOk {
+		return "", nil, false, nil
+	}
+
+	permissions := make(map[string]bool, len(claimedPermissions))
+	for _, permission := range claimedPermissions {
+		if permission, ok := permission.(string); ok {
+			permissions[permission] = true
+		}
+	}
+	return role, permissions, true, nil
+}
+
+// authorizeUser resolves the user of the token. The role claims are used when they are
+// current, the database otherwise.
+func authorizeUser(claims jwt.MapClaims) (*AuthorizedUser, error) {
+	userId, ok := claims[UserIdClaimKey].(float64)
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+	user := &AuthorizedUser{Id: int32(userId)}
+
+	var err error
+	var claimed bool
+	user.Role, user.Permissions, claimed, err = claimedRole(claims, user.Id)
+	if err == nil && !claimed {
+		user.Role, err = userRoleName(user.Id)
+		if err == nil {
+			user.Permissions, err = rolePermissions.get(user.Role)
+		}
+	}
+	if err == pgx.ErrNoRows {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// OwnerResolver returns the owner of the resource a request is about, false when
+// it has no owner. It returns ErrResourceNotFound when the resource doesn't exist.
+type OwnerResolver func(c *gin.Context) (int32, bool, error)
+
+// ownerFromParam resolves the owner of the resource with the id of the url parameter param.
+func ownerFromParam(param string, owner func(ctx context.Context, queries *db.Queries, id int32) (int32, bool, error)) OwnerResolver {
+	return func(c *gin.Context) (int32, bool, error) {
+		id, err := strconv.ParseInt(c.Param(param), 10, 32)
+		if err != nil {
+			return 0, false, ErrResourceNotFound
+		}
+		ownerId, owned, err := owner(context.Background(), db.New(db.Pool()), int32(id))
+		if err == pgx.ErrNoRows {
+			return 0, false, ErrResourceNotFound
+		}
+		return ownerId, owned, err
+	}
+}
+
+var (
+	BookGroupOwner = ownerFromParam("bookGroupId", func(ctx context.Context, queries *db.Queries, id int32) (int32, bool, error) {
+		bookGroup, err := queries.BookGroupById(ctx, id)
+		return bookGroup.OwnerID, err == nil, err
+	})
+	BookChapterOwner = ownerFromParam("chapterId", func(ctx context.Context, queries *db.Queries, id int32) (int32, bool, error) {
+		owner, err := queries.GetBookChapterOwner(ctx, id)
+		return owner.ID, err == nil, err
+	})
+	CommentOwner = ownerFromParam("commentId", func(ctx context.Context, queries *db.Queries, id int32) (int32, bool, error) {
+		commenter, err := queries.GetCommenter(ctx, id)
+		return commenter.ID, err == nil, err
+	})
+	// authors created before they had an owner belong to nobody
+	BookAuthorOwner = ownerFromParam("authorId", func(ctx context.Context, queries *db.Queries, id int32) (int32, bool, error) {
+		owner, err := queries.BookAuthorOwner(ctx, id)
+		return owner.Int32, owner.Valid, err
+	})
+)
+
+func abortWithError(c *gin.Context, err error, code int) {
+	ReportError(c, err, "error", code)
+	c.Abort()
+}
+
+// RequirePermission lets the request through when the role of the user can do action on
+// module. When owner isn't nil, the self variant of the action (modifySelf, deleteSelf) is
+// enough on the resources the user owns. It answers 401 without a valid user and 403 when
+// the user isn't allowed, or posts without a verified email, and puts the user on the
+// context for CurrentUser.
+func RequirePermission(module, action string, owner OwnerResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, err := authorizeUser(jwt.ExtractClaims(c))
+		if err == ErrUnauthorized {
+			abortWithError(c, err, http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			abortWithError(c, err, http.StatusInternalServerError)
+			return
+		}
+
+		allowed := user.Can(module, action)
+		if !allowed && owner != nil && selfActions[action] != "" && user.Can(module, selfActions[action]) {
+			ownerId, owned, err := owner(c)
+			if err == ErrResourceNotFound {
+				abortWithError(c, err, http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				abortWithError(c, err, http.StatusInternalServerError)
+				return
+			}
+			allowed = owned && ownerId == user.Id
+			user.Owner = allowed
+		}
+		if !allowed {
+			abortWithError(c, ErrPermissionDenied, http.StatusForbidden)
+			return
+		}
+		if action == PostAction {
+			verified, err := userEmailVerified(user.Id)
+			if err != nil {
+				abortWithError(c, err, http.StatusInternalServerError)
+				return
+			}
+			if !verified {
+				abortWithError(c, ErrEmailUnverified, http.StatusForbidden)
+				return
+			}
+		}
+
+		c.Set(currentUserKey, user)
+		c.Next()
+	}
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"fmt"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/static"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var seededPermissionRegex = regexp.MustCompile(`\('(\w+)', '(\w+)', \(SELECT id FROM roles WHERE name = '(\w+)'\)\)`)
+
+// seededPermissions reads the permissions the up migrations give to every role.
+func seededPermissions(t *testing.T) map[string]map[string]bool {
+	files, err := fs.Glob(static.Migrations, "migrations/*.up.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := map[string]map[string]bool{
+		OauthIncompleteRole: {}, MemberRole: {}, ModeratorRole: {}, AdminRole: {}, BannedRole: {},
+	}
+	for _, file := range files {
+		content, err := fs.ReadFile(static.Migrations, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, match := range seededPermissionRegex.FindAllStringSubmatch(string(content), -1) {
+			roles[match[3]][match[1]+"."+match[2]] = true
+		}
+	}
+	return roles
+}
+
+// useSeededRoles makes RequirePermission see users 1 to 5 with the seeded roles, without a database.
+func useSeededRoles(t *testing.T) map[string]int32 {
+	seeded := seededPermissions(t)
+	users := map[string]int32{AdminRole: 1, ModeratorRole: 2, MemberRole: 3, BannedRole: 4, OauthIncompleteRole: 5}
+
+	oldCache, oldUserRoleName, oldUserPermissionVersion := rolePermissions, userRoleName, userPermissionVersion
+	oldUserEmailVerified := userEmailVerified
+	rolePermissions = newPermissionCache(func(roleName string) (map[string]bool, error) {
+		return seeded[roleName], nil
+	})
+	userPermissionVersion = func(userId int32) (int32, error) {
+		return 1, nil
+	}
+	permissionVersions.invalidate()
+	userEmailVerified = func(userId int32) (bool, error) {
+		return true, nil
+	}
+	userRoleName = func(userId int32) (string, error) {
+		for role, id := range users {
+			if id == userId {
+				return role, nil
+			}
+		}
+		return "", pgx.ErrNoRows
+	}
+	t.Cleanup(func() {
+		rolePermissions, userRoleName, userPermissionVersion = oldCache, oldUserRoleName, oldUserPermissionVersion
+		userEmailVerified = oldUserEmailVerified
+		permissionVersions.invalidate()
+	})
+	return users
+}
+
+const (
+	ownedResource   = "owned"
+	othersResource  = "others"
+	missingResource = "missing"
+)
+
+func testOwner(c *gin.Context) (int32, bool, error) {
+	switch c.Param("resource") {
+	case ownedResource:
+		userId, _ := strconv.Atoi(c.GetHeader("X-User"))
+		return int32(userId), true, nil
+	case othersResource:
+		return 1000, true, nil
+	default:
+		return 0, false, ErrResourceNotFound
+	}
+}
+
+func permissionRouter(module, action string, owner OwnerResolver) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// X-User is the uid claim, X-Role and X-Version add the role claims when set
+	fakeAuth := func(c *gin.Context) {
+		if user := c.GetHeader("X-User"); user != "" {
+			userId, _ := strconv.Atoi(user)
+			claims := jwt.MapClaims{UserIdClaimKey: float64(userId)}
+			if role := c.GetHeader("X-Role"); role != "" {
+				version, _ := strconv.Atoi(c.GetHeader("X-Version"))
+				permissions := make([]interface{}, 0)
+				for _, permission := range strings.Split(c.GetHeader("X-Permissions"), ",") {
+					permissions = append(permissions, permission)
+				}
+				claims[RoleNameClaimKey] = role
+				claims[RolePermsClaimKey] = permissions
+				claims[PermVersionClaimKey] = float64(version)
+			}
+			c.Set("JWT_PAYLOAD", claims)
+		}
+	}
+	r.GET("/:resource", fakeAuth, RequirePermission(module, action, owner), func(c *gin.Context) {
+		user := CurrentUser(c)
+		c.String(http.StatusOK, fmt.Sprintf("%d %s %v", user.Id, user.Role, user.Owner))
+	})
+	return r
+}
+
+func TestRequirePermission(t *testing.T) {
+	users := useSeededRoles(t)
+
+	tests := []struct {
+		module   string
+		action   string
+		owned    bool
+		role     string
+		resource string
+		code     int
+	}{
+		{BookGroupModule, PostAction, false, AdminRole, othersResource, 200},
+		{BookGroupModule, PostAction, false, ModeratorRole, othersResource, 200},
+		{BookGroupModule, PostAction, false, MemberRole, othersResource, 200},
+		{BookGroupModule, PostAction, false, BannedRole, othersResource, 403},
+		{BookGroupModule, PostAction, false, OauthIncompleteRole, othersResource, 403},
+
+		{BookGroupModule, ModifyAction, true, AdminRole, othersResource, 200},
+		{BookGroupModule, ModifyAction, true, ModeratorRole, othersResource, 200},
+		{BookGroupModule, ModifyAction, true, MemberRole, othersResource, 403},
+		{BookGroupModule, ModifyAction, true, MemberRole, ownedResource, 200},
+		{BookGroupModule, ModifyAction, true, MemberRole, missingResource, 404},
+		{BookGroupModule, ModifyAction, true, BannedRole, ownedResource, 403},
+		{BookGroupModule, DeleteAction, true, MemberRole, ownedResource, 403},
+		{BookGroupModule, DeleteAction, true, ModeratorRole, othersResource, 200},
+		{BookGroupModule, ExportAction, false, MemberRole, othersResource, 200},
+		{BookGroupModule, ExportAction, false, BannedRole, othersResource, 403},
+
+		{BookChapterModule, ModifyAction, true, MemberRole, ownedResource, 200},
+		{BookChapterModule, ModifyAction, true, MemberRole, othersResource, 403},
+		{BookChapterModule, DeleteAction, true, MemberRole, ownedResource, 200},
+		{BookChapterModule, DeleteAction, true, MemberRole, othersResource, 403},
+		{BookChapterModule, DeleteAction, true, ModeratorRole, othersResource, 200},
+
+		{CommentModule, ModifyAction, true, AdminRole, othersResource, 200},
+		{CommentModule, ModifyAction, true, ModeratorRole, ownedResource, 200},
+		{CommentModule, ModifyAction, true, ModeratorRole, othersResource, 403},
+		{CommentModule, ModifyAction, true, MemberRole, ownedResource, 200},
+		{CommentModule, DeleteAction, true, MemberRole, ownedResource, 200},
+		{CommentModule, DeleteAction, true, MemberRole, othersResource, 403},
+		{CommentModule, DeleteAction, true, ModeratorRole, othersResource, 200},
+
+		{AuthorModule, PostAction, false, MemberRole, othersResource, 200},
+		{AuthorModule, ModifyAction, true, MemberRole, ownedResource, 403},
+		{AuthorModule, ModifyAction, true, ModeratorRole, othersResource, 200},
+		{AuthorModule, DeleteAction, true, MemberRole, ownedResource, 403},
+
+		{LikeModule, PostAction, false, MemberRole, othersResource, 200},
+		{LikeModule, PostAction, false, BannedRole, othersResource, 403},
+		{ImageModule, DeleteAction, false, AdminRole, othersResource, 200},
+		{ImageModule, DeleteAction, false, ModeratorRole, othersResource, 403},
+		{RoleModule, ModifyAction, false, AdminRole, othersResource, 200},
+		{RoleModule, ModifyAction, false, ModeratorRole, othersResource, 403},
+	}
+	for _, test := range tests {
+		name := fmt.Sprintf("%s %s.%s on %s", test.role, test.module, test.action, test.resource)
+		t.Run(name, func(t *testing.T) {
+			var owner OwnerResolver
+			if test.owned {
+				owner = testOwner
+			}
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/"+test.resource, nil)
+			req.Header.Set("X-User", strconv.Itoa(int(users[test.role])))
+			permissionRouter(test.module, test.action, owner).ServeHTTP(w, req)
+
+			assert.Equal(t, test.code, w.Code, w.Body.String())
+			if test.code == 200 {
+				// the owner flag tells the handler it was only let through for its own resource
+				owned := test.resource == ownedResource && !rolePermissions.roles[test.role].permissions[test.module+"."+test.action]
+				assert.Equal(t, fmt.Sprintf("%d %s %v", users[test.role], test.role, owned), w.Body.String())
+			}
+		})
+	}
+}
+
+func TestRequirePermissionUnverifiedEmail(t *testing.T) {
+	users := useSeededRoles(t)
+	userEmailVerified = func(userId int32) (bool, error) {
+		return userId != users[MemberRole], nil
+	}
+
+	request := func(action string, userId int32) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/"+othersResource, nil)
+		req.Header.Set("X-User", strconv.Itoa(int(userId)))
+		permissionRouter(BookGroupModule, action, nil).ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(PostAction, users[MemberRole])
+	assert.Equal(t, 403, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), ErrEmailUnverified.Error()))
+	assert.Equal(t, 200, request(PostAction, users[ModeratorRole]).Code)
+	// only posting needs the email
+	assert.Equal(t, 200, request(ReadAction, users[MemberRole]).Code)
+}
+
+func TestRequirePermissionUnauthorized(t *testing.T) {
+	useSeededRoles(t)
+	router := permissionRouter(BookGroupModule, PostAction, nil)
+
+	// no user in the token
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/"+othersResource, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), ErrUnauthorized.Error()))
+
+	// the user of the token doesn't exist anymore
+	w = httptest.NewRecorder()
+	req.Header.Set("X-User", "999")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	w = httptest.NewRecorder()
+	req.Header.Set("X-User", "4")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 403, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), ErrPermissionDenied.Error()))
+}
+
+func TestRequirePermissionClaims(t *testing.T) {
+	users := useSeededRoles(t)
+	versionLoads := 0
+	version := int32(1)
+	userPermissionVersion = func(userId int32) (int32, error) {
+		versionLoads++
+		return version, nil
+	}
+	roleLoads := 0
+	seededUserRoleName := userRoleName
+	userRoleName = func(userId int32) (string, error) {
+		roleLoads++
+		return seededUserRoleName(userId)
+	}
+	router := permissionRouter(BookGroupModule, PostAction, nil)
+
+	request := func(userId int32, role, permissions string, version int) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/"+othersResource, nil)
+		req.Header.Set("X-User", strconv.Itoa(int(userId)))
+		req.Header.Set("X-Role", role)
+		req.Header.Set("X-Permissions", permissions)
+		req.Header.Set("X-Version", strconv.Itoa(version))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// current claims are trusted, the database is only asked for the version once
+	assert.Equal(t, 200, request(users[BannedRole], MemberRole, "book.post", 1))
+	assert.Equal(t, 200, request(users[BannedRole], MemberRole, "book.post", 1))
+	assert.Equal(t, 403, request(users[MemberRole], MemberRole, "book.read", 1))
+	assert.Equal(t, 1+1, versionLoads)
+	assert.Equal(t, 0, roleLoads)
+
+	// once the role changed, the claims of the old tokens are ignored
+	version = 2
+	permissionVersions.forget(users[BannedRole])
+	assert.Equal(t, 403, request(users[BannedRole], MemberRole, "book.post", 1))
+	assert.Equal(t, 1, roleLoads)
+	assert.Equal(t, 200, request(users[BannedRole], MemberRole, "book.post", 2))
+	assert.Equal(t, 1, roleLoads)
+
+	// tokens without a version use the database
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/"+othersResource, nil)
+	req.Header.Set("X-User", strconv.Itoa(int(users[MemberRole])))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 2, roleLoads)
+}
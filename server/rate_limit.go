@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("too many requests, slow down")
+
+// rateLimitSweepInterval is how often the buckets refilled to the brim are forgotten.
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a token bucket: a client can make Requests at once, and the bucket is
+// refilled over Period.
+type RateLimit struct {
+	// Name keeps apart the buckets of the limits.
+	Name     string
+	Requests int64
+	Period   time.Duration
+}
+
+// rate is how many tokens a second the bucket gets back.
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// refill returns the tokens of a bucket elapsed after it had tokens.
+func (l RateLimit) refill(tokens float64, elapsed time.Duration) float64 {
+	return math.Min(float64(l.Requests), tokens+elapsed.Seconds()*l.rate())
+}
+
+// wait is how long until a bucket with tokens has a whole one.
+func (l RateLimit) wait(tokens float64) time.Duration {
+	return time.Duration((1 - tokens) / l.rate() * float64(time.Second))
+}
+
+// RateLimiter takes a token from the bucket of key. When the bucket is empty, it returns
+// false and how long until it has one again.
+type RateLimiter interface {
+	Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error)
+}
+
+var rateLimiter RateLimiter
+
+// InitRateLimit sets up the rate limiter backend.
+func InitRateLimit(cfg config.RateLimit) {
+	switch cfg.Backend {
+	case config.MemoryRateLimit:
+		rateLimiter = NewMemoryRateLimiter()
+	case config.PostgresRateLimit:
+		rateLimiter = NewPostgresRateLimiter()
+	default:
+		log.Fatalf("unsupported rate limit backend: %s\n", cfg.Backend)
+	}
+}
+
+// RateLimiterBackend returns the configured rate limiter, falling back to the memory one
+// when InitRateLimit has not been called (e.g. in tests).
+func RateLimiterBackend() RateLimiter {
+	if rateLimiter == nil {
+		rateLimiter = NewMemoryRateLimiter()
+	}
+	return rateLimiter
+}
+
+func SetRateLimiter(l RateLimiter) {
+	rateLimiter = l
+}
+
+// WriteRateLimit and SearchRateLimit are the limits of the route groups.
+func WriteRateLimit(cfg config.RateLimit) RateLimit {
+	return RateLimit{Name: "write", Requests: cfg.WriteRequests, Period: cfg.WritePeriod}
+}
+
+func SearchRateLimit(cfg config.RateLimit) RateLimit {
+	return RateLimit{Name: "search", Requests: cfg.SearchRequests, Period: cfg.SearchPeriod}
+}
+
+// ResetRateLimit limits the password reset mails sent to an email.
+func ResetRateLimit(cfg config.RateLimit) RateLimit {
+	return RateLimit{Name: "reset", Requests: cfg.ResetRequests, Period: cfg.ResetPeriod}
+}
+
+// rateLimitKey is the client of the request: the user of the token when the JWT middleware
+// ran before, else the ip.
+func rateLimitKey(c *gin.Context) string {
+	if userId, ok := jwt.ExtractClaims(c)[UserIdClaimKey].(float64); ok {
+		return fmt.Sprintf("user:%d", int32(userId))
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// LimitRate lets the requests through while the bucket of the client has tokens, the
+// others get a 429 with Retry-After. The requests go through when the backend fails.
+func LimitRate(limit RateLimit) gin.HandlerFunc {
+	if limit.Requests <= 0 {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+	return func(c *gin.Context) {
+		if takeRate(c, limit, rateLimitKey(c)) {
+			c.Next()
+		}
+	}
+}
+
+// takeRate takes a token from the bucket of key, or answers a 429 with Retry-After and
+// returns false when it is empty.
+func takeRate(c *gin.Context, limit RateLimit, key string) bool {
+	if limit.Requests <= 0 {
+		return true
+	}
+	allowed, wait, err := RateLimiterBackend().Take(c.Request.Context(), limit.Name+":"+key, limit)
+	if err != nil {
+		log.Printf("error limiting rate: %s\n", err)
+		return true
+	}
+	if !allowed {
+		c.Header("Retry-After", retryAfter(time.Now().Add(wait)))
+		abortWithError(c, ErrRateLimited, http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket is refilled, it can then be forgotten.
+	full time.Time
+}
+
+// MemoryRateLimiter keeps the buckets in the process, each replica limits on its own.
+type MemoryRateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[string]*memoryBucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		buckets: map[string]*memoryBucket{},
+		now:     time.Now,
+	}
+}
+
+func (l *MemoryRateLimiter) Take(_ context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(limit.Requests), updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = limit.refill(bucket.tokens, now.Sub(bucket.updated))
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, limit.wait(bucket.tokens), nil
+	}
+	bucket.tokens--
+	bucket.full = now.Add(time.Duration((float64(limit.Requests) - bucket.tokens) / limit.rate() * float64(time.Second)))
+	return true, 0, nil
+}
+
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < rateLimitSweepInterval {
+		return
+	}
+	l.swept = now
+	for key, bucket := range l.buckets {
+		if bucket.full.Before(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// PostgresRateLimiter keeps the buckets in the database, shared by the replicas. A token is
+// taken in a single statement, so concurrent requests can't take the same one.
+type PostgresRateLimiter struct {
+	mutex sync.Mutex
+	swept time.Time
+	// idle is the longest period of the limits, a bucket unused for as long is full.
+	idle time.Duration
+}
+
+func NewPostgresRateLimiter() *PostgresRateLimiter {
+	return &PostgresRateLimiter{}
+}
+
+func (l *PostgresRateLimiter) Take(ctx context.Context, key string, limit RateLimit) (bool, time.Duration, error) {
+	queries := db.New(db.Pool())
+	l.sweep(ctx, queries, limit.Period)
+
+	_, err := queries.TakeRateLimitToken(ctx, db.TakeRateLimitTokenParams{
+		Key:      key,
+		Capacity: float64(limit.Requests),
+		Rate:     limit.rate(),
+	})
+	if err == nil {
+		return true, 0, nil
+	}
+	if err != pgx.ErrNoRows {
+		return false, 0, errors.New("error taking rate limit token: " + err.Error())
+	}
+	tokens, err := queries.RateLimitTokens(ctx, db.RateLimitTokensParams{
+		Capacity: float64(limit.Requests),
+		Rate:     limit.rate(),
+		Key:      key,
+	})
+	if err != nil {
+		return false, 0, errors.New("error getting rate limit tokens: " + err.Error())
+	}
+	return false, limit.wait(tokens), nil
+}
+
+func (l *PostgresRateLimiter) sweep(ctx context.Context, queries *db.Queries, period time.Duration) {
+	l.mutex.Lock()
+	if period > l.idle {
+		l.idle = period
+	}
+	now := time.Now()
+	if now.Sub(l.swept) < rateLimitSweepInterval {
+		l.mutex.Unlock()
+		return
+	}
+	l.swept = now
+	idle := l.idle
+	l.mutex.Unlock()
+
+	err := queries.DeleteIdleRateLimitBuckets(ctx, now.Add(-idle))
+	if err != nil {
+		log.Printf("error deleting idle rate limit buckets: %s\n", err)
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"context"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	limiter := NewMemoryRateLimiter()
+	limiter.now = func() time.Time {
+		return now
+	}
+	limit := RateLimit{Name: "test", Requests: 2, Period: time.Second}
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := limiter.Take(ctx, "a", limit)
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, wait, _ := limiter.Take(ctx, "a", limit)
+	assert.False(t, allowed)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	// the buckets are apart
+	allowed, _, _ = limiter.Take(ctx, "b", limit)
+	assert.True(t, allowed)
+
+	now = now.Add(250 * time.Millisecond)
+	allowed, wait, _ = limiter.Take(ctx, "a", limit)
+	assert.False(t, allowed)
+	assert.Equal(t, 250*time.Millisecond, wait)
+	now = now.Add(250 * time.Millisecond)
+	allowed, _, _ = limiter.Take(ctx, "a", limit)
+	assert.True(t, allowed)
+
+	// the full buckets are forgotten
+	now = now.Add(rateLimitSweepInterval)
+	_, _, _ = limiter.Take(ctx, "c", limit)
+	assert.Len(t, limiter.buckets, 1)
+}
+
+func TestLimitRateMiddleware(t *testing.T) {
+	oldLimiter := rateLimiter
+	SetRateLimiter(NewMemoryRateLimiter())
+	defer SetRateLimiter(oldLimiter)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		if user := c.GetHeader("X-Test-User"); user != "" {
+			c.Set("JWT_PAYLOAD", jwt.MapClaims{UserIdClaimKey: float64(len(user))})
+		}
+	})
+	limit := RateLimit{Name: "test", Requests: 2, Period: time.Minute}
+	r.GET("/limited", LimitRate(limit), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	r.GET("/unlimited", LimitRate(RateLimit{Name: "off"}), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	get := func(path, user string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Test-User", user)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, get("/limited", "").Code)
+	assert.Equal(t, http.StatusOK, get("/limited", "").Code)
+	w := get("/limited", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+
+	// a user from the same ip has a bucket of their own
+	assert.Equal(t, http.StatusOK, get("/limited", "u").Code)
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, get("/unlimited", "").Code)
+	}
+}
+
+func TestLimitRateForwardedFor(t *testing.T) {
+	oldLimiter := rateLimiter
+	SetRateLimiter(NewMemoryRateLimiter())
+	defer SetRateLimiter(oldLimiter)
+
+	// the trusted proxies are only applied by Run, before it listens: running the engine on
+	// an address that is taken applies them without leaving a server behind
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	serve := func(name string, proxies []string) *httptest.Server {
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		trustProxies(r, proxies)
+		if r.Run(taken.Addr().String()) == nil {
+			t.Fatal("the engine ran on a taken address")
+		}
+		limit := RateLimit{Name: name, Requests: 1, Period: time.Minute}
+		r.GET("/limited", LimitRate(limit), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+		return httptest.NewServer(r)
+	}
+	get := func(url, forwardedFor string) int {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+
+	// a forged header doesn't get a bucket of its own
+	untrusted := serve("untrusted", config.Default().Server.TrustedProxies)
+	defer untrusted.Close()
+	url := untrusted.URL + "/limited"
+	assert.Equal(t, http.StatusOK, get(url, "198.51.100.1"))
+	assert.Equal(t, http.StatusTooManyRequests, get(url, "198.51.100.2"))
+
+	// the header of a trusted proxy does
+	trusted := serve("trusted", []string{"127.0.0.1"})
+	defer trusted.Close()
+	url = trusted.URL + "/limited"
+	assert.Equal(t, http.StatusOK, get(url, "198.51.100.1"))
+	assert.Equal(t, http.StatusOK, get(url, "198.51.100.2"))
+	assert.Equal(t, http.StatusTooManyRequests, get(url, "198.51.100.2"))
+}
+
+func TestPostgresRateLimiter(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	limiter := NewPostgresRateLimiter()
+	limit := RateLimit{Name: "test", Requests: 2, Period: time.Hour}
+	key := "test:ip:192.0.2.2"
+	ctx := context.Background()
+	defer func() {
+		_, _ = db.Pool().Exec(ctx, "DELETE FROM rate_limit_buckets WHERE key = $1", key)
+	}()
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := limiter.Take(ctx, key, limit)
+		assert.Nil(t, err)
+		assert.True(t, allowed)
+	}
+	allowed, wait, err := limiter.Take(ctx, key, limit)
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+	assert.InDelta(t, float64(30*time.Minute), float64(wait), float64(time.Minute))
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"time"
+)
+
+// The access tokens are short-lived, clients get new ones from POST /auth/refresh-token
+// with the refresh token given at login, in the refreshToken field or the refresh_token
+// cookie. Every refresh token is used once and replaced by the next one of its session.
+// Using one twice means it was stolen, the whole session is then revoked.
+
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token already used, the session is revoked")
+)
+
+const RefreshTokenCookie = "refresh_token"
+
+// refreshTokenKey is where the authenticator leaves the refresh token of a login.
+const refreshTokenKey = "refreshToken"
+
+type RefreshTokenInput struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// only the hash is stored, a leaked database doesn't give usable tokens
+func hashRefreshToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// randomToken returns 256 random bits, url safe.
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// IssueRefreshToken adds a refresh token to the session.
+func IssueRefreshToken(ctx context.Context, queries *db.Queries, sessionId string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", errors.New("error generating refresh token: " + err.Error())
+	}
+	err = queries.InsertRefreshToken(ctx, db.InsertRefreshTokenParams{
+		TokenHash: hashRefreshToken(token),
+		SessionID: sessionId,
+	})
+	if err != nil {
+		return "", errors.New("error storing refresh token: " + err.Error())
+	}
+	return token, nil
+}
+
+// RotateRefreshToken uses the refresh token and returns the claims of a new access token
+// along with the next refresh token. The session is kept open for lifetime more.
+func RotateRefreshToken(token string, lifetime time.Duration) (UserClaims, string, error) {
+	ctx := context.Background()
+	hash := hashRefreshToken(token)
+
+	var claims UserClaims
+	var next string
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		sessionId, err := queries.UseRefreshToken(ctx, hash)
+		if err != nil {
+			return err
+		}
+		userId, err := queries.ActiveSessionUser(ctx, sessionId)
+		if err == pgx.ErrNoRows {
+			return ErrSessionRevoked
+		}
+		if err != nil {
+			return err
+		}
+		_, err = queries.ExtendSession(ctx, db.ExtendSessionParams{
+			ID:          sessionId,
+			DateExpires: time.Now().Add(lifetime),
+		})
+		if err != nil {
+			return err
+		}
+
+		// the claims are read again, the role may have changed since the last token
+		user, err := queries.UserById(ctx, userId)
+		if err != nil {
+			return err
+		}
+		role, err := queries.Role(ctx, user.RoleID)
+		if err != nil {
+			return err
+		}
+		claims = sessionClaims(&user, &role, sessionId)
+		next, err = IssueRefreshToken(ctx, queries, sessionId)
+		return err
+	})
+	if err == pgx.ErrNoRows {
+		return UserClaims{}, "", refreshTokenMisuse(ctx, hash)
+	}
+	if err == ErrSessionRevoked {
+		return UserClaims{}, "", err
+	}
+	if err != nil {
+		return UserClaims{}, "", errors.New("error refreshing token: " + err.Error())
+	}
+	return claims, next, nil
+}
+
+// refreshTokenMisuse tells apart unknown tokens from reused ones, and revokes the session
+// of the reused ones.
+func refreshTokenMisuse(ctx context.Context, hash string) error {
+	sessionId, err := db.New(db.Pool()).RefreshTokenSession(ctx, hash)
+	if err == pgx.ErrNoRows {
+		return ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return errors.New("error getting refresh token: " + err.Error())
+	}
+	err = RevokeSession(sessionId)
+	if err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+func setRefreshCookie(c *gin.Context, token string, maxAge int) {
+	c.SetCookie(RefreshTokenCookie, token, maxAge, "/auth", "", false, true)
+}
+
+// tokenResponse answers a login or a refresh, as the default login response of gin-jwt
+// with the refresh token added.
+func tokenResponse(c *gin.Context, token string, expire time.Time, refreshToken string, lifetime time.Duration) {
+	setRefreshCookie(c, refreshToken, int(lifetime.Seconds()))
+	response := gin.H{
+		"code":         http.StatusOK,
+		"token":        token,
+		"expire":       expire.Format(time.RFC3339),
+		"refreshToken": refreshToken,
+	}
+	if recoveryCodes, ok := c.Get(recoveryCodesKey); ok {
+		response["recoveryCodes"] = recoveryCodes
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// respondWithToken answers a new access token of the claims, outside of the login handler
+// of gin-jwt.
+func respondWithToken(c *gin.Context, authMiddleware *jwt.GinJWTMiddleware, claims UserClaims, refreshToken string, lifetime time.Duration) {
+	token, expire, err := authMiddleware.TokenGenerator(claims)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusInternalServerError)
+		return
+	}
+	if authMiddleware.SendCookie {
+		c.SetCookie(authMiddleware.CookieName, token, int(authMiddleware.CookieMaxAge.Seconds()), "/",
+			authMiddleware.CookieDomain, authMiddleware.SecureCookie, authMiddleware.CookieHTTPOnly)
+	}
+	tokenResponse(c, token, expire, refreshToken, lifetime)
+}
+
+func refreshTokenErrorCode(err error) int {
+	switch err {
+	case ErrInvalidRefreshToken, ErrRefreshTokenReused, ErrSessionRevoked:
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// RefreshHandler trades a refresh token for a new access token and the next refresh token.
+func RefreshHandler(authMiddleware *jwt.GinJWTMiddleware, lifetime time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input RefreshTokenInput
+		_ = c.ShouldBindJSON(&input)
+		if input.RefreshToken == "" {
+			input.RefreshToken, _ = c.Cookie(RefreshTokenCookie)
+		}
+		if input.RefreshToken == "" {
+			ReportError(c, ErrInvalidRefreshToken, "error", http.StatusUnauthorized)
+			return
+		}
+
+		claims, refreshToken, err := RotateRefreshToken(input.RefreshToken, lifetime)
+		if err != nil {
+			ReportError(c, err, "error", refreshTokenErrorCode(err))
+			return
+		}
+		respondWithToken(c, authMiddleware, claims, refreshToken, lifetime)
+	}
+}
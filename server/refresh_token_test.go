@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRandomToken(t *testing.T) {
+	first, err := randomToken()
+	assert.Nil(t, err)
+	second, err := randomToken()
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+	assert.Len(t, first, 43)
+
+	assert.Equal(t, hashRefreshToken(first), hashRefreshToken(first))
+	assert.NotEqual(t, first, hashRefreshToken(first))
+}
+
+func TestRefreshHandlerWithoutToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/auth/refresh-token", RefreshHandler(&jwt.GinJWTMiddleware{}, time.Hour))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/auth/refresh-token", strings.NewReader(`{}`))
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	assert.True(t, strings.Contains(w.Body.String(), ErrInvalidRefreshToken.Error()))
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	username, email := "testrefreshuser", "refresh@atest.com"
+	user, _, err := CreateAccount(username, "secretpw", email, MemberRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = DeleteAccount(username)
+	}()
+
+	sessionId, err := CreateSession(user.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := IssueRefreshToken(context.Background(), db.New(db.Pool()), sessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, second, err := RotateRefreshToken(first, time.Hour)
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, user.ID, claims.UserId)
+	assert.Equal(t, MemberRole, claims.RoleName)
+	assert.Equal(t, sessionId, claims.SessionId)
+
+	_, _, err = RotateRefreshToken("unknown", time.Hour)
+	assert.Equal(t, ErrInvalidRefreshToken, err)
+
+	// a token used twice was stolen, the session it belongs to ends
+	_, _, err = RotateRefreshToken(first, time.Hour)
+	assert.Equal(t, ErrRefreshTokenReused, err)
+	active, _ := sessionActive(sessionId, user.ID)
+	assert.False(t, active)
+	_, _, err = RotateRefreshToken(second, time.Hour)
+	assert.Equal(t, ErrSessionRevoked, err)
+}
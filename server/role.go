@@ -0,0 +1,543 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRoleNotFound       = errors.New("role not found")
+	ErrRoleExists         = errors.New("role already exists")
+	ErrRoleInUse          = errors.New("role is given to some users")
+	ErrProtectedRole      = errors.New("role is used by the server, it can't be renamed or deleted")
+	ErrPermissionNotFound = errors.New("role doesn't have this permission")
+)
+
+// protectedRoles are referred to by name in the code.
+var protectedRoles = map[string]bool{
+	OauthIncompleteRole: true,
+	MemberRole:          true,
+	AdminRole:           true,
+}
+
+var roleNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]{1,31}$`)
+
+// permissionCacheTTL bounds how long other servers keep the permissions of a role
+// changed through this one. Changes made here are seen at once.
+const permissionCacheTTL = time.Minute
+
+type cachedPermissions struct {
+	permissions map[string]bool
+	loaded      time.Time
+}
+
+// permissionCache keeps the permission set of the roles by name, as "module.action".
+type permissionCache struct {
+	mutex sync.RWMutex
+	load  func(roleName string) (map[string]bool, error)
+	roles map[string]cachedPermissions
+	// generation changes on every invalidation, so a set loaded before it isn't stored.
+	generation uint64
+}
+
+func newPermissionCache(load func(roleName string) (map[string]bool, error)) *permissionCache {
+	return &permissionCache{load: load, roles: make(map[string]cachedPermissions)}
+}
+
+func (c *permissionCache) get(roleName string) (map[string]bool, error) {
+	c.mutex.RLock()
+	cached, ok := c.roles[roleName]
+	generation := c.generation
+	c.mutex.RUnlock()
+	if ok && time.Since(cached.loaded) < permissionCacheTTL {
+		return cached.permissions, nil
+	}
+
+	permissions, err := c.load(roleName)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	if c.generation == generation {
+		c.roles[roleName] = cachedPermissions{permissions: permissions, loaded: time.Now()}
+	}
+	c.mutex.Unlock()
+	return permissions, nil
+}
+
+func (c *permissionCache) invalidate() {
+	c.mutex.Lock()
+	c.roles = make(map[string]cachedPermissions)
+	c.generation++
+	c.mutex.Unlock()
+}
+
+var rolePermissions = newPermissionCache(loadRolePermissions)
+
+func loadRolePermissions(roleName string) (map[string]bool, error) {
+	rows, err := db.New(db.Pool()).RolePermissionsByName(context.Background(), roleName)
+	if err != nil {
+		return nil, errors.New("error getting role permissions: " + err.Error())
+	}
+	permissions := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		permissions[row.Module+"."+row.Action] = true
+	}
+	return permissions, nil
+}
+
+// RoleHasPermission tells if the role can do action on module, from the cached permissions.
+func RoleHasPermission(roleName, module, action string) (bool, error) {
+	permissions, err := rolePermissions.get(roleName)
+	if err != nil {
+		return false, err
+	}
+	return permissions[module+"."+action], nil
+}
+
+// bumpRoleVersion makes the role claims of the tokens of the users with the role outdated,
+// in the transaction changing the role.
+func bumpRoleVersion(ctx context.Context, queries *db.Queries, roleId int32) error {
+	err := queries.BumpRolePermissionVersion(ctx, roleId)
+	if err != nil {
+		return errors.New("error updating permission version: " + err.Error())
+	}
+	return nil
+}
+
+// rolesChanged drops the cached permissions once the change of a role is committed.
+func rolesChanged() {
+	rolePermissions.invalidate()
+	permissionVersions.invalidate()
+}
+
+func validPermission(module, action string) bool {
+	return containsString(Modules, module) && containsString(Actions, action)
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func nullableString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+func ListRoles() ([]db.ListRolesRow, error) {
+	roles, err := db.New(db.Pool()).ListRoles(context.Background())
+	if err != nil {
+		return nil, errors.New("error getting roles: " + err.Error())
+	}
+	for i := range roles {
+		if roles[i].Permissions == nil {
+			roles[i].Permissions = make([]string, 0)
+		}
+	}
+	if roles == nil {
+		roles = make([]db.ListRolesRow, 0)
+	}
+	return roles, nil
+}
+
+func CreateRole(name, description string) (*db.Role, error) {
+	if !roleNameRegex.MatchString(name) {
+		return nil, errors.New("invalid role name")
+	}
+	role, err := db.New(db.Pool()).InsertNewRole(context.Background(), db.InsertNewRoleParams{
+		Name:        name,
+		Description: nullableString(description),
+	})
+	if isUniqueViolation(err) {
+		return nil, ErrRoleExists
+	}
+	if err != nil {
+		return nil, errors.New("error creating role: " + err.Error())
+	}
+	return &role, nil
+}
+
+func roleById(ctx context.Context, queries *db.Queries, id int32) (*db.Role, error) {
+	role, err := queries.RoleById(ctx, id)
+	if err == pgx.ErrNoRows {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, errors.New("error getting role: " + err.Error())
+	}
+	return &role, nil
+}
+
+// UpdateRole renames the role and changes its description. The roles the server refers
+// to only have their description changed.
+func UpdateRole(id int32, name, description string) (*db.Role, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	role, err := roleById(ctx, queries, id)
+	if err != nil {
+		return nil, err
+	}
+	if name != role.Name {
+		if protectedRoles[role.Name] {
+			return nil, ErrProtectedRole
+		}
+		if !roleNameRegex.MatchString(name) {
+			return nil, errors.New("invalid role name")
+		}
+	}
+
+	var updated db.Role
+	err = RunInTx(ctx, func(queries *db.Queries) error {
+		var err error
+		updated, err = queries.UpdateRole(ctx, db.UpdateRoleParams{
+			ID:          id,
+			Name:        name,
+			Description: nullableString(description),
+		})
+		if isUniqueViolation(err) {
+			return ErrRoleExists
+		}
+		if err != nil {
+			return errors.New("error updating role: " + err.Error())
+		}
+		return bumpRoleVersion(ctx, queries, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	rolesChanged()
+	return &updated, nil
+}
+
+// DeleteRole deletes a role that no user has, along with its permissions.
+func DeleteRole(id int32) error {
+	ctx := context.Background()
+	role, err := roleById(ctx, db.New(db.Pool()), id)
+	if err != nil {
+		return err
+	}
+	if protectedRoles[role.Name] {
+		return ErrProtectedRole
+	}
+
+	err = RunInTx(ctx, func(queries *db.Queries) error {
+		users, err := queries.CountUsersWithRole(ctx, id)
+		if err != nil {
+			return err
+		}
+		if users > 0 {
+			return ErrRoleInUse
+		}
+		err = queries.DeleteRolePermissions(ctx, id)
+		if err != nil {
+			return err
+		}
+		_, err = queries.DeleteRoleById(ctx, id)
+		return err
+	})
+	if err == ErrRoleInUse {
+		return err
+	}
+	if err != nil {
+		return errors.New("error deleting role: " + err.Error())
+	}
+	rolePermissions.invalidate()
+	return nil
+}
+
+// SetRoleTwoFactor makes the users of the role log in with a second factor, or not.
+func SetRoleTwoFactor(roleId int32, required bool) error {
+	updated, err := db.New(db.Pool()).SetRoleRequireTwoFactor(context.Background(), db.SetRoleRequireTwoFactorParams{
+		ID:               roleId,
+		RequireTwoFactor: required,
+	})
+	if err != nil {
+		return errors.New("error updating role: " + err.Error())
+	}
+	if updated == 0 {
+		return ErrRoleNotFound
+	}
+	return nil
+}
+
+func GrantPermission(roleId int32, module, action string) error {
+	if !validPermission(module, action) {
+		return fmt.Errorf("invalid permission %s.%s", module, action)
+	}
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	_, err := roleById(ctx, queries, roleId)
+	if err != nil {
+		return err
+	}
+	err = RunInTx(ctx, func(queries *db.Queries) error {
+		err := queries.GrantPermission(ctx, db.GrantPermissionParams{
+			Module: module,
+			Action: action,
+			RoleID: roleId,
+		})
+		if err != nil {
+			return errors.New("error granting permission: " + err.Error())
+		}
+		return bumpRoleVersion(ctx, queries, roleId)
+	})
+	if err != nil {
+		return err
+	}
+	rolesChanged()
+	return nil
+}
+
+// RevokePermission takes a permission back from a role. The admin role keeps role.modify,
+// otherwise nobody could manage the roles anymore.
+func RevokePermission(roleId int32, module, action string) error {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	role, err := roleById(ctx, queries, roleId)
+	if err != nil {
+		return err
+	}
+	if role.Name == AdminRole && module == RoleModule && action == ModifyAction {
+		return errors.New("the admin role can't lose the role.modify permission")
+	}
+	err = RunInTx(ctx, func(queries *db.Queries) error {
+		revoked, err := queries.RevokePermission(ctx, db.RevokePermissionParams{
+			Module: module,
+			Action: action,
+			RoleID: roleId,
+		})
+		if err != nil {
+			return errors.New("error revoking permission: " + err.Error())
+		}
+		if revoked == 0 {
+			return ErrPermissionNotFound
+		}
+		return bumpRoleVersion(ctx, queries, roleId)
+	})
+	if err != nil {
+		return err
+	}
+	rolesChanged()
+	return nil
+}
+
+func roleErrorCode(err error) int {
+	switch err {
+	case ErrRoleNotFound, ErrPermissionNotFound:
+		return http.StatusNotFound
+	case ErrRoleExists, ErrRoleInUse:
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func roleIdParam(c *gin.Context) (int32, bool) {
+	var roleId int32
+	_, err := fmt.Sscan(c.Param("roleId"), &roleId)
+	if err != nil {
+		ReportError(c, errors.New("invalid role id"), "error", http.StatusBadRequest)
+		return 0, false
+	}
+	return roleId, true
+}
+
+type RoleInput struct {
+	Name        string `json:"name" binding:"required"`
+	Description string `json:"description"`
+}
+
+type RoleTwoFactorInput struct {
+	Required bool `json:"required"`
+}
+
+type PermissionInput struct {
+	Module string `json:"module" binding:"required"`
+	Action string `json:"action" binding:"required"`
+}
+
+func ListRolesHandler(c *gin.Context) {
+	roles, err := ListRoles()
+	if err != nil {
+		ReportError(c, err, "error", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"roles":   roles,
+		"modules": Modules,
+		"actions": Actions,
+	})
+}
+
+func CreateRoleHandler(c *gin.Context) {
+	var input RoleInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	role, err := CreateRole(input.Name, input.Description)
+	if err != nil {
+		ReportError(c, err, "error", roleErrorCode(err))
+		return
+	}
+	RecordAudit(c, AuditRecord{
+		Action:     CreateRoleAudit,
+		TargetType: RoleAuditTarget,
+		TargetId:   role.ID,
+		After:      roleAuditSnapshot(*role),
+	})
+	c.JSON(http.StatusCreated, role)
+}
+
+func UpdateRoleHandler(c *gin.Context) {
+	roleId, ok := roleIdParam(c)
+	if !ok {
+		return
+	}
+	var input RoleInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	before, err := roleById(context.Background(), db.New(db.Pool()), roleId)
+	if err != nil {
+		ReportError(c, err, "error", roleErrorCode(err))
+		return
+	}
+	role, err := UpdateRole(roleId, input.Name, input.Description)
+	if err != nil {
+		ReportError(c, err, "error", roleErrorCode(err))
+		return
+	}
+	RecordAudit(c, AuditRecord{
+		Action:     UpdateRoleAudit,
+		TargetType: RoleAuditTarget,
+		TargetId:   roleId,
+		Before:     roleAuditSnapshot(*before),
+		After:      roleAuditSnapshot(*role),
+	})
+	c.JSON(http.StatusOK, role)
+}
+
+func DeleteRoleHandler(c *gin.Context) {
+	roleId, ok := roleIdParam(c)
+	if !ok {
+		return
+	}
+	before, err := roleById(context.Background(), db.New(db.Pool()), roleId)
+	if err != nil {
+		ReportError(c, err, "error", roleErrorCode(err))
+		return
+	}
+	err = DeleteRole(roleId)
+	if err != nil {
+		ReportError(c, err, "error", roleErrorCode(err))
+		return
+	}
+	RecordAudit(c, AuditRecord{
+		Action:     DeleteRoleAudit,
+		TargetType: RoleAuditTarget,
+		TargetId:   roleId,
+		Before:     roleAuditSnapshot(*before),
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "role deleted",
+	})
+}
+
+func GrantPermissionHandler(c *gin.Context) {
+	roleId, ok := roleIdParam(c)
+	if !ok {
+		return
+	}
+	var input PermissionInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	err = GrantPermission(roleId, input.Module, input.Action)
+	if err != nil {
+		ReportError(c, err, "error", roleErrorCode(err))
+		return
+	}
+	RecordAudit(c, AuditRecord{
+		Action:     GrantPermissionAudit,
+		TargetType: RoleAuditTarget,
+		TargetId:   roleId,
+		After:      permissionAuditSnapshot(input.Module, input.Action),
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "permission granted",
+	})
+}
+
+func RevokePermissionHandler(c *gin.Context) {
+	roleId, ok := roleIdParam(c)
+	if !ok {
+		return
+	}
+	module, action := c.Param("module"), c.Param("action")
+	err := RevokePermission(roleId, module, action)
+	if err != nil {
+		ReportError(c, err, "error", roleErrorCode(err))
+		return
+	}
+	RecordAudit(c, AuditRecord{
+		Action:     RevokePermissionAudit,
+		TargetType: RoleAuditTarget,
+		TargetId:   roleId,
+		Before:     permissionAuditSnapshot(module, action),
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "permission revoked",
+	})
+}
+
+func SetRoleTwoFactorHandler(c *gin.Context) {
+	roleId, ok := roleIdParam(c)
+	if !ok {
+		return
+	}
+	var input RoleTwoFactorInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	before, err := roleById(context.Background(), db.New(db.Pool()), roleId)
+	if err != nil {
+		ReportError(c, err, "error", roleErrorCode(err))
+		return
+	}
+	err = SetRoleTwoFactor(roleId, input.Required)
+	if err != nil {
+		ReportError(c, err, "error", roleErrorCode(err))
+		return
+	}
+	RecordAudit(c, AuditRecord{
+		Action:     SetTwoFactorAudit,
+		TargetType: RoleAuditTarget,
+		TargetId:   roleId,
+		Before:     gin.H{"requireTwoFactor": before.RequireTwoFactor},
+		After:      gin.H{"requireTwoFactor": input.Required},
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"requireTwoFactor": input.Required,
+	})
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPermissionCache(t *testing.T) {
+	loads := 0
+	permissions := map[string]bool{"book.read": true}
+	cache := newPermissionCache(func(roleName string) (map[string]bool, error) {
+		loads++
+		if roleName == "broken" {
+			return nil, errors.New("broken")
+		}
+		return permissions, nil
+	})
+
+	got, err := cache.get(MemberRole)
+	assert.Nil(t, err)
+	assert.True(t, got["book.read"])
+	_, _ = cache.get(MemberRole)
+	assert.Equal(t, 1, loads)
+
+	permissions = map[string]bool{"book.post": true}
+	cache.invalidate()
+	got, err = cache.get(MemberRole)
+	assert.Nil(t, err)
+	assert.False(t, got["book.read"])
+	assert.True(t, got["book.post"])
+	assert.Equal(t, 2, loads)
+
+	_, err = cache.get("broken")
+	assert.NotNil(t, err)
+	_, _ = cache.get("broken")
+	assert.Equal(t, 4, loads)
+}
+
+func TestPermissionCacheInvalidatedWhileLoading(t *testing.T) {
+	var cache *permissionCache
+	cache = newPermissionCache(func(roleName string) (map[string]bool, error) {
+		// the role changes while its old permissions are read
+		cache.invalidate()
+		return map[string]bool{}, nil
+	})
+	_, _ = cache.get(MemberRole)
+	assert.Empty(t, cache.roles)
+}
+
+func TestValidPermission(t *testing.T) {
+	assert.True(t, validPermission(BookGroupModule, ReadAction))
+	assert.True(t, validPermission(RoleModule, ModifyAction))
+	assert.False(t, validPermission("books", ReadAction))
+	assert.False(t, validPermission(BookGroupModule, "write"))
+
+	assert.True(t, roleNameRegex.MatchString("translator"))
+	assert.False(t, roleNameRegex.MatchString("Translator"))
+	assert.False(t, roleNameRegex.MatchString("a"))
+}
+
+func TestRoleManagement(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	role, err := CreateRole("testtranslator", "translates books")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = DeleteRole(role.ID)
+	}()
+	_, err = CreateRole("testtranslator", "")
+	assert.Equal(t, ErrRoleExists, err)
+
+	allowed, err := RoleHasPermission(role.Name, BookChapterModule, PostAction)
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+
+	// the cached set is dropped when the permissions change
+	assert.Nil(t, GrantPermission(role.ID, BookChapterModule, PostAction))
+	allowed, err = RoleHasPermission(role.Name, BookChapterModule, PostAction)
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+	assert.NotNil(t, GrantPermission(role.ID, "chapters", PostAction))
+
+	assert.Nil(t, RevokePermission(role.ID, BookChapterModule, PostAction))
+	allowed, err = RoleHasPermission(role.Name, BookChapterModule, PostAction)
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, ErrPermissionNotFound, RevokePermission(role.ID, BookChapterModule, PostAction))
+
+	updated, err := UpdateRole(role.ID, "testeditor", "edits books")
+	assert.Nil(t, err)
+	assert.Equal(t, "testeditor", updated.Name)
+
+	// SetRole accepts the new role, it is in the roles table
+	username, email := "testroleuser", "roleuser@atest.com"
+	user, _, err := CreateAccount(username, "secretpw", email, MemberRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, SetRole(0, user.ID, "testeditor"))
+	assert.Equal(t, ErrRoleInUse, DeleteRole(role.ID))
+	assert.Nil(t, DeleteAccount(username))
+	assert.Nil(t, DeleteRole(role.ID))
+	assert.Equal(t, ErrRoleNotFound, DeleteRole(role.ID))
+
+	adminId, err := db.New(db.Pool()).GetRoleId(context.Background(), AdminRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrProtectedRole, DeleteRole(adminId))
+	_, err = UpdateRole(adminId, "superuser", "")
+	assert.Equal(t, ErrProtectedRole, err)
+	assert.NotNil(t, RevokePermission(adminId, RoleModule, ModifyAction))
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// allowedTags are the tags EPUB chapters can keep, with their own allowed attributes.
+// Tags that are not listed are unwrapped, their content is kept.
+var allowedTags = map[string][]string{
+	"p": {}, "br": {}, "hr": {}, "div": {}, "span": {}, "section": {},
+	"h1": {}, "h2": {}, "h3": {}, "h4": {}, "h5": {}, "h6": {},
+	"b": {}, "i": {}, "u": {}, "s": {}, "em": {}, "strong": {}, "small": {}, "mark": {},
+	"sub": {}, "sup": {}, "del": {}, "ins": {},
+	"blockquote": {}, "pre": {}, "code": {},
+	"ul": {}, "ol": {"start"}, "li": {},
+	"dl": {}, "dt": {}, "dd": {},
+	"ruby": {}, "rt": {}, "rp": {},
+	"figure": {}, "figcaption": {},
+	"table": {}, "caption": {}, "thead": {}, "tbody": {}, "tfoot": {}, "tr": {},
+	"th": {"colspan", "rowspan"}, "td": {"colspan", "rowspan"},
+	"a":   {"href"},
+	"img": {"src", "alt", "width", "height"},
+}
+
+// globalAttributes are allowed on every allowed tag.
+var globalAttributes = []string{"title", "lang", "dir"}
+
+// droppedTags are removed along with everything inside them.
+var droppedTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "frame": true, "frameset": true,
+	"object": true, "embed": true, "applet": true, "form": true, "input": true,
+	"button": true, "select": true, "textarea": true, "noscript": true, "template": true,
+	"head": true, "title": true, "meta": true, "link": true, "base": true,
+	"svg": true, "math": true, "audio": true, "video": true, "source": true, "track": true,
+	"canvas": true,
+}
+
+var numericAttributes = map[string]bool{
+	"width": true, "height": true, "colspan": true, "rowspan": true, "start": true,
+}
+
+// HtmlSanitizer whitelists the html of the EPUB chapters, when they are imported and
+// exported. The hypertext chapters are Markdown, checked by CheckChapterContent.
+type HtmlSanitizer struct {
+	// ImageSrc maps the src of an image to the one to keep, false drops the image.
+	// Images are dropped when it is nil.
+	ImageSrc func(src string) (string, bool)
+	// Rejected lists what was removed, once per construct.
+	Rejected []string
+}
+
+func (s *HtmlSanitizer) reject(format string, args ...interface{}) {
+	rejected := fmt.Sprintf(format, args...)
+	for _, existing := range s.Rejected {
+		if existing == rejected {
+			return
+		}
+	}
+	s.Rejected = append(s.Rejected, rejected)
+}
+
+// Sanitize parses content as the inside of a <body> and returns the cleaned html.
+func (s *HtmlSanitizer) Sanitize(content string) (string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(content), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return "", err
+	}
+	return s.SanitizeNodes(nodes), nil
+}
+
+// SanitizeNodes renders the cleaned version of nodes, which are left untouched.
+func (s *HtmlSanitizer) SanitizeNodes(nodes []*html.Node) string {
+	var buffer bytes.Buffer
+	for _, node := range nodes {
+		for _, cleaned := range s.sanitizeNode(node) {
+			_ = html.Render(&buffer, cleaned)
+		}
+	}
+	return buffer.String()
+}
+
+func (s *HtmlSanitizer) sanitizeChildren(node *html.Node) []*html.Node {
+	var children []*html.Node
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		children = append(children, s.sanitizeNode(child)...)
+	}
+	return children
+}
+
+func (s *HtmlSanitizer) sanitizeNode(node *html.Node) []*html.Node {
+	switch node.Type {
+	case html.TextNode:
+		return []*html.Node{{Type: html.TextNode, Data: node.Data}}
+	case html.DocumentNode:
+		return s.sanitizeChildren(node)
+	case html.ElementNode:
+	default:
+		// comments and doctypes
+		return nil
+	}
+
+	tag := strings.ToLower(node.Data)
+	if droppedTags[tag] {
+		s.reject("<%s>", tag)
+		return nil
+	}
+	allowedAttributes, ok := allowedTags[tag]
+	if !ok {
+		// html, body and unknown wrappers
+		return s.sanitizeChildren(node)
+	}
+
+	cleaned := &html.Node{Type: html.ElementNode, Data: tag, DataAtom: atom.Lookup([]byte(tag))}
+	for _, attribute := range node.Attr {
+		name := strings.ToLower(attribute.Key)
+		if attribute.Namespace != "" || !containsString(allowedAttributes, name) && !containsString(globalAttributes, name) {
+			s.reject("%s attribute on <%s>", name, tag)
+			continue
+		}
+		value, ok := s.sanitizeAttribute(tag, name, attribute.Val)
+		if !ok {
+			continue
+		}
+		cleaned.Attr = append(cleaned.Attr, html.Attribute{Key: name, Val: value})
+	}
+
+	if tag == "img" && !hasAttribute(cleaned, "src") {
+		return nil
+	}
+
+	for _, child := range s.sanitizeChildren(node) {
+		cleaned.AppendChild(child)
+	}
+	return []*html.Node{cleaned}
+}
+
+func (s *HtmlSanitizer) sanitizeAttribute(tag, name, value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	switch {
+	case numericAttributes[name]:
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			s.reject("invalid %s on <%s>", name, tag)
+			return "", false
+		}
+	case name == "href":
+		if !allowedLink(value) {
+			s.reject("link to %q", value)
+			return "", false
+		}
+	case name == "src":
+		if s.ImageSrc == nil {
+			s.reject("image %q", value)
+			return "", false
+		}
+		src, ok := s.ImageSrc(value)
+		if !ok {
+			s.reject("image %q", value)
+			return "", false
+		}
+		return src, true
+	}
+	return value, true
+}
+
+// allowedLink only lets chapters link to http, https and mailto urls.
+func allowedLink(value string) bool {
+	link, err := url.Parse(value)
+	return err == nil && (link.Scheme == "http" || link.Scheme == "https" || link.Scheme == "mailto")
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAttribute(node *html.Node, name string) bool {
+	for _, attribute := range node.Attr {
+		if attribute.Key == name {
+			return true
+		}
+	}
+	return false
+}
+
+// chapterImageSrc only lets chapters show images served by /image. Links to the public
+// url of the storage, publicUrl, are turned back into /image paths. It returns the cleaned
+// path and the storage key of the image.
+func chapterImageSrc(src, publicUrl string) (string, string, bool) {
+	if publicUrl != "" && strings.HasPrefix(src, publicUrl+"/") {
+		src = "/image/" + strings.TrimPrefix(src, publicUrl+"/")
+	}
+	link, err := url.Parse(src)
+	if err != nil || link.Scheme != "" || link.Host != "" || !strings.HasPrefix(link.Path, "/image/") {
+		return "", "", false
+	}
+	key := strings.TrimPrefix(link.Path, "/image/")
+	if !validStorageKey(key) {
+		return "", "", false
+	}
+
+	// only keep the query parameters /image understands
+	query := link.Query()
+	if _, err = ParseImageVariant(key, query.Get("w"), query.Get("fmt")); err != nil {
+		return "", "", false
+	}
+	cleanQuery := url.Values{}
+	for _, name := range []string{"w", "fmt"} {
+		if value := query.Get(name); value != "" {
+			cleanQuery.Set(name, value)
+		}
+	}
+	return (&url.URL{Path: "/image/" + key, RawQuery: cleanQuery.Encode()}).String(), key, true
+}
+
+// htmlText returns the text of a node, with the whitespace collapsed.
+func htmlText(node *html.Node) string {
+	var builder strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			builder.WriteString(n.Data)
+			builder.WriteString(" ")
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(node)
+	return strings.Join(strings.Fields(builder.String()), " ")
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHtmlSanitizer(t *testing.T) {
+	sanitizer := HtmlSanitizer{}
+	cleaned, err := sanitizer.Sanitize(`<p class="x" onclick="alert(1)">Hello <b>world</b></p>` +
+		`<script>alert(1)</script><a href="javascript:alert(1)">link</a>` +
+		`<a href="https://example.com" title="ok">ok</a><custom>kept</custom>` +
+		`<table><tr><td colspan="abc" rowspan="2">cell</td></tr></table>`)
+	assert.Nil(t, err)
+	assert.Equal(t, `<p>Hello <b>world</b></p><a>link</a><a href="https://example.com" title="ok">ok</a>kept`+
+		`<table><tbody><tr><td rowspan="2">cell</td></tr></tbody></table>`, cleaned)
+	assert.Contains(t, sanitizer.Rejected, "<script>")
+	assert.Contains(t, sanitizer.Rejected, "onclick attribute on <p>")
+	assert.Contains(t, sanitizer.Rejected, `link to "javascript:alert(1)"`)
+	assert.Contains(t, sanitizer.Rejected, "invalid colspan on <td>")
+}
+
+func TestHtmlSanitizerImages(t *testing.T) {
+	sanitizer := HtmlSanitizer{}
+	cleaned, _ := sanitizer.Sanitize(`<img src="a.png" alt="a"><p>text</p>`)
+	assert.Equal(t, `<p>text</p>`, cleaned)
+
+	sanitizer = HtmlSanitizer{ImageSrc: func(src string) (string, bool) {
+		return "/image/" + src, src == "a.png"
+	}}
+	cleaned, _ = sanitizer.Sanitize(`<img src="a.png" alt="a"><img src="b.png">`)
+	assert.Equal(t, `<img src="/image/a.png" alt="a"/>`, cleaned)
+	assert.Equal(t, []string{`image "b.png"`}, sanitizer.Rejected)
+}
+
+func TestChapterImageSrc(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+		ok       bool
+	}{
+		{"/image/abc.png", "/image/abc.png", true},
+		{"/image/abc.png?w=256&fmt=webp&x=1", "/image/abc.png?fmt=webp&w=256", true},
+		{"/image/abc.png?w=123", "", false},
+		{"/image/../secret", "", false},
+		{"https://example.com/image/abc.png", "", false},
+		{"//example.com/image/abc.png", "", false},
+		{"/static/abc.png", "", false},
+		{"data:image/png;base64,AAAA", "", false},
+		{"https://cdn.example.com/abc.png?w=64", "/image/abc.png?w=64", true},
+		{"https://cdn.example.com.evil.com/abc.png", "", false},
+	}
+	for _, test := range tests {
+		src, key, ok := chapterImageSrc(test.src, "https://cdn.example.com")
+		assert.Equal(t, test.ok, ok, test.src)
+		assert.Equal(t, test.expected, src, test.src)
+		if ok {
+			assert.Equal(t, "abc.png", key, test.src)
+		}
+	}
+}
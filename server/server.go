@@ -1,12 +1,14 @@
 package server
 
 import (
+	"github.com/dqhieuu/novo-app/config"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
 
-func Run() {
+func Run(cfg *config.Config) {
 	r := gin.Default()
+	trustProxies(r, cfg.Server.TrustedProxies)
 
 	// Global middleware
 	// Logger middleware will write the logs to gin.DefaultWriter even if you set with GIN_MODE=release.
@@ -17,47 +19,57 @@ func Run() {
 	r.Use(gin.Recovery())
 
 	// CORS middleware allows cross-origin requests
-	config := cors.DefaultConfig()
-	//config.AllowOrigins = []
-	//config.AllowCredentials = true
-	config.AllowAllOrigins = true
-	config.AllowHeaders = []string{"Origin", "Content-Length", "Content-Type", "Authorization"}
-	r.Use(cors.New(config))
+	r.Use(cors.New(corsConfig(cfg.Cors)))
 
-	r.Use(cors.Default())
-
-	InitOauth()
+	InitOauth(cfg)
+	InitTokenSigning(cfg.Auth)
+	InitMail(cfg)
+	InitLoginThrottle(cfg.Login)
+	InitRateLimit(cfg.RateLimit)
+	InitStorage(cfg.Images)
+	StartImageCollector(cfg.Images)
 
 	// Auth middleware
-	authMiddleware := AuthMiddleware()
+	authMiddleware := AuthMiddleware(cfg.Auth)
+
+	// Rate limits of the route groups, per user on the routes with a token and per ip else
+	writeLimit := LimitRate(WriteRateLimit(cfg.RateLimit))
+	search := r.Group("", LimitRate(SearchRateLimit(cfg.RateLimit)))
 
 	// For Password login
 	r.POST("/login", authMiddleware.LoginHandler)
 	// For Oauth login
 	r.GET("/login", authMiddleware.LoginHandler)
 
+	r.POST("/login/two-factor", TwoFactorLoginHandler(authMiddleware, SessionLifetime(cfg.Auth)))
+	r.POST("/login/two-factor/enroll", EnrollmentChallengeHandler)
+
 	r.POST("/register", RegisterPasswordHandler)
+	r.POST("/verify-email", VerifyEmailHandler)
+	r.POST("/password-reset", writeLimit, RequestPasswordResetHandler(ResetRateLimit(cfg.RateLimit)))
+	r.POST("/password-reset/confirm", ResetPasswordHandler)
 
-	r.GET("/oauth/google", GoogleOauthRedirect)
+	r.GET("/oauth/:provider", OauthRedirectHandler)
 
-	r.POST("/auth/upload/:imageType", UploadImageHandler)
-	r.Static("/image", "static/images")
+	r.POST("/auth/upload/:imageType", writeLimit, UploadImageHandler(cfg.Images))
+	r.GET("/image/*path", GetImageHandler(cfg.Images))
 
 	r.GET("/chapter/:chapterId", GetBookChapterContentHandler)
 	r.GET("/genre/all", ListAllGenresHandler)
 	r.GET("/comment", GetCommentsHandler)
 	r.GET("/genre/:genreId", GetBookByGenreHandler)
-	r.GET("/search-suggest/:query", GetSearchSuggestionHandler)
-	r.GET("/search/:query", GetSearchResultHandler)
+	search.GET("/search-suggest/:query", GetSearchSuggestionHandler)
+	search.GET("/search/:query", GetSearchResultHandler)
 	r.GET("/book/latest", GetLatestBookGroupsHandler)
 	r.GET("/book/random", GetRandomBookGroups)
 	r.GET("/user/:userId", GetUserInfoByIdHandler)
 	r.GET("/book/top/:type", GetBookGroupsByViewHandler)
 
 	r.GET("/author/:authorId", GetAuthorInfoHandler)
-	r.GET("/search-author/:query", SearchAuthorHandler)
-	r.GET("/search-user/:query", SearchUserHandler)
+	search.GET("/search-author/:query", SearchAuthorHandler)
+	search.GET("/search-user/:query", SearchUserHandler)
 	r.GET("/book/:bookGroupId", GetBookGroupContentHandler)
+	r.GET("/book/:bookGroupId/export", authMiddleware.MiddlewareFunc(), RequireSession, RequirePermission(BookGroupModule, ExportAction, nil), ExportBookGroupHandler)
 	r.GET("/comment/latest", GetLatestCommentsHandler)
 	//r.GET("/test", func(c *gin.Context){
 	//	testString := c.Param("testId")
@@ -68,30 +80,81 @@ func Run() {
 
 	auth := r.Group("/auth")
 
-	auth.POST("/refresh-token", authMiddleware.RefreshHandler)
+	auth.POST("/refresh-token", RefreshHandler(authMiddleware, SessionLifetime(cfg.Auth)))
 	{
-		auth.Use(authMiddleware.MiddlewareFunc())
-		auth.POST("/logout", authMiddleware.LogoutHandler)
+		auth.Use(authMiddleware.MiddlewareFunc(), RequireSession)
+		auth.POST("/logout", LogoutHandler(authMiddleware))
+		auth.POST("/logout-all", LogoutAllHandler(authMiddleware))
 		auth.GET("/role", GetRoleHandler)
-		auth.POST("/author", CreateAuthorHandler)
-		auth.PATCH("/author/:authorId", UpdateAuthorHandler)
-		auth.DELETE("/author/:authorId", DeleteAuthorHandler)
+		auth.POST("/author", RequirePermission(AuthorModule, PostAction, nil), CreateAuthorHandler)
+		auth.PATCH("/author/:authorId", RequirePermission(AuthorModule, ModifyAction, BookAuthorOwner), UpdateAuthorHandler)
+		auth.DELETE("/author/:authorId", RequirePermission(AuthorModule, DeleteAction, BookAuthorOwner), DeleteAuthorHandler)
 		auth.POST("/complete-oauth-register", CompleteOauthAccountHandler)
-		auth.POST("/book", CreateBookGroupHandler)
-		auth.POST("/chapter/hypertext", CreateHypertextChapterHandler)
-		auth.POST("/chapter/images", CreateImagesChapterHandler)
-		auth.POST("/comment", CreateCommentHandler)
-		auth.DELETE("chapter/:chapterId", DeleteBookChapterHandler)
-		auth.DELETE("/comment/:commentId", DeleteCommentHandler)
-		auth.PATCH("/comment/:commentId", EditCommentHandler)
-		auth.POST("/like/:bookGroupId/:operation", LikeOperationHandler)
-		auth.DELETE("/book/:bookGroupId", DeleteBookGroupHandler)
-		auth.PATCH("/book/:bookGroupId", UpdateBookGroupHandler)
-		auth.PATCH("/chapter/hypertext/:chapterId", UpdateHypertextChapter)
-		auth.PATCH("/chapter/images/:chapterId", UpdateImagesChapterHandler)
+		auth.POST("/book", RequirePermission(BookGroupModule, PostAction, nil), CreateBookGroupHandler)
+		auth.POST("/chapter/hypertext", RequirePermission(BookChapterModule, PostAction, nil), CreateHypertextChapterHandler(cfg.Images))
+		auth.POST("/chapter/images", RequirePermission(BookChapterModule, PostAction, nil), CreateImagesChapterHandler)
+		auth.POST("/chapter/archive", RequirePermission(BookChapterModule, PostAction, nil), CreateArchiveChapterHandler(cfg.Images))
+		auth.POST("/chapter/epub", RequirePermission(BookChapterModule, PostAction, nil), CreateEpubChaptersHandler(cfg.Images))
+		auth.POST("/comment", writeLimit, RequirePermission(CommentModule, PostAction, nil), CreateCommentHandler)
+		auth.DELETE("chapter/:chapterId", RequirePermission(BookChapterModule, DeleteAction, BookChapterOwner), DeleteBookChapterHandler)
+		auth.DELETE("/comment/:commentId", RequirePermission(CommentModule, DeleteAction, CommentOwner), DeleteCommentHandler)
+		auth.PATCH("/comment/:commentId", RequirePermission(CommentModule, ModifyAction, CommentOwner), EditCommentHandler)
+		auth.POST("/like/:bookGroupId/:operation", writeLimit, RequirePermission(LikeModule, PostAction, nil), LikeOperationHandler)
+		auth.DELETE("/book/:bookGroupId", RequirePermission(BookGroupModule, DeleteAction, BookGroupOwner), DeleteBookGroupHandler)
+		auth.PATCH("/book/:bookGroupId", RequirePermission(BookGroupModule, ModifyAction, BookGroupOwner), UpdateBookGroupHandler)
+		auth.PATCH("/chapter/hypertext/:chapterId", RequirePermission(BookChapterModule, ModifyAction, BookChapterOwner), UpdateHypertextChapter(cfg.Images))
+		auth.PATCH("/chapter/images/:chapterId", RequirePermission(BookChapterModule, ModifyAction, BookChapterOwner), UpdateImagesChapterHandler)
 		auth.PATCH("/change-user-info", ChangeCurrentUserInfoHandler)
 		auth.PATCH("/change-password", ChangeCurrentUserPasswordHandler)
-		auth.PATCH("/role", SetRoleHandler)
+		auth.POST("/password", SetPasswordHandler)
+		auth.POST("/verify-email/resend", ResendVerificationHandler)
+		auth.GET("/two-factor", TwoFactorStatusHandler)
+		auth.POST("/two-factor/enroll", EnrollTotpHandler)
+		auth.POST("/two-factor/confirm", ConfirmTotpHandler)
+		auth.POST("/two-factor/recovery-codes", RecoveryCodesHandler)
+		auth.POST("/two-factor/disable", DisableTotpHandler)
+		auth.GET("/login-methods", LoginMethodsHandler)
+		auth.GET("/oauth/:provider/link", OauthLinkHandler)
+		auth.POST("/identities", LinkIdentityHandler)
+		auth.DELETE("/identities/:provider/:subject", UnlinkIdentityHandler)
+		auth.PATCH("/role", RequirePermission(RoleModule, ModifyAction, nil), SetRoleHandler)
+		auth.GET("/admin/images/gc", RequirePermission(ImageModule, DeleteAction, nil), ImageGCReportHandler(cfg.Images))
+		auth.GET("/admin/audit", RequirePermission(RoleModule, ModifyAction, nil), AuditHandler)
+		auth.GET("/admin/lockouts", RequirePermission(RoleModule, ModifyAction, nil), LoginLockoutsHandler)
+		auth.DELETE("/admin/users/:userId/lockout", RequirePermission(RoleModule, ModifyAction, nil), UnlockAccountHandler)
+		auth.GET("/admin/users/:userId/login-attempts", RequirePermission(RoleModule, ModifyAction, nil), UserLoginAttemptsHandler)
+		roles := auth.Group("/admin/roles", RequirePermission(RoleModule, ModifyAction, nil))
+		roles.GET("", ListRolesHandler)
+		roles.POST("", CreateRoleHandler)
+		roles.PATCH("/:roleId", UpdateRoleHandler)
+		roles.DELETE("/:roleId", DeleteRoleHandler)
+		roles.PUT("/:roleId/two-factor", SetRoleTwoFactorHandler)
+		roles.POST("/:roleId/permissions", GrantPermissionHandler)
+		roles.DELETE("/:roleId/permissions/:module/:action", RevokePermissionHandler)
+		auth.POST("/upload/session", CreateUploadSessionHandler)
+		auth.GET("/upload/session/:sessionId", GetUploadSessionHandler)
+		auth.PATCH("/upload/session/:sessionId", AppendUploadSessionHandler(cfg.Images))
+		auth.POST("/upload/session/:sessionId/complete", CompleteUploadSessionHandler)
+		auth.DELETE("/upload/session/:sessionId", DeleteUploadSessionHandler)
+	}
+	_ = r.Run(cfg.Server.Address)
+}
+
+// trustProxies only takes the client ip from the headers of the requests sent by proxies,
+// gin trusts every address otherwise. The list is applied by Run.
+func trustProxies(r *gin.Engine, proxies []string) {
+	r.TrustedProxies = append([]string{}, proxies...)
+}
+
+func corsConfig(cfg config.Cors) cors.Config {
+	corsConfig := cors.DefaultConfig()
+	if cfg.AllowAllOrigins() {
+		corsConfig.AllowAllOrigins = true
+	} else {
+		corsConfig.AllowOrigins = cfg.AllowOrigins
 	}
-	_ = r.Run() // listen and serve on 0.0.0.0:8080 (for windows "localhost:8080")
+	corsConfig.AllowCredentials = cfg.AllowCredentials
+	corsConfig.AllowHeaders = cfg.AllowHeaders
+	corsConfig.ExposeHeaders = []string{"Retry-After"}
+	return corsConfig
 }
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"errors"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"net/http"
+	"time"
+)
+
+// Every login opens a session, its id is the jti claim of the tokens. Tokens of a
+// revoked or expired session are refused even when their signature is still valid.
+
+var ErrSessionRevoked = errors.New("session revoked or expired, log in again")
+
+const SessionIdClaimKey = "jti"
+
+// SessionLifetime is how long a session lasts after its token was issued or last refreshed.
+func SessionLifetime(cfg config.Auth) time.Duration {
+	if cfg.MaxRefresh > cfg.Timeout {
+		return cfg.MaxRefresh
+	}
+	return cfg.Timeout
+}
+
+// CreateSession opens a session for the user and returns its id. The expired sessions of
+// the user are dropped on the way.
+func CreateSession(userId int32, lifetime time.Duration) (string, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	err := queries.DeleteExpiredSessions(ctx, userId)
+	if err != nil {
+		return "", errors.New("error deleting expired sessions: " + err.Error())
+	}
+	sessionId := uuid.NewString()
+	err = queries.InsertSession(ctx, db.InsertSessionParams{
+		ID:          sessionId,
+		UserID:      userId,
+		DateExpires: time.Now().Add(lifetime),
+	})
+	if err != nil {
+		return "", errors.New("error creating session: " + err.Error())
+	}
+	return sessionId, nil
+}
+
+// sessionActive reads the session from the database, tests replace it.
+var sessionActive = func(sessionId string, userId int32) (bool, error) {
+	return db.New(db.Pool()).SessionActive(context.Background(), db.SessionActiveParams{
+		ID:     sessionId,
+		UserID: userId,
+	})
+}
+
+func RevokeSession(sessionId string) error {
+	err := db.New(db.Pool()).RevokeSession(context.Background(), sessionId)
+	if err != nil {
+		return errors.New("error revoking session: " + err.Error())
+	}
+	return nil
+}
+
+// RevokeUserSessions logs the user out of every device and returns how many sessions were open.
+func RevokeUserSessions(userId int32) (int64, error) {
+	revoked, err := db.New(db.Pool()).RevokeUserSessions(context.Background(), userId)
+	if err != nil {
+		return 0, errors.New("error revoking sessions: " + err.Error())
+	}
+	return revoked, nil
+}
+
+// RevokeOtherUserSessions logs the user out of every device but the one of sessionId.
+func RevokeOtherUserSessions(userId int32, sessionId string) (int64, error) {
+	revoked, err := db.New(db.Pool()).RevokeOtherUserSessions(context.Background(), db.RevokeOtherUserSessionsParams{
+		UserID: userId,
+		ID:     sessionId,
+	})
+	if err != nil {
+		return 0, errors.New("error revoking sessions: " + err.Error())
+	}
+	return revoked, nil
+}
+
+// tokenSession returns the user and the session of the claims, false when the token has none.
+func tokenSession(claims map[string]interface{}) (int32, string, bool) {
+	userId, ok := claims[UserIdClaimKey].(float64)
+	if !ok {
+		return 0, "", false
+	}
+	sessionId, ok := claims[SessionIdClaimKey].(string)
+	if !ok || sessionId == "" {
+		return 0, "", false
+	}
+	return int32(userId), sessionId, true
+}
+
+// RequireSession goes after the jwt middleware, it refuses the tokens of the sessions that
+// were revoked or expired with a 401.
+func RequireSession(c *gin.Context) {
+	userId, sessionId, ok := tokenSession(jwt.ExtractClaims(c))
+	if !ok {
+		abortWithError(c, ErrSessionRevoked, http.StatusUnauthorized)
+		return
+	}
+	active, err := sessionActive(sessionId, userId)
+	if err != nil {
+		abortWithError(c, err, http.StatusInternalServerError)
+		return
+	}
+	if !active {
+		abortWithError(c, ErrSessionRevoked, http.StatusUnauthorized)
+		return
+	}
+	c.Next()
+}
+
+// LogoutHandler revokes the session of the token before clearing the cookies.
+func LogoutHandler(authMiddleware *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, sessionId, _ := tokenSession(jwt.ExtractClaims(c))
+		err := RevokeSession(sessionId)
+		if err != nil {
+			ReportError(c, err, "error", http.StatusInternalServerError)
+			return
+		}
+		setRefreshCookie(c, "", -1)
+		authMiddleware.LogoutHandler(c)
+	}
+}
+
+// LogoutAllHandler revokes every session of the user, the current one included.
+func LogoutAllHandler(authMiddleware *jwt.GinJWTMiddleware) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId, _, _ := tokenSession(jwt.ExtractClaims(c))
+		_, err := RevokeUserSessions(userId)
+		if err != nil {
+			ReportError(c, err, "error", http.StatusInternalServerError)
+			return
+		}
+		setRefreshCookie(c, "", -1)
+		authMiddleware.LogoutHandler(c)
+	}
+}
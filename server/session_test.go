@@ -0,0 +1,113 @@
+package server
+
+import (
+	"errors"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionLifetime(t *testing.T) {
+	assert.Equal(t, 2*time.Hour, SessionLifetime(config.Auth{Timeout: time.Hour, MaxRefresh: 2 * time.Hour}))
+	assert.Equal(t, time.Hour, SessionLifetime(config.Auth{Timeout: time.Hour}))
+}
+
+func TestRequireSession(t *testing.T) {
+	oldSessionActive := sessionActive
+	defer func() {
+		sessionActive = oldSessionActive
+	}()
+	sessionActive = func(sessionId string, userId int32) (bool, error) {
+		switch sessionId {
+		case "broken":
+			return false, errors.New("broken")
+		case "active":
+			return userId == 1, nil
+		}
+		return false, nil
+	}
+
+	gin.SetMode(gin.TestMode)
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		code   int
+	}{
+		{"active session", jwt.MapClaims{UserIdClaimKey: float64(1), SessionIdClaimKey: "active"}, 200},
+		{"session of another user", jwt.MapClaims{UserIdClaimKey: float64(2), SessionIdClaimKey: "active"}, 401},
+		{"revoked session", jwt.MapClaims{UserIdClaimKey: float64(1), SessionIdClaimKey: "revoked"}, 401},
+		{"token without session", jwt.MapClaims{UserIdClaimKey: float64(1)}, 401},
+		{"database error", jwt.MapClaims{UserIdClaimKey: float64(1), SessionIdClaimKey: "broken"}, 500},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/", func(c *gin.Context) {
+				c.Set("JWT_PAYLOAD", test.claims)
+			}, RequireSession, func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/", nil)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, test.code, w.Code)
+		})
+	}
+}
+
+func TestSessions(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	username, email := "testsessionuser", "session@atest.com"
+	user, _, err := CreateAccount(username, "secretpw", email, MemberRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = DeleteAccount(username)
+	}()
+
+	phone, err := CreateSession(user.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := CreateSession(user.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := sessionActive(phone, user.ID)
+	assert.Nil(t, err)
+	assert.True(t, active)
+	active, _ = sessionActive(phone, user.ID+1)
+	assert.False(t, active)
+
+	// changing the password keeps the current session only
+	revoked, err := RevokeOtherUserSessions(user.ID, phone)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), revoked)
+	active, _ = sessionActive(laptop, user.ID)
+	assert.False(t, active)
+
+	assert.Nil(t, RevokeSession(phone))
+	active, _ = sessionActive(phone, user.ID)
+	assert.False(t, active)
+
+	// a new role ends every session
+	tablet, err := CreateSession(user.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, AssignRole(user.ID, BannedRole))
+	active, _ = sessionActive(tablet, user.ID)
+	assert.False(t, active)
+	revoked, err = RevokeUserSessions(user.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), revoked)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/dqhieuu/novo-app/config"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage is where image files live. Keys are slash separated and relative to the
+// storage root (e.g. "chapter-image/<uuid>.jpg"); they are what images.path keeps,
+// so the database does not depend on which backend is in use.
+type Storage interface {
+	Save(ctx context.Context, key string, data io.Reader, size int64, contentType string) error
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Delete(ctx context.Context, key string) error
+}
+
+const (
+	LocalStorageType = config.LocalStorage
+	S3StorageType    = config.S3Storage
+)
+
+var ErrImageNotFound = errors.New("image not found")
+
+var imageStorage Storage
+
+// publicImageUrl is the base url (usually a CDN) the files are publicly reachable at, without
+// its trailing slash. When it is empty, /image streams the files from the storage itself.
+func publicImageUrl(cfg config.Images) string {
+	return strings.TrimSuffix(cfg.PublicURL, "/")
+}
+
+// NewStorage creates the storage backend cfg chooses.
+func NewStorage(cfg config.Images) (Storage, error) {
+	switch cfg.Storage {
+	case LocalStorageType:
+		return NewLocalStorage(cfg.RootFolder), nil
+	case S3StorageType:
+		s3Storage, err := NewS3Storage(S3Config{
+			Endpoint:  cfg.S3.Endpoint,
+			AccessKey: cfg.S3.AccessKey,
+			SecretKey: cfg.S3.SecretKey.Value(),
+			Bucket:    cfg.S3.Bucket,
+			Region:    cfg.S3.Region,
+			UseSSL:    cfg.S3.UseSSL,
+		})
+		if err != nil {
+			return nil, errors.New("error initializing s3 storage: " + err.Error())
+		}
+		return s3Storage, nil
+	default:
+		return nil, errors.New("unsupported image storage: " + cfg.Storage)
+	}
+}
+
+// InitStorage sets up the image storage backend.
+func InitStorage(cfg config.Images) {
+	if imageStorage != nil {
+		return
+	}
+	storage, err := NewStorage(cfg)
+	if err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	imageStorage = storage
+}
+
+// ImageStorage returns the configured storage, falling back to the default local folder
+// when InitStorage has not been called (e.g. in tests).
+func ImageStorage() Storage {
+	if imageStorage == nil {
+		imageStorage = NewLocalStorage(config.Default().Images.RootFolder)
+	}
+	return imageStorage
+}
+
+func SetImageStorage(storage Storage) {
+	imageStorage = storage
+}
+
+// validStorageKey rejects keys that could escape the storage root.
+func validStorageKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+type LocalStorage struct {
+	Root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+func (s *LocalStorage) fullPath(key string) (string, error) {
+	if !validStorageKey(key) {
+		return "", errors.New("invalid storage key: " + key)
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalStorage) Save(_ context.Context, key string, data io.Reader, _ int64, _ string) error {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+	if err != nil {
+		return errors.New("error checking directory: " + err.Error())
+	}
+
+	// written next to the key then renamed, so that a failed write never leaves a
+	// truncated file to be served and cached as the image
+	file, err := os.CreateTemp(filepath.Dir(fullPath), "."+filepath.Base(fullPath)+".*.tmp")
+	if err != nil {
+		return errors.New("error creating new file: " + err.Error())
+	}
+	_, err = io.Copy(file, data)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), fullPath)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return errors.New("error copying file: " + err.Error())
+	}
+	return nil
+}
+
+func (s *LocalStorage) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrImageNotFound
+		}
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *LocalStorage) Exists(_ context.Context, key string) (bool, error) {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(fullPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *LocalStorage) Delete(_ context.Context, key string) error {
+	fullPath, err := s.fullPath(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(fullPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
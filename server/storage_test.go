@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a tiny in-memory stand-in for MinIO, answering path-style object requests.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+			data = decodeAwsChunked(data)
+		}
+		f.objects[key] = data
+		sum := md5.Sum(data)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				_, _ = w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>not found</Message></Error>`))
+			}
+			return
+		}
+		sum := md5.Sum(data)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// decodeAwsChunked strips the "<size>;chunk-signature=...\r\n" framing of signed streaming uploads
+func decodeAwsChunked(body []byte) []byte {
+	var data []byte
+	for {
+		lineEnd := bytes.Index(body, []byte("\r\n"))
+		if lineEnd < 0 {
+			return data
+		}
+		header := string(body[:lineEnd])
+		size, err := strconv.ParseInt(strings.SplitN(header, ";", 2)[0], 16, 64)
+		if err != nil || size == 0 {
+			return data
+		}
+		body = body[lineEnd+2:]
+		data = append(data, body[:size]...)
+		body = body[size+2:]
+	}
+}
+
+func testStorageRoundTrip(t *testing.T, storage Storage) {
+	ctx := context.Background()
+	key := "test/round-trip.png"
+	content := []byte("not really a png")
+
+	exists, err := storage.Exists(ctx, key)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	_, err = storage.Open(ctx, key)
+	assert.Equal(t, ErrImageNotFound, err)
+
+	err = storage.Save(ctx, key, bytes.NewReader(content), int64(len(content)), "image/png")
+	if err != nil {
+		t.Fatalf("Error saving object: %s\n", err)
+	}
+
+	exists, err = storage.Exists(ctx, key)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	file, err := storage.Open(ctx, key)
+	if err != nil {
+		t.Fatalf("Error opening object: %s\n", err)
+	}
+	data, err := ioutil.ReadAll(file)
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	assert.Equal(t, content, data)
+
+	assert.Nil(t, storage.Delete(ctx, key))
+	exists, err = storage.Exists(ctx, key)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	err = storage.Save(ctx, "../escape.png", bytes.NewReader(content), int64(len(content)), "image/png")
+	assert.NotNil(t, err)
+}
+
+func TestLocalStorage(t *testing.T) {
+	testStorageRoundTrip(t, NewLocalStorage(t.TempDir()))
+}
+
+// failingReader fails after its content, like a full disk or a dropped upload.
+type failingReader struct {
+	content io.Reader
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	if err == io.EOF {
+		return n, errors.New("read failed")
+	}
+	return n, err
+}
+
+func TestLocalStorageFailedSave(t *testing.T) {
+	root := t.TempDir()
+	storage := NewLocalStorage(root)
+	ctx := context.Background()
+	content := []byte("complete image")
+	err := storage.Save(ctx, "test/image.png", bytes.NewReader(content), int64(len(content)), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed write leaves the previous file, and nothing else
+	err = storage.Save(ctx, "test/image.png", &failingReader{content: strings.NewReader("trunc")}, 100, "image/png")
+	assert.NotNil(t, err)
+	file, err := storage.Open(ctx, "test/image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(file)
+	_ = file.Close()
+	assert.Equal(t, content, data)
+	files, _ := ioutil.ReadDir(filepath.Join(root, "test"))
+	assert.Len(t, files, 1)
+
+	err = storage.Save(ctx, "test/other.png", &failingReader{content: strings.NewReader("trunc")}, 100, "image/png")
+	assert.NotNil(t, err)
+	exists, _ := storage.Exists(ctx, "test/other.png")
+	assert.False(t, exists)
+}
+
+func TestS3Storage(t *testing.T) {
+	fake := httptest.NewServer(&fakeS3{objects: map[string][]byte{}})
+	defer fake.Close()
+
+	storage, err := NewS3Storage(S3Config{
+		Endpoint:  strings.TrimPrefix(fake.URL, "http://"),
+		AccessKey: "minioadmin",
+		SecretKey: "minioadmin",
+		Bucket:    "novo",
+	})
+	if err != nil {
+		t.Fatalf("Error creating s3 storage: %s\n", err)
+	}
+	testStorageRoundTrip(t, storage)
+}
+
+func TestValidStorageKey(t *testing.T) {
+	assert.True(t, validStorageKey("chapter-image/abc.jpg"))
+	assert.True(t, validStorageKey("abc.jpg"))
+	assert.False(t, validStorageKey(""))
+	assert.False(t, validStorageKey("/etc/passwd"))
+	assert.False(t, validStorageKey("chapter-image/../../etc/passwd"))
+	assert.False(t, validStorageKey("chapter-image//abc.jpg"))
+	assert.False(t, validStorageKey(`chapter-image\abc.jpg`))
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/dqhieuu/novo-app/config"
+)
+
+// tokenKey signs the tokens the database keeps, InitTokenSigning sets it to the JWT key.
+var tokenKey []byte
+
+// InitTokenSigning sets the key of signToken.
+func InitTokenSigning(cfg config.Auth) {
+	tokenKey = []byte(cfg.JwtKey.Value())
+}
+
+// signToken is what the database keeps of a token used for purpose: neither a leaked
+// database gives usable tokens nor writing to it makes new ones.
+func signToken(token, purpose string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(purpose + ":" + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,12 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSignToken(t *testing.T) {
+	assert.Equal(t, signToken("token", VerifyEmailPurpose), signToken("token", VerifyEmailPurpose))
+	assert.NotEqual(t, signToken("token", VerifyEmailPurpose), signToken("token", ResetPasswordPurpose))
+	assert.NotEqual(t, signToken("token", VerifyEmailPurpose), signToken("other", VerifyEmailPurpose))
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA-1 test vectors of RFC 6238, with 6 digits
+var rfcTotpSecret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestTotpCode(t *testing.T) {
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		code, err := totpCode(rfcTotpSecret, totpStep(time.Unix(unix, 0)))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, code, unix)
+	}
+	_, err := totpCode("not base32!", 1)
+	assert.NotNil(t, err)
+}
+
+func TestValidateTotp(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+
+	got, ok := validateTotp(rfcTotpSecret, "005924", now)
+	assert.True(t, ok)
+	assert.Equal(t, step, got)
+	_, ok = validateTotp(rfcTotpSecret, "005 924", now)
+	assert.True(t, ok)
+
+	// a step late or early is still fine, not two
+	got, ok = validateTotp(rfcTotpSecret, "005924", now.Add(totpPeriod*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, step, got)
+	_, ok = validateTotp(rfcTotpSecret, "005924", now.Add(-totpPeriod*time.Second))
+	assert.True(t, ok)
+	_, ok = validateTotp(rfcTotpSecret, "005924", now.Add(2*totpPeriod*time.Second))
+	assert.False(t, ok)
+
+	_, ok = validateTotp(rfcTotpSecret, "005925", now)
+	assert.False(t, ok)
+	_, ok = validateTotp(rfcTotpSecret, "05924", now)
+	assert.False(t, ok)
+}
+
+func TestTotpURI(t *testing.T) {
+	secret, err := generateTotpSecret()
+	assert.Nil(t, err)
+	assert.Len(t, secret, 32)
+
+	uri, err := url.Parse(totpURI(secret, "user@atest.com"))
+	assert.Nil(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Novo:user@atest.com", uri.Path)
+	assert.Equal(t, secret, uri.Query().Get("secret"))
+	assert.Equal(t, TotpIssuer, uri.Query().Get("issuer"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code, err := newRecoveryCode()
+	assert.Nil(t, err)
+	assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, code)
+	assert.Equal(t, normalizeRecoveryCode(code), normalizeRecoveryCode(" "+strings.ToUpper(code)))
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/jackc/pgx/v4"
+)
+
+// beginTx starts the transactions of RunInTx, tests replace it to inject failures.
+var beginTx = func(ctx context.Context) (pgx.Tx, error) {
+	return db.Pool().Begin(ctx)
+}
+
+// RunInTx runs fn with queries bound to a single transaction, committed when fn returns nil
+// and rolled back otherwise. Repository calls made through queries succeed or fail together.
+func RunInTx(ctx context.Context, fn func(queries *db.Queries) error) error {
+	tx, err := beginTx(ctx)
+	if err != nil {
+		return errors.New("error starting transaction: " + err.Error())
+	}
+	defer func() {
+		_ = tx.Rollback(ctx)
+	}()
+
+	err = fn(db.New(db.Pool()).WithTx(tx))
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return errors.New("error committing transaction: " + err.Error())
+	}
+	return nil
+}
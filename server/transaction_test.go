@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var errInjected = errors.New("injected failure")
+
+// fakeTx records the statements sent to it and fails the failAt-th one (counting from 1).
+type fakeTx struct {
+	pgx.Tx
+	failAt     int
+	failCommit bool
+	statements int
+	committed  bool
+	rolledBack bool
+}
+
+type fakeRow struct {
+	err error
+}
+
+func (r fakeRow) Scan(...interface{}) error {
+	return r.err
+}
+
+func (tx *fakeTx) statement() error {
+	tx.statements++
+	if tx.statements == tx.failAt {
+		return errInjected
+	}
+	return nil
+}
+
+func (tx *fakeTx) Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error) {
+	return nil, tx.statement()
+}
+
+func (tx *fakeTx) Query(context.Context, string, ...interface{}) (pgx.Rows, error) {
+	return nil, errors.New("not supported by fakeTx")
+}
+
+func (tx *fakeTx) QueryRow(context.Context, string, ...interface{}) pgx.Row {
+	return fakeRow{tx.statement()}
+}
+
+func (tx *fakeTx) Commit(context.Context) error {
+	if tx.failCommit {
+		return errInjected
+	}
+	tx.committed = true
+	return nil
+}
+
+func (tx *fakeTx) Rollback(context.Context) error {
+	if tx.committed {
+		return pgx.ErrTxClosed
+	}
+	tx.rolledBack = true
+	return nil
+}
+
+func useFakeTx(t *testing.T, tx *fakeTx) {
+	previous := beginTx
+	beginTx = func(context.Context) (pgx.Tx, error) {
+		return tx, nil
+	}
+	t.Cleanup(func() {
+		beginTx = previous
+	})
+}
+
+func TestRunInTx(t *testing.T) {
+	tx := &fakeTx{}
+	useFakeTx(t, tx)
+	err := RunInTx(context.Background(), func(queries *db.Queries) error {
+		return queries.DeleteTempImage(context.Background(), 1)
+	})
+	assert.Nil(t, err)
+	assert.True(t, tx.committed)
+	assert.False(t, tx.rolledBack)
+
+	tx = &fakeTx{failCommit: true}
+	useFakeTx(t, tx)
+	err = RunInTx(context.Background(), func(queries *db.Queries) error {
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.True(t, tx.rolledBack)
+
+	beginTx = func(context.Context) (pgx.Tx, error) {
+		return nil, errInjected
+	}
+	called := false
+	err = RunInTx(context.Background(), func(queries *db.Queries) error {
+		called = true
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.False(t, called)
+}
+
+func TestCreateBookGroupRollback(t *testing.T) {
+	input := &InputBookGroup{
+		Title:       "title",
+		GenreIds:    []int32{1, 2},
+		AuthorIds:   []int32{3},
+		CoverArtIds: []int32{4, 5},
+	}
+
+	tx := &fakeTx{}
+	useFakeTx(t, tx)
+	_, err := CreateBookGroup(input)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, tx.statements)
+	assert.True(t, tx.committed)
+
+	// fail on the author, after the group and its genres were inserted
+	tx = &fakeTx{failAt: 4}
+	useFakeTx(t, tx)
+	_, err = CreateBookGroup(input)
+	assert.NotNil(t, err)
+	assert.Equal(t, 4, tx.statements)
+	assert.False(t, tx.committed)
+	assert.True(t, tx.rolledBack)
+}
+
+func TestUpdateBookGroupRollback(t *testing.T) {
+	tx := &fakeTx{failAt: 5}
+	useFakeTx(t, tx)
+	err := UpdateBookGroup(1, &InputBookGroup{
+		Title:       "title",
+		GenreIds:    []int32{1},
+		AuthorIds:   []int32{2, 3},
+		CoverArtIds: []int32{4},
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 5, tx.statements)
+	assert.False(t, tx.committed)
+	assert.True(t, tx.rolledBack)
+}
+
+func TestChapterRollback(t *testing.T) {
+	// insert the chapter, then an image and its temp image row, then fail on the second image
+	tx := &fakeTx{failAt: 4}
+	useFakeTx(t, tx)
+	_, err := CreateImagesChapter(1, "", []int32{1, 2, 3}, 1, 1)
+	assert.NotNil(t, err)
+	assert.Equal(t, 4, tx.statements)
+	assert.True(t, tx.rolledBack)
+
+	tx = &fakeTx{failAt: 3}
+	useFakeTx(t, tx)
+	err = UpdateBookChapter(UpdateChapterParams{Id: 1, ChapterNumber: 1, Images: []int32{1, 2}})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, tx.statements)
+	assert.True(t, tx.rolledBack)
+}
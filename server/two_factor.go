@@ -0,0 +1,633 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Users can add a TOTP second factor to their account, roles can require it. The password
+// or OAuth login of such a user then only returns a login challenge, traded for the tokens
+// at POST /login/two-factor with a code of the authenticator app or a recovery code. A user
+// of a role requiring it who hasn't enrolled yet is mailed a link instead: a password alone
+// doesn't give the secret, the link trades for it and a challenge whose first code enables it.
+// Logged in users enroll from their session.
+
+var (
+	ErrSecondFactorRequired    = errors.New("a two-factor code is required")
+	ErrInvalidLoginChallenge   = errors.New("the login challenge is invalid or expired, log in again")
+	ErrInvalidTotpCode         = errors.New("invalid two-factor code")
+	ErrTotpAlreadyEnabled      = errors.New("two-factor authentication is already enabled")
+	ErrTotpNotEnrolled         = errors.New("two-factor authentication isn't enabled")
+	ErrTwoFactorRequiredByRole = errors.New("the role of the account requires two-factor authentication")
+	ErrTwoFactorEnrollMailed   = errors.New("the role of the account requires two-factor authentication, a link to set it up was sent to the email of the account")
+)
+
+const (
+	LoginChallengeTTL = 5 * time.Minute
+	// maxChallengeAttempts is how many codes a login challenge takes, log in again after.
+	maxChallengeAttempts = 5
+	recoveryCodeCount    = 10
+
+	loginChallengePurpose = "login_challenge"
+	recoveryCodePurpose   = "recovery_code"
+	EnrollTotpPurpose     = "enroll_totp"
+
+	// loginChallengeKey is where the authenticator leaves the challenge of a login.
+	loginChallengeKey = "loginChallenge"
+	// recoveryCodesKey is where the login leaves the recovery codes made by enabling TOTP.
+	recoveryCodesKey = "recoveryCodes"
+)
+
+// LoginChallenge is answered to a login needing a second factor. Enroll is set when the
+// user opened the enrollment link and sets up the authenticator app first, with Secret and URI.
+type LoginChallenge struct {
+	Challenge string `json:"challenge"`
+	Enroll    bool   `json:"enroll"`
+	Secret    string `json:"secret,omitempty"`
+	URI       string `json:"uri,omitempty"`
+}
+
+type TwoFactorLogin struct {
+	Challenge string `json:"challenge" binding:"required"`
+	Code      string `json:"code" binding:"required"`
+}
+
+type TotpCodeInput struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TwoFactorStatus struct {
+	Enabled           bool  `json:"enabled"`
+	Required          bool  `json:"required"`
+	RecoveryCodesLeft int64 `json:"recoveryCodesLeft"`
+}
+
+// userTotp returns the TOTP of the user, nil when there is none.
+func userTotp(ctx context.Context, queries *db.Queries, userId int32) (*db.UserTotp, error) {
+	totp, err := queries.UserTotp(ctx, userId)
+	if err == pgx.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &totp, nil
+}
+
+func totpEnabled(totp *db.UserTotp) bool {
+	return totp != nil && totp.DateEnabled.Valid
+}
+
+// setPendingTotp gives the user a new secret, enabled by its first code.
+func setPendingTotp(ctx context.Context, queries *db.Queries, user *db.User) (*TotpEnrollment, error) {
+	secret, err := generateTotpSecret()
+	if err != nil {
+		return nil, errors.New("error generating totp secret: " + err.Error())
+	}
+	set, err := queries.SetPendingUserTotp(ctx, db.SetPendingUserTotpParams{
+		UserID: user.ID,
+		Secret: secret,
+	})
+	if err != nil {
+		return nil, errors.New("error storing totp secret: " + err.Error())
+	}
+	if set == 0 {
+		return nil, ErrTotpAlreadyEnabled
+	}
+	return &TotpEnrollment{
+		Secret: secret,
+		URI:    totpURI(secret, user.Email),
+	}, nil
+}
+
+// newLoginChallenge stores a new login challenge of the user and returns it.
+func newLoginChallenge(ctx context.Context, queries *db.Queries, userId int32) (string, error) {
+	err := queries.DeleteExpiredLoginChallenges(ctx)
+	if err != nil {
+		return "", errors.New("error deleting expired login challenges: " + err.Error())
+	}
+	challenge, err := randomToken()
+	if err != nil {
+		return "", errors.New("error generating login challenge: " + err.Error())
+	}
+	err = queries.InsertLoginChallenge(ctx, db.InsertLoginChallengeParams{
+		TokenHash:   signToken(challenge, loginChallengePurpose),
+		UserID:      userId,
+		DateExpires: time.Now().Add(LoginChallengeTTL),
+	})
+	if err != nil {
+		return "", errors.New("error storing login challenge: " + err.Error())
+	}
+	return challenge, nil
+}
+
+// mailTotpEnrollment mails the user a link to set up the second factor their role requires.
+func mailTotpEnrollment(ctx context.Context, queries *db.Queries, user *db.User) error {
+	token, err := issueEmailToken(ctx, queries, user.ID, EnrollTotpPurpose, user.Email, mailConfig.ResetTTL)
+	if err != nil {
+		return err
+	}
+	return MailSender().Send(ctx, Email{
+		To:      user.Email,
+		Subject: "Thiết lập xác thực hai lớp",
+		Body: "Vai trò của tài khoản Novo yêu cầu xác thực hai lớp. Mở liên kết sau để thiết lập:\n\n" +
+			emailLink("/two-factor/enroll", token) + "\n\n" +
+			"Liên kết hết hạn sau " + mailConfig.ResetTTL.String() + ". " +
+			"Nếu bạn không vừa đăng nhập, hãy đổi mật khẩu ngay.\n",
+	})
+}
+
+// StartLoginChallenge returns the challenge of a login of the user, nil when the user
+// doesn't need a second factor. A user of a role requiring it who hasn't enabled it is
+// mailed an enrollment link, and the login fails with ErrTwoFactorEnrollMailed.
+func StartLoginChallenge(user *db.User, role *db.RoleRow) (*LoginChallenge, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	totp, err := userTotp(ctx, queries, user.ID)
+	if err != nil {
+		return nil, errors.New("error getting user totp: " + err.Error())
+	}
+	if !totpEnabled(totp) {
+		if !role.RequireTwoFactor {
+			return nil, nil
+		}
+		err = mailTotpEnrollment(ctx, queries, user)
+		if err != nil {
+			return nil, errors.New("error mailing totp enrollment: " + err.Error())
+		}
+		return nil, ErrTwoFactorEnrollMailed
+	}
+
+	challenge, err := newLoginChallenge(ctx, queries, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginChallenge{Challenge: challenge}, nil
+}
+
+// StartEnrollmentChallenge trades the token of the enrollment link for a new secret and a
+// login challenge, whose first code enables the secret.
+func StartEnrollmentChallenge(token string) (*LoginChallenge, error) {
+	ctx := context.Background()
+	challenge := &LoginChallenge{Enroll: true}
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		sent, err := useEmailToken(ctx, queries, token, EnrollTotpPurpose)
+		if err != nil {
+			return err
+		}
+		user, err := queries.UserById(ctx, sent.UserID)
+		if err != nil {
+			return err
+		}
+		if user.Email != sent.Email {
+			return ErrInvalidEmailToken
+		}
+		enrollment, err := setPendingTotp(ctx, queries, &user)
+		if err != nil {
+			return err
+		}
+		challenge.Secret = enrollment.Secret
+		challenge.URI = enrollment.URI
+		challenge.Challenge, err = newLoginChallenge(ctx, queries, user.ID)
+		return err
+	})
+	if err == ErrInvalidEmailToken || err == ErrTotpAlreadyEnabled {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.New("error starting totp enrollment: " + err.Error())
+	}
+	return challenge, nil
+}
+
+// UserByLoginChallenge finishes a login with the second factor from ip. The recovery codes
+// are returned when the code enabled the TOTP of the user. The wrong codes are failed logins
+// of the account and the ip: during their lockout, it returns ErrLoginLocked and its end.
+func UserByLoginChallenge(input TwoFactorLogin, ip string) (*db.User, *db.RoleRow, []string, time.Time, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+	hash := signToken(input.Challenge, loginChallengePurpose)
+
+	// counted outside of the transaction, so that wrong codes use up the challenge
+	userId, err := queries.LoginChallengeAttempt(ctx, db.LoginChallengeAttemptParams{
+		TokenHash: hash,
+		Attempts:  maxChallengeAttempts,
+	})
+	if err == pgx.ErrNoRows {
+		return nil, nil, nil, time.Time{}, ErrInvalidLoginChallenge
+	}
+	if err != nil {
+		return nil, nil, nil, time.Time{}, errors.New("error getting login challenge: " + err.Error())
+	}
+
+	var user db.User
+	var role db.RoleRow
+	var recoveryCodes []string
+	account := accountThrottleKey(userId)
+	attempt := loginAttempt{userId: sql.NullInt32{Int32: userId, Valid: true}, identifier: account, ip: ip}
+	until, err := throttleLogin(attempt, loginThrottles(account, ip), func(queries *db.Queries) error {
+		totp, err := userTotp(ctx, queries, userId)
+		if err != nil {
+			return err
+		}
+		if totp == nil {
+			return ErrInvalidLoginChallenge
+		}
+		if totpEnabled(totp) {
+			err = verifySecondFactor(ctx, queries, totp, input.Code)
+		} else {
+			recoveryCodes, err = enableTotp(ctx, queries, totp, input.Code)
+		}
+		if err != nil {
+			return err
+		}
+		err = queries.DeleteLoginChallenge(ctx, hash)
+		if err != nil {
+			return err
+		}
+		user, err = queries.UserById(ctx, userId)
+		if err != nil {
+			return err
+		}
+		role, err = queries.Role(ctx, user.RoleID)
+		return err
+	}, func(err error) bool {
+		return err == ErrInvalidTotpCode
+	}, LoginSecondFactorFailed)
+	if err == ErrLoginLocked || err == ErrInvalidLoginChallenge || err == ErrInvalidTotpCode {
+		return nil, nil, nil, until, err
+	}
+	if err != nil {
+		return nil, nil, nil, time.Time{}, errors.New("error checking login challenge: " + err.Error())
+	}
+	return &user, &role, recoveryCodes, time.Time{}, nil
+}
+
+// useTotpCode checks a code of the app, each code works once.
+func useTotpCode(ctx context.Context, queries *db.Queries, totp *db.UserTotp, code string) (bool, error) {
+	step, ok := validateTotp(totp.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	used, err := queries.UseTotpStep(ctx, db.UseTotpStepParams{
+		UserID:   totp.UserID,
+		LastStep: step,
+	})
+	return used > 0, err
+}
+
+// verifySecondFactor checks a code of the app or a recovery code of the user.
+func verifySecondFactor(ctx context.Context, queries *db.Queries, totp *db.UserTotp, code string) error {
+	ok, err := useTotpCode(ctx, queries, totp, code)
+	if err != nil || ok {
+		return err
+	}
+	used, err := queries.UseRecoveryCode(ctx, db.UseRecoveryCodeParams{
+		UserID:   totp.UserID,
+		CodeHash: signToken(normalizeRecoveryCode(code), recoveryCodePurpose),
+	})
+	if err != nil {
+		return err
+	}
+	if used == 0 {
+		return ErrInvalidTotpCode
+	}
+	return nil
+}
+
+// enableTotp enables the pending TOTP with its first code and returns the recovery codes.
+func enableTotp(ctx context.Context, queries *db.Queries, totp *db.UserTotp, code string) ([]string, error) {
+	ok, err := useTotpCode(ctx, queries, totp, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidTotpCode
+	}
+	err = queries.EnableUserTotp(ctx, totp.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return replaceRecoveryCodes(ctx, queries, totp.UserID)
+}
+
+// newRecoveryCode returns 50 random bits, as xxxxx-xxxxx.
+func newRecoveryCode() (string, error) {
+	random := make([]byte, 10)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(random))
+	return code[:5] + "-" + code[5:10], nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// replaceRecoveryCodes gives the user new recovery codes, the old ones stop working. Only
+// their hashes are kept, the user sees them once.
+func replaceRecoveryCodes(ctx context.Context, queries *db.Queries, userId int32) ([]string, error) {
+	err := queries.DeleteRecoveryCodes(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		err = queries.InsertRecoveryCode(ctx, db.InsertRecoveryCodeParams{
+			UserID:   userId,
+			CodeHash: signToken(normalizeRecoveryCode(code), recoveryCodePurpose),
+		})
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// EnrollTotp gives the user a new secret to add to the authenticator app, ConfirmTotp then
+// enables it.
+func EnrollTotp(userId int32) (*TotpEnrollment, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	user, err := queries.UserById(ctx, userId)
+	if err != nil {
+		return nil, errors.New("error getting user: " + err.Error())
+	}
+	return setPendingTotp(ctx, queries, &user)
+}
+
+// ConfirmTotp enables the secret of EnrollTotp with a code of the app, and returns the
+// recovery codes.
+func ConfirmTotp(userId int32, code string) ([]string, error) {
+	ctx := context.Background()
+	var recoveryCodes []string
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		totp, err := userTotp(ctx, queries, userId)
+		if err != nil {
+			return err
+		}
+		if totp == nil {
+			return ErrTotpNotEnrolled
+		}
+		if totpEnabled(totp) {
+			return ErrTotpAlreadyEnabled
+		}
+		recoveryCodes, err = enableTotp(ctx, queries, totp, code)
+		return err
+	})
+	if err == ErrTotpNotEnrolled || err == ErrTotpAlreadyEnabled || err == ErrInvalidTotpCode {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.New("error enabling totp: " + err.Error())
+	}
+	return recoveryCodes, nil
+}
+
+// enabledTotpTx runs fn with the enabled TOTP of the user, once code checked.
+func enabledTotpTx(userId int32, code string, fn func(ctx context.Context, queries *db.Queries) error) error {
+	ctx := context.Background()
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		totp, err := userTotp(ctx, queries, userId)
+		if err != nil {
+			return err
+		}
+		if !totpEnabled(totp) {
+			return ErrTotpNotEnrolled
+		}
+		err = verifySecondFactor(ctx, queries, totp, code)
+		if err != nil {
+			return err
+		}
+		return fn(ctx, queries)
+	})
+	if err == ErrTotpNotEnrolled || err == ErrInvalidTotpCode {
+		return err
+	}
+	if err != nil {
+		return errors.New("error updating totp: " + err.Error())
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user.
+func RegenerateRecoveryCodes(userId int32, code string) ([]string, error) {
+	var recoveryCodes []string
+	err := enabledTotpTx(userId, code, func(ctx context.Context, queries *db.Queries) error {
+		var err error
+		recoveryCodes, err = replaceRecoveryCodes(ctx, queries, userId)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// DisableTotp removes the second factor of the user, unless the role requires it.
+func DisableTotp(userId int32, code string) error {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	user, err := queries.UserById(ctx, userId)
+	if err != nil {
+		return errors.New("error getting user: " + err.Error())
+	}
+	role, err := queries.Role(ctx, user.RoleID)
+	if err != nil {
+		return errors.New("error getting role: " + err.Error())
+	}
+	if role.RequireTwoFactor {
+		return ErrTwoFactorRequiredByRole
+	}
+
+	return enabledTotpTx(userId, code, func(ctx context.Context, queries *db.Queries) error {
+		err := queries.DeleteRecoveryCodes(ctx, userId)
+		if err != nil {
+			return err
+		}
+		return queries.DeleteUserTotp(ctx, userId)
+	})
+}
+
+// UserTwoFactorStatus tells if the user has a second factor, and if the role requires it.
+func UserTwoFactorStatus(userId int32) (*TwoFactorStatus, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	user, err := queries.UserById(ctx, userId)
+	if err != nil {
+		return nil, errors.New("error getting user: " + err.Error())
+	}
+	role, err := queries.Role(ctx, user.RoleID)
+	if err != nil {
+		return nil, errors.New("error getting role: " + err.Error())
+	}
+	totp, err := userTotp(ctx, queries, userId)
+	if err != nil {
+		return nil, errors.New("error getting user totp: " + err.Error())
+	}
+	status := &TwoFactorStatus{
+		Enabled:  totpEnabled(totp),
+		Required: role.RequireTwoFactor,
+	}
+	if status.Enabled {
+		status.RecoveryCodesLeft, err = queries.CountRecoveryCodes(ctx, userId)
+		if err != nil {
+			return nil, errors.New("error counting recovery codes: " + err.Error())
+		}
+	}
+	return status, nil
+}
+
+func twoFactorErrorCode(err error) int {
+	switch err {
+	case ErrInvalidLoginChallenge:
+		return http.StatusUnauthorized
+	case ErrInvalidTotpCode, ErrInvalidEmailToken:
+		return http.StatusBadRequest
+	case ErrLoginLocked:
+		return http.StatusTooManyRequests
+	case ErrTotpAlreadyEnabled, ErrTotpNotEnrolled, ErrTwoFactorRequiredByRole:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// TwoFactorLoginHandler trades a login challenge and its code for the tokens of the login.
+func TwoFactorLoginHandler(authMiddleware *jwt.GinJWTMiddleware, lifetime time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var input TwoFactorLogin
+		err := c.ShouldBindJSON(&input)
+		if err != nil {
+			ReportError(c, err, "error", http.StatusBadRequest)
+			return
+		}
+		user, role, recoveryCodes, until, err := UserByLoginChallenge(input, c.ClientIP())
+		if err == ErrLoginLocked {
+			c.Header("Retry-After", retryAfter(until))
+		}
+		if err != nil {
+			ReportError(c, err, "error", twoFactorErrorCode(err))
+			return
+		}
+		claims, err := login(c, user, role, lifetime)
+		if err != nil {
+			ReportError(c, err, "error", http.StatusInternalServerError)
+			return
+		}
+		if recoveryCodes != nil {
+			c.Set(recoveryCodesKey, recoveryCodes)
+		}
+		respondWithToken(c, authMiddleware, claims, c.GetString(refreshTokenKey), lifetime)
+	}
+}
+
+// EnrollmentChallengeHandler answers the secret and the login challenge of an enrollment link.
+func EnrollmentChallengeHandler(c *gin.Context) {
+	var input EmailTokenInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	challenge, err := StartEnrollmentChallenge(input.Token)
+	if err != nil {
+		ReportError(c, err, "error", twoFactorErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, challenge)
+}
+
+func TwoFactorStatusHandler(c *gin.Context) {
+	status, err := UserTwoFactorStatus(currentUserId(c))
+	if err != nil {
+		ReportError(c, err, "error", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func EnrollTotpHandler(c *gin.Context) {
+	enrollment, err := EnrollTotp(currentUserId(c))
+	if err != nil {
+		ReportError(c, err, "error", twoFactorErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, enrollment)
+}
+
+func ConfirmTotpHandler(c *gin.Context) {
+	var input TotpCodeInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	recoveryCodes, err := ConfirmTotp(currentUserId(c), input.Code)
+	if err != nil {
+		ReportError(c, err, "error", twoFactorErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"recoveryCodes": recoveryCodes,
+	})
+}
+
+func RecoveryCodesHandler(c *gin.Context) {
+	var input TotpCodeInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	recoveryCodes, err := RegenerateRecoveryCodes(currentUserId(c), input.Code)
+	if err != nil {
+		ReportError(c, err, "error", twoFactorErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"recoveryCodes": recoveryCodes,
+	})
+}
+
+func DisableTotpHandler(c *gin.Context) {
+	var input TotpCodeInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	err = DisableTotp(currentUserId(c), input.Code)
+	if err != nil {
+		ReportError(c, err, "error", twoFactorErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "two-factor authentication disabled",
+	})
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func currentTotpCode(t *testing.T, secret string, offset int64) string {
+	code, err := totpCode(secret, totpStep(time.Now())+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	oldConfig := loginConfig
+	loginConfig = config.Login{AccountAttempts: 100, IPAttempts: 100, Lockout: time.Minute, MaxLockout: time.Hour, FailureTTL: time.Hour}
+	defer func() {
+		loginConfig = oldConfig
+	}()
+
+	mails := &capturingMailer{}
+	oldMailer := mailer
+	SetMailer(mails)
+	defer SetMailer(oldMailer)
+
+	// the roles only require a second factor once an admin says so
+	requiring, err := CreateRole("testtotprole", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, SetRoleTwoFactor(requiring.ID, true))
+	username, password := "testtotpuser", "secretpw"
+	account, _, err := CreateAccount(username, password, "totp@atest.com", requiring.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := "192.0.2.41"
+	defer func() {
+		_ = DeleteAccount(username)
+		_ = DeleteRole(requiring.ID)
+		_ = UnlockAccount(account.ID)
+		_, _ = db.New(db.Pool()).DeleteLoginThrottle(context.Background(), "ip:"+ip)
+	}()
+	user, role, err := UserByLoginInfo(PasswordLogin{UsernameOrEmail: username, Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, role.RequireTwoFactor)
+
+	// the password alone doesn't give the secret, the user is mailed a link to enroll
+	challenge, err := StartLoginChallenge(user, role)
+	assert.Equal(t, ErrTwoFactorEnrollMailed, err)
+	assert.Nil(t, challenge)
+	token := lastEmailToken(t, mails)
+	_, err = StartEnrollmentChallenge("wrong" + token)
+	assert.Equal(t, ErrInvalidEmailToken, err)
+	challenge, err = StartEnrollmentChallenge(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, challenge.Enroll)
+	assert.NotEmpty(t, challenge.Secret)
+	_, err = StartEnrollmentChallenge(token)
+	assert.Equal(t, ErrInvalidEmailToken, err)
+
+	// the first code of the challenge enables it
+	_, _, _, _, err = UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: "000000"}, ip)
+	assert.Equal(t, ErrInvalidTotpCode, err)
+	code := currentTotpCode(t, challenge.Secret, 0)
+	loggedIn, _, recoveryCodes, _, err := UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: code}, ip)
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, loggedIn.ID)
+	assert.Len(t, recoveryCodes, recoveryCodeCount)
+	_, _, _, _, err = UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: code}, ip)
+	assert.Equal(t, ErrInvalidLoginChallenge, err)
+
+	// then the codes work once, and the recovery codes too
+	secret := challenge.Secret
+	challenge, err = StartLoginChallenge(user, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, challenge.Enroll)
+	assert.Empty(t, challenge.Secret)
+	_, _, _, _, err = UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: code}, ip)
+	assert.Equal(t, ErrInvalidTotpCode, err)
+	_, _, recoveryCodes2, _, err := UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: recoveryCodes[0]}, ip)
+	assert.Nil(t, err)
+	assert.Nil(t, recoveryCodes2)
+
+	challenge, _ = StartLoginChallenge(user, role)
+	_, _, _, _, err = UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: recoveryCodes[0]}, ip)
+	assert.Equal(t, ErrInvalidTotpCode, err)
+	_, _, _, _, err = UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: currentTotpCode(t, secret, 1)}, ip)
+	assert.Nil(t, err)
+
+	// wrong codes use up the challenge
+	challenge, _ = StartLoginChallenge(user, role)
+	for i := 0; i < maxChallengeAttempts; i++ {
+		_, _, _, _, err = UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: "000000"}, ip)
+		assert.Equal(t, ErrInvalidTotpCode, err)
+	}
+	_, _, _, _, err = UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: recoveryCodes[1]}, ip)
+	assert.Equal(t, ErrInvalidLoginChallenge, err)
+
+	status, err := UserTwoFactorStatus(user.ID)
+	assert.Nil(t, err)
+	assert.True(t, status.Enabled)
+	assert.True(t, status.Required)
+	assert.Equal(t, int64(recoveryCodeCount-1), status.RecoveryCodesLeft)
+	assert.Equal(t, ErrTwoFactorRequiredByRole, DisableTotp(user.ID, recoveryCodes[1]))
+	_, err = EnrollTotp(user.ID)
+	assert.Equal(t, ErrTotpAlreadyEnabled, err)
+
+	// the wrong codes are failed logins of the account, the right password doesn't reset them
+	assert.Nil(t, UnlockAccount(user.ID))
+	loginConfig.AccountAttempts = 1
+	challenge, _ = StartLoginChallenge(user, role)
+	for i := 0; i < 2; i++ {
+		_, _, _, _, err = UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: "000000"}, ip)
+		assert.Equal(t, ErrInvalidTotpCode, err)
+	}
+	_, _, _, until, err := UserByLoginChallenge(TwoFactorLogin{Challenge: challenge.Challenge, Code: recoveryCodes[1]}, ip)
+	assert.Equal(t, ErrLoginLocked, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), until, 5*time.Second)
+	_, _, _, err = ThrottledPasswordLogin(PasswordLogin{UsernameOrEmail: username, Password: password}, ip)
+	assert.Equal(t, ErrLoginLocked, err)
+}
+
+func TestTotpEnrollment(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	username, password := "testtotpmember", "secretpw"
+	_, _, err := CreateAccount(username, password, "totpmember@atest.com", MemberRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = DeleteAccount(username)
+	}()
+	user, role, err := UserByLoginInfo(PasswordLogin{UsernameOrEmail: username, Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// members log in with the password alone until they enable it
+	challenge, err := StartLoginChallenge(user, role)
+	assert.Nil(t, err)
+	assert.Nil(t, challenge)
+	_, err = ConfirmTotp(user.ID, "000000")
+	assert.Equal(t, ErrTotpNotEnrolled, err)
+
+	enrollment, err := EnrollTotp(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, _ = StartLoginChallenge(user, role)
+	assert.Nil(t, challenge)
+	_, err = ConfirmTotp(user.ID, "000000")
+	assert.Equal(t, ErrInvalidTotpCode, err)
+	recoveryCodes, err := ConfirmTotp(user.ID, currentTotpCode(t, enrollment.Secret, 0))
+	assert.Nil(t, err)
+	assert.Len(t, recoveryCodes, recoveryCodeCount)
+
+	challenge, _ = StartLoginChallenge(user, role)
+	assert.NotNil(t, challenge)
+
+	// new recovery codes replace the old ones
+	newCodes, err := RegenerateRecoveryCodes(user.ID, recoveryCodes[0])
+	assert.Nil(t, err)
+	assert.Equal(t, ErrInvalidTotpCode, DisableTotp(user.ID, recoveryCodes[1]))
+	assert.Nil(t, DisableTotp(user.ID, newCodes[0]))
+	challenge, _ = StartLoginChallenge(user, role)
+	assert.Nil(t, challenge)
+}
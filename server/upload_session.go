@@ -0,0 +1,375 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/config"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads:
+//  POST   /auth/upload/session                    {imageType, size, sha1} -> {id, offset, size}
+//         imageType can also be "chapter-archive" or "book-epub", the session is then given
+//         to /auth/chapter/archive or /auth/chapter/epub instead of being completed
+//  GET    /auth/upload/session/:sessionId         -> {id, offset, size}, to resume after a failure
+//  PATCH  /auth/upload/session/:sessionId         raw chunk at the Upload-Offset header -> {offset},
+//         a chunk is at most the image max size
+//  POST   /auth/upload/session/:sessionId/complete -> {id, path}, as /auth/upload/:imageType
+//  DELETE /auth/upload/session/:sessionId
+// The chunks are staged on the local disk whatever the image storage is.
+
+const UploadSessionFolder = "static/uploads"
+const UploadOffsetHeader = "Upload-Offset"
+const MaxUploadSessionSize = 1024 * 1024 * 500
+
+// UploadSessionTTL is how long an upload can stay idle before the image collector drops it.
+const UploadSessionTTL = 24 * time.Hour
+
+var ErrChunkTooLarge = errors.New("chunk too large")
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+type NewUploadSession struct {
+	ImageType string `json:"imageType" binding:"required"`
+	Size      int64  `json:"size" binding:"required"`
+	Sha1      string `json:"sha1" binding:"required"`
+}
+
+func uploadSessionPath(sessionId string) string {
+	return filepath.Join(UploadSessionFolder, sessionId+".part")
+}
+
+func validImageCategory(category string) bool {
+	switch category {
+	case ChapterImage, UserAvatar, AuthorAvatar, GenreImage, CoverArt:
+		return true
+	}
+	return false
+}
+
+// validUploadCategory accepts the image categories and the archives imported from a session.
+func validUploadCategory(category string) bool {
+	return validImageCategory(category) || category == ChapterArchive || category == BookEpub
+}
+
+func validSha1(checksum string) bool {
+	decoded, err := hex.DecodeString(checksum)
+	return err == nil && len(decoded) == sha1.Size
+}
+
+// writeUploadChunk writes the chunk at offset, dropping anything past it that was left by an
+// interrupted request, and returns the new offset. The chunk can't go past limit bytes.
+func writeUploadChunk(path string, offset int64, chunk io.Reader, limit int64) (int64, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return offset, errors.New("error checking directory: " + err.Error())
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return offset, errors.New("error opening upload file: " + err.Error())
+	}
+	defer file.Close()
+
+	err = file.Truncate(offset)
+	if err != nil {
+		return offset, errors.New("error truncating upload file: " + err.Error())
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return offset, errors.New("error seeking upload file: " + err.Error())
+	}
+
+	written, err := io.Copy(file, io.LimitReader(chunk, limit+1))
+	if err == nil && written > limit {
+		err = ErrChunkTooLarge
+	}
+	if err != nil {
+		_ = file.Truncate(offset)
+		return offset, err
+	}
+	return offset + written, nil
+}
+
+// verifyUploadChecksum compares the sha1 of the whole file with the one given when the session started.
+func verifyUploadChecksum(file io.ReadSeeker, checksum string) error {
+	hash := sha1.New()
+	_, err := io.Copy(hash, file)
+	if err != nil {
+		return errors.New("error reading upload file: " + err.Error())
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.New("error resetting file pointer: " + err.Error())
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != strings.ToLower(checksum) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+func removeUploadSession(ctx context.Context, queries *db.Queries, sessionId string) error {
+	err := queries.DeleteUploadSession(ctx, sessionId)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(uploadSessionPath(sessionId))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CleanUploadSessions drops the uploads nobody touched for longer than ttl.
+func CleanUploadSessions(ttl time.Duration) (int, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	sessionIds, err := queries.ExpiredUploadSessions(ctx, time.Now().Add(-ttl))
+	if err != nil {
+		return 0, errors.New("error getting expired upload sessions: " + err.Error())
+	}
+	for _, sessionId := range sessionIds {
+		err = removeUploadSession(ctx, queries, sessionId)
+		if err != nil {
+			return 0, errors.New("error removing upload session: " + err.Error())
+		}
+	}
+	return len(sessionIds), nil
+}
+
+// uploadSessionFromRequest loads the session of the sessionId param, reporting the error itself.
+func uploadSessionFromRequest(c *gin.Context, queries *db.Queries) (*db.UploadSession, bool) {
+	sessionId := c.Param("sessionId")
+	if _, err := uuid.Parse(sessionId); err != nil {
+		ReportError(c, errors.New("invalid upload session id"), "error", http.StatusBadRequest)
+		return nil, false
+	}
+
+	extract := jwt.ExtractClaims(c)
+	userId := int32(extract[UserIdClaimKey].(float64))
+	session, err := queries.GetUploadSession(context.Background(), db.GetUploadSessionParams{
+		ID:     sessionId,
+		UserID: userId,
+	})
+	if err == pgx.ErrNoRows {
+		ReportError(c, errors.New("upload session not found"), "error", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		ReportError(c, err, "error getting upload session", http.StatusInternalServerError)
+		return nil, false
+	}
+	return &session, true
+}
+
+func CreateUploadSessionHandler(c *gin.Context) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	var newSession NewUploadSession
+	if err := c.ShouldBindJSON(&newSession); err != nil {
+		ReportError(c, err, "error parsing json", http.StatusBadRequest)
+		return
+	}
+	if !validUploadCategory(newSession.ImageType) {
+		ReportError(c, errors.New("invalid image category"), "error", http.StatusNotAcceptable)
+		return
+	}
+	if newSession.Size <= 0 {
+		ReportError(c, errors.New("invalid size"), "error", http.StatusBadRequest)
+		return
+	}
+	if newSession.Size > MaxUploadSessionSize {
+		ReportError(c, errors.New("file too large"), "error", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !validSha1(newSession.Sha1) {
+		ReportError(c, errors.New("invalid sha1 checksum"), "error", http.StatusBadRequest)
+		return
+	}
+
+	extract := jwt.ExtractClaims(c)
+	userId := int32(extract[UserIdClaimKey].(float64))
+	session, err := queries.InsertUploadSession(ctx, db.InsertUploadSessionParams{
+		ID:       uuid.NewString(),
+		UserID:   userId,
+		Category: newSession.ImageType,
+		Size:     newSession.Size,
+		Sha1:     strings.ToLower(newSession.Sha1),
+	})
+	if err != nil {
+		ReportError(c, err, "error creating upload session", http.StatusInternalServerError)
+		return
+	}
+
+	c.Header(UploadOffsetHeader, "0")
+	c.JSON(http.StatusCreated, gin.H{
+		"id":     session.ID,
+		"offset": session.Received,
+		"size":   session.Size,
+	})
+}
+
+func GetUploadSessionHandler(c *gin.Context) {
+	queries := db.New(db.Pool())
+	session, ok := uploadSessionFromRequest(c, queries)
+	if !ok {
+		return
+	}
+
+	c.Header(UploadOffsetHeader, strconv.FormatInt(session.Received, 10))
+	c.JSON(http.StatusOK, gin.H{
+		"id":     session.ID,
+		"offset": session.Received,
+		"size":   session.Size,
+	})
+}
+
+func AppendUploadSessionHandler(cfg config.Images) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.Background()
+		queries := db.New(db.Pool())
+		session, ok := uploadSessionFromRequest(c, queries)
+		if !ok {
+			return
+		}
+
+		offset, err := strconv.ParseInt(c.GetHeader(UploadOffsetHeader), 10, 64)
+		if err != nil {
+			ReportError(c, errors.New("invalid "+UploadOffsetHeader+" header"), "error", http.StatusBadRequest)
+			return
+		}
+		if offset != session.Received {
+			c.Header(UploadOffsetHeader, strconv.FormatInt(session.Received, 10))
+			c.JSON(http.StatusConflict, gin.H{
+				"error":  "offset mismatch",
+				"offset": session.Received,
+			})
+			return
+		}
+
+		limit := session.Size - session.Received
+		if limit > cfg.MaxSize {
+			limit = cfg.MaxSize
+		}
+		newOffset, err := writeUploadChunk(uploadSessionPath(session.ID), offset, c.Request.Body, limit)
+		if err == ErrChunkTooLarge {
+			ReportError(c, err, "error", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			// the connection dropped mid chunk, the client resumes from the last saved offset
+			ReportError(c, err, "error writing chunk", http.StatusBadRequest)
+			return
+		}
+
+		updated, err := queries.UpdateUploadSessionReceived(ctx, db.UpdateUploadSessionReceivedParams{
+			NewReceived: newOffset,
+			ID:          session.ID,
+			OldReceived: offset,
+		})
+		if err != nil {
+			ReportError(c, err, "error updating upload session", http.StatusInternalServerError)
+			return
+		}
+		if updated == 0 {
+			ReportError(c, errors.New("upload session was changed by another request"), "error", http.StatusConflict)
+			return
+		}
+
+		c.Header(UploadOffsetHeader, strconv.FormatInt(newOffset, 10))
+		c.JSON(http.StatusOK, gin.H{
+			"offset": newOffset,
+		})
+	}
+}
+
+func CompleteUploadSessionHandler(c *gin.Context) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+	session, ok := uploadSessionFromRequest(c, queries)
+	if !ok {
+		return
+	}
+
+	if session.Received != session.Size {
+		c.Header(UploadOffsetHeader, strconv.FormatInt(session.Received, 10))
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "upload is not complete",
+			"offset": session.Received,
+		})
+		return
+	}
+	if !validImageCategory(session.Category) {
+		ReportError(c, errors.New("archives are imported with /auth/chapter/archive or /auth/chapter/epub"), "error", http.StatusConflict)
+		return
+	}
+
+	file, err := os.Open(uploadSessionPath(session.ID))
+	if err != nil {
+		ReportError(c, err, "error opening upload file", http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		_ = file.Close()
+		err := removeUploadSession(ctx, queries, session.ID)
+		if err != nil {
+			log.Printf("error removing upload session %s: %s\n", session.ID, err)
+		}
+	}()
+
+	// a corrupted upload can't be resumed, the session is dropped and the client starts over
+	err = verifyUploadChecksum(file, session.Sha1)
+	if err == ErrChecksumMismatch {
+		ReportError(c, err, "error", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		ReportError(c, err, "error", http.StatusInternalServerError)
+		return
+	}
+
+	saveImageId, savePath, err := SaveImageFromStream(file, session.Category, uuid.NewString(), "")
+	switch err {
+	case ErrUnsupportedMediaType:
+		ReportError(c, err, "error", http.StatusUnsupportedMediaType)
+	case nil:
+		c.JSON(http.StatusOK, gin.H{
+			"id":   saveImageId,
+			"path": savePath,
+		})
+	default:
+		ReportError(c, err, "error saving image", http.StatusInternalServerError)
+	}
+}
+
+func DeleteUploadSessionHandler(c *gin.Context) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+	session, ok := uploadSessionFromRequest(c, queries)
+	if !ok {
+		return
+	}
+
+	err := removeUploadSession(ctx, queries, session.ID)
+	if err != nil {
+		ReportError(c, err, "error removing upload session", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "delete successful",
+	})
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteUploadChunk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.part")
+	content := []byte("0123456789abcdef")
+
+	offset, err := writeUploadChunk(path, 0, bytes.NewReader(content[:6]), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), offset)
+
+	// a retried chunk overwrites whatever an interrupted request left past the offset
+	err = ioutil.WriteFile(path, append(content[:6:6], []byte("garbage")...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset, err = writeUploadChunk(path, 6, bytes.NewReader(content[6:]), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(content)), offset)
+
+	_, err = writeUploadChunk(path, offset, bytes.NewReader([]byte("too long")), 4)
+	assert.Equal(t, ErrChunkTooLarge, err)
+
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestVerifyUploadChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.part")
+	content := []byte("resumable upload")
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum(content)
+	checksum := hex.EncodeToString(sum[:])
+	assert.True(t, validSha1(checksum))
+	assert.False(t, validSha1("abc"))
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	assert.Nil(t, verifyUploadChecksum(file, checksum))
+	data, err := ioutil.ReadAll(file)
+	assert.Nil(t, err)
+	assert.Equal(t, content, data, "The file should be rewound after verification")
+
+	_, _ = file.Seek(0, 0)
+	assert.Equal(t, ErrChecksumMismatch, verifyUploadChecksum(file, hex.EncodeToString(make([]byte, sha1.Size))))
+}
@@ -9,6 +9,7 @@ import (
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/dqhieuu/novo-app/db"
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
 	"golang.org/x/crypto/bcrypt"
 	"log"
 	"net/http"
@@ -21,19 +22,31 @@ import (
 
 const LimitUserBookGroups = 20
 
+// The errors of the wrong credentials, counted by the login throttle.
+var (
+	ErrUserNotFound      = errors.New("user not found")
+	ErrPasswordlessUser  = errors.New("can't access oauth user (having a nullable password)")
+	ErrIncorrectPassword = errors.New("incorrect password")
+)
+
 const (
 	MemberRole    = "member"
 	ModeratorRole = "moderator"
 	BannedRole    = "banned"
+	AdminRole     = "admin"
+
+	// OauthIncompleteRole is given to oauth users until they pick a user name.
+	OauthIncompleteRole = "oauth_incomplete"
 )
 
 type UserInfo struct {
-	Role       string      `json:"role" binding:"required"`
-	Permission []string    `json:"permission" binding:"required"`
-	Id         int32       `json:"id" binding:"required"`
-	Name       interface{} `json:"name"`
-	Avatar     interface{} `json:"avatar"`
-	Email      string      `json:"email" binding:"required"`
+	Role          string      `json:"role" binding:"required"`
+	Permission    []string    `json:"permission" binding:"required"`
+	Id            int32       `json:"id" binding:"required"`
+	Name          interface{} `json:"name"`
+	Avatar        interface{} `json:"avatar"`
+	Email         string      `json:"email" binding:"required"`
+	EmailVerified bool        `json:"emailVerified"`
 }
 
 type UserProfile struct {
@@ -105,7 +118,7 @@ func ValidUsername(username string) bool {
 	return validUsername
 }
 
-func createAccount(username, password, email, roleName string) (*db.User, *db.RoleRow, error) {
+func createAccount(username, password, email, roleName string, emailVerified bool) (*db.User, *db.RoleRow, error) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 	username = strings.TrimSpace(username)
@@ -128,10 +141,11 @@ func createAccount(username, password, email, roleName string) (*db.User, *db.Ro
 	}
 
 	user, err := queries.InsertUser(ctx, db.InsertUserParams{
-		UserName: sql.NullString{String: username, Valid: true},
-		Password: sql.NullString{String: hex.EncodeToString(hashedPassword), Valid: true},
-		Email:    email,
-		RoleName: roleName,
+		UserName:      sql.NullString{String: username, Valid: true},
+		Password:      sql.NullString{String: hex.EncodeToString(hashedPassword), Valid: true},
+		Email:         email,
+		EmailVerified: emailVerified,
+		RoleName:      roleName,
 	})
 	if err != nil {
 		return nil, nil, errors.New(fmt.Sprintf("creating new user failed: %s", err))
@@ -146,17 +160,22 @@ func createAccount(username, password, email, roleName string) (*db.User, *db.Ro
 }
 
 func UserByLoginInfo(loginInfo PasswordLogin) (*db.User, *db.RoleRow, error) {
-	ctx := context.Background()
-	queries := db.New(db.Pool())
+	return userByLoginInfo(context.Background(), db.New(db.Pool()), loginInfo)
+}
+
+func userByLoginInfo(ctx context.Context, queries *db.Queries, loginInfo PasswordLogin) (*db.User, *db.RoleRow, error) {
 	user, err := queries.UserByUsernameOrEmail(ctx, sql.NullString{String: loginInfo.UsernameOrEmail, Valid: true})
+	if err == pgx.ErrNoRows {
+		return nil, nil, ErrUserNotFound
+	}
 	if err != nil {
-		return nil, nil, errors.New("user not found")
+		return nil, nil, errors.New("error getting user: " + err.Error())
 	}
 
 	hexPassword := user.Password
 
 	if !hexPassword.Valid {
-		return nil, nil, errors.New("can't access oauth user (having a nullable password)")
+		return nil, nil, ErrPasswordlessUser
 	}
 
 	passwordHash, err := hex.DecodeString(hexPassword.String)
@@ -165,7 +184,7 @@ func UserByLoginInfo(loginInfo PasswordLogin) (*db.User, *db.RoleRow, error) {
 	}
 
 	if !EqualPasswords(passwordHash, []byte(loginInfo.Password)) {
-		return nil, nil, errors.New("incorrect password")
+		return nil, nil, ErrIncorrectPassword
 	}
 
 	role, err := queries.Role(ctx, user.RoleID)
@@ -177,7 +196,13 @@ func UserByLoginInfo(loginInfo PasswordLogin) (*db.User, *db.RoleRow, error) {
 }
 
 func RegisterAccount(username, password, email string) (*db.User, *db.RoleRow, error) {
-	return createAccount(username, password, email, "member")
+	return createAccount(username, password, email, "member", false)
+}
+
+// CreateAccount creates a password account with any role, for the admin command. Its
+// email is trusted as verified.
+func CreateAccount(username, password, email, roleName string) (*db.User, *db.RoleRow, error) {
+	return createAccount(username, password, email, roleName, true)
 }
 
 func DeleteAccount(username string) error {
@@ -256,12 +281,18 @@ func RegisterPasswordHandler(c *gin.Context) {
 		ReportError(c, errors.New("email already exists"), "error", http.StatusBadRequest)
 		return
 	}
-	_, _, err = RegisterAccount(r.Username, r.Password, r.Email)
+	user, _, err := RegisterAccount(r.Username, r.Password, r.Email)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
 
+	// the account exists either way, the user can ask for another email
+	err = SendVerificationEmail(user.ID)
+	if err != nil {
+		log.Printf("error sending verification email: %s\n", err)
+	}
+
 	c.JSON(http.StatusOK, gin.H{
 		"message": "Register successfully",
 	})
@@ -294,6 +325,7 @@ func GetRoleHandler(c *gin.Context) {
 	}
 
 	userInfo.Role = user.Role
+	userInfo.EmailVerified = user.EmailVerified
 
 	userInfo.Id = userId
 	if user.Avatarpath.Valid {
@@ -474,6 +506,14 @@ func ChangeCurrentUserPasswordHandler(c *gin.Context) {
 		return
 	}
 
+	// the other devices have to log in with the new password
+	_, sessionId, _ := tokenSession(extract)
+	_, err = RevokeOtherUserSessions(userId, sessionId)
+	if err != nil {
+		ReportError(c, err, "error", 500)
+		return
+	}
+
 	c.JSON(200, gin.H{
 		"message": "change password successful",
 	})
@@ -566,6 +606,14 @@ func ChangeCurrentUserInfoHandler(c *gin.Context) {
 	}
 	log.Printf("%+v\n", updateInfoParam)
 
+	// a new email is unverified until its owner opens the link sent to it
+	if updateInfoParam.Email != user.Email {
+		err = SendVerificationEmail(userId)
+		if err != nil {
+			log.Printf("error sending verification email: %s\n", err)
+		}
+	}
+
 	c.JSON(200, gin.H{
 		"message": "update info successful",
 	})
@@ -576,67 +624,75 @@ type SetRoleInput struct {
 	Role   string `json:"role"`
 }
 
+// SetRole gives a role of the roles table to another user. Admins are only made with the
+// admin command, and oauth_incomplete is only given by the oauth login.
 func SetRole(adminId int32, userId int32, role string) error {
-	ctx := context.Background()
-	queries := db.New(db.Pool())
-
 	if userId == adminId {
 		return errors.New("can not set role of admin")
 	}
-
-	switch role {
-	case MemberRole, ModeratorRole, BannedRole:
-		roleId, err := queries.GetRoleId(ctx, role)
-		if err != nil {
-			return err
-		}
-		err = queries.SetRole(ctx, db.SetRoleParams{
-			ID:     userId,
-			RoleID: roleId,
-		})
-		if err != nil {
-			return err
-		}
-		return nil
-	default:
+	if role == AdminRole || role == OauthIncompleteRole {
 		return errors.New("invalid role")
 	}
+	return AssignRole(userId, role)
 }
 
-func SetRoleHandler(c *gin.Context) {
+// AssignRole gives any existing role to the user, admin included, and ends their sessions.
+// SetRole adds the checks needed when the request comes from a user.
+func AssignRole(userId int32, role string) error {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	claims := jwt.ExtractClaims(c)
-	adminId := int32(claims[UserIdClaimKey].(float64))
-
-	check, err := queries.CheckPermissionOnUserId(ctx, db.CheckPermissionOnUserIdParams{
-		Module: "role",
-		Action: "modify",
-		ID:     adminId,
+	roleId, err := queries.GetRoleId(ctx, role)
+	if err == pgx.ErrNoRows {
+		return errors.New("invalid role")
+	}
+	if err != nil {
+		return err
+	}
+	err = queries.SetRole(ctx, db.SetRoleParams{
+		ID:     userId,
+		RoleID: roleId,
 	})
+	permissionVersions.forget(userId)
 	if err != nil {
-		ReportError(c, err, "error", 500)
+		return err
+	}
+	// the user logs in again with the new role
+	_, err = RevokeUserSessions(userId)
+	return err
+}
+
+func SetRoleHandler(c *gin.Context) {
+	var input SetRoleInput
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", 400)
 		return
 	}
-	if !check {
-		ReportError(c, errors.New("unauthorized"), "error",403)
+
+	oldRole, err := userRoleName(input.UserId)
+	if err == pgx.ErrNoRows {
+		ReportError(c, errors.New("user does not exist"), "error", 400)
 		return
-	} else {
-		var input SetRoleInput
-		err = c.ShouldBindJSON(&input)
-		if err != nil {
-			ReportError(c, err, "error", 400)
-			return
-		}
+	}
+	if err != nil {
+		ReportError(c, err, "error", 500)
+		return
+	}
 
-		err = SetRole(adminId, input.UserId, input.Role)
-		if err != nil {
-			ReportError(c, err, "error", 400)
-			return
-		}
-		c.JSON(200, gin.H{
-			"message": "set role successful",
-		})
+	err = SetRole(CurrentUser(c).Id, input.UserId, input.Role)
+	if err != nil {
+		ReportError(c, err, "error", 400)
+		return
 	}
+	RecordAudit(c, AuditRecord{
+		Action:     SetRoleAudit,
+		TargetType: UserAuditTarget,
+		TargetId:   input.UserId,
+		Before:     gin.H{"role": oldRole},
+		After:      gin.H{"role": input.Role},
+	})
+	c.JSON(200, gin.H{
+		"message": "set role successful",
+	})
 }
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// A user logs in with a password, with the OAuth identities linked to the account, or both.
+// Identities are only linked on purpose by a logged in user, and the last login method of
+// an account can't be removed.
+
+var (
+	ErrIdentityLinked     = errors.New("this identity is already linked to another account")
+	ErrIdentityNotFound   = errors.New("this identity isn't linked to the account")
+	ErrLastLoginMethod    = errors.New("the account would be left without a way to log in")
+	ErrPasswordAlreadySet = errors.New("the account already has a password, change it instead")
+	ErrInvalidPassword    = errors.New("invalid password")
+)
+
+type LoginIdentity struct {
+	Provider    string `json:"provider"`
+	Subject     string `json:"subject"`
+	Email       string `json:"email,omitempty"`
+	DateCreated int64  `json:"dateCreated"`
+}
+
+type LoginMethods struct {
+	Password   bool            `json:"password"`
+	Identities []LoginIdentity `json:"identities"`
+}
+
+type SetPassword struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// UserLoginMethods lists the ways the user logs in.
+func UserLoginMethods(userId int32) (*LoginMethods, error) {
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	user, err := queries.UserById(ctx, userId)
+	if err != nil {
+		return nil, errors.New("error getting user: " + err.Error())
+	}
+	identities, err := queries.UserIdentities(ctx, userId)
+	if err != nil {
+		return nil, errors.New("error getting user identities: " + err.Error())
+	}
+
+	methods := &LoginMethods{
+		Password:   user.Password.Valid,
+		Identities: make([]LoginIdentity, 0, len(identities)),
+	}
+	for _, identity := range identities {
+		methods.Identities = append(methods.Identities, LoginIdentity{
+			Provider:    identity.Provider,
+			Subject:     identity.Subject,
+			Email:       identity.Email.String,
+			DateCreated: identity.DateCreated.UnixMicro(),
+		})
+	}
+	return methods, nil
+}
+
+// LinkIdentity finishes the link started by StartOauthLink, the identity then logs in to
+// the account of the user.
+func LinkIdentity(userId int32, login OauthLogin) error {
+	identity, err := oauthIdentity(login, sql.NullInt32{Int32: userId, Valid: true})
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	queries := db.New(db.Pool())
+
+	email := sql.NullString{String: identity.Email, Valid: identity.Email != ""}
+	err = queries.InsertUserIdentity(ctx, db.InsertUserIdentityParams{
+		Provider: login.Provider,
+		Subject:  identity.Subject,
+		UserID:   userId,
+		Email:    email,
+	})
+	if isUniqueViolation(err) {
+		linkedUserId, err := queries.IdentityUser(ctx, db.IdentityUserParams{
+			Provider: login.Provider,
+			Subject:  identity.Subject,
+		})
+		if err != nil {
+			return errors.New("error getting user identity: " + err.Error())
+		}
+		if linkedUserId != userId {
+			return ErrIdentityLinked
+		}
+		return nil
+	}
+	if err != nil {
+		return errors.New("error linking user identity: " + err.Error())
+	}
+	return nil
+}
+
+// UnlinkIdentity removes an identity from the login methods of the user, unless it is the
+// last one. The user row is locked so that two unlinks can't both take the last but one.
+func UnlinkIdentity(userId int32, provider, subject string) error {
+	ctx := context.Background()
+	err := RunInTx(ctx, func(queries *db.Queries) error {
+		password, err := queries.UserPasswordForUpdate(ctx, userId)
+		if err != nil {
+			return err
+		}
+		if !password.Valid {
+			count, err := queries.CountUserIdentities(ctx, userId)
+			if err != nil {
+				return err
+			}
+			if count <= 1 {
+				return ErrLastLoginMethod
+			}
+		}
+		deleted, err := queries.DeleteUserIdentity(ctx, db.DeleteUserIdentityParams{
+			Provider: provider,
+			Subject:  subject,
+			UserID:   userId,
+		})
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return ErrIdentityNotFound
+		}
+		return nil
+	})
+	if err == ErrLastLoginMethod || err == ErrIdentityNotFound {
+		return err
+	}
+	if err != nil {
+		return errors.New("error unlinking user identity: " + err.Error())
+	}
+	return nil
+}
+
+// SetUserPassword gives a password to an account that only logs in with OAuth.
+func SetUserPassword(userId int32, password string) error {
+	if !ValidPassword(password) {
+		return ErrInvalidPassword
+	}
+	hashedPassword, err := GeneratePasswordHash(password)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	err = RunInTx(ctx, func(queries *db.Queries) error {
+		current, err := queries.UserPasswordForUpdate(ctx, userId)
+		if err != nil {
+			return err
+		}
+		if current.Valid {
+			return ErrPasswordAlreadySet
+		}
+		return queries.UpdatePassword(ctx, db.UpdatePasswordParams{
+			ID: userId,
+			Password: sql.NullString{
+				String: hex.EncodeToString(hashedPassword),
+				Valid:  true,
+			},
+		})
+	})
+	if err == ErrPasswordAlreadySet {
+		return err
+	}
+	if err != nil {
+		return errors.New("error setting password: " + err.Error())
+	}
+	return nil
+}
+
+func identityErrorCode(err error) int {
+	switch err {
+	case ErrUnknownProvider, ErrIdentityNotFound:
+		return http.StatusNotFound
+	case ErrInvalidOauthState, ErrPasswordAlreadySet, ErrInvalidPassword:
+		return http.StatusBadRequest
+	case ErrIdentityLinked, ErrLastLoginMethod:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func currentUserId(c *gin.Context) int32 {
+	return int32(jwt.ExtractClaims(c)[UserIdClaimKey].(float64))
+}
+
+func LoginMethodsHandler(c *gin.Context) {
+	methods, err := UserLoginMethods(currentUserId(c))
+	if err != nil {
+		ReportError(c, err, "error", http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, methods)
+}
+
+// OauthLinkHandler answers the url of the provider, the request carries the access token
+// so the browser can't simply be redirected like by OauthRedirectHandler.
+func OauthLinkHandler(c *gin.Context) {
+	url, err := StartOauthLink(c.Param("provider"), currentUserId(c))
+	if err != nil {
+		ReportError(c, err, "error", identityErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"url": url,
+	})
+}
+
+func LinkIdentityHandler(c *gin.Context) {
+	var login OauthLogin
+	err := c.ShouldBindJSON(&login)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	err = LinkIdentity(currentUserId(c), login)
+	if err != nil {
+		ReportError(c, err, "error", identityErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "identity linked",
+	})
+}
+
+func UnlinkIdentityHandler(c *gin.Context) {
+	err := UnlinkIdentity(currentUserId(c), c.Param("provider"), c.Param("subject"))
+	if err != nil {
+		ReportError(c, err, "error", identityErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "identity unlinked",
+	})
+}
+
+func SetPasswordHandler(c *gin.Context) {
+	var input SetPassword
+	err := c.ShouldBindJSON(&input)
+	if err != nil {
+		ReportError(c, err, "error", http.StatusBadRequest)
+		return
+	}
+	err = SetUserPassword(currentUserId(c), input.Password)
+	if err != nil {
+		ReportError(c, err, "error", identityErrorCode(err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message": "password set",
+	})
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/dqhieuu/novo-app/db"
+	"github.com/gin-gonic/gin"
+	gojwt "github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIdentityHandlersInvalidInput(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set("JWT_PAYLOAD", jwt.MapClaims{UserIdClaimKey: float64(1)})
+	})
+	r.POST("/auth/identities", LinkIdentityHandler)
+	r.POST("/auth/password", SetPasswordHandler)
+
+	for _, path := range []string{"/auth/identities", "/auth/password"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, strings.NewReader(`{}`))
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+	}
+}
+
+func TestLinkIdentity(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	mock := newMockOidcServer(t)
+	oauthProviders["mock"] = NewOidcProvider(mockClientId, mockClientSecret, mockRedirectURL, mock.URL, nil)
+	defer delete(oauthProviders, "mock")
+
+	username, email := "testlinkuser", "link@atest.com"
+	user, _, err := CreateAccount(username, "secretpw", email, MemberRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = DeleteAccount(username)
+	}()
+
+	// logging in with an identity of the same email doesn't give the account away
+	mock.user = gojwt.MapClaims{"sub": "mock-link", "email": email, "email_verified": true}
+	authUrl, err := StartOauthLogin("mock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := authorize(t, authUrl)
+	_, _, err = UserByOauthToken(OauthLogin{Provider: "mock", Code: code, State: state})
+	assert.Equal(t, ErrOauthAccountExists, err)
+
+	// a login state can't link, and a link state only links for its user
+	authUrl, _ = StartOauthLogin("mock")
+	code, state = authorize(t, authUrl)
+	assert.Equal(t, ErrInvalidOauthState, LinkIdentity(user.ID, OauthLogin{Provider: "mock", Code: code, State: state}))
+	authUrl, _ = StartOauthLink("mock", user.ID)
+	code, state = authorize(t, authUrl)
+	assert.Equal(t, ErrInvalidOauthState, LinkIdentity(user.ID+1, OauthLogin{Provider: "mock", Code: code, State: state}))
+
+	authUrl, _ = StartOauthLink("mock", user.ID)
+	code, state = authorize(t, authUrl)
+	assert.Nil(t, LinkIdentity(user.ID, OauthLogin{Provider: "mock", Code: code, State: state}))
+	authUrl, _ = StartOauthLogin("mock")
+	code, state = authorize(t, authUrl)
+	linked, _, err := UserByOauthToken(OauthLogin{Provider: "mock", Code: code, State: state})
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, linked.ID)
+
+	methods, err := UserLoginMethods(user.ID)
+	assert.Nil(t, err)
+	assert.True(t, methods.Password)
+	assert.Len(t, methods.Identities, 1)
+	assert.Equal(t, ErrPasswordAlreadySet, SetUserPassword(user.ID, "otherpw123"))
+
+	// without a password, the last identity stays
+	_, err = db.Pool().Exec(context.Background(), "UPDATE users SET password = NULL WHERE id = $1", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrLastLoginMethod, UnlinkIdentity(user.ID, "mock", "mock-link"))
+	assert.Nil(t, SetUserPassword(user.ID, "otherpw123"))
+	assert.Nil(t, UnlinkIdentity(user.ID, "mock", "mock-link"))
+	assert.Equal(t, ErrIdentityNotFound, UnlinkIdentity(user.ID, "mock", "mock-link"))
+}
+
+func TestAdoptLegacyGoogleAccount(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	mock := newMockOidcServer(t)
+	google := oauthProviders[GoogleProvider]
+	oauthProviders[GoogleProvider] = NewOidcProvider(mockClientId, mockClientSecret, mockRedirectURL, mock.URL, nil)
+	oauthProviders["mock"] = NewOidcProvider(mockClientId, mockClientSecret, mockRedirectURL, mock.URL, nil)
+	defer func() {
+		oauthProviders[GoogleProvider] = google
+		if google == nil {
+			delete(oauthProviders, GoogleProvider)
+		}
+		delete(oauthProviders, "mock")
+	}()
+	login := func(provider string) (*db.User, error) {
+		authUrl, err := StartOauthLogin(provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, state := authorize(t, authUrl)
+		user, _, err := UserByOauthToken(OauthLogin{Provider: provider, Code: code, State: state})
+		return user, err
+	}
+
+	// an account of the former Google login, without a password or an identity
+	username, email := "testlegacygoogle", "legacygoogle@atest.com"
+	user, _, err := CreateAccount(username, "secretpw", email, MemberRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = DeleteAccount(username)
+	}()
+	_, err = db.Pool().Exec(context.Background(), "UPDATE users SET password = NULL WHERE id = $1", user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only Google made these accounts, and only with a verified email
+	mock.user = gojwt.MapClaims{"sub": "google-legacy", "email": email, "email_verified": true}
+	_, err = login("mock")
+	assert.Equal(t, ErrOauthAccountExists, err)
+	mock.user = gojwt.MapClaims{"sub": "google-legacy", "email": email, "email_verified": false}
+	_, err = login(GoogleProvider)
+	assert.Equal(t, ErrOauthEmailUnverified, err)
+
+	mock.user = gojwt.MapClaims{"sub": "google-legacy", "email": email, "email_verified": true}
+	adopted, err := login(GoogleProvider)
+	assert.Nil(t, err)
+	if assert.NotNil(t, adopted) {
+		assert.Equal(t, user.ID, adopted.ID)
+	}
+	methods, err := UserLoginMethods(user.ID)
+	assert.Nil(t, err)
+	assert.Len(t, methods.Identities, 1)
+
+	// once it has an identity, the account isn't adopted again
+	mock.user = gojwt.MapClaims{"sub": "google-other", "email": email, "email_verified": true}
+	_, err = login(GoogleProvider)
+	assert.Equal(t, ErrOauthAccountExists, err)
+}
@@ -4,114 +4,192 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/dqhieuu/novo-app/db"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v4"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	googleOauth2 "google.golang.org/api/oauth2/v2"
-	"google.golang.org/api/option"
 	"log"
 	"net/http"
+	"time"
 )
 
-var googleConfig *oauth2.Config
-
 type CompleteOauth struct {
 	Username string      `json:"username" binding:"required" form:"username"`
 	Avatar   interface{} `json:"avatar" form:"avatar"`
 }
 
-func InitOauth() {
-	if googleConfig == nil {
-		googleConfig = &oauth2.Config{
-			ClientID:     "589093568358-p2sil2brte394rh5fh415ok8j5ghq6kc.apps.googleusercontent.com",
-			ClientSecret: "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",
-			Endpoint:     google.Endpoint,
-			Scopes:       []string{googleOauth2.UserinfoEmailScope, googleOauth2.UserinfoProfileScope},
-			RedirectURL:  "https://novoapp.tech/?provider=google",
-		}
-	}
+// OauthStateTTL is how long users have to log in at the provider.
+const OauthStateTTL = 10 * time.Minute
+
+var (
+	ErrInvalidOauthState    = errors.New("oauth login expired or wasn't started here")
+	ErrOauthEmailUnverified = errors.New("the provider gave no verified email")
+	ErrOauthAccountExists   = errors.New("an account already uses this email, log in to it and link the provider")
+)
+
+// StartOauthLogin keeps the state, nonce and PKCE verifier of a new login and returns the
+// url of the provider to send the user to.
+func StartOauthLogin(providerName string) (string, error) {
+	return startOauth(providerName, sql.NullInt32{})
+}
+
+// StartOauthLink is StartOauthLogin for a logged in user adding the provider to its
+// login methods, the state can then only be used by LinkIdentity of this user.
+func StartOauthLink(providerName string, userId int32) (string, error) {
+	return startOauth(providerName, sql.NullInt32{Int32: userId, Valid: true})
 }
 
-func UserByGoogleOauthCode(code string) (*db.User, *db.RoleRow, error) {
-	conf := googleConfig
+func startOauth(providerName string, userId sql.NullInt32) (string, error) {
+	provider, ok := oauthProviders[providerName]
+	if !ok {
+		return "", ErrUnknownProvider
+	}
 	ctx := context.Background()
+	queries := db.New(db.Pool())
 
-	// Exchange code for oauth token
-	token, err := conf.Exchange(ctx, code)
-	if err != nil {
-		return nil, nil, err
+	var secrets [3]string
+	for i := range secrets {
+		var err error
+		secrets[i], err = randomToken()
+		if err != nil {
+			return "", errors.New("error generating oauth state: " + err.Error())
+		}
 	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
 
-	// Access Google service from token
-	oauth2Service, err := googleOauth2.NewService(ctx, option.WithTokenSource(conf.TokenSource(ctx, token)))
+	err := queries.DeleteExpiredOauthStates(ctx, time.Now().Add(-OauthStateTTL))
 	if err != nil {
-		return nil, nil, err
+		return "", errors.New("error deleting expired oauth states: " + err.Error())
 	}
-
-	// Use Google service with said token to get user info
-	userInfo, err := oauth2Service.Userinfo.V2.Me.Get().Do()
+	err = queries.InsertOauthState(ctx, db.InsertOauthStateParams{
+		State:    state,
+		Provider: providerName,
+		Nonce:    nonce,
+		Verifier: verifier,
+		UserID:   userId,
+	})
 	if err != nil {
-		return nil, nil, err
+		return "", errors.New("error storing oauth state: " + err.Error())
 	}
+	return provider.AuthCodeURL(ctx, state, nonce, verifier)
+}
 
-	// Check if there's a user with email identical to that from service query
-	queries := db.New(db.Pool())
-	user, err := queries.UserByEmail(ctx, userInfo.Email)
-	if err != nil {
-		// If query finds no account record, create a new one with the received email
-		if err == pgx.ErrNoRows {
-			account, role, err := RegisterOauthAccount(userInfo.Email)
-			if err != nil {
-				return nil, nil, err
-			}
-			return account, role, nil
-		}
-		return nil, nil, err
+// oauthIdentity trades the code of a login started with startOauth for the identity at
+// the provider. The state is only usable once, by the user it was started for.
+func oauthIdentity(login OauthLogin, userId sql.NullInt32) (*OauthIdentity, error) {
+	provider, ok := oauthProviders[login.Provider]
+	if !ok {
+		return nil, ErrUnknownProvider
 	}
+	ctx := context.Background()
 
-	// Get detailed role from roleId
-	role, err := queries.Role(ctx, user.RoleID)
+	state, err := db.New(db.Pool()).TakeOauthState(ctx, db.TakeOauthStateParams{
+		State:    login.State,
+		Provider: login.Provider,
+	})
+	if err == pgx.ErrNoRows || err == nil && (time.Since(state.DateCreated) > OauthStateTTL || state.UserID != userId) {
+		return nil, ErrInvalidOauthState
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, errors.New("error getting oauth state: " + err.Error())
 	}
-
-	return &user, &role, nil
+	return provider.Identity(ctx, login.Code, state.Nonce, state.Verifier)
 }
 
+// UserByOauthToken finishes the login started by StartOauthLogin.
 func UserByOauthToken(login OauthLogin) (*db.User, *db.RoleRow, error) {
-	if login.Provider == "google" {
-		return UserByGoogleOauthCode(login.Code)
+	identity, err := oauthIdentity(login, sql.NullInt32{})
+	if err != nil {
+		return nil, nil, err
 	}
+	return UserByIdentity(login.Provider, identity)
+}
 
-	return nil, nil, errors.New("unsupported provider")
+// legacyGoogleAccount tells if the account was made by the Google login from before the
+// identities were kept: it has neither a password nor an identity.
+func legacyGoogleAccount(ctx context.Context, queries *db.Queries, provider string, user db.User) (bool, error) {
+	if provider != GoogleProvider || user.Password.Valid {
+		return false, nil
+	}
+	identities, err := queries.CountUserIdentities(ctx, user.ID)
+	if err != nil {
+		return false, err
+	}
+	return identities == 0, nil
 }
 
-func createOauthAccount(email, roleName string) (*db.User, *db.RoleRow, error) {
+// UserByIdentity returns the user the identity is linked to. An identity seen for the first
+// time gets a new oauth_incomplete account, only when the provider verified the email.
+// It is never linked to an existing account by its email, the owner of the account links
+// it with LinkIdentity. The one exception are the accounts of the former Google login,
+// adopted by the first Google login with their verified email.
+func UserByIdentity(provider string, identity *OauthIdentity) (*db.User, *db.RoleRow, error) {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
 
-	user, err := queries.InsertUser(ctx, db.InsertUserParams{
-		Email:    email,
-		RoleName: roleName,
+	userId, err := queries.IdentityUser(ctx, db.IdentityUserParams{
+		Provider: provider,
+		Subject:  identity.Subject,
 	})
+	if err != nil && err != pgx.ErrNoRows {
+		return nil, nil, errors.New("error getting user identity: " + err.Error())
+	}
 
-	if err != nil {
-		return nil, nil, errors.New(fmt.Sprintf("creating new unregistered user failed: %s", err))
+	var user db.User
+	if err == nil {
+		user, err = queries.UserById(ctx, userId)
+		if err != nil {
+			return nil, nil, errors.New("error getting user: " + err.Error())
+		}
+	} else {
+		if identity.Email == "" || !identity.EmailVerified {
+			return nil, nil, ErrOauthEmailUnverified
+		}
+		err = RunInTx(ctx, func(queries *db.Queries) error {
+			user, err = queries.UserByEmail(ctx, identity.Email)
+			switch err {
+			case nil:
+				legacy, err := legacyGoogleAccount(ctx, queries, provider, user)
+				if err != nil {
+					return err
+				}
+				if !legacy {
+					return ErrOauthAccountExists
+				}
+			case pgx.ErrNoRows:
+				user, err = queries.InsertUser(ctx, db.InsertUserParams{
+					Email:         identity.Email,
+					EmailVerified: true,
+					RoleName:      OauthIncompleteRole,
+				})
+				if err != nil {
+					return err
+				}
+			default:
+				return err
+			}
+			return queries.InsertUserIdentity(ctx, db.InsertUserIdentityParams{
+				Provider: provider,
+				Subject:  identity.Subject,
+				UserID:   user.ID,
+				Email:    sql.NullString{String: identity.Email, Valid: true},
+			})
+		})
+		if err == ErrOauthAccountExists {
+			return nil, nil, err
+		}
+		if err != nil {
+			return nil, nil, errors.New("error creating oauth account: " + err.Error())
+		}
 	}
 
 	role, err := queries.Role(ctx, user.RoleID)
-
+	if err != nil {
+		return nil, nil, err
+	}
 	return &user, &role, nil
 }
 
-func RegisterOauthAccount(email string) (*db.User, *db.RoleRow, error) {
-	return createOauthAccount(email, "oauth_incomplete")
-}
-
 func CompleteOauthRegistration(userId int32, name string, avatarId *int32, roleId int32) error {
 	ctx := context.Background()
 	queries := db.New(db.Pool())
@@ -150,13 +228,20 @@ func CompleteOauthRegistration(userId int32, name string, avatarId *int32, roleI
 		}
 	}
 
+	permissionVersions.forget(userId)
 	return nil
 }
 
-func GoogleOauthRedirect(c *gin.Context) {
-	conf := googleConfig
-
-	url := conf.AuthCodeURL("unused", oauth2.AccessTypeOffline)
+func OauthRedirectHandler(c *gin.Context) {
+	url, err := StartOauthLogin(c.Param("provider"))
+	if err == ErrUnknownProvider {
+		ReportError(c, err, "error", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		ReportError(c, err, "error", http.StatusInternalServerError)
+		return
+	}
 	c.Redirect(http.StatusFound, url)
 }
 
@@ -182,7 +267,7 @@ func CompleteOauthAccountHandler(c *gin.Context) {
 		ReportError(c, err, "error", 500)
 		return
 	}
-	if peekUserRow.Role != "oauth_incomplete" {
+	if peekUserRow.Role != OauthIncompleteRole {
 		ReportError(c, errors.New("role is not oauth complete"), "error", http.StatusBadRequest)
 		return
 	}
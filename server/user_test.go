@@ -66,3 +66,36 @@ func TestCreateAccount(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAssignRole(t *testing.T) {
+	db.Init()
+	defer db.Close()
+
+	username, password, email := "testadmin", "secretpw", "admin@atest.com"
+	user, role, err := CreateAccount(username, password, email, MemberRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := DeleteAccount(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	assert.Equal(t, MemberRole, role.RoleName)
+
+	// SetRole never gives the admin role, AssignRole does
+	assert.NotNil(t, SetRole(0, user.ID, AdminRole))
+	assert.Nil(t, AssignRole(user.ID, AdminRole))
+	assert.EqualError(t, AssignRole(user.ID, "superuser"), "invalid role")
+
+	user2, err := db.New(db.Pool()).UserByEmail(context.Background(), email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	role2, err := db.New(db.Pool()).Role(context.Background(), user2.RoleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, AdminRole, role2.RoleName)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"github.com/dqhieuu/novo-app/config"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"image"
@@ -18,12 +19,21 @@ const (
 	CommentModule     = "comment"
 	AuthorModule      = "author"
 	LikeModule        = "like"
+	ImageModule       = "image"
+	RoleModule        = "role"
 	PostAction        = "post"
 	ReadAction        = "read"
 	ModifyAction      = "modify"
 	DeleteAction      = "delete"
 	ModifySelfAction  = "modifySelf"
 	DeleteSelfAction  = "deleteSelf"
+	ExportAction      = "export"
+)
+
+// Modules and Actions are what role permissions can be made of, the handlers don't check anything else.
+var (
+	Modules = []string{BookGroupModule, BookChapterModule, CommentModule, AuthorModule, LikeModule, ImageModule, RoleModule}
+	Actions = []string{PostAction, ReadAction, ModifyAction, DeleteAction, ModifySelfAction, DeleteSelfAction, ExportAction}
 )
 
 func CreateImage(width int, height int) (*os.File, int64, string, string, error) {
@@ -49,7 +59,7 @@ func CreateImage(width int, height int) (*os.File, int64, string, string, error)
 		}
 	}
 	dst := "test/" + "test-" + uuid.NewString() + ".png"
-	fullPath, _, err := checkFileDir(dst, RootFolder)
+	fullPath, _, err := checkFileDir(dst, config.Default().Images.RootFolder)
 	if err != nil {
 		return nil, -1, "", "", err
 	}
@@ -70,10 +80,12 @@ func CreateImage(width int, height int) (*os.File, int64, string, string, error)
 	return fileStream, imageStatus.Size(), dst, fullPath, nil
 }
 
+// HasControlCharacters is the control character check of the names, aliases and comments. It
+// is turned off, every content passes it; the commented out pattern is the one it checked.
 func HasControlCharacters(content string) bool {
+	//hasInvalidChars, _ := regexp.MatchString(`[\x00-\x07\x0E-\x1F\x7F]`, content)
+	//return hasInvalidChars
 	return false
-	hasInvalidChars, _ := regexp.MatchString(`[\x00-\x07\x0E-\x1F\x7F]`, content)
-	return hasInvalidChars
 }
 
 func CheckEmptyString(content string) bool {
@@ -0,0 +1,12 @@
+package server
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHasControlCharacters(t *testing.T) {
+	for _, content := range []string{"", "a title", "first line\nsecond line", "tab\there", "bell\a", "\x00", "del\x7f"} {
+		assert.False(t, HasControlCharacters(content), "%q", content)
+	}
+}
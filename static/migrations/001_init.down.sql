@@ -0,0 +1,19 @@
+DROP TABLE IF EXISTS book_comments;
+DROP TABLE IF EXISTS book_chapter_views;
+DROP TABLE IF EXISTS book_chapter_images;
+DROP TABLE IF EXISTS book_chapters;
+DROP TABLE IF EXISTS book_group_authors;
+DROP TABLE IF EXISTS book_group_genres;
+DROP TABLE IF EXISTS book_group_likes;
+DROP TABLE IF EXISTS book_group_arts;
+DROP TABLE IF EXISTS book_group_alt_titles;
+DROP TABLE IF EXISTS book_groups;
+DROP TABLE IF EXISTS book_authors;
+DROP TABLE IF EXISTS genres;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS role_permissions;
+DROP TABLE IF EXISTS roles;
+DROP TABLE IF EXISTS temp_images;
+DROP TABLE IF EXISTS images;
+
+DROP EXTENSION IF EXISTS unaccent;
@@ -0,0 +1,13 @@
+DROP TRIGGER IF EXISTS insert_like ON book_group_likes;
+DROP TRIGGER IF EXISTS save_temp_image ON images;
+DROP TRIGGER IF EXISTS book_author_tsv_trigger ON book_authors;
+DROP TRIGGER IF EXISTS book_author_change_tsv_trigger ON book_authors;
+DROP TRIGGER IF EXISTS book_group_author_change_tsv_trigger ON book_group_authors;
+DROP TRIGGER IF EXISTS book_group_tsv_trigger ON book_groups;
+
+DROP FUNCTION IF EXISTS book_author_tsv_trigger_func();
+DROP FUNCTION IF EXISTS tsv_on_book_author_change();
+DROP FUNCTION IF EXISTS tsv_on_book_group_author_change();
+DROP FUNCTION IF EXISTS book_group_tsv_trigger_func();
+DROP FUNCTION IF EXISTS insert_like_operation();
+DROP FUNCTION IF EXISTS add_temp_image();
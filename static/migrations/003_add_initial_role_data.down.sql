@@ -0,0 +1,10 @@
+-- fails while users still have one of these roles, delete them first
+DELETE
+FROM role_permissions
+WHERE role_id IN (SELECT id
+                  FROM roles
+                  WHERE name IN ('oauth_incomplete', 'member', 'moderator', 'admin', 'banned'));
+
+DELETE
+FROM roles
+WHERE name IN ('oauth_incomplete', 'member', 'moderator', 'admin', 'banned');
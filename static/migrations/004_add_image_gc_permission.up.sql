@@ -0,0 +1,2 @@
+INSERT INTO role_permissions (module, action, role_id)
+VALUES ('image', 'delete', (SELECT id FROM roles WHERE name = 'admin'));
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS upload_sessions
+(
+    id           text        NOT NULL,
+    user_id      int         NOT NULL,
+    category     text        NOT NULL,
+    size         bigint      NOT NULL,
+    received     bigint      NOT NULL DEFAULT 0,
+    sha1         text        NOT NULL,
+    date_created timestamptz NOT NULL DEFAULT now(),
+    date_updated timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    CONSTRAINT fk_upload_sessions_users
+        FOREIGN KEY (user_id)
+            REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,4 @@
+DELETE
+FROM role_permissions
+WHERE module = 'book'
+  AND action = 'export';
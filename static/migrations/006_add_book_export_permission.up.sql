@@ -0,0 +1,4 @@
+INSERT INTO role_permissions (module, action, role_id)
+VALUES ('book', 'export', (SELECT id FROM roles WHERE name = 'admin')),
+       ('book', 'export', (SELECT id FROM roles WHERE name = 'moderator')),
+       ('book', 'export', (SELECT id FROM roles WHERE name = 'member'));
@@ -0,0 +1,2 @@
+ALTER TABLE book_authors
+    DROP COLUMN owner_id;
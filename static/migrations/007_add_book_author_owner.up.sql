@@ -0,0 +1,5 @@
+ALTER TABLE book_authors
+    ADD COLUMN owner_id int,
+    ADD CONSTRAINT fk_book_authors_users
+        FOREIGN KEY (owner_id)
+            REFERENCES users (id) ON DELETE SET NULL;
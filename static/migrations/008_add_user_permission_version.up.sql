@@ -0,0 +1,2 @@
+ALTER TABLE users
+    ADD COLUMN permission_version int NOT NULL DEFAULT 1;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS sessions
+(
+    id           text        NOT NULL,
+    user_id      int         NOT NULL,
+    date_created timestamptz NOT NULL DEFAULT now(),
+    date_expires timestamptz NOT NULL,
+    date_revoked timestamptz,
+    PRIMARY KEY (id),
+    CONSTRAINT fk_sessions_users
+        FOREIGN KEY (user_id)
+            REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions (user_id);
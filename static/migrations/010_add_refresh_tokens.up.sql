@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS refresh_tokens
+(
+    token_hash   text        NOT NULL,
+    session_id   text        NOT NULL,
+    date_created timestamptz NOT NULL DEFAULT now(),
+    date_used    timestamptz,
+    PRIMARY KEY (token_hash),
+    CONSTRAINT fk_refresh_tokens_sessions
+        FOREIGN KEY (session_id)
+            REFERENCES sessions (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON refresh_tokens (session_id);
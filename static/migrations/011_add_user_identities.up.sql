@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS user_identities
+(
+    provider     text        NOT NULL,
+    subject      text        NOT NULL,
+    user_id      int         NOT NULL,
+    email        text,
+    date_created timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (provider, subject),
+    CONSTRAINT fk_user_identities_users
+        FOREIGN KEY (user_id)
+            REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities (user_id);
+
+CREATE TABLE IF NOT EXISTS oauth_states
+(
+    state        text        NOT NULL,
+    provider     text        NOT NULL,
+    nonce        text        NOT NULL,
+    verifier     text        NOT NULL,
+    date_created timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (state)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE oauth_states
+    DROP COLUMN user_id;
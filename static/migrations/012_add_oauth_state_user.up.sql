@@ -0,0 +1,5 @@
+ALTER TABLE oauth_states
+    ADD COLUMN user_id int,
+    ADD CONSTRAINT fk_oauth_states_users
+        FOREIGN KEY (user_id)
+            REFERENCES users (id) ON DELETE CASCADE;
@@ -0,0 +1,23 @@
+ALTER TABLE users
+    ADD COLUMN email_verified boolean NOT NULL DEFAULT false;
+
+-- the accounts made before verification existed keep posting
+UPDATE users
+SET email_verified = true;
+
+CREATE TABLE IF NOT EXISTS email_tokens
+(
+    token_hash   text        NOT NULL,
+    user_id      int         NOT NULL,
+    purpose      text        NOT NULL,
+    email        text        NOT NULL,
+    date_created timestamptz NOT NULL DEFAULT now(),
+    date_expires timestamptz NOT NULL,
+    date_used    timestamptz,
+    PRIMARY KEY (token_hash),
+    CONSTRAINT fk_email_tokens_users
+        FOREIGN KEY (user_id)
+            REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_email_tokens_user_id ON email_tokens (user_id);
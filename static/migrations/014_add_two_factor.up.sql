@@ -0,0 +1,38 @@
+ALTER TABLE roles
+    ADD COLUMN require_two_factor boolean NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS user_totp
+(
+    user_id      int         NOT NULL,
+    secret       text        NOT NULL,
+    date_created timestamptz NOT NULL DEFAULT now(),
+    date_enabled timestamptz,
+    last_step    bigint      NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id),
+    CONSTRAINT fk_user_totp_users
+        FOREIGN KEY (user_id)
+            REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS totp_recovery_codes
+(
+    user_id   int  NOT NULL,
+    code_hash text NOT NULL,
+    date_used timestamptz,
+    PRIMARY KEY (user_id, code_hash),
+    CONSTRAINT fk_totp_recovery_codes_users
+        FOREIGN KEY (user_id)
+            REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS login_challenges
+(
+    token_hash   text        NOT NULL,
+    user_id      int         NOT NULL,
+    date_expires timestamptz NOT NULL,
+    attempts     int         NOT NULL DEFAULT 0,
+    PRIMARY KEY (token_hash),
+    CONSTRAINT fk_login_challenges_users
+        FOREIGN KEY (user_id)
+            REFERENCES users (id) ON DELETE CASCADE
+);
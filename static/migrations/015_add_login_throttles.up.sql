@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS login_throttles
+(
+    key               text        NOT NULL,
+    failures          int         NOT NULL DEFAULT 0,
+    date_last_failure timestamptz NOT NULL DEFAULT now(),
+    locked_until      timestamptz,
+    PRIMARY KEY (key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_throttles_date_last_failure ON login_throttles (date_last_failure);
+
+CREATE TABLE IF NOT EXISTS login_attempts
+(
+    id           bigserial   NOT NULL,
+    user_id      int,
+    identifier   text        NOT NULL,
+    ip           text        NOT NULL,
+    outcome      text        NOT NULL,
+    date_created timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    CONSTRAINT fk_login_attempts_users
+        FOREIGN KEY (user_id)
+            REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_login_attempts_user_id ON login_attempts (user_id, date_created);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_ip ON login_attempts (ip, date_created);
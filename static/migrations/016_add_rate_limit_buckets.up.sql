@@ -0,0 +1,10 @@
+-- the buckets are refilled in a minute, they don't need to survive a crash
+CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_buckets
+(
+    key          text             NOT NULL,
+    tokens       double precision NOT NULL,
+    date_updated timestamptz      NOT NULL DEFAULT now(),
+    PRIMARY KEY (key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_date_updated ON rate_limit_buckets (date_updated);
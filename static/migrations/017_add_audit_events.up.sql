@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS audit_events
+(
+    id           bigserial   NOT NULL,
+    actor_id     int,
+    action       text        NOT NULL,
+    target_type  text        NOT NULL,
+    target_id    int         NOT NULL,
+    before       jsonb,
+    after        jsonb,
+    ip           text        NOT NULL,
+    date_created timestamptz NOT NULL DEFAULT now(),
+    PRIMARY KEY (id),
+    CONSTRAINT fk_audit_events_users
+        FOREIGN KEY (actor_id)
+            REFERENCES users (id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_date_created ON audit_events (date_created);
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON audit_events (actor_id, date_created);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events (target_type, target_id, date_created);
@@ -0,0 +1,26 @@
+-- name: AuditEvents :many
+SELECT audit_events.*, u.user_name AS actor_name
+FROM audit_events
+         LEFT JOIN users u ON u.id = audit_events.actor_id
+WHERE (sqlc.arg(actor_id)::int = 0 OR actor_id = sqlc.arg(actor_id))
+  AND (sqlc.arg(action)::text = '' OR action = sqlc.arg(action))
+  AND (sqlc.arg(target_type)::text = '' OR target_type = sqlc.arg(target_type))
+  AND (sqlc.arg(target_id)::int = 0 OR target_id = sqlc.arg(target_id))
+  AND (sqlc.arg(date_from)::timestamptz IS NULL OR date_created >= sqlc.arg(date_from))
+  AND (sqlc.arg(date_to)::timestamptz IS NULL OR date_created < sqlc.arg(date_to))
+ORDER BY date_created DESC, id DESC
+OFFSET sqlc.arg(offset_rows)::bigint ROWS FETCH FIRST sqlc.arg(limit_rows) ROWS ONLY;
+
+-- name: CountAuditEvents :one
+SELECT count(*)
+FROM audit_events
+WHERE (sqlc.arg(actor_id)::int = 0 OR actor_id = sqlc.arg(actor_id))
+  AND (sqlc.arg(action)::text = '' OR action = sqlc.arg(action))
+  AND (sqlc.arg(target_type)::text = '' OR target_type = sqlc.arg(target_type))
+  AND (sqlc.arg(target_id)::int = 0 OR target_id = sqlc.arg(target_id))
+  AND (sqlc.arg(date_from)::timestamptz IS NULL OR date_created >= sqlc.arg(date_from))
+  AND (sqlc.arg(date_to)::timestamptz IS NULL OR date_created < sqlc.arg(date_to));
+
+-- name: InsertAuditEvent :exec
+INSERT INTO audit_events(actor_id, action, target_type, target_id, before, after, ip)
+VALUES ($1, $2, $3, $4, $5, $6, $7);
@@ -5,6 +5,13 @@ SELECT EXISTS(
                WHERE name = $1
            );
 
+-- name: BookAuthorIdByName :one
+SELECT id
+FROM book_authors
+WHERE name = $1
+ORDER BY id
+FETCH FIRST ROW ONLY;
+
 -- name: CheckAuthorExistById :one
 SELECT EXISTS(
                SELECT 1
@@ -24,8 +31,8 @@ ORDER BY id ASC
 OFFSET $1 ROWS FETCH FIRST $2 ROWS ONLY;
 
 -- name: InsertBookAuthor :one
-INSERT INTO book_authors(name, aliases, description, avatar_image_id)
-VALUES (@name, @aliases, @description, @avatar_image_id)
+INSERT INTO book_authors(name, aliases, description, avatar_image_id, owner_id)
+VALUES (@name, @aliases, @description, @avatar_image_id, @owner_id)
 RETURNING *;
 
 -- name: DeleteBookAuthor :exec
@@ -53,4 +60,13 @@ SELECT book_authors.name, book_authors.id, book_authors.aliases, i.path
 FROM book_authors
          LEFT JOIN images i on book_authors.avatar_image_id = i.id
 WHERE book_author_tsv @@ to_tsquery(unaccent($1))
-LIMIT 5;
\ No newline at end of file
+LIMIT 5;
+
+-- name: ReindexBookAuthors :execrows
+UPDATE book_authors
+SET name = name;
+
+-- name: BookAuthorOwner :one
+SELECT owner_id
+FROM book_authors
+WHERE id = $1;
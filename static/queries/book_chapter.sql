@@ -43,9 +43,10 @@ SELECT book_chapters.chapter_number,
 FROM book_chapters
          JOIN book_groups bg on book_chapters.book_group_id = bg.id
          JOIN users u on book_chapters.owner_id = u.id
-         JOIN book_chapter_views bcv on book_chapters.id = bcv.book_chapter_id
+         LEFT JOIN book_chapter_views bcv on book_chapters.id = bcv.book_chapter_id
 WHERE bg.id = $1
-GROUP BY book_chapters.id, u.id;
+GROUP BY book_chapters.id, u.id
+ORDER BY book_chapters.chapter_number;
 
 -- name: GetBookChapterOwner :one
 SELECT users.id, users.user_name
@@ -53,3 +54,13 @@ FROM users
          JOIN book_chapters bc on users.id = bc.owner_id
 WHERE bc.id = $1;
 
+-- name: HypertextChapters :many
+SELECT id, text_content
+FROM book_chapters
+WHERE type = 'hypertext'
+ORDER BY id;
+
+-- name: UpdateBookChapterTextContent :exec
+UPDATE book_chapters
+SET text_content=$2
+WHERE id = $1;
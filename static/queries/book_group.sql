@@ -294,3 +294,7 @@ LIMIT $1;
 -- name: CheckBookGroupById :one
 SELECT EXISTS(SElECT 1 FROM book_groups WHERE id = $1);
 
+
+-- name: ReindexBookGroups :execrows
+UPDATE book_groups
+SET title = title;
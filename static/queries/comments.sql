@@ -91,6 +91,11 @@ FROM users
          LEFT JOIN images i on users.avatar_image_id = i.id
 WHERE bc.id = $1;
 
+-- name: GetComment :one
+SELECT *
+FROM book_comments
+WHERE id = $1;
+
 -- name: GetCommentChapterInfo :one
 SELECT book_chapters.id, book_chapters.chapter_number
 FROM book_chapters
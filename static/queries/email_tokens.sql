@@ -0,0 +1,18 @@
+-- name: DeleteUserEmailTokens :exec
+DELETE
+FROM email_tokens
+WHERE user_id = $1
+  AND purpose = $2;
+
+-- name: InsertEmailToken :exec
+INSERT INTO email_tokens(token_hash, user_id, purpose, email, date_expires)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: UseEmailToken :one
+UPDATE email_tokens
+SET date_used = now()
+WHERE token_hash = $1
+  AND purpose = $2
+  AND date_used IS NULL
+  AND date_expires > now()
+RETURNING user_id, email;
@@ -48,3 +48,34 @@ SELECT exists(
 
 
 
+
+
+-- name: SubmitAttachedTempImages :execrows
+DELETE
+FROM temp_images t
+WHERE exists(select 1 from book_chapter_images where image_id = t.image_id)
+   OR exists(select 1 from book_group_arts where image_id = t.image_id)
+   OR exists(select 1 from book_groups where primary_cover_art_id = t.image_id)
+   OR exists(select 1 from users where avatar_image_id = t.image_id)
+   OR exists(select 1 from genres where image_id = t.image_id)
+   OR exists(select 1 from book_authors where avatar_image_id = t.image_id);
+
+-- name: ExpiredTempImages :many
+SELECT i.id, i.path, t.date_created
+FROM temp_images t
+         JOIN images i ON i.id = t.image_id
+WHERE t.date_created < $1
+  AND NOT exists(select 1 from book_chapter_images where image_id = t.image_id)
+  AND NOT exists(select 1 from book_group_arts where image_id = t.image_id)
+  AND NOT exists(select 1 from book_groups where primary_cover_art_id = t.image_id)
+  AND NOT exists(select 1 from users where avatar_image_id = t.image_id)
+  AND NOT exists(select 1 from genres where image_id = t.image_id)
+  AND NOT exists(select 1 from book_authors where avatar_image_id = t.image_id)
+ORDER BY t.date_created;
+
+-- name: SubmitTempImagesByPath :execrows
+DELETE
+FROM temp_images t
+    USING images i
+WHERE i.id = t.image_id
+  AND i.path = ANY (sqlc.arg(paths)::text[]);
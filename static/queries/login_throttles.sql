@@ -0,0 +1,50 @@
+-- name: DeleteLoginThrottle :execrows
+DELETE
+FROM login_throttles
+WHERE key = $1;
+
+-- name: DeleteStaleLoginThrottles :exec
+DELETE
+FROM login_throttles
+WHERE date_last_failure < $1
+  AND (locked_until IS NULL OR locked_until < now());
+
+-- name: InsertLoginAttempt :exec
+INSERT INTO login_attempts(user_id, identifier, ip, outcome)
+VALUES ($1, $2, $3, $4);
+
+-- name: LockLoginThrottle :one
+INSERT INTO login_throttles(key)
+VALUES ($1)
+ON CONFLICT (key) DO UPDATE
+    SET key = excluded.key
+RETURNING *;
+
+-- name: LockedLoginThrottles :many
+SELECT *
+FROM login_throttles
+WHERE locked_until > now()
+ORDER BY locked_until DESC;
+
+-- name: RecordLoginFailure :one
+INSERT INTO login_throttles(key, failures, date_last_failure)
+VALUES (sqlc.arg(key), 1, now())
+ON CONFLICT (key) DO UPDATE
+    SET failures          = CASE
+                                WHEN login_throttles.date_last_failure < sqlc.arg(forget_before) THEN 1
+                                ELSE login_throttles.failures + 1
+        END,
+        date_last_failure = now()
+RETURNING failures;
+
+-- name: SetLoginLock :exec
+UPDATE login_throttles
+SET locked_until = $2
+WHERE key = $1;
+
+-- name: UserLoginAttempts :many
+SELECT *
+FROM login_attempts
+WHERE user_id = $1
+ORDER BY date_created DESC
+LIMIT $2;
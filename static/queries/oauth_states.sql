@@ -0,0 +1,15 @@
+-- name: DeleteExpiredOauthStates :exec
+DELETE
+FROM oauth_states
+WHERE date_created < $1;
+
+-- name: InsertOauthState :exec
+INSERT INTO oauth_states(state, provider, nonce, verifier, user_id)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: TakeOauthState :one
+DELETE
+FROM oauth_states
+WHERE state = $1
+  AND provider = $2
+RETURNING *;
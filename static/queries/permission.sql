@@ -9,4 +9,27 @@ SELECT exists(
            );
 
 -- name: GetUserPermission :many
-SELECT rp.* FROM users JOIN role_permissions rp on users.role_id = rp.role_id WHERE users.id = $1;
\ No newline at end of file
+SELECT rp.* FROM users JOIN role_permissions rp on users.role_id = rp.role_id WHERE users.id = $1;
+
+-- name: RolePermissionsByName :many
+SELECT rp.module, rp.action
+FROM role_permissions rp
+         JOIN roles r ON r.id = rp.role_id
+WHERE r.name = $1;
+
+-- name: GrantPermission :exec
+INSERT INTO role_permissions (module, action, role_id)
+VALUES ($1, $2, $3)
+ON CONFLICT DO NOTHING;
+
+-- name: RevokePermission :execrows
+DELETE
+FROM role_permissions
+WHERE module = $1
+  AND action = $2
+  AND role_id = $3;
+
+-- name: DeleteRolePermissions :exec
+DELETE
+FROM role_permissions
+WHERE role_id = $1;
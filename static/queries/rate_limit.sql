@@ -0,0 +1,21 @@
+-- name: DeleteIdleRateLimitBuckets :exec
+DELETE
+FROM rate_limit_buckets
+WHERE date_updated < $1;
+
+-- name: RateLimitTokens :one
+SELECT least(sqlc.arg(capacity)::float8,
+             tokens + extract(epoch FROM now() - date_updated)::float8 * sqlc.arg(rate)::float8)::float8 AS tokens
+FROM rate_limit_buckets
+WHERE key = sqlc.arg(key);
+
+-- name: TakeRateLimitToken :one
+INSERT INTO rate_limit_buckets AS b (key, tokens, date_updated)
+VALUES (sqlc.arg(key), sqlc.arg(capacity)::float8 - 1, now())
+ON CONFLICT (key) DO UPDATE
+    SET tokens       = least(sqlc.arg(capacity)::float8,
+                             b.tokens + extract(epoch FROM now() - b.date_updated)::float8 * sqlc.arg(rate)::float8) - 1,
+        date_updated = now()
+WHERE least(sqlc.arg(capacity)::float8,
+            b.tokens + extract(epoch FROM now() - b.date_updated)::float8 * sqlc.arg(rate)::float8) >= 1
+RETURNING tokens;
@@ -0,0 +1,15 @@
+-- name: InsertRefreshToken :exec
+INSERT INTO refresh_tokens(token_hash, session_id)
+VALUES ($1, $2);
+
+-- name: RefreshTokenSession :one
+SELECT session_id
+FROM refresh_tokens
+WHERE token_hash = $1;
+
+-- name: UseRefreshToken :one
+UPDATE refresh_tokens
+SET date_used = now()
+WHERE token_hash = $1
+  AND date_used IS NULL
+RETURNING session_id;
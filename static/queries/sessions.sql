@@ -0,0 +1,50 @@
+-- name: ActiveSessionUser :one
+SELECT user_id
+FROM sessions
+WHERE id = $1
+  AND date_revoked IS NULL
+  AND date_expires > now();
+
+-- name: DeleteExpiredSessions :exec
+DELETE
+FROM sessions
+WHERE user_id = $1
+  AND date_expires < now();
+
+-- name: ExtendSession :execrows
+UPDATE sessions
+SET date_expires = $2
+WHERE id = $1
+  AND date_revoked IS NULL
+  AND date_expires > now();
+
+-- name: InsertSession :exec
+INSERT INTO sessions(id, user_id, date_expires)
+VALUES ($1, $2, $3);
+
+-- name: RevokeOtherUserSessions :execrows
+UPDATE sessions
+SET date_revoked = now()
+WHERE user_id = $1
+  AND id <> $2
+  AND date_revoked IS NULL;
+
+-- name: RevokeSession :exec
+UPDATE sessions
+SET date_revoked = now()
+WHERE id = $1
+  AND date_revoked IS NULL;
+
+-- name: RevokeUserSessions :execrows
+UPDATE sessions
+SET date_revoked = now()
+WHERE user_id = $1
+  AND date_revoked IS NULL;
+
+-- name: SessionActive :one
+SELECT exists(SELECT 1
+              FROM sessions
+              WHERE id = $1
+                AND user_id = $2
+                AND date_revoked IS NULL
+                AND date_expires > now());
@@ -0,0 +1,73 @@
+-- name: CountRecoveryCodes :one
+SELECT count(*)
+FROM totp_recovery_codes
+WHERE user_id = $1
+  AND date_used IS NULL;
+
+-- name: DeleteExpiredLoginChallenges :exec
+DELETE
+FROM login_challenges
+WHERE date_expires < now();
+
+-- name: DeleteLoginChallenge :exec
+DELETE
+FROM login_challenges
+WHERE token_hash = $1;
+
+-- name: DeleteRecoveryCodes :exec
+DELETE
+FROM totp_recovery_codes
+WHERE user_id = $1;
+
+-- name: DeleteUserTotp :exec
+DELETE
+FROM user_totp
+WHERE user_id = $1;
+
+-- name: EnableUserTotp :exec
+UPDATE user_totp
+SET date_enabled = now()
+WHERE user_id = $1;
+
+-- name: InsertLoginChallenge :exec
+INSERT INTO login_challenges(token_hash, user_id, date_expires)
+VALUES ($1, $2, $3);
+
+-- name: InsertRecoveryCode :exec
+INSERT INTO totp_recovery_codes(user_id, code_hash)
+VALUES ($1, $2);
+
+-- name: LoginChallengeAttempt :one
+UPDATE login_challenges
+SET attempts = attempts + 1
+WHERE token_hash = $1
+  AND date_expires > now()
+  AND attempts < $2
+RETURNING user_id;
+
+-- name: SetPendingUserTotp :execrows
+INSERT INTO user_totp(user_id, secret)
+VALUES ($1, $2)
+ON CONFLICT (user_id) DO UPDATE
+    SET secret       = excluded.secret,
+        date_created = now(),
+        last_step    = 0
+WHERE user_totp.date_enabled IS NULL;
+
+-- name: UseRecoveryCode :execrows
+UPDATE totp_recovery_codes
+SET date_used = now()
+WHERE user_id = $1
+  AND code_hash = $2
+  AND date_used IS NULL;
+
+-- name: UseTotpStep :execrows
+UPDATE user_totp
+SET last_step = $2
+WHERE user_id = $1
+  AND last_step < $2;
+
+-- name: UserTotp :one
+SELECT *
+FROM user_totp
+WHERE user_id = $1;
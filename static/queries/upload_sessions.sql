@@ -0,0 +1,27 @@
+-- name: InsertUploadSession :one
+INSERT INTO upload_sessions(id, user_id, category, size, sha1)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING *;
+
+-- name: GetUploadSession :one
+SELECT *
+FROM upload_sessions
+WHERE id = $1
+  AND user_id = $2;
+
+-- name: UpdateUploadSessionReceived :execrows
+UPDATE upload_sessions
+SET received     = sqlc.arg(new_received),
+    date_updated = now()
+WHERE id = sqlc.arg(id)
+  AND received = sqlc.arg(old_received);
+
+-- name: DeleteUploadSession :exec
+DELETE
+FROM upload_sessions
+WHERE id = $1;
+
+-- name: ExpiredUploadSessions :many
+SELECT id
+FROM upload_sessions
+WHERE date_updated < $1;
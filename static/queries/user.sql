@@ -5,6 +5,11 @@ WHERE user_name = $1
    OR email = $1
     FETCH FIRST ROWS ONLY;
 
+-- name: UserById :one
+SELECT *
+FROM users
+WHERE id = $1;
+
 -- name: UserByEmail :one
 SELECT *
 FROM users
@@ -12,8 +17,8 @@ WHERE email = $1
     FETCH FIRST ROWS ONLY;
 
 -- name: InsertUser :one
-INSERT INTO users(user_name, password, email, role_id)
-VALUES (@user_name, @password, @email, (SELECT id FROM roles WHERE name = @role_name))
+INSERT INTO users(user_name, password, email, email_verified, role_id)
+VALUES (@user_name, @password, @email, @email_verified, (SELECT id FROM roles WHERE name = @role_name))
 RETURNING *;
 
 -- name: DeleteUser :exec
@@ -25,7 +30,8 @@ WHERE user_name = $1;
 UPDATE users
 SET user_name       = $2,
     avatar_image_id = $3,
-    role_id         = $4
+    role_id         = $4,
+    permission_version = permission_version + 1
 WHERE id = $1;
 
 -- name: GetUserInfo :one
@@ -36,7 +42,8 @@ SELECT users.id,
        r.name as role,
        users.summary,
        i.path as avatarPath,
-       i.id   as avatarId
+       i.id   as avatarId,
+       users.email_verified
 FROM users
          JOIN roles r on users.role_id = r.id
          LEFT JOIN images i on users.avatar_image_id = i.id
@@ -128,7 +135,8 @@ Update users
 SET email           = $2,
     user_name       = $3,
     summary         = $4,
-    avatar_image_id = $5
+    avatar_image_id = $5,
+    email_verified  = email_verified AND email = $2
 WHERE id = $1;
 
 -- name: CheckUsernameExist :one
@@ -137,4 +145,24 @@ SELECT exists(select 1 from users where user_name = $1);
 -- name: CheckEmailExist :one
 SELECT exists(select 1 from users where email = $1);
 
+-- name: UserPermissionVersion :one
+SELECT permission_version
+FROM users
+WHERE id = $1;
+
+-- name: UserPasswordForUpdate :one
+SELECT password
+FROM users
+WHERE id = $1
+    FOR UPDATE;
+
+-- name: UserEmailVerified :one
+SELECT email_verified
+FROM users
+WHERE id = $1;
 
+-- name: VerifyUserEmail :execrows
+UPDATE users
+SET email_verified = true
+WHERE id = $1
+  AND email = $2;
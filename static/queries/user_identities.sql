@@ -0,0 +1,27 @@
+-- name: CountUserIdentities :one
+SELECT count(*)
+FROM user_identities
+WHERE user_id = $1;
+
+-- name: DeleteUserIdentity :execrows
+DELETE
+FROM user_identities
+WHERE provider = $1
+  AND subject = $2
+  AND user_id = $3;
+
+-- name: IdentityUser :one
+SELECT user_id
+FROM user_identities
+WHERE provider = $1
+  AND subject = $2;
+
+-- name: InsertUserIdentity :exec
+INSERT INTO user_identities(provider, subject, user_id, email)
+VALUES ($1, $2, $3, $4);
+
+-- name: UserIdentities :many
+SELECT provider, subject, email, date_created
+FROM user_identities
+WHERE user_id = $1
+ORDER BY date_created;
@@ -10,14 +10,65 @@ WHERE name = $1;
 
 -- name: Role :one
 SELECT r.name                             role_name,
-       array_remove(array_agg(module || '.' || action), null)::text[] role_permissions
+       array_remove(array_agg(module || '.' || action), null)::text[] role_permissions,
+       r.require_two_factor
 FROM roles r
          LEFT JOIN role_permissions rp ON r.id = rp.role_id
 WHERE r.id = $1
-GROUP BY r.name;
+GROUP BY r.name, r.require_two_factor;
 
 -- name: GetRoleId :one
 SELECT id FROM roles WHERE name = $1;
 
 -- name: SetRole :exec
-UPDATE users SET role_id = $2 where id = $1;
\ No newline at end of file
+UPDATE users SET role_id = $2, permission_version = permission_version + 1 where id = $1;
+
+-- name: RoleById :one
+SELECT *
+FROM roles
+WHERE id = $1;
+
+-- name: ListRoles :many
+SELECT r.id,
+       r.name,
+       r.description,
+       r.require_two_factor,
+       array_remove(array_agg(rp.module || '.' || rp.action ORDER BY rp.module, rp.action), null)::text[] permissions,
+       (SELECT count(*) FROM users u WHERE u.role_id = r.id)                                             user_count
+FROM roles r
+         LEFT JOIN role_permissions rp ON r.id = rp.role_id
+GROUP BY r.id
+ORDER BY r.id;
+
+-- name: UpdateRole :one
+UPDATE roles
+SET name        = $2,
+    description = $3
+WHERE id = $1
+RETURNING *;
+
+-- name: SetRoleRequireTwoFactor :execrows
+UPDATE roles
+SET require_two_factor = $2
+WHERE id = $1;
+
+-- name: DeleteRoleById :execrows
+DELETE
+FROM roles
+WHERE id = $1;
+
+-- name: CountUsersWithRole :one
+SELECT count(*)
+FROM users
+WHERE role_id = $1;
+
+-- name: UserRoleName :one
+SELECT r.name
+FROM users u
+         JOIN roles r ON r.id = u.role_id
+WHERE u.id = $1;
+
+-- name: BumpRolePermissionVersion :exec
+UPDATE users
+SET permission_version = permission_version + 1
+WHERE role_id = $1;
@@ -0,0 +1,9 @@
+// Package static embeds the files the server binary needs at runtime.
+package static
+
+import "embed"
+
+// Migrations holds the schema migrations, named <version>_<name>.<up|down>.sql.
+//
+//go:embed migrations/*.sql
+var Migrations embed.FS